@@ -0,0 +1,58 @@
+package api
+
+import (
+    "net"
+    "strings"
+
+    "github.com/labstack/echo"
+)
+
+// The client IP locks out sign-ins and is recorded in the audit log and the sessions, so it must not be taken from
+// request headers that anyone can set. It is the remote address of the connection, unless that address belongs to
+// one of the TrustedProxies in the Config. Only then the X-Forwarded-For header is consulted: its entries are
+// walked from the right, skipping trusted proxies, and the first other address is the client. Proxies that only
+// set X-Real-IP are supported as well.
+
+// clientIP returns the IP address of the client that sent the request
+func (s *Server) clientIP(c echo.Context) string {
+    req := c.Request()
+    clientIP := req.RemoteAddr
+    if host, _, err := net.SplitHostPort(clientIP); err == nil {
+        clientIP = host
+    }
+    if !s.isTrustedProxy(clientIP) {
+        return clientIP
+    }
+
+    if forwardedFor := req.Header.Get(echo.HeaderXForwardedFor); forwardedFor != "" {
+        hops := strings.Split(forwardedFor, ",")
+        for i := len(hops) - 1; i >= 0; i-- {
+            hop := strings.TrimSpace(hops[i])
+            if net.ParseIP(hop) == nil {
+                break // not written by a proxy we trust, the last trusted hop is the best we know
+            } else if !s.isTrustedProxy(hop) {
+                return hop
+            }
+            clientIP = hop
+        }
+        return clientIP
+    }
+    if realIP := strings.TrimSpace(req.Header.Get(echo.HeaderXRealIP)); net.ParseIP(realIP) != nil {
+        return realIP
+    }
+    return clientIP
+}
+
+// isTrustedProxy returns true if the ip belongs to one of the configured trusted proxies
+func (s *Server) isTrustedProxy(ip string) bool {
+    parsed := net.ParseIP(ip)
+    if parsed == nil {
+        return false
+    }
+    for _, network := range s.trustedProxies {
+        if network.Contains(parsed) {
+            return true
+        }
+    }
+    return false
+}
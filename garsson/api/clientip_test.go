@@ -0,0 +1,49 @@
+package api
+
+import (
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+
+    "github.com/labstack/echo"
+    "github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+    _, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+    tests := []struct {
+        name         string
+        remoteAddr   string
+        forwardedFor string
+        realIP       string
+        trusted      bool
+        clientIP     string
+    }{
+        {name: "direct", remoteAddr: "192.0.2.1:4000", clientIP: "192.0.2.1"},
+        {name: "spoofed forwarded for", remoteAddr: "192.0.2.1:4000", forwardedFor: "198.51.100.7", clientIP: "192.0.2.1"},
+        {name: "spoofed real ip", remoteAddr: "192.0.2.1:4000", realIP: "198.51.100.7", clientIP: "192.0.2.1"},
+        {name: "untrusted proxy", remoteAddr: "192.0.2.1:4000", forwardedFor: "198.51.100.7", trusted: true, clientIP: "192.0.2.1"},
+        {name: "trusted proxy", remoteAddr: "10.0.0.2:4000", forwardedFor: "198.51.100.7", trusted: true, clientIP: "198.51.100.7"},
+        {name: "chain of trusted proxies", remoteAddr: "10.0.0.2:4000", forwardedFor: "198.51.100.7, 10.0.0.3", trusted: true, clientIP: "198.51.100.7"},
+        {name: "spoofed entry before proxy", remoteAddr: "10.0.0.2:4000", forwardedFor: "203.0.113.9, 198.51.100.7", trusted: true, clientIP: "198.51.100.7"},
+        {name: "garbage before proxy", remoteAddr: "10.0.0.2:4000", forwardedFor: "unknown, 10.0.0.3", trusted: true, clientIP: "10.0.0.3"},
+        {name: "real ip of trusted proxy", remoteAddr: "10.0.0.2:4000", realIP: "198.51.100.7", trusted: true, clientIP: "198.51.100.7"},
+        {name: "trusted proxy without headers", remoteAddr: "10.0.0.2:4000", trusted: true, clientIP: "10.0.0.2"},
+    }
+    for _, test := range tests {
+        s := &Server{router: echo.New()}
+        if test.trusted {
+            s.trustedProxies = []*net.IPNet{proxies}
+        }
+        req := httptest.NewRequest(http.MethodGet, "/", nil)
+        req.RemoteAddr = test.remoteAddr
+        if test.forwardedFor != "" {
+            req.Header.Set(echo.HeaderXForwardedFor, test.forwardedFor)
+        }
+        if test.realIP != "" {
+            req.Header.Set(echo.HeaderXRealIP, test.realIP)
+        }
+        assert.Equal(t, test.clientIP, s.clientIP(s.router.NewContext(req, httptest.NewRecorder())), test.name)
+    }
+}
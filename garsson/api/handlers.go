@@ -3,16 +3,13 @@ package api
 import (
     "fmt"
     "strconv"
-    "time"
 
     "github.com/gocraft/dbr"
     "github.com/labstack/echo"
-    "github.com/labstack/gommon/random"
     "github.com/toefel18/garsson-api/garsson/auth"
     "github.com/toefel18/garsson-api/garsson/db/migration"
     "github.com/toefel18/garsson-api/garsson/log"
     "github.com/toefel18/garsson-api/garsson/order"
-    "golang.org/x/net/websocket"
 
     "net/http"
 )
@@ -35,23 +32,6 @@ func (s *Server) handleHello() echo.HandlerFunc {
     }
 }
 
-func (s *Server) handleWebSocketOrderEventStream() echo.HandlerFunc {
-    return func(c echo.Context) error {
-        websocket.Handler(func (ws *websocket.Conn){
-            defer ws.Close()
-            for {
-                err := websocket.Message.Send(ws, "Hello World " + random.String(5))
-                if err != nil {
-                    log.WithError(err).Error("Websocket comm error")
-                }
-
-                time.Sleep(10 * time.Second)
-            }
-        }).ServeHTTP(c.Response(), c.Request())
-        return nil
-    }
-}
-
 func (s *Server) login() echo.HandlerFunc {
     type LoginRequest struct {
         Email    string `json:"email" form:"email" query:"email"`
@@ -60,24 +40,140 @@ func (s *Server) login() echo.HandlerFunc {
 
     return func(c echo.Context) error {
         loginRequest := new(LoginRequest)
-        if err := c.Bind(loginRequest); err == echo.ErrUnsupportedMediaType {
-            return c.JSON(http.StatusUnsupportedMediaType, GenericResponse{Code: http.StatusUnsupportedMediaType, Message: "unsupported media type, use: application/json, application/xml or application/x-www-form-urlencoded"})
-        } else if err != nil {
-            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        if errResponse := bindRequest(c, loginRequest); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+
+        sess := s.dao.NewSession()
+        c.Set(LoginEmailKey, loginRequest.Email)
+        if err := auth.CheckLoginAllowed(sess, loginRequest.Email, s.clientIP(c)); err != nil {
+            return s.rejectLockedLogin(c, err)
+        } else if tokens, user, err := auth.Authenticate(sess, loginRequest.Email, loginRequest.Password, s.signingKeys); err != nil {
+            if mfaRequired, ok := err.(*auth.MFARequiredError); ok {
+                return s.respondMFARequired(c, mfaRequired)
+            }
+            return s.rejectFailedLogin(c, loginRequest.Email, err)
+        } else {
+            s.resetFailedLogins(user.Email)
+            return s.respondWithTokens(c, tokens, user, "login success")
+        }
+    }
+}
+
+// rejectLockedLogin responds to a sign-in attempt for a locked account or from a blocked client IP
+func (s *Server) rejectLockedLogin(c echo.Context, err error) error {
+    if lockedErr, ok := err.(*auth.LockedError); ok {
+        c.Set(LoginFailureReasonKey, "locked "+lockedErr.Kind)
+        c.Response().Header().Set("Retry-After", strconv.Itoa(int(lockedErr.RetryAfter().Seconds())+1))
+        return c.JSON(http.StatusTooManyRequests, GenericResponse{Code: http.StatusTooManyRequests, Message: lockedErr.Error()})
+    }
+    return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+}
+
+// rejectFailedLogin counts the failed attempt and responds with a generic message, so the caller cannot tell
+// whether the email or the password was wrong
+func (s *Server) rejectFailedLogin(c echo.Context, email string, err error) error {
+    switch err {
+    case auth.ErrUserNotFound, auth.ErrInvalidPassword, auth.ErrInvalidPin, auth.ErrUserDisabled, auth.ErrInvalidMFACode:
+        c.Set(LoginFailureReasonKey, err.Error())
+        if recordErr := auth.RecordFailedLogin(s.dao.NewSession(), s.lockoutPolicy, email, s.clientIP(c)); recordErr != nil {
+            log.WithError(recordErr).WithField("email", email).Error("could not record failed login")
         }
+        return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: invalidCredentialsMessage})
+    case auth.ErrUnknownDevice, auth.ErrInvalidMFAToken, auth.ErrMFANotEnabled:
+        c.Set(LoginFailureReasonKey, err.Error())
+        return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
+    case auth.ErrPinNotAllowed:
+        c.Set(LoginFailureReasonKey, err.Error())
+        return c.JSON(http.StatusForbidden, GenericResponse{Code: http.StatusForbidden, Message: err.Error()})
+    default:
+        return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+    }
+}
 
-        if jwt, user, err := auth.Authenticate(s.dao.NewSession(), loginRequest.Email, loginRequest.Password, s.jwtSigningSecret); err != nil {
-            log.WithField("email", loginRequest.Email).WithError(err).Warn("failed to authenticate")
+func (s *Server) resetFailedLogins(email string) {
+    if err := auth.ResetFailedLogins(s.dao.NewSession(), email); err != nil {
+        log.WithError(err).WithField("email", email).Warn("could not reset failed login counter")
+    }
+}
+
+func (s *Server) refreshToken() echo.HandlerFunc {
+    type RefreshRequest struct {
+        RefreshToken string `json:"refreshToken" form:"refreshToken" query:"refreshToken"`
+    }
+
+    return func(c echo.Context) error {
+        refreshRequest := new(RefreshRequest)
+        if errResponse := bindRequest(c, refreshRequest); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+
+        if tokens, user, err := auth.RefreshTokens(s.dao.NewSession(), s.revocations, refreshRequest.RefreshToken, s.signingKeys); err == auth.ErrInvalidRefreshToken || err == auth.ErrUserDisabled {
             return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
-        } else if authenticatedUser, validationErr := auth.ValidateJWT(jwt, s.jwtSigningSecret); validationErr != nil {
-            log.WithError(validationErr).WithField("email", user.Email).WithField("roles", user.Roles).Info("generated JWT but could not validate")
-            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: validationErr.Error()})
+        } else if err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
         } else {
-            log.WithField("email", user.Email).WithField("roles", user.Roles).Info("user authenticated")
-            c.Set(AuthenticatedUserKey, authenticatedUser)
-            c.Response().Header().Add("Authorization", fmt.Sprintf("Bearer %v", jwt))
-            return c.JSON(http.StatusOK, GenericResponse{Code: http.StatusOK, Message: "login success", Data: user})
+            return s.respondWithTokens(c, tokens, user, "token refreshed")
+        }
+    }
+}
+
+func (s *Server) logout() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        user, err := s.getCurrentUser(c)
+        if err != nil {
+            return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
+        }
+        if err := auth.Logout(s.dao.NewSession(), s.revocations, user); err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
         }
+        log.WithField("email", user.Email).Info("user logged out")
+        return c.JSON(http.StatusOK, GenericResponse{Code: http.StatusOK, Message: "logout success"})
+    }
+}
+
+// respondWithTokens validates the new access token and returns it in the Authorization header, the refresh token,
+// if any, is returned in the Refresh-Token header.
+func (s *Server) respondWithTokens(c echo.Context, tokens auth.Tokens, user auth.UserEntity, message string) error {
+    return s.respondWithTokensAndData(c, tokens, user, message, user)
+}
+
+// respondWithTokensAndData is respondWithTokens with a different response body
+func (s *Server) respondWithTokensAndData(c echo.Context, tokens auth.Tokens, user auth.UserEntity, message string, data interface{}) error {
+    if authenticatedUser, validationErr := auth.ValidateJWT(tokens.AccessToken, s.signingKeys, s.revocations); validationErr != nil {
+        log.WithError(validationErr).WithField("email", user.Email).WithField("roles", user.Roles).Info("generated JWT but could not validate")
+        return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: validationErr.Error()})
+    } else {
+        log.WithField("email", user.Email).WithField("roles", user.Roles).Info("user authenticated")
+        s.describeSession(c, authenticatedUser)
+        c.Set(AuthenticatedUserKey, authenticatedUser)
+        c.Response().Header().Add("Authorization", fmt.Sprintf("Bearer %v", tokens.AccessToken))
+        if tokens.RefreshToken != "" {
+            c.Response().Header().Add(RefreshTokenHeader, tokens.RefreshToken)
+        }
+        return c.JSON(http.StatusOK, GenericResponse{Code: http.StatusOK, Message: message, Data: data})
+    }
+}
+
+// describeSession records the client that received the tokens, failures are logged because the sign-in succeeded
+func (s *Server) describeSession(c echo.Context, user auth.UserFromJwt) {
+    if user.Claims == nil || user.Claims.SessionID == "" {
+        return
+    }
+    if err := auth.DescribeSession(s.dao.NewSession(), user.Claims.SessionID, auth.SessionClient{
+        IP:        s.clientIP(c),
+        UserAgent: c.Request().UserAgent(),
+        DeviceID:  user.Claims.Device,
+    }); err != nil {
+        log.WithError(err).WithField("email", user.Email).Warn("could not record client of session")
+    }
+}
+
+// handleJWKS publishes the public keys that verify our JWTs
+func (s *Server) handleJWKS() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        c.Response().Header().Set("Cache-Control", "public, max-age=300")
+        return c.JSON(http.StatusOK, s.signingKeys.JWKS())
     }
 }
 
@@ -93,7 +189,7 @@ func (s *Server) databaseVersion() echo.HandlerFunc {
 
 func (s *Server) handleProducts() echo.HandlerFunc {
     return func(c echo.Context) error {
-        if products, err := order.QueryProducts(s.dao.NewSession()); err != nil {
+        if products, err := order.FindProducts(s.dao.NewSession()); err != nil {
             return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
         } else {
             return c.JSON(http.StatusOK, products)
@@ -101,16 +197,36 @@ func (s *Server) handleProducts() echo.HandlerFunc {
     }
 }
 
+// handleOrders returns a page of orders, filtered by the query parameters status (repeatable), waiter, barHandler,
+// customerName, createdFrom and createdUntil, sorted by sort. The nextCursor of the pagination selects the next page.
 func (s *Server) handleOrders() echo.HandlerFunc {
     return func(c echo.Context) error {
-        status := c.QueryParams()["status"]
+        query := order.OrderQuery{
+            Statuses:     queryParamList(c, "status", nil),
+            Waiter:       c.QueryParam("waiter"),
+            BarHandler:   c.QueryParam("barHandler"),
+            CustomerName: c.QueryParam("customerName"),
+            CreatedFrom:  c.QueryParam("createdFrom"),
+            CreatedUntil: c.QueryParam("createdUntil"),
+            Sort:         c.QueryParam("sort"),
+            Cursor:       c.QueryParam("cursor"),
+        }
+        for _, value := range query.Statuses {
+            if !order.IsValidStatus(value) {
+                return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: fmt.Sprintf("unknown status %v, use one of %v", value, order.Statuses())})
+            }
+        }
+        if rawLimit := c.QueryParam("limit"); rawLimit != "" {
+            var err error
+            if query.Limit, err = strconv.Atoi(rawLimit); err != nil {
+                return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: order.ErrInvalidLimit.Error()})
+            }
+        }
 
-        if len(status) == 0 {
-            return c.JSON(http.StatusOK, []string{})
-        } else if orders, err := order.FindOrdersWithStatus(s.dao.NewSession(), status); err != nil {
-            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        if page, err := order.FindOrders(s.dao.NewSession(), query); err != nil {
+            return orderErrorResponse(c, err)
         } else {
-            return c.JSON(http.StatusOK, orders)
+            return c.JSON(http.StatusOK, page)
         }
     }
 }
@@ -124,11 +240,21 @@ func (s *Server) handleOrder() echo.HandlerFunc {
         } else if err != nil {
             return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
         } else {
-            return c.JSON(http.StatusOK, order)
+            return respondWithOrder(c, http.StatusOK, order)
         }
     }
 }
 
+// bindRequest binds the request body into request, returns the response to send if binding failed
+func bindRequest(c echo.Context, request interface{}) *GenericResponse {
+    if err := c.Bind(request); err == echo.ErrUnsupportedMediaType {
+        return &GenericResponse{Code: http.StatusUnsupportedMediaType, Message: "unsupported media type, use: application/json, application/xml or application/x-www-form-urlencoded"}
+    } else if err != nil {
+        return &GenericResponse{Code: http.StatusBadRequest, Message: err.Error()}
+    }
+    return nil
+}
+
 func queryParamList(c echo.Context, key string, defaultValue []string) []string {
     values := c.QueryParams()[key]
     if len(values) == 0 {
@@ -0,0 +1,125 @@
+package api
+
+import (
+    "fmt"
+    "net/http"
+    "net/url"
+
+    "github.com/labstack/echo"
+    "github.com/toefel18/garsson-api/garsson/auth"
+    "github.com/toefel18/garsson-api/garsson/log"
+    "github.com/toefel18/garsson-api/garsson/mail"
+)
+
+const invitationMailFmt = `Hello,
+
+You have been invited to Garsson. Choose your password via the link below, the link is valid for %d hours.
+
+%s
+
+If you did not expect this invitation, you can ignore this mail.
+`
+
+const passwordResetMailFmt = `Hello,
+
+A password reset was requested for your Garsson account. Choose a new password via the link below, the link is
+valid for %d minutes.
+
+%s
+
+If you did not request a password reset, you can ignore this mail. Your password remains unchanged.
+`
+
+// accountTokenRequest is the body of the endpoints that consume an invitation or password reset token
+type accountTokenRequest struct {
+    Token    string `json:"token"`
+    Password string `json:"password"`
+}
+
+func (s *Server) handleInviteUser() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        invitation := new(auth.Invitation)
+        if errResponse := bindRequest(c, invitation); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+
+        user, rawToken, err := auth.InviteUser(s.dao.NewSession(), *invitation)
+        if err != nil {
+            return userErrorResponse(c, err)
+        }
+        log.WithField("email", user.Email).WithField("roles", user.Roles).Info("user invited")
+        if err := s.mailer.Send(mail.Message{
+            To:      user.Email,
+            Subject: "Your invitation to Garsson",
+            Body:    fmt.Sprintf(invitationMailFmt, int(auth.InviteTokenValidity.Hours()), s.accountTokenLink("/invite", rawToken)),
+        }); err != nil {
+            log.WithError(err).WithField("email", user.Email).Error("could not send invitation")
+            return c.JSON(http.StatusBadGateway, GenericResponse{Code: http.StatusBadGateway, Message: "user created but the invitation could not be sent, invite the user again", Data: user})
+        }
+        return c.JSON(http.StatusCreated, user)
+    }
+}
+
+func (s *Server) handleAcceptInvitation() echo.HandlerFunc {
+    return s.consumeAccountToken(auth.AccountTokenInvite, "invitation accepted")
+}
+
+func (s *Server) handleRequestPasswordReset() echo.HandlerFunc {
+    type PasswordResetRequest struct {
+        Email string `json:"email"`
+    }
+
+    return func(c echo.Context) error {
+        request := new(PasswordResetRequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+
+        // the response is the same whether or not the account exists, so it cannot be used to discover accounts
+        response := GenericResponse{Code: http.StatusAccepted, Message: "if the account exists, a password reset link has been sent"}
+        user, rawToken, err := auth.RequestPasswordReset(s.dao.NewSession(), request.Email)
+        if err == auth.ErrUserNotFound || err == auth.ErrUserDisabled || err == auth.ErrManagedByIdentityProvider {
+            log.WithField("email", request.Email).WithField("reason", err.Error()).Warn("password reset refused")
+            return c.JSON(http.StatusAccepted, response)
+        } else if err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        }
+        if err := s.mailer.Send(mail.Message{
+            To:      user.Email,
+            Subject: "Reset your Garsson password",
+            Body:    fmt.Sprintf(passwordResetMailFmt, int(auth.ResetTokenValidity.Minutes()), s.accountTokenLink("/reset-password", rawToken)),
+        }); err != nil {
+            log.WithError(err).WithField("email", user.Email).Error("could not send password reset link")
+            return c.JSON(http.StatusBadGateway, GenericResponse{Code: http.StatusBadGateway, Message: "the password reset link could not be sent, try again later"})
+        }
+        log.WithField("email", user.Email).Info("password reset link sent")
+        return c.JSON(http.StatusAccepted, response)
+    }
+}
+
+func (s *Server) handleResetPassword() echo.HandlerFunc {
+    return s.consumeAccountToken(auth.AccountTokenReset, "password changed")
+}
+
+// consumeAccountToken sets the password of the user that owns the invitation or reset token
+func (s *Server) consumeAccountToken(purpose, message string) echo.HandlerFunc {
+    return func(c echo.Context) error {
+        request := new(accountTokenRequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+
+        if user, err := auth.ConsumeAccountToken(s.dao.NewSession(), s.revocations, purpose, request.Token, request.Password); err != nil {
+            return userErrorResponse(c, err)
+        } else {
+            s.streams.closeUser(user.Email) // the sessions of the user have been revoked
+            log.WithField("email", user.Email).WithField("purpose", purpose).Info(message)
+            return c.JSON(http.StatusOK, GenericResponse{Code: http.StatusOK, Message: message, Data: user})
+        }
+    }
+}
+
+// accountTokenLink returns the link to the page of the application that consumes the token
+func (s *Server) accountTokenLink(path, rawToken string) string {
+    return s.publicURL + path + "?token=" + url.QueryEscape(rawToken)
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+    "net/http"
+
+    "github.com/labstack/echo"
+    "github.com/toefel18/garsson-api/garsson/auth"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+func (s *Server) handleListAPIKeys() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if keys, err := auth.ListAPIKeys(s.dao.NewSession()); err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        } else {
+            return c.JSON(http.StatusOK, keys)
+        }
+    }
+}
+
+func (s *Server) handleCreateAPIKey() echo.HandlerFunc {
+    type CreateAPIKeyResponse struct {
+        auth.APIKey
+        // Key must be configured on the client, it cannot be retrieved later
+        Key string `json:"key"`
+    }
+
+    return func(c echo.Context) error {
+        newKey := new(auth.NewAPIKey)
+        if errResponse := bindRequest(c, newKey); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+
+        if key, rawKey, err := auth.CreateAPIKey(s.dao.NewSession(), *newKey, s.currentAccountEmail(c)); err == auth.ErrInvalidAPIKeyName || auth.IsValidationError(err) {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        } else if err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        } else {
+            log.WithField("apiKey", key.ID).WithField("name", key.Name).WithField("roles", key.Roles).Info("api key created")
+            return c.JSON(http.StatusCreated, CreateAPIKeyResponse{APIKey: key, Key: rawKey})
+        }
+    }
+}
+
+func (s *Server) handleRevokeAPIKey() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        apiKeyID := c.Param("apiKeyId")
+        if err := s.apiKeys.Revoke(s.dao.NewSession(), apiKeyID); err == auth.ErrAPIKeyNotFound {
+            return c.JSON(http.StatusNotFound, GenericResponse{Code: http.StatusNotFound, Message: err.Error()})
+        } else if err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        }
+        log.WithField("apiKey", apiKeyID).Info("api key revoked")
+        return c.JSON(http.StatusOK, GenericResponse{Code: http.StatusOK, Message: "api key revoked"})
+    }
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+    "net/http"
+
+    "github.com/labstack/echo"
+    "github.com/toefel18/garsson-api/garsson/auth"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+const (
+    // DeviceTokenHeader is the request header that carries the token of a registered device
+    DeviceTokenHeader = "X-Device-Token"
+)
+
+func (s *Server) loginWithPin() echo.HandlerFunc {
+    type PinLoginRequest struct {
+        Email string `json:"email" form:"email" query:"email"`
+        Pin   string `json:"pin" form:"pin" query:"pin"`
+    }
+
+    return func(c echo.Context) error {
+        loginRequest := new(PinLoginRequest)
+        if errResponse := bindRequest(c, loginRequest); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+
+        sess := s.dao.NewSession()
+        deviceToken := c.Request().Header.Get(DeviceTokenHeader)
+        c.Set(LoginEmailKey, loginRequest.Email)
+        if err := auth.CheckLoginAllowed(sess, loginRequest.Email, s.clientIP(c)); err != nil {
+            return s.rejectLockedLogin(c, err)
+        } else if jwt, user, err := auth.AuthenticateWithPin(sess, deviceToken, loginRequest.Email, loginRequest.Pin, s.signingKeys); err != nil {
+            return s.rejectFailedLogin(c, loginRequest.Email, err)
+        } else {
+            s.resetFailedLogins(user.Email)
+            return s.respondWithTokens(c, auth.Tokens{AccessToken: jwt}, user, "login success")
+        }
+    }
+}
+
+func (s *Server) handleSetPin() echo.HandlerFunc {
+    type SetPinRequest struct {
+        Password string `json:"password"`
+        Pin      string `json:"pin"`
+    }
+
+    return func(c echo.Context) error {
+        user, err := s.getCurrentUser(c)
+        if err != nil {
+            return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
+        } else if user.Claims != nil && user.Claims.Device != "" {
+            return c.JSON(http.StatusForbidden, GenericResponse{Code: http.StatusForbidden, Message: "sign in with your password to change your pin"})
+        }
+
+        request := new(SetPinRequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+
+        if err := auth.SetPin(s.dao.NewSession(), user.Email, request.Password, request.Pin); err == auth.ErrInvalidPinFormat {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        } else if err == auth.ErrInvalidPassword {
+            return c.JSON(http.StatusForbidden, GenericResponse{Code: http.StatusForbidden, Message: err.Error()})
+        } else if err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        }
+        log.WithField("email", user.Email).Info("pin changed")
+        return c.JSON(http.StatusOK, GenericResponse{Code: http.StatusOK, Message: "pin changed"})
+    }
+}
+
+func (s *Server) handleListDevices() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if devices, err := auth.ListDevices(s.dao.NewSession()); err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        } else {
+            return c.JSON(http.StatusOK, devices)
+        }
+    }
+}
+
+func (s *Server) handleRegisterDevice() echo.HandlerFunc {
+    type RegisterDeviceRequest struct {
+        Name string `json:"name"`
+    }
+    type RegisterDeviceResponse struct {
+        auth.Device
+        // Token must be configured on the device, it cannot be retrieved later
+        Token string `json:"token"`
+    }
+
+    return func(c echo.Context) error {
+        request := new(RegisterDeviceRequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+
+        if device, token, err := auth.RegisterDevice(s.dao.NewSession(), request.Name, s.currentAccountEmail(c)); err == auth.ErrInvalidDeviceName {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        } else if err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        } else {
+            log.WithField("device", device.ID).WithField("name", device.Name).Info("device registered")
+            return c.JSON(http.StatusCreated, RegisterDeviceResponse{Device: device, Token: token})
+        }
+    }
+}
+
+func (s *Server) handleRevokeDevice() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        deviceID := c.Param("deviceId")
+        if err := auth.RevokeDevice(s.dao.NewSession(), deviceID); err == auth.ErrDeviceNotFound {
+            return c.JSON(http.StatusNotFound, GenericResponse{Code: http.StatusNotFound, Message: err.Error()})
+        } else if err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        }
+        log.WithField("device", deviceID).Info("device revoked")
+        return c.JSON(http.StatusOK, GenericResponse{Code: http.StatusOK, Message: "device revoked"})
+    }
+}
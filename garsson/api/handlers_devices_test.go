@@ -0,0 +1,69 @@
+package api
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/labstack/echo"
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/auth"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// pinHash4321 is the argon2id hash of the PIN 4321
+const pinHash4321 = "$argon2id$v=19$m=65536,t=1,p=4$LzIvCKzMsCp2rAfJ4MKINg$DT/fjQAZRX3nMXh0u7gSuG8xAscBgHRTMVWX8fqjkXU"
+
+var pinLockoutPolicy = auth.LockoutPolicy{AccountThreshold: 3, IPThreshold: 20, BaseLockout: time.Minute, MaxLockout: time.Hour, ResetAfter: time.Hour}
+
+func pinLogin(s *Server, pin string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(http.MethodPost, "/api/v1/login/pin", strings.NewReader(`{"email":"bar@garsson.io","pin":"`+pin+`"}`))
+    req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+    req.Header.Set(DeviceTokenHeader, "device")
+    rec := httptest.NewRecorder()
+    s.loginWithPin()(s.router.NewContext(req, rec))
+    return rec
+}
+
+func failedLoginCounterRows() *sqlmock.Rows {
+    return sqlmock.NewRows([]string{"kind", "subject", "failed_attempts", "time_last_failure", "time_locked_until"})
+}
+
+func TestLoginWithPin_WrongPinLocksAccountAtThreshold(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    s := NewServer(dao, Config{LockoutPolicy: pinLockoutPolicy})
+    mock.ExpectQuery(`SELECT \* FROM failed_login_counter`).WillReturnRows(failedLoginCounterRows())
+    mock.ExpectQuery(`SELECT \* FROM device`).WillReturnRows(sqlmock.NewRows([]string{"id", "revoked"}).AddRow("tablet-1", false))
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(sqlmock.NewRows([]string{"email", "pin_hash", "disabled"}).AddRow("bar@garsson.io", pinHash4321, false))
+    mock.ExpectQuery(`SELECT role_name FROM user_role`).WillReturnRows(sqlmock.NewRows([]string{"role_name"}))
+    mock.ExpectQuery(`SELECT \* FROM role_inheritance`).WillReturnRows(sqlmock.NewRows([]string{"role_name", "inherited_role_name"}))
+    mock.ExpectQuery(`SELECT \* FROM role_permission`).WillReturnRows(sqlmock.NewRows([]string{"role_name", "permission_name"}))
+    mock.ExpectBegin()
+    mock.ExpectQuery(`INSERT INTO failed_login_counter .* VALUES \('account', 'bar@garsson.io'`).WillReturnRows(sqlmock.NewRows([]string{"failed_attempts"}).AddRow(3))
+    mock.ExpectExec(`UPDATE "failed_login_counter" SET "time_locked_until" = .* WHERE \(kind = 'account' AND subject = 'bar@garsson.io'\)`).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery(`INSERT INTO failed_login_counter .* VALUES \('ip', `).WillReturnRows(sqlmock.NewRows([]string{"failed_attempts"}).AddRow(1))
+    mock.ExpectCommit()
+
+    rec := pinLogin(s, "1234")
+    assert.Equal(t, http.StatusUnauthorized, rec.Code)
+    assert.Contains(t, rec.Body.String(), invalidCredentialsMessage, "a wrong pin is not distinguishable from an unknown user")
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLoginWithPin_LockedAccountIsNotChecked(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    s := NewServer(dao, Config{LockoutPolicy: pinLockoutPolicy})
+    lockedUntil := db.FormatTime(time.Now().Add(time.Minute))
+    mock.ExpectQuery(`SELECT \* FROM failed_login_counter`).
+        WillReturnRows(failedLoginCounterRows().AddRow("account", "bar@garsson.io", 3, db.Now(), lockedUntil))
+
+    rec := pinLogin(s, "4321")
+    assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+    assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+    assert.NoError(t, mock.ExpectationsWereMet(), "the pin is not verified while the account is locked")
+}
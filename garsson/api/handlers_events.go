@@ -0,0 +1,402 @@
+package api
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/labstack/echo"
+    "github.com/toefel18/garsson-api/garsson/auth"
+    "github.com/toefel18/garsson-api/garsson/log"
+    "github.com/toefel18/garsson-api/garsson/order"
+    "golang.org/x/net/websocket"
+)
+
+// The order event stream is a WebSocket that sends every order event matching the ?status= and ?station= filters as
+// JSON, a station display for example only receives the orders with a ticket at its station.
+// Browsers cannot set the Authorization header on a WebSocket, so they offer the access token as the subprotocol
+// access_token.<jwt> next to the OrderEventsProtocol, which the server selects. The connection is closed when the
+// access token expires, the client reconnects with a refreshed token.
+//
+// golang.org/x/net/websocket answers pings of the client but hides their pongs, therefore the keep-alive is part of
+// the protocol: the server sends {"type":"ping"} and closes connections from which it did not receive any message,
+// such as {"type":"pong"}, within streamPongWait.
+//
+// Displays that cannot use WebSockets read the same events as Server-Sent Events from /api/v1/orders/events. Each
+// event carries its id, a reconnecting EventSource sends the last one in Last-Event-ID and receives the missed events
+// before the live ones. If they cannot be replayed a reset event tells the client to reload the orders.
+// An EventSource cannot set the Authorization header either, so the client first requests a single-use stream ticket
+// from /api/v1/orders/events/tickets with its access token and opens /api/v1/orders/events?ticket=<ticket>. Every
+// reconnect needs a new ticket, the stream ends when the access token that requested the ticket expires.
+//
+// Both streams end as well when their session is revoked. Revocations on this instance close the streams at once
+// through the streamRegistry, revocations on other instances are noticed at the next ping.
+
+const (
+    // OrderEventsProtocol is the WebSocket subprotocol of the order event stream
+    OrderEventsProtocol = "garsson.orders.v1"
+    // accessTokenProtocolPrefix precedes the access token offered as WebSocket subprotocol
+    accessTokenProtocolPrefix = "access_token."
+    // webSocketProtocolHeader contains the subprotocols offered by the client
+    webSocketProtocolHeader = "Sec-WebSocket-Protocol"
+
+    // streamPingInterval is how often the server pings the client
+    streamPingInterval = 30 * time.Second
+    // streamPongWait is how long the server waits for a message of the client before closing the connection
+    streamPongWait = streamPingInterval*2 + 15*time.Second
+    // streamWriteWait is how long sending a message may take
+    streamWriteWait = 10 * time.Second
+
+    streamMessageSubscribed = "subscribed"
+    streamMessagePing       = "ping"
+    streamMessageClosing    = "closing"
+    streamMessageReset      = "reset"
+
+    // orderEventSourcePath is the route of the Server-Sent Events, the only route that accepts a stream ticket
+    orderEventSourcePath = "/api/v1/orders/events"
+    // streamTicketParam is the query parameter that contains the stream ticket of an EventSource
+    streamTicketParam = "ticket"
+    // lastEventIDHeader contains the id of the last Server-Sent Event that a reconnecting client received
+    lastEventIDHeader = "Last-Event-ID"
+    // eventSourceRetry is the reconnection delay in milliseconds that EventSource clients are told to use
+    eventSourceRetry = 3000
+)
+
+// streamMessage is a message of the order event stream that is not an event
+type streamMessage struct {
+    Type    string             `json:"type"`
+    Message string             `json:"message,omitempty"`
+    Filter  *order.EventFilter `json:"filter,omitempty"`
+}
+
+// streamRegistry keeps the open event streams, so that they can be closed when their session is revoked
+type streamRegistry struct {
+    mutex   sync.Mutex
+    streams map[chan struct{}]streamOwner
+}
+
+// streamOwner is the user and session that opened a stream
+type streamOwner struct {
+    email     string
+    sessionID string
+}
+
+func newStreamRegistry() *streamRegistry {
+    return &streamRegistry{streams: map[chan struct{}]streamOwner{}}
+}
+
+// open registers a stream of the user, the returned channel is closed when its session is revoked. The stream must
+// call the returned function when it ends.
+func (r *streamRegistry) open(user auth.UserFromJwt) (<-chan struct{}, func()) {
+    owner := streamOwner{email: user.Email}
+    if user.Claims != nil {
+        owner.sessionID = user.Claims.SessionID
+    }
+    revoked := make(chan struct{})
+    r.mutex.Lock()
+    r.streams[revoked] = owner
+    r.mutex.Unlock()
+    return revoked, func() {
+        r.mutex.Lock()
+        delete(r.streams, revoked)
+        r.mutex.Unlock()
+    }
+}
+
+// closeSession closes the streams of the session
+func (r *streamRegistry) closeSession(sessionID string) {
+    r.closeWhere(func(owner streamOwner) bool { return owner.sessionID == sessionID })
+}
+
+// closeUser closes all streams of the user
+func (r *streamRegistry) closeUser(email string) {
+    r.closeWhere(func(owner streamOwner) bool { return owner.email == email })
+}
+
+func (r *streamRegistry) closeWhere(matches func(owner streamOwner) bool) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    for revoked, owner := range r.streams {
+        if matches(owner) {
+            close(revoked)
+            delete(r.streams, revoked)
+        }
+    }
+}
+
+// isStreamRevoked returns true if the access token or the session of the stream has been revoked
+func (s *Server) isStreamRevoked(user auth.UserFromJwt) bool {
+    if user.Claims == nil {
+        return false
+    }
+    return s.revocations.IsRevoked(user.Claims.Id) || (user.Claims.SessionID != "" && s.sessions.IsRevoked(user.Claims.SessionID))
+}
+
+// handleWebSocketOrderEventStream streams the order events that match the ?status= and ?station= filters
+func (s *Server) handleWebSocketOrderEventStream() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        filter, err := orderEventFilter(c)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        }
+        user, err := s.getCurrentUser(c)
+        if err != nil {
+            return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
+        }
+        var expires <-chan time.Time
+        if user.Claims != nil && user.Claims.ExpiresAt > 0 {
+            expiry := time.NewTimer(time.Until(time.Unix(user.Claims.ExpiresAt, 0)))
+            defer expiry.Stop()
+            expires = expiry.C
+        }
+
+        server := websocket.Server{
+            Handshake: selectOrderEventsProtocol,
+            Handler: func(ws *websocket.Conn) {
+                log.WithField("user", user.Email).WithField("statuses", filter.Statuses).WithField("stations", filter.Stations).Info("order event stream opened")
+                s.streamOrderEvents(ws, user, filter, expires)
+                log.WithField("user", user.Email).Info("order event stream closed")
+            },
+        }
+        server.ServeHTTP(c.Response(), c.Request())
+        return nil
+    }
+}
+
+// streamOrderEvents sends events until the client disconnects, stops answering, cannot keep up, or its token expires
+// or is revoked
+func (s *Server) streamOrderEvents(ws *websocket.Conn, user auth.UserFromJwt, filter order.EventFilter, expires <-chan time.Time) {
+    defer ws.Close()
+    subscription := s.orderEvents.Subscribe(filter)
+    defer subscription.Close()
+    revoked, closeStream := s.streams.open(user)
+    defer closeStream()
+
+    disconnected := make(chan struct{})
+    go func() {
+        defer close(disconnected)
+        for {
+            ws.SetReadDeadline(time.Now().Add(streamPongWait))
+            var ignored string
+            if err := websocket.Message.Receive(ws, &ignored); err != nil {
+                return
+            }
+        }
+    }()
+
+    ping := time.NewTicker(streamPingInterval)
+    defer ping.Stop()
+    if err := sendStreamMessage(ws, streamMessage{Type: streamMessageSubscribed, Filter: &filter}); err != nil {
+        return
+    }
+    for {
+        var err error
+        select {
+        case <-disconnected:
+            return
+        case event, subscribed := <-subscription.Events():
+            if !subscribed {
+                sendStreamMessage(ws, streamMessage{Type: streamMessageClosing, Message: "events may have been missed, reload the orders and reconnect"})
+                return
+            }
+            err = sendStreamMessage(ws, event)
+        case <-ping.C:
+            if s.isStreamRevoked(user) {
+                sendStreamMessage(ws, streamMessage{Type: streamMessageClosing, Message: auth.ErrSessionRevoked.Error()})
+                return
+            }
+            err = sendStreamMessage(ws, streamMessage{Type: streamMessagePing})
+        case <-expires:
+            sendStreamMessage(ws, streamMessage{Type: streamMessageClosing, Message: "access token expired, reconnect with a new token"})
+            return
+        case <-revoked:
+            sendStreamMessage(ws, streamMessage{Type: streamMessageClosing, Message: auth.ErrSessionRevoked.Error()})
+            return
+        }
+        if err != nil {
+            log.WithError(err).Debug("could not send to order event stream")
+            return
+        }
+    }
+}
+
+// handleOrderEventSource streams the order events that match the ?status= and ?station= filters as Server-Sent Events
+func (s *Server) handleOrderEventSource() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        filter, err := orderEventFilter(c)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        }
+        var lastEventID int64
+        if header := c.Request().Header.Get(lastEventIDHeader); header != "" {
+            if lastEventID, err = strconv.ParseInt(header, 10, 64); err != nil {
+                return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: "Last-Event-ID must be number"})
+            }
+        }
+        user, err := s.getCurrentUser(c)
+        if err != nil {
+            return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
+        }
+        var expires <-chan time.Time
+        if user.Claims != nil && user.Claims.ExpiresAt > 0 {
+            expiry := time.NewTimer(time.Until(time.Unix(user.Claims.ExpiresAt, 0)))
+            defer expiry.Stop()
+            expires = expiry.C
+        }
+
+        // subscribe before replaying, so that no event is missed in between
+        subscription := s.orderEvents.Subscribe(filter)
+        defer subscription.Close()
+        revoked, closeStream := s.streams.open(user)
+        defer closeStream()
+        var missed []order.Event
+        if lastEventID > 0 {
+            if missed, err = order.ReplayEvents(s.dao.NewSession(), lastEventID, filter); err != nil && err != order.ErrEventsUnavailable {
+                return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+            }
+        }
+
+        res := c.Response()
+        res.Header().Set(echo.HeaderContentType, "text/event-stream")
+        res.Header().Set("Cache-Control", "no-cache")
+        res.Header().Set("X-Accel-Buffering", "no")
+        res.WriteHeader(http.StatusOK)
+        fmt.Fprintf(res, "retry: %v\n\n", eventSourceRetry)
+        if err == order.ErrEventsUnavailable {
+            writeServerSentEvent(res, 0, streamMessageReset, streamMessage{Type: streamMessageReset, Message: err.Error()})
+        }
+        for _, event := range missed {
+            writeServerSentEvent(res, event.ID, event.Type, event)
+            lastEventID = event.ID
+        }
+        res.Flush()
+
+        log.WithField("user", user.Email).WithField("statuses", filter.Statuses).WithField("replayed", len(missed)).Info("order event source opened")
+        defer log.WithField("user", user.Email).Info("order event source closed")
+        ping := time.NewTicker(streamPingInterval)
+        defer ping.Stop()
+        for {
+            select {
+            case <-c.Request().Context().Done():
+                return nil
+            case event, subscribed := <-subscription.Events():
+                if !subscribed {
+                    writeServerSentEvent(res, 0, streamMessageClosing, streamMessage{Type: streamMessageClosing, Message: "events may have been missed, reconnect"})
+                    res.Flush()
+                    return nil
+                } else if event.ID <= lastEventID {
+                    continue // already replayed
+                }
+                writeServerSentEvent(res, event.ID, event.Type, event)
+                lastEventID = event.ID
+            case <-ping.C:
+                if s.isStreamRevoked(user) {
+                    writeServerSentEvent(res, 0, streamMessageClosing, streamMessage{Type: streamMessageClosing, Message: auth.ErrSessionRevoked.Error()})
+                    res.Flush()
+                    return nil
+                }
+                // a comment keeps proxies from closing the idle connection
+                fmt.Fprint(res, ": ping\n\n")
+            case <-expires:
+                writeServerSentEvent(res, 0, streamMessageClosing, streamMessage{Type: streamMessageClosing, Message: "access token expired, reconnect with a new token"})
+                res.Flush()
+                return nil
+            case <-revoked:
+                writeServerSentEvent(res, 0, streamMessageClosing, streamMessage{Type: streamMessageClosing, Message: auth.ErrSessionRevoked.Error()})
+                res.Flush()
+                return nil
+            }
+            res.Flush()
+        }
+    }
+}
+
+// handleIssueStreamTicket returns a single-use ticket with which an EventSource opens the order event source
+func (s *Server) handleIssueStreamTicket() echo.HandlerFunc {
+    type StreamTicketResponse struct {
+        Ticket           string `json:"ticket"`
+        ExpiresInSeconds int64  `json:"expiresInSeconds"`
+    }
+
+    return func(c echo.Context) error {
+        user, err := s.getCurrentUser(c)
+        if err != nil {
+            return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
+        } else if user.Claims == nil {
+            return c.JSON(http.StatusForbidden, GenericResponse{Code: http.StatusForbidden, Message: "stream tickets are only issued for access tokens"})
+        }
+        ticket, err := auth.IssueStreamTicket(s.dao.NewSession(), user.Email, *user.Claims)
+        if err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        }
+        c.Response().Header().Set("Cache-Control", "no-store")
+        return c.JSON(http.StatusCreated, StreamTicketResponse{Ticket: ticket, ExpiresInSeconds: int64(auth.StreamTicketValidity / time.Second)})
+    }
+}
+
+// writeServerSentEvent writes the data as JSON in an event of the type, an id of 0 is omitted
+func writeServerSentEvent(res *echo.Response, id int64, eventType string, data interface{}) error {
+    payload, err := json.Marshal(data)
+    if err != nil {
+        return err
+    }
+    if id > 0 {
+        fmt.Fprintf(res, "id: %v\n", id)
+    }
+    _, err = fmt.Fprintf(res, "event: %v\ndata: %s\n\n", eventType, payload)
+    return err
+}
+
+func sendStreamMessage(ws *websocket.Conn, message interface{}) error {
+    ws.SetWriteDeadline(time.Now().Add(streamWriteWait))
+    return websocket.JSON.Send(ws, message)
+}
+
+// orderEventFilter returns the filter in the query parameters
+func orderEventFilter(c echo.Context) (order.EventFilter, error) {
+    statuses := queryParamList(c, "status", nil)
+    for _, status := range statuses {
+        if !order.IsValidStatus(status) {
+            return order.EventFilter{}, fmt.Errorf("unknown status %v, use one of %v", status, order.Statuses())
+        }
+    }
+    var stations []int64
+    for _, station := range queryParamList(c, "station", nil) {
+        if id, err := strconv.ParseInt(station, 10, 64); err != nil {
+            return order.EventFilter{}, fmt.Errorf("station must be number, not %v", station)
+        } else {
+            stations = append(stations, id)
+        }
+    }
+    return order.EventFilter{Statuses: statuses, Stations: stations}, nil
+}
+
+// selectOrderEventsProtocol accepts the OrderEventsProtocol if offered, the access token is never echoed back
+func selectOrderEventsProtocol(config *websocket.Config, req *http.Request) error {
+    offered := config.Protocol
+    config.Protocol = nil
+    for _, protocol := range offered {
+        if protocol == OrderEventsProtocol {
+            config.Protocol = []string{OrderEventsProtocol}
+        }
+    }
+    return nil
+}
+
+// webSocketAuthorization returns the access token that a WebSocket client offered as subprotocol as bearer
+// authorization, empty if none was offered
+func webSocketAuthorization(req *http.Request) string {
+    if !strings.EqualFold(req.Header.Get(echo.HeaderUpgrade), "websocket") {
+        return ""
+    }
+    for _, protocol := range strings.Split(req.Header.Get(webSocketProtocolHeader), ",") {
+        if protocol = strings.TrimSpace(protocol); strings.HasPrefix(protocol, accessTokenProtocolPrefix) {
+            return bearerPrefix + protocol[len(accessTokenProtocolPrefix):]
+        }
+    }
+    return ""
+}
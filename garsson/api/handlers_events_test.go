@@ -0,0 +1,115 @@
+package api
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/dgrijalva/jwt-go"
+    "github.com/labstack/echo"
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/auth"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "github.com/toefel18/garsson-api/garsson/order"
+    "golang.org/x/net/websocket"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestWebSocketAuthorization(t *testing.T) {
+    tests := []struct {
+        name          string
+        upgrade       string
+        protocols     string
+        authorization string
+    }{
+        {name: "token offered", upgrade: "websocket", protocols: OrderEventsProtocol + ", access_token.abc.def.ghi", authorization: "Bearer abc.def.ghi"},
+        {name: "token offered first", upgrade: "WebSocket", protocols: "access_token.abc.def.ghi," + OrderEventsProtocol, authorization: "Bearer abc.def.ghi"},
+        {name: "no token", upgrade: "websocket", protocols: OrderEventsProtocol, authorization: ""},
+        {name: "no protocols", upgrade: "websocket", authorization: ""},
+        {name: "not a websocket", protocols: "access_token.abc.def.ghi", authorization: ""},
+    }
+    for _, test := range tests {
+        req := httptest.NewRequest(http.MethodGet, "/api/v1/orders/ws-eventstream", nil)
+        if test.upgrade != "" {
+            req.Header.Set(echo.HeaderUpgrade, test.upgrade)
+        }
+        if test.protocols != "" {
+            req.Header.Set(webSocketProtocolHeader, test.protocols)
+        }
+        assert.Equal(t, test.authorization, webSocketAuthorization(req), test.name)
+    }
+}
+
+func TestSelectOrderEventsProtocol_NeverEchoesToken(t *testing.T) {
+    config := &websocket.Config{Protocol: []string{"access_token.abc.def.ghi", OrderEventsProtocol}}
+    assert.NoError(t, selectOrderEventsProtocol(config, nil))
+    assert.Equal(t, []string{OrderEventsProtocol}, config.Protocol)
+
+    config = &websocket.Config{Protocol: []string{"access_token.abc.def.ghi"}}
+    assert.NoError(t, selectOrderEventsProtocol(config, nil))
+    assert.Empty(t, config.Protocol, "the token is not selected as protocol")
+}
+
+// orderEventServer serves the routes of a server with an event bus
+func orderEventServer(t *testing.T) (*httptest.Server, *Server, sqlmock.Sqlmock, *auth.KeySet) {
+    dao, mock := dbtest.NewDbMock(t)
+    keys := testSigningKeys(t)
+    s := NewServer(dao, Config{SigningKeys: keys, OrderEvents: order.NewEventBus()})
+    s.configureRoutes()
+    return httptest.NewServer(s.router), s, mock, keys
+}
+
+// dialOrderEvents opens the order event stream with the protocols
+func dialOrderEvents(server *httptest.Server, protocols ...string) (*websocket.Conn, error) {
+    config, err := websocket.NewConfig(strings.Replace(server.URL, "http", "ws", 1)+"/api/v1/orders/ws-eventstream", server.URL)
+    if err != nil {
+        return nil, err
+    }
+    config.Protocol = protocols
+    return websocket.DialConfig(config)
+}
+
+func TestWebSocketOrderEventStream_RejectsHandshakeWithoutToken(t *testing.T) {
+    server, _, mock, _ := orderEventServer(t)
+    defer server.Close()
+
+    _, err := dialOrderEvents(server, OrderEventsProtocol)
+    assert.Error(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet(), "the stream is not opened")
+}
+
+func TestWebSocketOrderEventStream_ClosesWhenSubscriptionIsDropped(t *testing.T) {
+    server, s, mock, keys := orderEventServer(t)
+    defer server.Close()
+    expectRevocationListLoad(mock)
+    token, err := keys.Sign(auth.JwtClaims{
+        StandardClaims: jwt.StandardClaims{
+            Id:        "jti-1",
+            Issuer:    "garsson-api",
+            IssuedAt:  time.Now().Unix(),
+            ExpiresAt: time.Now().Add(auth.TokenValidity).Unix(),
+            Audience:  "garsson-api-users",
+            Subject:   "bar@garsson.io",
+        },
+        Permissions: []string{auth.PermissionOrdersRead},
+    })
+    assert.NoError(t, err)
+
+    ws, err := dialOrderEvents(server, OrderEventsProtocol, accessTokenProtocolPrefix+token)
+    if !assert.NoError(t, err) {
+        return
+    }
+    defer ws.Close()
+    assert.Equal(t, OrderEventsProtocol, ws.Config().Protocol[0], "the token is not echoed")
+    ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+    var message streamMessage
+    assert.NoError(t, websocket.JSON.Receive(ws, &message))
+    assert.Equal(t, streamMessageSubscribed, message.Type)
+
+    s.orderEvents.DropAll()
+    assert.NoError(t, websocket.JSON.Receive(ws, &message))
+    assert.Equal(t, streamMessageClosing, message.Type)
+    assert.Error(t, websocket.JSON.Receive(ws, &message), "the connection is closed")
+}
@@ -0,0 +1,259 @@
+package api
+
+import (
+    "net/http"
+
+    "github.com/labstack/echo"
+    "github.com/toefel18/garsson-api/garsson/auth"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+// MFAChallenge is the response to a correct password of a user that needs a second factor
+type MFAChallenge struct {
+    MFAToken string `json:"mfaToken"`
+    // EnrollmentRequired indicates that the user must set up an authenticator via /api/v1/login/mfa/enroll first, with
+    // an enrollment code issued by an administrator
+    EnrollmentRequired bool `json:"enrollmentRequired"`
+}
+
+// SignInWithRecoveryCodes is the response to a sign-in that enabled an authenticator
+type SignInWithRecoveryCodes struct {
+    User          auth.UserEntity `json:"user"`
+    RecoveryCodes []string        `json:"recoveryCodes"`
+}
+
+type mfaCodeRequest struct {
+    MFAToken string `json:"mfaToken"`
+    // Code is a code of the authenticator or a recovery code
+    Code string `json:"code"`
+}
+
+// respondMFARequired asks the client to continue the sign-in with the second factor. Failed logins are only reset
+// after the second step, otherwise the lockout could be avoided by alternating password and code guesses.
+func (s *Server) respondMFARequired(c echo.Context, mfaRequired *auth.MFARequiredError) error {
+    c.Set(LoginFailureReasonKey, "second factor pending")
+    return c.JSON(http.StatusAccepted, GenericResponse{
+        Code:    http.StatusAccepted,
+        Message: mfaRequired.Error(),
+        Data:    MFAChallenge{MFAToken: mfaRequired.MFAToken, EnrollmentRequired: mfaRequired.EnrollmentRequired},
+    })
+}
+
+// handleMFALogin completes a sign-in with a code of the second factor
+func (s *Server) handleMFALogin() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        request := new(mfaCodeRequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+        claims, err := auth.ValidateMFAToken(request.MFAToken, s.signingKeys, s.revocations)
+        if err != nil {
+            return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
+        }
+
+        sess := s.dao.NewSession()
+        c.Set(LoginEmailKey, claims.Subject)
+        if err := auth.CheckLoginAllowed(sess, claims.Subject, s.clientIP(c)); err != nil {
+            return s.rejectLockedLogin(c, err)
+        }
+        tokens, user, recoveryCodes, err := auth.CompleteMFASignIn(sess, s.revocations, claims, request.Code, s.signingKeys)
+        if err != nil {
+            return s.rejectFailedLogin(c, claims.Subject, err)
+        }
+        s.resetFailedLogins(user.Email)
+        if len(recoveryCodes) > 0 {
+            return s.respondWithTokensAndData(c, tokens, user, "login success, store the recovery codes safely",
+                SignInWithRecoveryCodes{User: user, RecoveryCodes: recoveryCodes})
+        }
+        return s.respondWithTokens(c, tokens, user, "login success")
+    }
+}
+
+// handleMFALoginEnroll sets up an authenticator for a user whose role requires a second factor, with the enrollment
+// code that an administrator issued. The sign-in is completed by handleMFALogin with a code of the new authenticator.
+func (s *Server) handleMFALoginEnroll() echo.HandlerFunc {
+    type EnrollRequest struct {
+        MFAToken       string `json:"mfaToken"`
+        EnrollmentCode string `json:"enrollmentCode"`
+    }
+
+    return func(c echo.Context) error {
+        request := new(EnrollRequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+        claims, err := auth.ValidateMFAToken(request.MFAToken, s.signingKeys, s.revocations)
+        if err != nil {
+            return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
+        }
+        if enrollment, err := auth.EnrollTOTPDuringSignIn(s.dao.NewSession(), claims, request.EnrollmentCode); err != nil {
+            return mfaErrorResponse(c, err)
+        } else {
+            return c.JSON(http.StatusOK, enrollment)
+        }
+    }
+}
+
+func (s *Server) handleGetMyMFA() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if status, err := auth.GetMFAStatus(s.dao.NewSession(), s.currentAccountEmail(c)); err != nil {
+            return mfaErrorResponse(c, err)
+        } else {
+            return c.JSON(http.StatusOK, status)
+        }
+    }
+}
+
+func (s *Server) handleEnrollMyTOTP() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if errResponse := s.passwordSessionOnly(c); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+        if enrollment, err := auth.EnrollTOTP(s.dao.NewSession(), s.currentAccountEmail(c)); err != nil {
+            return mfaErrorResponse(c, err)
+        } else {
+            return c.JSON(http.StatusOK, enrollment)
+        }
+    }
+}
+
+func (s *Server) handleConfirmMyTOTP() echo.HandlerFunc {
+    return s.handleMyMFACode(func(email, code string) (interface{}, error) {
+        return auth.ConfirmTOTP(s.dao.NewSession(), email, code)
+    })
+}
+
+func (s *Server) handleRegenerateMyRecoveryCodes() echo.HandlerFunc {
+    return s.handleMyMFACode(func(email, code string) (interface{}, error) {
+        return auth.RegenerateRecoveryCodes(s.dao.NewSession(), email, code)
+    })
+}
+
+func (s *Server) handleDisableMyMFA() echo.HandlerFunc {
+    return s.handleMyMFACode(func(email, code string) (interface{}, error) {
+        if err := auth.DisableMFA(s.dao.NewSession(), email, code); err != nil {
+            return nil, err
+        }
+        return GenericResponse{Code: http.StatusOK, Message: "two-factor authentication disabled"}, nil
+    })
+}
+
+// handleMyMFACode verifies a code of the current user, wrong codes count as failed sign-in so that a stolen access
+// token cannot be used to guess codes
+func (s *Server) handleMyMFACode(action func(email, code string) (interface{}, error)) echo.HandlerFunc {
+    type CodeRequest struct {
+        Code string `json:"code"`
+    }
+
+    return func(c echo.Context) error {
+        if errResponse := s.passwordSessionOnly(c); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+        request := new(CodeRequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+
+        email := s.currentAccountEmail(c)
+        sess := s.dao.NewSession()
+        if err := auth.CheckLoginAllowed(sess, email, s.clientIP(c)); err != nil {
+            return s.rejectLockedLogin(c, err)
+        }
+        result, err := action(email, request.Code)
+        if err == auth.ErrInvalidMFACode {
+            if recordErr := auth.RecordFailedLogin(sess, s.lockoutPolicy, email, s.clientIP(c)); recordErr != nil {
+                log.WithError(recordErr).WithField("email", email).Error("could not record failed code")
+            }
+        }
+        if err != nil {
+            return mfaErrorResponse(c, err)
+        }
+        return c.JSON(http.StatusOK, result)
+    }
+}
+
+// handleResetUserMFA removes the second factor of a user that lost it
+func (s *Server) handleResetUserMFA() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if email, err := emailParam(c); err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        } else if err := auth.ResetMFA(s.dao.NewSession(), email); err == auth.ErrMFANotEnabled {
+            return c.JSON(http.StatusNotFound, GenericResponse{Code: http.StatusNotFound, Message: err.Error()})
+        } else if err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        } else {
+            log.WithField("email", email).WithField("by", s.currentAccountEmail(c)).Info("two-factor authentication reset")
+            return c.JSON(http.StatusOK, GenericResponse{Code: http.StatusOK, Message: "two-factor authentication reset"})
+        }
+    }
+}
+
+// handleIssueUserMFAEnrollment issues the code with which a user sets up its authenticator while signing in, the
+// administrator hands it to the user
+func (s *Server) handleIssueUserMFAEnrollment() echo.HandlerFunc {
+    type EnrollmentResponse struct {
+        EnrollmentCode   string `json:"enrollmentCode"`
+        ExpiresInSeconds int    `json:"expiresInSeconds"`
+    }
+
+    return func(c echo.Context) error {
+        email, err := emailParam(c)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        }
+        enrollmentCode, err := auth.IssueMFAEnrollment(s.dao.NewSession(), email)
+        if err != nil {
+            return mfaErrorResponse(c, err)
+        }
+        log.WithField("email", email).WithField("by", s.currentAccountEmail(c)).Info("issued two-factor enrollment code")
+        c.Response().Header().Set("Cache-Control", "no-store")
+        return c.JSON(http.StatusCreated, EnrollmentResponse{EnrollmentCode: enrollmentCode, ExpiresInSeconds: int(auth.MFAEnrollmentValidity.Seconds())})
+    }
+}
+
+// handleSetRoleMFARequired changes whether a role requires a second factor
+func (s *Server) handleSetRoleMFARequired() echo.HandlerFunc {
+    type RoleMFARequest struct {
+        Required bool `json:"required"`
+    }
+
+    return func(c echo.Context) error {
+        request := new(RoleMFARequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+        role := c.Param("role")
+        if err := auth.SetRoleMFARequired(s.dao.NewSession(), role, request.Required); err == auth.ErrUnknownRole {
+            return c.JSON(http.StatusNotFound, GenericResponse{Code: http.StatusNotFound, Message: err.Error()})
+        } else if err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        }
+        log.WithField("role", role).WithField("required", request.Required).Info("changed two-factor requirement of role")
+        return c.JSON(http.StatusOK, GenericResponse{Code: http.StatusOK, Message: "role updated"})
+    }
+}
+
+// passwordSessionOnly refuses changes to the second factor from a PIN session on a shared device
+func (s *Server) passwordSessionOnly(c echo.Context) *GenericResponse {
+    if user, err := s.getCurrentUser(c); err != nil {
+        return &GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()}
+    } else if user.Claims != nil && user.Claims.Device != "" {
+        return &GenericResponse{Code: http.StatusForbidden, Message: "sign in with your password to manage two-factor authentication"}
+    }
+    return nil
+}
+
+func mfaErrorResponse(c echo.Context, err error) error {
+    switch err {
+    case auth.ErrInvalidMFACode:
+        return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+    case auth.ErrMFAAlreadyEnabled, auth.ErrMFANotEnabled, auth.ErrMFARequiredByRole:
+        return c.JSON(http.StatusConflict, GenericResponse{Code: http.StatusConflict, Message: err.Error()})
+    case auth.ErrInvalidMFAToken, auth.ErrUserDisabled, auth.ErrInvalidMFAEnrollment:
+        return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
+    case auth.ErrUserNotFound:
+        return c.JSON(http.StatusNotFound, GenericResponse{Code: http.StatusNotFound, Message: err.Error()})
+    default:
+        return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+    }
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/labstack/echo"
+    "github.com/toefel18/garsson-api/garsson/auth"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+const (
+    // oidcCookieName is the cookie that remembers state, nonce and code verifier during the sign-in at the IdP
+    oidcCookieName = "garsson_oidc"
+    // oidcCookiePath limits the cookie to the OpenID Connect endpoints
+    oidcCookiePath = "/api/v1/login/oidc"
+    // oidcSignInTimeout is the time in which the user must complete the sign-in at the IdP
+    oidcSignInTimeout = 10 * time.Minute
+)
+
+// handleOIDCLogin redirects the browser to the identity provider
+func (s *Server) handleOIDCLogin() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        request, err := auth.NewOIDCAuthRequest()
+        if err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        }
+        redirectURL, err := s.oidcAuthCodeURL(c, request)
+        if err != nil {
+            log.WithError(err).Error("could not reach identity provider")
+            return c.JSON(http.StatusBadGateway, GenericResponse{Code: http.StatusBadGateway, Message: "identity provider unavailable"})
+        }
+        return c.Redirect(http.StatusFound, redirectURL)
+    }
+}
+
+// handleStartMyOIDCLink starts the sign-in at the identity provider that links the account of the current user. The
+// response contains the URL of the identity provider, to which the application navigates the browser.
+func (s *Server) handleStartMyOIDCLink() echo.HandlerFunc {
+    type StartLinkResponse struct {
+        RedirectURL string `json:"redirectUrl"`
+    }
+
+    return func(c echo.Context) error {
+        user, err := s.getCurrentUser(c)
+        if err != nil {
+            return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
+        } else if user.Claims != nil && user.Claims.Device != "" {
+            return c.JSON(http.StatusForbidden, GenericResponse{Code: http.StatusForbidden, Message: "sign in with your password to link your account"})
+        }
+        request, err := auth.StartOIDCLink(s.dao.NewSession(), user.Email)
+        if err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        }
+        redirectURL, err := s.oidcAuthCodeURL(c, request)
+        if err != nil {
+            log.WithError(err).Error("could not reach identity provider")
+            return c.JSON(http.StatusBadGateway, GenericResponse{Code: http.StatusBadGateway, Message: "identity provider unavailable"})
+        }
+        return c.JSON(http.StatusOK, StartLinkResponse{RedirectURL: redirectURL})
+    }
+}
+
+// handleLinkUserOIDC links the account of a user to its subject at the identity provider
+func (s *Server) handleLinkUserOIDC() echo.HandlerFunc {
+    type LinkRequest struct {
+        Subject string `json:"subject"`
+    }
+
+    return func(c echo.Context) error {
+        email, err := emailParam(c)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        }
+        request := new(LinkRequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+        if user, err := auth.LinkExternalSubject(s.dao.NewSession(), email, request.Subject); err != nil {
+            return userErrorResponse(c, err)
+        } else {
+            return c.JSON(http.StatusOK, user)
+        }
+    }
+}
+
+// handleOIDCCallback completes the sign-in after the identity provider redirected back, the browser is redirected
+// to the application with our tokens in the URL fragment, which is not sent to servers
+func (s *Server) handleOIDCCallback() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        request, err := s.readOIDCCookie(c)
+        s.setOIDCCookie(c, "", -1)
+        if err != nil || request.State == "" || c.QueryParam("state") != request.State {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: "sign-in expired or invalid state, start again"})
+        } else if idpError := c.QueryParam("error"); idpError != "" {
+            log.WithField("error", idpError).WithField("description", c.QueryParam("error_description")).Warn("identity provider rejected sign-in")
+            return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: "sign-in at identity provider failed"})
+        }
+
+        identity, err := s.oidc.Exchange(c.QueryParam("code"), request)
+        if err != nil {
+            log.WithError(err).Warn("could not complete sign-in at identity provider")
+            return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: "sign-in at identity provider failed"})
+        }
+        if request.Link {
+            return s.completeOIDCLink(c, request, identity)
+        }
+        c.Set(LoginEmailKey, identity.Email)
+        tokens, user, err := auth.AuthenticateOIDC(s.dao.NewSession(), s.oidc, identity, s.signingKeys)
+        if mfaRequired, ok := err.(*auth.MFARequiredError); ok {
+            // the application continues the sign-in at /api/v1/login/mfa, like after a password
+            c.Set(LoginFailureReasonKey, "second factor pending")
+            fragment := url.Values{"mfaToken": {mfaRequired.MFAToken}, "enrollmentRequired": {strconv.FormatBool(mfaRequired.EnrollmentRequired)}}
+            return c.Redirect(http.StatusFound, s.oidcPostLoginURL+"#"+fragment.Encode())
+        } else if err == auth.ErrUserDisabled || err == auth.ErrInvalidIDToken || err == auth.ErrAccountNotLinked {
+            c.Set(LoginFailureReasonKey, err.Error())
+            return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
+        } else if err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        }
+
+        authenticatedUser, err := auth.ValidateJWT(tokens.AccessToken, s.signingKeys, s.revocations)
+        if err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        }
+        log.WithField("email", user.Email).WithField("roles", user.Roles).Info("user authenticated via identity provider")
+        s.describeSession(c, authenticatedUser)
+        c.Set(AuthenticatedUserKey, authenticatedUser)
+        fragment := url.Values{"accessToken": {tokens.AccessToken}, "refreshToken": {tokens.RefreshToken}}
+        return c.Redirect(http.StatusFound, s.oidcPostLoginURL+"#"+fragment.Encode())
+    }
+}
+
+// completeOIDCLink links the identity to the account that started the link, the browser returns to the application
+// which still holds the tokens of the user
+func (s *Server) completeOIDCLink(c echo.Context, request auth.OIDCAuthRequest, identity auth.OIDCIdentity) error {
+    user, err := auth.CompleteOIDCLink(s.dao.NewSession(), request, identity)
+    if err == auth.ErrInvalidOIDCLink {
+        return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+    } else if err == auth.ErrIdentityAlreadyLinked {
+        return c.JSON(http.StatusConflict, GenericResponse{Code: http.StatusConflict, Message: err.Error()})
+    } else if err != nil {
+        return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+    }
+    fragment := url.Values{"linked": {user.Email}}
+    return c.Redirect(http.StatusFound, s.oidcPostLoginURL+"#"+fragment.Encode())
+}
+
+// oidcAuthCodeURL returns the URL of the identity provider and remembers the request in a cookie for the callback
+func (s *Server) oidcAuthCodeURL(c echo.Context, request auth.OIDCAuthRequest) (string, error) {
+    redirectURL, err := s.oidc.AuthCodeURL(request)
+    if err != nil {
+        return "", err
+    }
+    encodedRequest, _ := json.Marshal(request)
+    s.setOIDCCookie(c, base64.RawURLEncoding.EncodeToString(encodedRequest), oidcSignInTimeout)
+    return redirectURL, nil
+}
+
+func (s *Server) setOIDCCookie(c echo.Context, value string, maxAge time.Duration) {
+    c.SetCookie(&http.Cookie{
+        Name:     oidcCookieName,
+        Value:    value,
+        Path:     oidcCookiePath,
+        MaxAge:   int(maxAge.Seconds()),
+        HttpOnly: true,
+        Secure:   c.IsTLS() || strings.HasPrefix(s.publicURL, "https://"),
+        SameSite: http.SameSiteLaxMode,
+    })
+}
+
+func (s *Server) readOIDCCookie(c echo.Context) (auth.OIDCAuthRequest, error) {
+    var request auth.OIDCAuthRequest
+    cookie, err := c.Cookie(oidcCookieName)
+    if err != nil {
+        return request, err
+    }
+    decoded, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+    if err != nil {
+        return request, err
+    }
+    err = json.Unmarshal(decoded, &request)
+    return request, err
+}
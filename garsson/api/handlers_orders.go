@@ -0,0 +1,291 @@
+package api
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/labstack/echo"
+    "github.com/toefel18/garsson-api/garsson/log"
+    "github.com/toefel18/garsson-api/garsson/order"
+)
+
+const (
+    // ETagHeader contains the version of the returned order
+    ETagHeader = "ETag"
+    // IfMatchHeader contains the version of the order on which a change is based
+    IfMatchHeader = "If-Match"
+)
+
+var (
+    errInvalidOrderETag   = errors.New("If-Match does not contain an ETag of this order, reload it and try again")
+    errInvalidOrderLineID = errors.New("order line id must be number")
+)
+
+// handleCreateOrder places an order, the authenticated user is the waiter
+func (s *Server) handleCreateOrder() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        newOrder := new(order.NewOrder)
+        if errResponse := bindRequest(c, newOrder); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+
+        waiter := s.currentAccountEmail(c)
+        if created, err := order.CreateOrder(s.dao.NewSession(), waiter, *newOrder); err != nil {
+            return orderErrorResponse(c, err)
+        } else {
+            log.WithField("order", created.ID).WithField("waiter", waiter).Info("order placed")
+            c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/api/v1/orders/%v", created.ID))
+            return respondWithOrder(c, http.StatusCreated, created)
+        }
+    }
+}
+
+// handleTransitionOrder changes the status of an order, the lifecycle determines the permission required
+func (s *Server) handleTransitionOrder() echo.HandlerFunc {
+    type TransitionRequest struct {
+        Status string `json:"status"`
+    }
+
+    return func(c echo.Context) error {
+        request := new(TransitionRequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+        orderID, err := orderIDParam(c)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        }
+        user, err := s.getCurrentUser(c)
+        if err != nil {
+            return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
+        }
+
+        if changed, err := order.TransitionOrder(s.dao.NewSession(), orderID, request.Status, s.currentAccountEmail(c), user.Permissions); err != nil {
+            return orderErrorResponse(c, err)
+        } else {
+            log.WithField("order", orderID).WithField("status", changed.Status).WithField("by", user.Email).Info("order status changed")
+            return respondWithOrder(c, http.StatusOK, changed)
+        }
+    }
+}
+
+// handleAddOrderLine adds a line to the order version in the If-Match header
+func (s *Server) handleAddOrderLine() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        newLine := new(order.NewOrderLine)
+        if errResponse := bindRequest(c, newLine); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+        return s.editOrder(c, func(orderID, version int64) (*order.CustomerOrder, error) {
+            return order.AddOrderLine(s.dao.NewSession(), orderID, version, *newLine)
+        })
+    }
+}
+
+// handleChangeOrderLine changes the quantity of a line of the order version in the If-Match header
+func (s *Server) handleChangeOrderLine() echo.HandlerFunc {
+    type ChangeLineRequest struct {
+        Quantity int64 `json:"quantity"`
+    }
+
+    return func(c echo.Context) error {
+        request := new(ChangeLineRequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+        lineID, err := orderLineIDParam(c)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        }
+        return s.editOrder(c, func(orderID, version int64) (*order.CustomerOrder, error) {
+            return order.ChangeOrderLineQuantity(s.dao.NewSession(), orderID, version, lineID, request.Quantity)
+        })
+    }
+}
+
+// handleRemoveOrderLine removes a line of the order version in the If-Match header
+func (s *Server) handleRemoveOrderLine() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        lineID, err := orderLineIDParam(c)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        }
+        return s.editOrder(c, func(orderID, version int64) (*order.CustomerOrder, error) {
+            return order.RemoveOrderLine(s.dao.NewSession(), orderID, version, lineID)
+        })
+    }
+}
+
+// handleMoveOrder moves the order version in the If-Match header to another table
+func (s *Server) handleMoveOrder() echo.HandlerFunc {
+    type MoveRequest struct {
+        TableID int64 `json:"tableId"`
+    }
+
+    return func(c echo.Context) error {
+        request := new(MoveRequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+        return s.editOrder(c, func(orderID, version int64) (*order.CustomerOrder, error) {
+            return order.MoveOrder(s.dao.NewSession(), orderID, version, request.TableID)
+        })
+    }
+}
+
+// handleRecordPayment records a payment of the order, the authenticated user processes it
+func (s *Server) handleRecordPayment() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        newPayment := new(order.NewPayment)
+        if errResponse := bindRequest(c, newPayment); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+        orderID, err := orderIDParam(c)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        }
+
+        processedBy := s.currentAccountEmail(c)
+        if paid, err := order.RecordPayment(s.dao.NewSession(), orderID, processedBy, *newPayment); err != nil {
+            return orderErrorResponse(c, err)
+        } else {
+            log.WithField("order", orderID).WithField("method", newPayment.Method).WithField("amount", newPayment.AmountInCents).
+                WithField("by", processedBy).Info("payment recorded")
+            return respondWithOrder(c, http.StatusCreated, paid)
+        }
+    }
+}
+
+// handleSplitEvenly splits the outstanding balance of the order into ?parts= equal shares
+func (s *Server) handleSplitEvenly() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        orderID, err := orderIDParam(c)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        }
+        parts, err := strconv.Atoi(c.QueryParam("parts"))
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: "parts must be number"})
+        }
+
+        if split, err := order.SplitOrderEvenly(s.dao.NewSession(), orderID, parts); err != nil {
+            return orderErrorResponse(c, err)
+        } else {
+            return c.JSON(http.StatusOK, split)
+        }
+    }
+}
+
+// handleSplitByLines returns the share of the outstanding balance for the selected order lines
+func (s *Server) handleSplitByLines() echo.HandlerFunc {
+    type SplitRequest struct {
+        Lines []order.LineSelection `json:"lines"`
+    }
+
+    return func(c echo.Context) error {
+        request := new(SplitRequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+        orderID, err := orderIDParam(c)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        }
+
+        if split, err := order.SplitOrderByLines(s.dao.NewSession(), orderID, request.Lines); err != nil {
+            return orderErrorResponse(c, err)
+        } else {
+            return c.JSON(http.StatusOK, split)
+        }
+    }
+}
+
+// editOrder requires the version of the order that the client has seen in the If-Match header, so that concurrent
+// edits fail with 412 instead of overwriting each other
+func (s *Server) editOrder(c echo.Context, edit func(orderID, version int64) (*order.CustomerOrder, error)) error {
+    orderID, err := orderIDParam(c)
+    if err != nil {
+        return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+    }
+    ifMatch := c.Request().Header.Get(IfMatchHeader)
+    if ifMatch == "" {
+        return c.JSON(http.StatusPreconditionRequired, GenericResponse{Code: http.StatusPreconditionRequired, Message: "send the ETag of the order in the If-Match header"})
+    }
+    version, err := parseOrderETag(ifMatch)
+    if err != nil {
+        return c.JSON(http.StatusPreconditionFailed, GenericResponse{Code: http.StatusPreconditionFailed, Message: err.Error()})
+    }
+
+    if edited, err := edit(orderID, version); err != nil {
+        return orderErrorResponse(c, err)
+    } else {
+        log.WithField("order", orderID).WithField("version", edited.Version).WithField("by", s.currentAccountEmail(c)).Info("order changed")
+        return respondWithOrder(c, http.StatusOK, edited)
+    }
+}
+
+// respondWithOrder sends the order with its version as ETag
+func respondWithOrder(c echo.Context, code int, customerOrder *order.CustomerOrder) error {
+    c.Response().Header().Set(ETagHeader, orderETag(customerOrder.Version))
+    return c.JSON(code, customerOrder)
+}
+
+func orderETag(version int64) string {
+    return fmt.Sprintf("\"%v\"", version)
+}
+
+// parseOrderETag returns the version in an ETag created by orderETag
+func parseOrderETag(etag string) (int64, error) {
+    etag = strings.TrimSpace(etag)
+    if len(etag) < 2 || !strings.HasPrefix(etag, "\"") || !strings.HasSuffix(etag, "\"") {
+        return 0, errInvalidOrderETag
+    } else if version, err := strconv.ParseInt(etag[1:len(etag)-1], 10, 64); err != nil {
+        return 0, errInvalidOrderETag
+    } else {
+        return version, nil
+    }
+}
+
+// orderLineIDParam returns the :lineId path parameter
+func orderLineIDParam(c echo.Context) (int64, error) {
+    if lineID, err := strconv.ParseInt(c.Param("lineId"), 10, 64); err != nil {
+        return 0, errInvalidOrderLineID
+    } else {
+        return lineID, nil
+    }
+}
+
+// orderIDParam returns the :orderId path parameter
+func orderIDParam(c echo.Context) (int64, error) {
+    if orderID, err := strconv.ParseInt(c.Param("orderId"), 10, 64); err != nil {
+        return 0, errors.New("order id must be number")
+    } else {
+        return orderID, nil
+    }
+}
+
+func orderErrorResponse(c echo.Context, err error) error {
+    if _, illegal := err.(*order.IllegalTransitionError); illegal {
+        return c.JSON(http.StatusConflict, GenericResponse{Code: http.StatusConflict, Message: err.Error()})
+    }
+    switch {
+    case err == order.ErrOrderNotFound, err == order.ErrOrderLineNotFound, err == order.ErrTableNotFound, err == order.ErrStationNotFound,
+        err == order.ErrProductNotFound, err == order.ErrTicketNotFound:
+        return c.JSON(http.StatusNotFound, GenericResponse{Code: http.StatusNotFound, Message: err.Error()})
+    case err == order.ErrTransitionNotPermitted:
+        return c.JSON(http.StatusForbidden, GenericResponse{Code: http.StatusForbidden, Message: err.Error()})
+    case err == order.ErrVersionMismatch:
+        return c.JSON(http.StatusPreconditionFailed, GenericResponse{Code: http.StatusPreconditionFailed, Message: err.Error()})
+    case err == order.ErrOrderChanged, err == order.ErrOrderClosed, err == order.ErrLastOrderLine, err == order.ErrOverpayment,
+        err == order.ErrOrderNotPaid, err == order.ErrTableNumberTaken, err == order.ErrTableOutOfService, err == order.ErrStationNameTaken,
+        err == order.ErrIllegalTicketStatus:
+        return c.JSON(http.StatusConflict, GenericResponse{Code: http.StatusConflict, Message: err.Error()})
+    case order.IsValidationError(err):
+        return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+    default:
+        return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+    }
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestParseOrderETag(t *testing.T) {
+    tests := []struct {
+        etag    string
+        version int64
+        valid   bool
+    }{
+        {etag: `"3"`, version: 3, valid: true},
+        {etag: ` "12" `, version: 12, valid: true},
+        {etag: orderETag(7), version: 7, valid: true},
+        {etag: `W/"3"`, valid: false}, // If-Match requires a strong comparison
+        {etag: `3`, valid: false},
+        {etag: `"3`, valid: false},
+        {etag: `""`, valid: false},
+        {etag: `"`, valid: false},
+        {etag: `"three"`, valid: false},
+        {etag: `"3", "4"`, valid: false},
+        {etag: ``, valid: false},
+    }
+    for _, test := range tests {
+        version, err := parseOrderETag(test.etag)
+        if test.valid {
+            assert.NoError(t, err, test.etag)
+            assert.Equal(t, test.version, version, test.etag)
+        } else {
+            assert.Equal(t, errInvalidOrderETag, err, test.etag)
+        }
+    }
+}
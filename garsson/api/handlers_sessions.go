@@ -0,0 +1,97 @@
+package api
+
+import (
+    "net/http"
+
+    "github.com/labstack/echo"
+    "github.com/toefel18/garsson-api/garsson/auth"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+func (s *Server) handleListMySessions() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        return s.respondWithSessions(c, s.currentAccountEmail(c))
+    }
+}
+
+func (s *Server) handleRevokeMySession() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        return s.revokeSession(c, s.currentAccountEmail(c))
+    }
+}
+
+// handleRevokeMySessions signs the current user out everywhere, including the session of this request
+func (s *Server) handleRevokeMySessions() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        return s.revokeSessions(c, s.currentAccountEmail(c))
+    }
+}
+
+func (s *Server) handleListUserSessions() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if email, err := emailParam(c); err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        } else {
+            return s.respondWithSessions(c, email)
+        }
+    }
+}
+
+func (s *Server) handleRevokeUserSession() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if email, err := emailParam(c); err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        } else {
+            return s.revokeSession(c, email)
+        }
+    }
+}
+
+func (s *Server) handleRevokeUserSessions() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if email, err := emailParam(c); err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        } else {
+            return s.revokeSessions(c, email)
+        }
+    }
+}
+
+// respondWithSessions responds with the active sessions of the user, marking the session of this request
+func (s *Server) respondWithSessions(c echo.Context, email string) error {
+    if sessions, err := auth.ListSessions(s.dao.NewSession(), email, s.currentSessionID(c)); err != nil {
+        return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+    } else {
+        return c.JSON(http.StatusOK, sessions)
+    }
+}
+
+// revokeSession revokes the :sessionId of the user
+func (s *Server) revokeSession(c echo.Context, email string) error {
+    sessionID := c.Param("sessionId")
+    if err := s.sessions.Revoke(s.dao.NewSession(), s.revocations, email, sessionID); err == auth.ErrSessionNotFound {
+        return c.JSON(http.StatusNotFound, GenericResponse{Code: http.StatusNotFound, Message: err.Error()})
+    } else if err != nil {
+        return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+    }
+    s.streams.closeSession(sessionID)
+    log.WithField("email", email).WithField("session", sessionID).WithField("by", s.currentAccountEmail(c)).Info("session revoked")
+    return c.JSON(http.StatusOK, GenericResponse{Code: http.StatusOK, Message: "session revoked"})
+}
+
+func (s *Server) revokeSessions(c echo.Context, email string) error {
+    if err := auth.RevokeUserTokens(s.dao.NewSession(), s.revocations, email); err != nil {
+        return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+    }
+    s.streams.closeUser(email)
+    log.WithField("email", email).WithField("by", s.currentAccountEmail(c)).Info("all sessions revoked")
+    return c.JSON(http.StatusOK, GenericResponse{Code: http.StatusOK, Message: "all sessions revoked"})
+}
+
+// currentSessionID returns the session of the token that made the request, empty for api keys and old tokens
+func (s *Server) currentSessionID(c echo.Context) string {
+    if user, err := s.getCurrentUser(c); err == nil && user.Claims != nil {
+        return user.Claims.SessionID
+    }
+    return ""
+}
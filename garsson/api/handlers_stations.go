@@ -0,0 +1,121 @@
+package api
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+
+    "github.com/labstack/echo"
+    "github.com/toefel18/garsson-api/garsson/log"
+    "github.com/toefel18/garsson-api/garsson/order"
+)
+
+// handleStations lists the stations where products are prepared
+func (s *Server) handleStations() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if stations, err := order.ListStations(s.dao.NewSession()); err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        } else {
+            return c.JSON(http.StatusOK, stations)
+        }
+    }
+}
+
+// handleCreateStation adds a station
+func (s *Server) handleCreateStation() echo.HandlerFunc {
+    type StationRequest struct {
+        Name string `json:"name"`
+    }
+
+    return func(c echo.Context) error {
+        request := new(StationRequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+
+        if station, err := order.CreateStation(s.dao.NewSession(), request.Name); err != nil {
+            return orderErrorResponse(c, err)
+        } else {
+            log.WithField("station", station.Name).WithField("by", s.currentAccountEmail(c)).Info("station added")
+            c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/api/v1/stations/%v", station.ID))
+            return c.JSON(http.StatusCreated, station)
+        }
+    }
+}
+
+// handleSetProductStation sets where a product is prepared, a stationId of 0 means it needs no preparation
+func (s *Server) handleSetProductStation() echo.HandlerFunc {
+    type ProductStationRequest struct {
+        StationID int64 `json:"stationId"`
+    }
+
+    return func(c echo.Context) error {
+        request := new(ProductStationRequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+        productID, err := strconv.ParseInt(c.Param("productId"), 10, 64)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: "product id must be number"})
+        }
+
+        if product, err := order.SetProductStation(s.dao.NewSession(), productID, request.StationID); err != nil {
+            return orderErrorResponse(c, err)
+        } else {
+            log.WithField("product", productID).WithField("station", request.StationID).WithField("by", s.currentAccountEmail(c)).Info("product station changed")
+            return c.JSON(http.StatusOK, product)
+        }
+    }
+}
+
+// handleStationQueue returns the outstanding tickets of the station in fire order
+func (s *Server) handleStationQueue() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        stationID, err := stationIDParam(c)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        }
+
+        if queue, err := order.StationQueue(s.dao.NewSession(), stationID); err != nil {
+            return orderErrorResponse(c, err)
+        } else {
+            return c.JSON(http.StatusOK, queue)
+        }
+    }
+}
+
+// handleSetTicketStatus starts or finishes the preparation of a ticket and responds with its order
+func (s *Server) handleSetTicketStatus() echo.HandlerFunc {
+    type TicketStatusRequest struct {
+        Status string `json:"status"`
+    }
+
+    return func(c echo.Context) error {
+        request := new(TicketStatusRequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+        ticketID, err := strconv.ParseInt(c.Param("ticketId"), 10, 64)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: "ticket id must be number"})
+        }
+
+        actor := s.currentAccountEmail(c)
+        if changed, err := order.SetTicketStatus(s.dao.NewSession(), ticketID, request.Status, actor); err != nil {
+            return orderErrorResponse(c, err)
+        } else {
+            log.WithField("ticket", ticketID).WithField("status", request.Status).WithField("by", actor).Info("ticket status changed")
+            return respondWithOrder(c, http.StatusOK, changed)
+        }
+    }
+}
+
+// stationIDParam returns the :stationId path parameter
+func stationIDParam(c echo.Context) (int64, error) {
+    if stationID, err := strconv.ParseInt(c.Param("stationId"), 10, 64); err != nil {
+        return 0, errors.New("station id must be number")
+    } else {
+        return stationID, nil
+    }
+}
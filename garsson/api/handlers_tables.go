@@ -0,0 +1,121 @@
+package api
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/labstack/echo"
+    "github.com/toefel18/garsson-api/garsson/log"
+    "github.com/toefel18/garsson-api/garsson/order"
+)
+
+// handleTables shows every table with its open orders and the amount owed
+func (s *Server) handleTables() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if tables, err := order.ListTables(s.dao.NewSession(), time.Now()); err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        } else {
+            return c.JSON(http.StatusOK, tables)
+        }
+    }
+}
+
+// handleCreateTable adds a table
+func (s *Server) handleCreateTable() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        newTable := new(order.NewDiningTable)
+        if errResponse := bindRequest(c, newTable); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+
+        if table, err := order.CreateTable(s.dao.NewSession(), *newTable); err != nil {
+            return orderErrorResponse(c, err)
+        } else {
+            log.WithField("table", table.Number).WithField("by", s.currentAccountEmail(c)).Info("table added")
+            c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/api/v1/tables/%v", table.ID))
+            return c.JSON(http.StatusCreated, table)
+        }
+    }
+}
+
+// handleUpdateTable changes the number, area and capacity of a table
+func (s *Server) handleUpdateTable() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        changed := new(order.NewDiningTable)
+        if errResponse := bindRequest(c, changed); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+        tableID, err := tableIDParam(c)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        }
+
+        if table, err := order.UpdateTable(s.dao.NewSession(), tableID, *changed); err != nil {
+            return orderErrorResponse(c, err)
+        } else {
+            return c.JSON(http.StatusOK, table)
+        }
+    }
+}
+
+// handleSetTableStatus marks a table available, occupied, reserved or out of service
+func (s *Server) handleSetTableStatus() echo.HandlerFunc {
+    type StatusRequest struct {
+        Status string `json:"status"`
+    }
+
+    return func(c echo.Context) error {
+        request := new(StatusRequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+        tableID, err := tableIDParam(c)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        }
+
+        if table, err := order.SetTableStatus(s.dao.NewSession(), tableID, request.Status); err != nil {
+            return orderErrorResponse(c, err)
+        } else {
+            log.WithField("table", table.Number).WithField("status", table.Status).WithField("by", s.currentAccountEmail(c)).Info("table status changed")
+            return c.JSON(http.StatusOK, table)
+        }
+    }
+}
+
+// handleMergeTables moves the open orders of the table in the request to the table in the path
+func (s *Server) handleMergeTables() echo.HandlerFunc {
+    type MergeRequest struct {
+        FromTableID int64 `json:"fromTableId"`
+    }
+
+    return func(c echo.Context) error {
+        request := new(MergeRequest)
+        if errResponse := bindRequest(c, request); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+        tableID, err := tableIDParam(c)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        }
+
+        if merged, err := order.MergeTables(s.dao.NewSession(), tableID, request.FromTableID, time.Now()); err != nil {
+            return orderErrorResponse(c, err)
+        } else {
+            log.WithField("table", tableID).WithField("from", request.FromTableID).WithField("by", s.currentAccountEmail(c)).Info("tables merged")
+            return c.JSON(http.StatusOK, merged)
+        }
+    }
+}
+
+// tableIDParam returns the :tableId path parameter
+func tableIDParam(c echo.Context) (int64, error) {
+    if tableID, err := strconv.ParseInt(c.Param("tableId"), 10, 64); err != nil {
+        return 0, errors.New("table id must be number")
+    } else {
+        return tableID, nil
+    }
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+    "net/http"
+    "net/url"
+    "strconv"
+
+    "github.com/labstack/echo"
+    "github.com/toefel18/garsson-api/garsson/auth"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+func (s *Server) handleListUsers() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if users, err := auth.ListUsers(s.dao.NewSession()); err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        } else {
+            return c.JSON(http.StatusOK, users)
+        }
+    }
+}
+
+func (s *Server) handleGetUser() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if email, err := emailParam(c); err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        } else if user, err := auth.FindUser(s.dao.NewSession(), email); err != nil {
+            return userErrorResponse(c, err)
+        } else {
+            return c.JSON(http.StatusOK, user)
+        }
+    }
+}
+
+func (s *Server) handleCreateUser() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        newUser := new(auth.NewUser)
+        if errResponse := bindRequest(c, newUser); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+
+        if user, err := auth.CreateUser(s.dao.NewSession(), *newUser); err != nil {
+            return userErrorResponse(c, err)
+        } else {
+            log.WithField("email", user.Email).WithField("roles", user.Roles).Info("user created")
+            return c.JSON(http.StatusCreated, user)
+        }
+    }
+}
+
+func (s *Server) handleUpdateUser() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        update := new(auth.UserUpdate)
+        if errResponse := bindRequest(c, update); errResponse != nil {
+            return c.JSON(errResponse.Code, errResponse)
+        }
+
+        if email, err := emailParam(c); err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        } else if user, err := auth.UpdateUser(s.dao.NewSession(), s.revocations, email, *update); err != nil {
+            return userErrorResponse(c, err)
+        } else {
+            if (update.Disabled != nil && *update.Disabled) || update.Password != nil {
+                s.streams.closeUser(user.Email) // the sessions of the user have been revoked
+            }
+            log.WithField("email", user.Email).WithField("roles", user.Roles).WithField("disabled", user.Disabled).Info("user updated")
+            return c.JSON(http.StatusOK, user)
+        }
+    }
+}
+
+func (s *Server) handleDeleteUser() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if email, err := emailParam(c); err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        } else if err := auth.DeleteUser(s.dao.NewSession(), email); err != nil {
+            return userErrorResponse(c, err)
+        } else {
+            log.WithField("email", email).Info("user deleted")
+            return c.JSON(http.StatusOK, GenericResponse{Code: http.StatusOK, Message: "user deleted"})
+        }
+    }
+}
+
+func (s *Server) handleUnlockUser() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if email, err := emailParam(c); err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        } else if err := auth.UnlockAccount(s.dao.NewSession(), email); err != nil {
+            return userErrorResponse(c, err)
+        } else {
+            log.WithField("email", email).Info("user unlocked")
+            return c.JSON(http.StatusOK, GenericResponse{Code: http.StatusOK, Message: "user unlocked"})
+        }
+    }
+}
+
+func (s *Server) handleListUserLogins() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if email, err := emailParam(c); err != nil {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+        } else {
+            return s.respondWithLoginEvents(c, email)
+        }
+    }
+}
+
+func (s *Server) handleListMyLogins() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if user, err := s.getCurrentUser(c); err != nil {
+            return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
+        } else {
+            return s.respondWithLoginEvents(c, user.Email)
+        }
+    }
+}
+
+// respondWithLoginEvents responds with the most recent sign-in attempts for email, the amount can be set
+// with the limit query parameter
+func (s *Server) respondWithLoginEvents(c echo.Context, email string) error {
+    limit := auth.DefaultLoginEventLimit
+    if rawLimit := c.QueryParam("limit"); rawLimit != "" {
+        var err error
+        if limit, err = strconv.Atoi(rawLimit); err != nil || limit <= 0 {
+            return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: "limit must be a positive number"})
+        }
+    }
+    if events, err := auth.ListLoginEvents(s.dao.NewSession(), email, limit); err != nil {
+        return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+    } else {
+        return c.JSON(http.StatusOK, events)
+    }
+}
+
+func (s *Server) handleListRoles() echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if roles, err := auth.ListRoles(s.dao.NewSession()); err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        } else {
+            return c.JSON(http.StatusOK, roles)
+        }
+    }
+}
+
+// emailParam returns the unescaped :email path parameter
+func emailParam(c echo.Context) (string, error) {
+    return url.PathUnescape(c.Param("email"))
+}
+
+// userErrorResponse maps errors of the auth user management functions to a response
+func userErrorResponse(c echo.Context, err error) error {
+    switch {
+    case err == auth.ErrUserNotFound:
+        return c.JSON(http.StatusNotFound, GenericResponse{Code: http.StatusNotFound, Message: err.Error()})
+    case err == auth.ErrUserAlreadyExists, err == auth.ErrUserStillReferenced, err == auth.ErrIdentityAlreadyLinked:
+        return c.JSON(http.StatusConflict, GenericResponse{Code: http.StatusConflict, Message: err.Error()})
+    case auth.IsValidationError(err):
+        return c.JSON(http.StatusBadRequest, GenericResponse{Code: http.StatusBadRequest, Message: err.Error()})
+    default:
+        return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+    }
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/lib/pq"
+    "github.com/labstack/echo"
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/auth"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestCreateUser_DuplicateEmailIsConflict(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    s := NewServer(dao, Config{})
+    mock.ExpectBegin()
+    mock.ExpectExec(`INSERT INTO "user_account"`).WillReturnError(&pq.Error{Code: "23505"})
+    mock.ExpectRollback()
+
+    req := httptest.NewRequest(http.MethodPost, "/api/v1/users", strings.NewReader(`{"email":"bar@garsson.io","password":"correct horse","roles":["bar"]}`))
+    req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+    rec := httptest.NewRecorder()
+    assert.NoError(t, s.handleCreateUser()(s.router.NewContext(req, rec)))
+    assert.Equal(t, http.StatusConflict, rec.Code)
+    assert.Contains(t, rec.Body.String(), auth.ErrUserAlreadyExists.Error())
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetUser_NeverExposesPasswordHash(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    s := NewServer(dao, Config{})
+    mock.ExpectQuery(`SELECT \* FROM user_account WHERE \(email = 'bar@garsson.io'\)`).
+        WillReturnRows(sqlmock.NewRows([]string{"email", "password_hash", "pin_hash", "disabled"}).AddRow("bar@garsson.io", "$argon2id$secret-hash", "$argon2id$pin-hash", false))
+    mock.ExpectQuery(`SELECT role_name FROM user_role`).WillReturnRows(sqlmock.NewRows([]string{"role_name"}).AddRow("bar"))
+    mock.ExpectQuery(`SELECT \* FROM role_inheritance`).WillReturnRows(sqlmock.NewRows([]string{"role_name", "inherited_role_name"}))
+    mock.ExpectQuery(`SELECT \* FROM role_permission`).WillReturnRows(sqlmock.NewRows([]string{"role_name", "permission_name"}))
+
+    req := httptest.NewRequest(http.MethodGet, "/api/v1/users/bar@garsson.io", nil)
+    rec := httptest.NewRecorder()
+    c := s.router.NewContext(req, rec)
+    c.SetParamNames("email")
+    c.SetParamValues("bar@garsson.io")
+    assert.NoError(t, s.handleGetUser()(c))
+    assert.Equal(t, http.StatusOK, rec.Code)
+    assert.NotContains(t, rec.Body.String(), "hash")
+    assert.NotContains(t, rec.Body.String(), "argon2id")
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListUsers_NeverExposesPasswordHash(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    s := NewServer(dao, Config{})
+    mock.ExpectQuery(`SELECT \* FROM user_account ORDER BY email`).
+        WillReturnRows(sqlmock.NewRows([]string{"email", "password_hash", "disabled"}).AddRow("bar@garsson.io", "$argon2id$secret-hash", false))
+    mock.ExpectQuery(`SELECT \* FROM user_role`).WillReturnRows(sqlmock.NewRows([]string{"email", "role_name"}).AddRow("bar@garsson.io", "bar"))
+
+    rec := httptest.NewRecorder()
+    assert.NoError(t, s.handleListUsers()(s.router.NewContext(httptest.NewRequest(http.MethodGet, "/api/v1/users", nil), rec)))
+    assert.Equal(t, http.StatusOK, rec.Code)
+    assert.Contains(t, rec.Body.String(), `"email":"bar@garsson.io"`)
+    assert.NotContains(t, rec.Body.String(), "argon2id")
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func loginEventRows() *sqlmock.Rows {
+    return sqlmock.NewRows([]string{"id", "email", "method", "success", "time_attempted", "ip", "user_agent", "device_id", "failure_reason"}).
+        AddRow(1, "waiter@garsson.nl", "password", true, "2018-06-01T20:00:00Z", "192.0.2.1", nil, nil, nil)
+}
+
+func TestListMyLogins_OnlyEventsOfCaller(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    s := NewServer(dao, Config{})
+    mock.ExpectQuery(`SELECT \* FROM login_event WHERE \(email = 'waiter@garsson.nl'\) ORDER BY id DESC LIMIT 5`).WillReturnRows(loginEventRows())
+
+    req := httptest.NewRequest(http.MethodGet, "/api/v1/me/logins?limit=5&email=admin@garsson.nl", nil)
+    rec := httptest.NewRecorder()
+    c := s.router.NewContext(req, rec)
+    c.SetParamNames("email")
+    c.SetParamValues("admin@garsson.nl")
+    c.Set(AuthenticatedUserKey, auth.UserFromJwt{Email: "waiter@garsson.nl"})
+    assert.NoError(t, s.requireUserAccount()(s.handleListMyLogins())(c))
+    assert.Equal(t, http.StatusOK, rec.Code)
+    assert.Contains(t, rec.Body.String(), `"email":"waiter@garsson.nl"`)
+    assert.NotContains(t, rec.Body.String(), "admin@garsson.nl")
+    assert.NoError(t, mock.ExpectationsWereMet(), "the events of other users are not queried")
+}
+
+func TestListMyLogins_NotForAPIKeys(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    s := NewServer(dao, Config{})
+
+    req := httptest.NewRequest(http.MethodGet, "/api/v1/me/logins", nil)
+    rec := httptest.NewRecorder()
+    c := s.router.NewContext(req, rec)
+    c.Set(AuthenticatedUserKey, auth.UserFromJwt{Email: "pos", APIKeyID: "key-1"})
+    assert.NoError(t, s.requireUserAccount()(s.handleListMyLogins())(c))
+    assert.Equal(t, http.StatusForbidden, rec.Code)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListUserLogins_InvalidLimit(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    s := NewServer(dao, Config{})
+
+    req := httptest.NewRequest(http.MethodGet, "/api/v1/users/waiter@garsson.nl/logins?limit=-1", nil)
+    rec := httptest.NewRecorder()
+    c := s.router.NewContext(req, rec)
+    c.SetParamNames("email")
+    c.SetParamValues("waiter@garsson.nl")
+    assert.NoError(t, s.handleListUserLogins()(c))
+    assert.Equal(t, http.StatusBadRequest, rec.Code)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// audited sends a sign-in request through the auditLogin middleware to the handler
+func audited(s *Server, method string, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(http.MethodPost, "/api/v1/login/pin", nil)
+    req.RemoteAddr = "192.0.2.1:4000"
+    req.Header.Set("User-Agent", "Tablet/1.0")
+    req.Header.Set(DeviceTokenHeader, "device")
+    rec := httptest.NewRecorder()
+    s.auditLogin(method)(handler)(s.router.NewContext(req, rec))
+    return rec
+}
+
+func TestAuditLogin_RecordsSuccess(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    s := NewServer(dao, Config{})
+    mock.ExpectExec(`INSERT INTO "login_event" .* VALUES \('bar@garsson.io','pin',TRUE,'[^']+','192.0.2.1','Tablet/1.0','tablet-1',NULL\)`).
+        WillReturnResult(sqlmock.NewResult(1, 1))
+
+    audited(s, auth.LoginMethodPin, func(c echo.Context) error {
+        c.Set(LoginEmailKey, "bar@garsson.io")
+        c.Set(AuthenticatedUserKey, auth.UserFromJwt{Email: "bar@garsson.io", Claims: &auth.JwtClaims{Device: "tablet-1"}})
+        return c.NoContent(http.StatusOK)
+    })
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuditLogin_RecordsFailure(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    s := NewServer(dao, Config{})
+    mock.ExpectQuery(`SELECT \* FROM device`).WillReturnRows(sqlmock.NewRows([]string{"id", "revoked"}).AddRow("tablet-1", false))
+    mock.ExpectExec(`INSERT INTO "login_event" .* VALUES \('bar@garsson.io','pin',FALSE,'[^']+','192.0.2.1','Tablet/1.0','tablet-1','invalid pin'\)`).
+        WillReturnResult(sqlmock.NewResult(1, 1))
+
+    audited(s, auth.LoginMethodPin, func(c echo.Context) error {
+        c.Set(LoginEmailKey, "bar@garsson.io")
+        c.Set(LoginFailureReasonKey, auth.ErrInvalidPin.Error())
+        return c.NoContent(http.StatusUnauthorized)
+    })
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuditLogin_SkipsUnparsedRequests(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    s := NewServer(dao, Config{})
+
+    audited(s, auth.LoginMethodPassword, func(c echo.Context) error {
+        return c.NoContent(http.StatusBadRequest)
+    })
+    assert.NoError(t, mock.ExpectationsWereMet(), "nothing is recorded without an attempted email")
+}
@@ -17,17 +17,31 @@ const (
     bearerPrefix = "Bearer "
     // bearerPrefixLen contains the length of 'Bearer '
     bearerPrefixLen = 7
+    // apiKeyPrefix precedes the key in the Authorization header of machine clients
+    apiKeyPrefix = "ApiKey "
+    // DevUserHeader contains the email of the user to impersonate when development authentication is enabled
+    DevUserHeader = "X-Dev-User"
+    // DevRolesHeader optionally contains the comma separated roles to impersonate instead of those of the user
+    DevRolesHeader = "X-Dev-Roles"
+    // RefreshTokenHeader is the response header that contains the refresh token after login or refresh
+    RefreshTokenHeader = "Refresh-Token"
     // AuthenticatedUserKey is the key to lookup the authenticated user via echo.Context.Get()
     AuthenticatedUserKey = "authenticated_user"
-    // GrantingRoleKey is the key to lookup the role that granted the user access
-    GrantingRoleKey = "granting_role"
-    // MissingRoleKey is the key to lookup the role that the user is missing to gain access
-    MissingRoleKey = "missing_role"
+    // GrantingPermissionKey is the key to lookup the permission that granted the user access
+    GrantingPermissionKey = "granting_permission"
+    // MissingPermissionKey is the key to lookup the permission that the user is missing to gain access
+    MissingPermissionKey = "missing_permission"
+    // LoginEmailKey is the key to lookup the email that a sign-in was attempted for
+    LoginEmailKey = "login_email"
+    // LoginFailureReasonKey is the key to lookup why a sign-in attempt failed
+    LoginFailureReasonKey = "login_failure_reason"
+    // invalidCredentialsMessage is the response to every failed sign-in, it does not reveal what was wrong
+    invalidCredentialsMessage = "invalid email or password"
 )
 
 func (s *Server) configureMiddleware() {
     corsCfg := middleware.DefaultCORSConfig
-    corsCfg.ExposeHeaders = append(corsCfg.ExposeHeaders, "Authorization")
+    corsCfg.ExposeHeaders = append(corsCfg.ExposeHeaders, "Authorization", RefreshTokenHeader, ETagHeader)
 
     s.router.Use(s.loggingMiddleware([]string{"/app"}))
     s.router.Use(middleware.CORSWithConfig(corsCfg))
@@ -63,7 +77,7 @@ func (s *Server) loggingMiddleware(skipPrefixes []string) echo.MiddlewareFunc {
             logStmt := log.WithFields(log.Fields{
                 "method":       req.Method,
                 "uri":          req.RequestURI,
-                "remoteIP":     c.RealIP(),
+                "remoteIP":     s.clientIP(c),
                 "host":         req.Host,
                 "status":       res.Status,
                 "user":         username,
@@ -76,13 +90,19 @@ func (s *Server) loggingMiddleware(skipPrefixes []string) echo.MiddlewareFunc {
             if err != nil {
                 logStmt = logStmt.WithError(err)
             }
-            missingRole := c.Get(MissingRoleKey)
-            if missingRole != nil {
-                logStmt = logStmt.WithField("userIsMissingRole", missingRole)
+            missingPermission := c.Get(MissingPermissionKey)
+            if missingPermission != nil {
+                logStmt = logStmt.WithField("userIsMissingPermission", missingPermission)
             }
-            grantingRole := c.Get(GrantingRoleKey)
-            if grantingRole != nil {
-                logStmt = logStmt.WithField("accessGrantedByRole", grantingRole)
+            grantingPermission := c.Get(GrantingPermissionKey)
+            if grantingPermission != nil {
+                logStmt = logStmt.WithField("accessGrantedByPermission", grantingPermission)
+            }
+            if loginEmail := c.Get(LoginEmailKey); loginEmail != nil {
+                logStmt = logStmt.WithField("loginEmail", loginEmail)
+            }
+            if loginFailureReason := c.Get(LoginFailureReasonKey); loginFailureReason != nil {
+                logStmt = logStmt.WithField("loginFailureReason", loginFailureReason)
             }
             if req.Referer() != "" {
                 logStmt = logStmt.WithField("referer", req.Referer())
@@ -101,48 +121,157 @@ func (s *Server) loggingMiddleware(skipPrefixes []string) echo.MiddlewareFunc {
     }
 }
 
-// authenticate parses the JWT and sets a variable in the context, stops processing when not authenticated
+// authenticate parses the JWT, or looks up the api key, and sets a variable in the context, stops processing when
+// not authenticated
 func (s *Server) authenticate() echo.MiddlewareFunc {
     return func(next echo.HandlerFunc) echo.HandlerFunc {
         return func(c echo.Context) (error) {
             req := c.Request()
             authHeader := req.Header.Get(echo.HeaderAuthorization)
             if authHeader == "" {
+                authHeader = webSocketAuthorization(req)
+            }
+            if devUser := req.Header.Get(DevUserHeader); s.devAuth && devUser != "" {
+                return s.impersonate(c, next, devUser, req.Header.Get(DevRolesHeader))
+            } else if ticket := c.QueryParam(streamTicketParam); authHeader == "" && ticket != "" && c.Path() == orderEventSourcePath {
+                return s.authenticateStreamTicket(c, next, ticket)
+            } else if authHeader == "" {
                 return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: "Authorization header not set, provide 'Authorization: Bearer <jwt>', acquire jwt via /v1/login"})
+            } else if strings.HasPrefix(authHeader, apiKeyPrefix) {
+                return s.authenticateAPIKey(c, next, authHeader[len(apiKeyPrefix):])
             } else if !strings.HasPrefix(authHeader, bearerPrefix) {
-                return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: "Authorization header does not start with 'Bearer '"})
-            } else if user, err := auth.ValidateJWT(authHeader[bearerPrefixLen:], s.jwtSigningSecret); err != nil {
+                return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: "Authorization header does not start with 'Bearer ' or 'ApiKey '"})
+            } else if user, err := auth.ValidateJWT(authHeader[bearerPrefixLen:], s.signingKeys, s.revocations); err != nil {
                 return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
             } else {
-                c.Set(AuthenticatedUserKey, user)
-                return next(c)
+                return s.authenticateSession(c, next, user)
+            }
+        }
+    }
+}
+
+// authenticateSession rejects tokens of revoked sessions, tokens issued before sessions were tracked have no session
+func (s *Server) authenticateSession(c echo.Context, next echo.HandlerFunc, user auth.UserFromJwt) error {
+    if user.Claims != nil && user.Claims.SessionID != "" {
+        if err := s.sessions.Check(s.dao.NewSession(), user.Claims.SessionID); err == auth.ErrSessionRevoked {
+            return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
+        } else if err != nil {
+            return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+        }
+    }
+    c.Set(AuthenticatedUserKey, user)
+    return next(c)
+}
+
+// authenticateStreamTicket authenticates an EventSource with the ticket it received for the access token of a session
+func (s *Server) authenticateStreamTicket(c echo.Context, next echo.HandlerFunc, ticket string) error {
+    if user, err := auth.RedeemStreamTicket(s.dao.NewSession(), s.revocations, ticket); err == auth.ErrInvalidStreamTicket {
+        return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
+    } else if err != nil {
+        return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+    } else {
+        return s.authenticateSession(c, next, user)
+    }
+}
+
+func (s *Server) authenticateAPIKey(c echo.Context, next echo.HandlerFunc, rawKey string) error {
+    if principal, err := s.apiKeys.Authenticate(s.dao.NewSession(), rawKey); err == auth.ErrInvalidAPIKey {
+        return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: err.Error()})
+    } else if err != nil {
+        return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+    } else {
+        c.Set(AuthenticatedUserKey, principal)
+        return next(c)
+    }
+}
+
+// impersonate authenticates as the requested user without credentials, only used with development authentication
+func (s *Server) impersonate(c echo.Context, next echo.HandlerFunc, email, rolesHeader string) error {
+    var roles []string
+    for _, role := range strings.Split(rolesHeader, ",") {
+        if trimmedRole := strings.TrimSpace(role); trimmedRole != "" {
+            roles = append(roles, trimmedRole)
+        }
+    }
+    if principal, err := auth.ImpersonateUser(s.dao.NewSession(), email, roles); err == auth.ErrUserNotFound || auth.IsValidationError(err) {
+        return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: "cannot impersonate: " + err.Error()})
+    } else if err != nil {
+        return c.JSON(http.StatusInternalServerError, GenericResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+    } else {
+        log.WithFields(log.Fields{"user": principal.Email, "roles": principal.Roles}).Debug("impersonating user with development authentication")
+        c.Set(AuthenticatedUserKey, principal)
+        return next(c)
+    }
+}
+
+// requireUserAccount assumes authenticate has already run, rejects api keys on endpoints about the own user account
+func (s *Server) requireUserAccount() echo.MiddlewareFunc {
+    return func(next echo.HandlerFunc) echo.HandlerFunc {
+        return func(c echo.Context) error {
+            if user, err := s.getCurrentUser(c); err == nil && user.IsAPIKey() {
+                return c.JSON(http.StatusForbidden, GenericResponse{Code: http.StatusForbidden, Message: "not available for api keys"})
             }
+            return next(c)
         }
     }
 }
 
-// requireRole assumes authenticate has already run, checks if the user has the required role
-func (s *Server) requireRole(role string) echo.MiddlewareFunc {
+// requirePermission assumes authenticate has already run, checks if the roles of the user grant the permission
+func (s *Server) requirePermission(permission string) echo.MiddlewareFunc {
     return func(next echo.HandlerFunc) echo.HandlerFunc {
         return func(c echo.Context) (error) {
             user, err := s.getCurrentUser(c)
             if err != nil {
-                log.WithError(err).Warn("requireRole expects that authenticate() middleware has run, appears not!")
+                log.WithError(err).Warn("requirePermission expects that authenticate() middleware has run, appears not!")
                 return c.JSON(http.StatusUnauthorized, GenericResponse{Code: http.StatusUnauthorized, Message: "not authenticated"})
             }
-            hasRole, grantingRole := user.HasRole(role)
-            if !hasRole {
+            if !user.HasPermission(permission) {
                 log.WithFields(log.Fields{
                     "user": user.Email,
                     "userRoles": user.Roles,
-                    "requiredRole": role,
+                    "requiredPermission": permission,
                 }).Warn("blocked unauthorized access")
-                c.Set(MissingRoleKey, role)
+                c.Set(MissingPermissionKey, permission)
                 return c.JSON(http.StatusForbidden, GenericResponse{Code: http.StatusForbidden, Message: "not authorized"})
             } else {
-                c.Set(GrantingRoleKey, grantingRole)
+                c.Set(GrantingPermissionKey, permission)
             }
             return next(c)
         }
     }
 }
+
+// auditLogin records the sign-in attempt of the login handler that it wraps. Requests that could not be parsed are
+// not recorded, the handler sets LoginEmailKey once the attempted email is known.
+func (s *Server) auditLogin(method string) echo.MiddlewareFunc {
+    return func(next echo.HandlerFunc) echo.HandlerFunc {
+        return func(c echo.Context) error {
+            err := next(c)
+            email, ok := c.Get(LoginEmailKey).(string)
+            if !ok {
+                return err
+            }
+
+            sess := s.dao.NewSession()
+            attempt := auth.LoginAttempt{Email: email, Method: method, IP: s.clientIP(c), UserAgent: c.Request().UserAgent()}
+            if user, userErr := s.getCurrentUser(c); err == nil && userErr == nil {
+                if user.Claims != nil {
+                    attempt.DeviceID = user.Claims.Device
+                }
+            } else {
+                if reason, ok := c.Get(LoginFailureReasonKey).(string); ok {
+                    attempt.FailureReason = reason
+                } else {
+                    attempt.FailureReason = http.StatusText(c.Response().Status)
+                }
+                if deviceToken := c.Request().Header.Get(DeviceTokenHeader); method == auth.LoginMethodPin && deviceToken != "" {
+                    attempt.DeviceID = auth.DeviceIDOfToken(sess, deviceToken)
+                }
+            }
+            if recordErr := auth.RecordLoginAttempt(sess, attempt); recordErr != nil {
+                log.WithError(recordErr).WithField("email", email).Error("could not record login event")
+            }
+            return err
+        }
+    }
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/dgrijalva/jwt-go"
+    "github.com/labstack/echo"
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/auth"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// sessionToken returns an access token of waiter@garsson.nl in the session
+func sessionToken(t *testing.T, keys *auth.KeySet, sessionID string) string {
+    token, err := keys.Sign(auth.JwtClaims{
+        StandardClaims: jwt.StandardClaims{
+            Id:        "jti-1",
+            Issuer:    "garsson-api",
+            IssuedAt:  time.Now().Unix(),
+            ExpiresAt: time.Now().Add(auth.TokenValidity).Unix(),
+            Audience:  "garsson-api-users",
+            Subject:   "waiter@garsson.nl",
+        },
+        SessionID: sessionID,
+    })
+    assert.NoError(t, err)
+    return token
+}
+
+func testSigningKeys(t *testing.T) *auth.KeySet {
+    key, err := auth.GenerateEd25519Key("ed-1")
+    assert.NoError(t, err)
+    keys := auth.NewKeySet()
+    assert.NoError(t, keys.Add(key))
+    return keys
+}
+
+// authenticated sends a request with the token through the authenticate middleware, returns the response and
+// whether the request reached the handler
+func authenticated(s *Server, token string) (*httptest.ResponseRecorder, bool) {
+    req := httptest.NewRequest(http.MethodGet, "/api/v1/orders", nil)
+    req.Header.Set(echo.HeaderAuthorization, bearerPrefix+token)
+    rec := httptest.NewRecorder()
+    handled := false
+    s.authenticate()(func(c echo.Context) error {
+        handled = true
+        return c.NoContent(http.StatusNoContent)
+    })(s.router.NewContext(req, rec))
+    return rec, handled
+}
+
+func expectRevocationListLoad(mock sqlmock.Sqlmock) {
+    mock.ExpectExec(`DELETE FROM "revoked_token"`).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectQuery(`SELECT jti FROM revoked_token`).WillReturnRows(sqlmock.NewRows([]string{"jti"}))
+}
+
+func TestAuthenticate_ChecksSessionFromCache(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    keys := testSigningKeys(t)
+    s := NewServer(dao, Config{SigningKeys: keys})
+    expectRevocationListLoad(mock)
+    mock.ExpectQuery(`SELECT id FROM user_session`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+    mock.ExpectExec(`UPDATE "user_session" SET "time_last_seen" = .* WHERE \(id = 'family-1'`).WillReturnResult(sqlmock.NewResult(0, 1))
+
+    for i := 0; i < 3; i++ {
+        rec, handled := authenticated(s, sessionToken(t, keys, "family-1"))
+        assert.Equal(t, http.StatusNoContent, rec.Code)
+        assert.True(t, handled)
+    }
+    assert.NoError(t, mock.ExpectationsWereMet(), "the session is not queried on every request")
+}
+
+func TestAuthenticate_RejectsRevokedSession(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    keys := testSigningKeys(t)
+    s := NewServer(dao, Config{SigningKeys: keys})
+    expectRevocationListLoad(mock)
+    mock.ExpectQuery(`SELECT id FROM user_session`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("family-1"))
+
+    rec, handled := authenticated(s, sessionToken(t, keys, "family-1"))
+    assert.Equal(t, http.StatusUnauthorized, rec.Code)
+    assert.Contains(t, rec.Body.String(), auth.ErrSessionRevoked.Error())
+    assert.False(t, handled)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuthenticate_TokenWithoutSession(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    keys := testSigningKeys(t)
+    s := NewServer(dao, Config{SigningKeys: keys})
+    expectRevocationListLoad(mock)
+
+    rec, handled := authenticated(s, sessionToken(t, keys, ""))
+    assert.Equal(t, http.StatusNoContent, rec.Code)
+    assert.True(t, handled)
+    assert.NoError(t, mock.ExpectationsWereMet(), "tokens issued before sessions were tracked are accepted")
+}
+
+// impersonated sends a request with the development authentication headers through the authenticate middleware,
+// returns the response and the principal that reached the handler, if any
+func impersonated(s *Server, email, roles string) (*httptest.ResponseRecorder, *auth.UserFromJwt) {
+    req := httptest.NewRequest(http.MethodGet, "/api/v1/orders", nil)
+    req.Header.Set(DevUserHeader, email)
+    if roles != "" {
+        req.Header.Set(DevRolesHeader, roles)
+    }
+    rec := httptest.NewRecorder()
+    var principal *auth.UserFromJwt
+    s.authenticate()(func(c echo.Context) error {
+        if user, err := s.getCurrentUser(c); err == nil {
+            principal = &user
+        }
+        return c.NoContent(http.StatusNoContent)
+    })(s.router.NewContext(req, rec))
+    return rec, principal
+}
+
+func TestAuthenticate_IgnoresImpersonationWithoutDevAuth(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    s := NewServer(dao, Config{SigningKeys: testSigningKeys(t)})
+
+    rec, principal := impersonated(s, "admin@garsson.io", "admin")
+    assert.Equal(t, http.StatusUnauthorized, rec.Code)
+    assert.Nil(t, principal)
+    assert.NoError(t, mock.ExpectationsWereMet(), "the user is not looked up")
+}
+
+func TestAuthenticate_ImpersonatesRequestedRoles(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    s := NewServer(dao, Config{SigningKeys: testSigningKeys(t), DevAuth: true})
+    mock.ExpectQuery(`SELECT \* FROM role ORDER BY name`).WillReturnRows(sqlmock.NewRows([]string{"name", "description", "mfa_required"}).
+        AddRow("bar", nil, false).AddRow("waiter", nil, false).AddRow("admin", nil, false))
+    mock.ExpectQuery(`SELECT \* FROM role_inheritance`).WillReturnRows(sqlmock.NewRows([]string{"role_name", "inherited_role_name"}))
+    mock.ExpectQuery(`SELECT \* FROM role_permission`).WillReturnRows(sqlmock.NewRows([]string{"role_name", "permission_name"}).
+        AddRow("bar", auth.PermissionOrdersPrepare).
+        AddRow("waiter", auth.PermissionOrdersWrite).
+        AddRow("admin", auth.PermissionUsersManage))
+
+    rec, principal := impersonated(s, "dev@garsson.io", " bar, waiter ,")
+    assert.Equal(t, http.StatusNoContent, rec.Code)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    if assert.NotNil(t, principal) {
+        assert.Equal(t, "dev@garsson.io", principal.Email)
+        assert.Equal(t, []string{"bar", "waiter"}, principal.Roles)
+        assert.ElementsMatch(t, []string{auth.PermissionOrdersPrepare, auth.PermissionOrdersWrite}, principal.Permissions)
+    }
+}
+
+func TestAuthenticate_ImpersonationRejectsUnknownUser(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    s := NewServer(dao, Config{SigningKeys: testSigningKeys(t), DevAuth: true})
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(sqlmock.NewRows([]string{"email"}))
+
+    rec, principal := impersonated(s, "nobody@garsson.io", "")
+    assert.Equal(t, http.StatusUnauthorized, rec.Code)
+    assert.Contains(t, rec.Body.String(), auth.ErrUserNotFound.Error())
+    assert.Nil(t, principal)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuthenticate_ImpersonationRejectsUnknownRole(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    s := NewServer(dao, Config{SigningKeys: testSigningKeys(t), DevAuth: true})
+    mock.ExpectQuery(`SELECT \* FROM role ORDER BY name`).WillReturnRows(sqlmock.NewRows([]string{"name", "description", "mfa_required"}).AddRow("bar", nil, false))
+
+    rec, principal := impersonated(s, "dev@garsson.io", "bar,superuser")
+    assert.Equal(t, http.StatusUnauthorized, rec.Code)
+    assert.Contains(t, rec.Body.String(), auth.ErrUnknownRole.Error())
+    assert.Nil(t, principal)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeUserSession_ClosesStreamsOfSession(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    s := NewServer(dao, Config{})
+    revoked, closeRevoked := s.streams.open(auth.UserFromJwt{Email: "waiter@garsson.nl", Claims: &auth.JwtClaims{SessionID: "family-1"}})
+    defer closeRevoked()
+    other, closeOther := s.streams.open(auth.UserFromJwt{Email: "waiter@garsson.nl", Claims: &auth.JwtClaims{SessionID: "family-2"}})
+    defer closeOther()
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM user_session`).WillReturnRows(sqlmock.NewRows([]string{"id", "email", "current_token_id", "time_expires", "revoked"}).
+        AddRow("family-1", "waiter@garsson.nl", "jti-1", "2099-01-01T00:00:00Z", false))
+    mock.ExpectExec(`UPDATE "user_session" SET "revoked"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "refresh_token" SET "revoked"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`INSERT INTO "revoked_token"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    req := httptest.NewRequest(http.MethodDelete, "/api/v1/users/waiter@garsson.nl/sessions/family-1", nil)
+    rec := httptest.NewRecorder()
+    c := s.router.NewContext(req, rec)
+    c.SetParamNames("email", "sessionId")
+    c.SetParamValues("waiter@garsson.nl", "family-1")
+    assert.NoError(t, s.handleRevokeUserSession()(c))
+    assert.Equal(t, http.StatusOK, rec.Code)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.True(t, isClosed(revoked), "the stream of the revoked session is closed")
+    assert.False(t, isClosed(other))
+}
+
+func TestStreamRegistry_CloseUser(t *testing.T) {
+    streams := newStreamRegistry()
+    first, closeFirst := streams.open(auth.UserFromJwt{Email: "waiter@garsson.nl", Claims: &auth.JwtClaims{SessionID: "family-1"}})
+    second, closeSecond := streams.open(auth.UserFromJwt{Email: "waiter@garsson.nl", Claims: &auth.JwtClaims{SessionID: "family-2"}})
+    other, closeOther := streams.open(auth.UserFromJwt{Email: "bar@garsson.io", Claims: &auth.JwtClaims{SessionID: "family-3"}})
+    defer closeOther()
+
+    streams.closeUser("waiter@garsson.nl")
+    assert.True(t, isClosed(first))
+    assert.True(t, isClosed(second))
+    assert.False(t, isClosed(other))
+    closeFirst() // ending a closed stream is harmless
+    closeSecond()
+    assert.Len(t, streams.streams, 1)
+}
+
+func isClosed(revoked <-chan struct{}) bool {
+    select {
+    case <-revoked:
+        return true
+    default:
+        return false
+    }
+}
@@ -1,16 +1,94 @@
 package api
 
+import "github.com/toefel18/garsson-api/garsson/auth"
+
 func (s *Server) configureRoutes() {
-    s.router.POST("/api/v1/login", s.login())
+    s.router.GET("/.well-known/jwks.json", s.handleJWKS())
+    s.router.POST("/api/v1/login", s.login(), s.auditLogin(auth.LoginMethodPassword))
+    s.router.POST("/api/v1/login/pin", s.loginWithPin(), s.auditLogin(auth.LoginMethodPin))
+    s.router.POST("/api/v1/login/mfa", s.handleMFALogin(), s.auditLogin(auth.LoginMethodMFA))
+    s.router.POST("/api/v1/login/mfa/enroll", s.handleMFALoginEnroll())
+    s.router.POST("/api/v1/token/refresh", s.refreshToken())
+    s.router.POST("/api/v1/invitations/accept", s.handleAcceptInvitation())
+    s.router.POST("/api/v1/password-reset/request", s.handleRequestPasswordReset())
+    s.router.POST("/api/v1/password-reset", s.handleResetPassword())
+    if s.oidc != nil {
+        s.router.GET("/api/v1/login/oidc", s.handleOIDCLogin())
+        s.router.GET("/api/v1/login/oidc/callback", s.handleOIDCCallback(), s.auditLogin(auth.LoginMethodOIDC))
+    }
 
 	authenticated := s.router.Group("/api")
 	authenticated.Use(s.authenticate())
 
 	v1 := authenticated.Group("/v1")
 	v1.GET("/hello", s.handleHello())
-	v1.GET("/db", s.databaseVersion(), s.requireRole("sjonnie"))
-	v1.GET("/products", s.handleProducts())
-	v1.GET("/orders", s.handleOrders())
-	v1.GET("/orders/:orderId", s.handleOrder())
-	s.router.GET("/api/v1/orders/ws-eventstream", s.handleWebSocketOrderEventStream())
+	v1.POST("/logout", s.logout(), s.requireUserAccount())
+	v1.PUT("/me/pin", s.handleSetPin(), s.requireUserAccount())
+	v1.GET("/me/logins", s.handleListMyLogins(), s.requireUserAccount())
+	v1.GET("/me/sessions", s.handleListMySessions(), s.requireUserAccount())
+	v1.DELETE("/me/sessions", s.handleRevokeMySessions(), s.requireUserAccount())
+	v1.DELETE("/me/sessions/:sessionId", s.handleRevokeMySession(), s.requireUserAccount())
+	v1.GET("/me/mfa", s.handleGetMyMFA(), s.requireUserAccount())
+	v1.POST("/me/mfa/totp", s.handleEnrollMyTOTP(), s.requireUserAccount())
+	v1.POST("/me/mfa/totp/confirm", s.handleConfirmMyTOTP(), s.requireUserAccount())
+	v1.POST("/me/mfa/recovery-codes", s.handleRegenerateMyRecoveryCodes(), s.requireUserAccount())
+	v1.POST("/me/mfa/disable", s.handleDisableMyMFA(), s.requireUserAccount())
+	v1.GET("/db", s.databaseVersion(), s.requirePermission(auth.PermissionDatabaseRead))
+	v1.GET("/products", s.handleProducts(), s.requirePermission(auth.PermissionProductsRead))
+	v1.PUT("/products/:productId/station", s.handleSetProductStation(), s.requirePermission(auth.PermissionStationsManage))
+	v1.GET("/orders", s.handleOrders(), s.requirePermission(auth.PermissionOrdersRead))
+	v1.POST("/orders", s.handleCreateOrder(), s.requirePermission(auth.PermissionOrdersWrite), s.requireUserAccount())
+	v1.GET("/orders/ws-eventstream", s.handleWebSocketOrderEventStream(), s.requirePermission(auth.PermissionOrdersRead))
+	v1.GET("/orders/events", s.handleOrderEventSource(), s.requirePermission(auth.PermissionOrdersRead))
+	v1.POST("/orders/events/tickets", s.handleIssueStreamTicket(), s.requirePermission(auth.PermissionOrdersRead), s.requireUserAccount())
+	v1.GET("/orders/:orderId", s.handleOrder(), s.requirePermission(auth.PermissionOrdersRead))
+	v1.POST("/orders/:orderId/transitions", s.handleTransitionOrder(), s.requirePermission(auth.PermissionOrdersRead))
+	v1.POST("/orders/:orderId/lines", s.handleAddOrderLine(), s.requirePermission(auth.PermissionOrdersWrite))
+	v1.PATCH("/orders/:orderId/lines/:lineId", s.handleChangeOrderLine(), s.requirePermission(auth.PermissionOrdersWrite))
+	v1.DELETE("/orders/:orderId/lines/:lineId", s.handleRemoveOrderLine(), s.requirePermission(auth.PermissionOrdersWrite))
+	v1.PUT("/orders/:orderId/table", s.handleMoveOrder(), s.requirePermission(auth.PermissionOrdersWrite))
+	v1.POST("/orders/:orderId/payments", s.handleRecordPayment(), s.requirePermission(auth.PermissionOrdersWrite), s.requireUserAccount())
+	v1.GET("/orders/:orderId/split/even", s.handleSplitEvenly(), s.requirePermission(auth.PermissionOrdersRead))
+	v1.POST("/orders/:orderId/split/lines", s.handleSplitByLines(), s.requirePermission(auth.PermissionOrdersRead))
+	v1.GET("/tables", s.handleTables(), s.requirePermission(auth.PermissionOrdersRead))
+	v1.POST("/tables", s.handleCreateTable(), s.requirePermission(auth.PermissionTablesManage))
+	v1.PUT("/tables/:tableId", s.handleUpdateTable(), s.requirePermission(auth.PermissionTablesManage))
+	v1.PUT("/tables/:tableId/status", s.handleSetTableStatus(), s.requirePermission(auth.PermissionOrdersWrite))
+	v1.POST("/tables/:tableId/merge", s.handleMergeTables(), s.requirePermission(auth.PermissionOrdersWrite))
+	v1.GET("/stations", s.handleStations(), s.requirePermission(auth.PermissionOrdersRead))
+	v1.POST("/stations", s.handleCreateStation(), s.requirePermission(auth.PermissionStationsManage))
+	v1.GET("/stations/:stationId/queue", s.handleStationQueue(), s.requirePermission(auth.PermissionOrdersRead))
+	v1.PUT("/tickets/:ticketId/status", s.handleSetTicketStatus(), s.requirePermission(auth.PermissionOrdersPrepare))
+	v1.GET("/roles", s.handleListRoles(), s.requirePermission(auth.PermissionUsersManage))
+	v1.PUT("/roles/:role/mfa", s.handleSetRoleMFARequired(), s.requirePermission(auth.PermissionUsersManage))
+
+	users := v1.Group("/users", s.requirePermission(auth.PermissionUsersManage))
+	users.GET("", s.handleListUsers())
+	users.POST("", s.handleCreateUser())
+	users.POST("/invitations", s.handleInviteUser())
+	users.GET("/:email", s.handleGetUser())
+	users.PUT("/:email", s.handleUpdateUser())
+	users.DELETE("/:email", s.handleDeleteUser())
+	users.POST("/:email/unlock", s.handleUnlockUser())
+	users.GET("/:email/logins", s.handleListUserLogins())
+	users.DELETE("/:email/mfa", s.handleResetUserMFA())
+	users.POST("/:email/mfa/enrollment", s.handleIssueUserMFAEnrollment())
+	users.GET("/:email/sessions", s.handleListUserSessions())
+	users.DELETE("/:email/sessions", s.handleRevokeUserSessions())
+	users.DELETE("/:email/sessions/:sessionId", s.handleRevokeUserSession())
+
+	if s.oidc != nil {
+		v1.POST("/me/oidc/link", s.handleStartMyOIDCLink(), s.requireUserAccount())
+		users.PUT("/:email/oidc", s.handleLinkUserOIDC())
+	}
+
+	devices := v1.Group("/devices", s.requirePermission(auth.PermissionDevicesManage))
+	devices.GET("", s.handleListDevices())
+	devices.POST("", s.handleRegisterDevice())
+	devices.DELETE("/:deviceId", s.handleRevokeDevice())
+
+	apiKeys := v1.Group("/api-keys", s.requirePermission(auth.PermissionAPIKeysManage))
+	apiKeys.GET("", s.handleListAPIKeys())
+	apiKeys.POST("", s.handleCreateAPIKey())
+	apiKeys.DELETE("/:apiKeyId", s.handleRevokeAPIKey())
 }
\ No newline at end of file
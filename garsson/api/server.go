@@ -2,11 +2,15 @@ package api
 
 import (
     "errors"
+    "net"
+    "strings"
 
     "github.com/labstack/echo"
     "github.com/toefel18/garsson-api/garsson/auth"
     "github.com/toefel18/garsson-api/garsson/db"
     "github.com/toefel18/garsson-api/garsson/log"
+    "github.com/toefel18/garsson-api/garsson/mail"
+    "github.com/toefel18/garsson-api/garsson/order"
 )
 
 // Implementation inspired by https://medium.com/@matryer/how-i-write-go-http-services-after-seven-years-37c208122831
@@ -16,21 +20,76 @@ var (
     ErrNotAuthenticated = errors.New("not authenticated")
 )
 
+// Config contains the settings of the server
+type Config struct {
+    // SigningKeys sign and verify JWTs
+    SigningKeys *auth.KeySet
+    // LockoutPolicy determines when sign-ins are blocked after failed attempts
+    LockoutPolicy auth.LockoutPolicy
+    // Mailer sends invitations and password reset links
+    Mailer mail.Mailer
+    // PublicURL is the address of the application as seen by users, it is the base of links in mails
+    PublicURL string
+    // OIDC enables sign-in via an OpenID Connect identity provider, nil if disabled
+    OIDC *auth.OIDCProvider
+    // OIDCPostLoginURL is the page of the application that receives the tokens after signing in via the identity
+    // provider, PublicURL if empty
+    OIDCPostLoginURL string
+    // OrderEvents distributes the order events of all instances to the event streams
+    OrderEvents *order.EventBus
+    // TrustedProxies are the networks of reverse proxies whose X-Forwarded-For and X-Real-IP headers are believed,
+    // the client IP is the remote address of the connection if the request does not come from one of them
+    TrustedProxies []*net.IPNet
+    // DevAuth enables impersonation of users via the X-Dev-User and X-Dev-Roles headers, for development only!
+    DevAuth bool
+}
+
 type Server struct {
-    router           *echo.Echo
-    dao              *db.Dao
-    jwtSigningSecret []byte
+    router      *echo.Echo
+    dao         *db.Dao
+    signingKeys   *auth.KeySet
+    revocations   *auth.RevocationList
+    sessions      *auth.SessionCache
+    streams       *streamRegistry
+    apiKeys       *auth.APIKeyCache
+    lockoutPolicy auth.LockoutPolicy
+    mailer        mail.Mailer
+    publicURL     string
+    devAuth       bool
+    oidc             *auth.OIDCProvider
+    oidcPostLoginURL string
+    orderEvents      *order.EventBus
+    trustedProxies   []*net.IPNet
 }
 
-func NewServer(dao *db.Dao) *Server {
+func NewServer(dao *db.Dao, config Config) *Server {
+    if config.OIDCPostLoginURL == "" {
+        config.OIDCPostLoginURL = config.PublicURL
+    }
     return &Server{
-        router:           echo.New(),
-        dao:              dao,
-        jwtSigningSecret: []byte("dummy-for-now"),
+        router:        echo.New(),
+        dao:           dao,
+        signingKeys:   config.SigningKeys,
+        revocations:   auth.NewRevocationList(dao, auth.DefaultRevocationRefreshInterval),
+        sessions:      auth.NewSessionCache(dao, auth.DefaultSessionRefreshInterval),
+        streams:       newStreamRegistry(),
+        apiKeys:       auth.NewAPIKeyCache(auth.DefaultAPIKeyCacheTTL),
+        lockoutPolicy: config.LockoutPolicy,
+        mailer:        config.Mailer,
+        publicURL:     strings.TrimSuffix(config.PublicURL, "/"),
+        devAuth:       config.DevAuth,
+        oidc:             config.OIDC,
+        oidcPostLoginURL: config.OIDCPostLoginURL,
+        orderEvents:      config.OrderEvents,
+        trustedProxies:   config.TrustedProxies,
     }
 }
 
 func (s *Server) Start() {
+    if s.devAuth {
+        log.WithFields(log.Fields{"headers": DevUserHeader + ", " + DevRolesHeader}).
+            Warn("!!! DEVELOPMENT AUTHENTICATION ENABLED: anyone can impersonate any user, NEVER enable this in production !!!")
+    }
     s.configureMiddleware()
     s.configureRoutes()
     log.Fatal(s.router.Start(":8080"))
@@ -46,3 +105,12 @@ func (s *Server) getCurrentUser(c echo.Context) (auth.UserFromJwt, error) {
     return auth.UserFromJwt{}, ErrNotAuthenticated
 }
 
+
+// currentAccountEmail returns the email of the authenticated user, or an empty string for api keys and
+// unauthenticated requests
+func (s *Server) currentAccountEmail(c echo.Context) string {
+    if user, err := s.getCurrentUser(c); err == nil && !user.IsAPIKey() {
+        return user.Email
+    }
+    return ""
+}
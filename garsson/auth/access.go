@@ -5,18 +5,781 @@ import (
     "github.com/toefel18/garsson-api/garsson/db"
 )
 
-// QueryUserEntity returns the user as stored in the db, or dbr.ErrNotFound if no user was found
-// with that email.
+// QueryUserEntity returns the user as stored in the db, including its roles and effective permissions, or
+// dbr.ErrNotFound if no user was found with that email.
 func QueryUserEntity(session dbr.SessionRunner, email string) (user UserEntity, err error) {
     err = session.
         Select("*").
         From(db.UserAccountTable).
         Where("email = ?", email).
         LoadOne(&user)
+    if err == nil {
+        err = loadUserAccess(session, &user)
+    }
     return
 }
 
+// UpdateLastSignInToNow sets the last sign-in of the user to the current time
 func UpdateLastSignInToNow(session dbr.SessionRunner, email string) error {
-    // TODO implement: update LastSignIn to now!
-    return nil
-}
\ No newline at end of file
+    _, err := session.
+        Update(db.UserAccountTable).
+        Set("last_sign_in", db.Now()).
+        Where("email = ?", email).
+        Exec()
+    return err
+}
+
+// UpdatePasswordHash stores a new password hash for the user
+func UpdatePasswordHash(session dbr.SessionRunner, email, passwordHash string) error {
+    _, err := session.
+        Update(db.UserAccountTable).
+        Set("password_hash", passwordHash).
+        Where("email = ?", email).
+        Exec()
+    return err
+}
+
+// QueryUserEntities returns all users ordered by email, including their roles but without permissions
+func QueryUserEntities(session dbr.SessionRunner) ([]UserEntity, error) {
+    var users = []UserEntity{} // do not replace will nil slice declaration
+    if _, err := session.
+        Select("*").
+        From(db.UserAccountTable).
+        OrderBy("email").
+        Load(&users); err != nil {
+        return nil, err
+    }
+    var userRoles []userRoleEntity
+    if _, err := session.
+        Select("*").
+        From(db.UserRoleTable).
+        OrderBy("role_name").
+        Load(&userRoles); err != nil {
+        return nil, err
+    }
+    rolesByEmail := map[string][]string{}
+    for _, userRole := range userRoles {
+        rolesByEmail[userRole.Email] = append(rolesByEmail[userRole.Email], userRole.RoleName)
+    }
+    for i := range users {
+        users[i].Roles = append([]string{}, rolesByEmail[users[i].Email]...)
+    }
+    return users, nil
+}
+
+func insertUserEntity(session dbr.SessionRunner, user UserEntity) error {
+    _, err := session.
+        InsertInto(db.UserAccountTable).
+        Pair("email", user.Email).
+        Pair("password_hash", user.PasswordHash).
+        Pair("disabled", user.Disabled).
+        Pair("external_subject", user.ExternalSubject).
+        Exec()
+    return err
+}
+
+func updateUserEntity(session dbr.SessionRunner, email string, changes map[string]interface{}) (int64, error) {
+    if result, err := session.
+        Update(db.UserAccountTable).
+        SetMap(changes).
+        Where("email = ?", email).
+        Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+func deleteUserEntity(session dbr.SessionRunner, email string) (int64, error) {
+    if result, err := session.
+        DeleteFrom(db.UserAccountTable).
+        Where("email = ?", email).
+        Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+func queryUserRoles(session dbr.SessionRunner, email string) ([]string, error) {
+    var roles = []string{}
+    _, err := session.
+        Select("role_name").
+        From(db.UserRoleTable).
+        Where("email = ?", email).
+        OrderBy("role_name").
+        Load(&roles)
+    return roles, err
+}
+
+// replaceUserRoles removes all roles of the user and grants the given roles, fails with a foreign key violation
+// if a role does not exist
+func replaceUserRoles(session dbr.SessionRunner, email string, roles []string) error {
+    if _, err := session.
+        DeleteFrom(db.UserRoleTable).
+        Where("email = ?", email).
+        Exec(); err != nil {
+        return err
+    }
+    if len(roles) == 0 {
+        return nil
+    }
+    insert := session.InsertInto(db.UserRoleTable).Columns("email", "role_name")
+    for _, role := range roles {
+        insert.Record(userRoleEntity{Email: email, RoleName: role})
+    }
+    _, err := insert.Exec()
+    return err
+}
+
+func queryRoles(session dbr.SessionRunner) ([]roleEntity, error) {
+    var roles []roleEntity
+    _, err := session.
+        Select("*").
+        From(db.RoleTable).
+        OrderBy("name").
+        Load(&roles)
+    return roles, err
+}
+
+func queryRoleInheritances(session dbr.SessionRunner) ([]roleInheritanceEntity, error) {
+    var inheritances []roleInheritanceEntity
+    _, err := session.
+        Select("*").
+        From(db.RoleInheritanceTable).
+        OrderBy("role_name").
+        OrderBy("inherited_role_name").
+        Load(&inheritances)
+    return inheritances, err
+}
+
+func queryRolePermissions(session dbr.SessionRunner) ([]rolePermissionEntity, error) {
+    var rolePermissions []rolePermissionEntity
+    _, err := session.
+        Select("*").
+        From(db.RolePermissionTable).
+        OrderBy("role_name").
+        OrderBy("permission_name").
+        Load(&rolePermissions)
+    return rolePermissions, err
+}
+
+func updateRoleMFARequired(session dbr.SessionRunner, role string, required bool) (int64, error) {
+    if result, err := session.
+        Update(db.RoleTable).
+        Set("mfa_required", required).
+        Where("name = ?", role).
+        Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+func insertRefreshToken(session dbr.SessionRunner, token refreshTokenEntity) error {
+    _, err := session.
+        InsertInto(db.RefreshTokenTable).
+        Columns("token_hash", "family_id", "email", "access_token_id", "time_issued", "time_expires", "time_used", "revoked").
+        Record(token).
+        Exec()
+    return err
+}
+
+func queryRefreshToken(session dbr.SessionRunner, tokenHash string) (token refreshTokenEntity, err error) {
+    err = session.
+        Select("*").
+        From(db.RefreshTokenTable).
+        Where("token_hash = ?", tokenHash).
+        LoadOne(&token)
+    return
+}
+
+func queryLatestRefreshTokenOfFamily(session dbr.SessionRunner, familyID string) (token refreshTokenEntity, err error) {
+    err = session.
+        Select("*").
+        From(db.RefreshTokenTable).
+        Where("family_id = ?", familyID).
+        OrderDir("time_issued", false).
+        Limit(1).
+        LoadOne(&token)
+    return
+}
+
+// queryRefreshTokensIssuedSince returns the refresh tokens of the user issued at or after the time, in any state
+func queryRefreshTokensIssuedSince(session dbr.SessionRunner, email, since string) ([]refreshTokenEntity, error) {
+    var tokens []refreshTokenEntity
+    _, err := session.
+        Select("*").
+        From(db.RefreshTokenTable).
+        Where("email = ? AND time_issued >= ?", email, since).
+        Load(&tokens)
+    return tokens, err
+}
+
+func queryFamilyIDByAccessTokenID(session dbr.SessionRunner, accessTokenID string) (familyID string, err error) {
+    err = session.
+        Select("family_id").
+        From(db.RefreshTokenTable).
+        Where("access_token_id = ?", accessTokenID).
+        LoadOne(&familyID)
+    return
+}
+
+// markRefreshTokenUsed returns the number of updated rows, which is 0 if the token was already used
+func markRefreshTokenUsed(session dbr.SessionRunner, tokenHash string) (int64, error) {
+    if result, err := session.
+        Update(db.RefreshTokenTable).
+        Set("time_used", db.Now()).
+        Where("token_hash = ? AND time_used IS NULL", tokenHash).
+        Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+func revokeRefreshTokenFamily(session dbr.SessionRunner, familyID string) (int64, error) {
+    if result, err := session.
+        Update(db.RefreshTokenTable).
+        Set("revoked", true).
+        Where("family_id = ?", familyID).
+        Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+func revokeRefreshTokensOfUser(session dbr.SessionRunner, email string) (int64, error) {
+    if result, err := session.
+        Update(db.RefreshTokenTable).
+        Set("revoked", true).
+        Where("email = ? AND revoked = FALSE", email).
+        Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+func insertRevokedToken(session dbr.SessionRunner, token revokedTokenEntity) error {
+    _, err := session.
+        InsertInto(db.RevokedTokenTable).
+        Columns("jti", "email", "time_revoked", "time_expires").
+        Record(token).
+        Exec()
+    return err
+}
+
+func queryRevokedTokenIDs(session dbr.SessionRunner) ([]string, error) {
+    var jtis []string
+    _, err := session.
+        Select("jti").
+        From(db.RevokedTokenTable).
+        Where("time_expires > ?", db.Now()).
+        Load(&jtis)
+    return jtis, err
+}
+
+func deleteExpiredRevokedTokens(session dbr.SessionRunner) error {
+    _, err := session.
+        DeleteFrom(db.RevokedTokenTable).
+        Where("time_expires <= ?", db.Now()).
+        Exec()
+    return err
+}
+
+func updateExternalSubject(session dbr.SessionRunner, email, subject string) (int64, error) {
+    if result, err := session.
+        Update(db.UserAccountTable).
+        Set("external_subject", subject).
+        Where("email = ?", email).
+        Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+func queryEmailByExternalSubject(session dbr.SessionRunner, subject string) (email string, err error) {
+    err = session.
+        Select("email").
+        From(db.UserAccountTable).
+        Where("external_subject = ?", subject).
+        LoadOne(&email)
+    return
+}
+
+func updatePinHash(session dbr.SessionRunner, email string, pinHash dbr.NullString) error {
+    _, err := session.
+        Update(db.UserAccountTable).
+        Set("pin_hash", pinHash).
+        Where("email = ?", email).
+        Exec()
+    return err
+}
+
+func insertDevice(session dbr.SessionRunner, device deviceEntity) error {
+    _, err := session.
+        InsertInto(db.DeviceTable).
+        Columns("id", "name", "token_hash", "registered_by", "time_registered", "time_last_used", "revoked").
+        Record(device).
+        Exec()
+    return err
+}
+
+func queryDevices(session dbr.SessionRunner) ([]deviceEntity, error) {
+    var devices []deviceEntity
+    _, err := session.
+        Select("*").
+        From(db.DeviceTable).
+        OrderBy("name").
+        Load(&devices)
+    return devices, err
+}
+
+func queryDeviceByTokenHash(session dbr.SessionRunner, tokenHash string) (device deviceEntity, err error) {
+    err = session.
+        Select("*").
+        From(db.DeviceTable).
+        Where("token_hash = ?", tokenHash).
+        LoadOne(&device)
+    return
+}
+
+func updateDeviceLastUsed(session dbr.SessionRunner, id string) error {
+    _, err := session.
+        Update(db.DeviceTable).
+        Set("time_last_used", db.Now()).
+        Where("id = ?", id).
+        Exec()
+    return err
+}
+
+func revokeDevice(session dbr.SessionRunner, id string) (int64, error) {
+    if result, err := session.
+        Update(db.DeviceTable).
+        Set("revoked", true).
+        Where("id = ?", id).
+        Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+func queryFailedLoginCounters(session dbr.SessionRunner, email, ip string) ([]failedLoginCounterEntity, error) {
+    var counters []failedLoginCounterEntity
+    _, err := session.
+        Select("*").
+        From(db.FailedLoginCounterTable).
+        Where("(kind = ? AND subject = ?) OR (kind = ? AND subject = ?)", LockoutKindAccount, email, LockoutKindIP, ip).
+        Load(&counters)
+    return counters, err
+}
+
+// incrementFailedLoginCounter adds a failure and returns the new amount of failures, counting restarts if the last
+// failure happened before resetBefore
+func incrementFailedLoginCounter(session dbr.SessionRunner, kind, subject, now, resetBefore string) (int, error) {
+    var attempts int
+    err := session.InsertBySql(`INSERT INTO failed_login_counter (kind, subject, failed_attempts, time_last_failure)
+                                VALUES (?, ?, 1, ?)
+                                ON CONFLICT (kind, subject) DO UPDATE SET
+                                  failed_attempts = CASE WHEN failed_login_counter.time_last_failure < ? THEN 1
+                                                         ELSE failed_login_counter.failed_attempts + 1 END,
+                                  time_last_failure = EXCLUDED.time_last_failure
+                                RETURNING failed_attempts`, kind, subject, now, resetBefore).
+        Load(&attempts)
+    return attempts, err
+}
+
+func updateFailedLoginLock(session dbr.SessionRunner, kind, subject, lockedUntil string) error {
+    _, err := session.
+        Update(db.FailedLoginCounterTable).
+        Set("time_locked_until", lockedUntil).
+        Where("kind = ? AND subject = ?", kind, subject).
+        Exec()
+    return err
+}
+
+func deleteFailedLoginCounter(session dbr.SessionRunner, kind, subject string) error {
+    _, err := session.
+        DeleteFrom(db.FailedLoginCounterTable).
+        Where("kind = ? AND subject = ?", kind, subject).
+        Exec()
+    return err
+}
+
+func insertLoginEvent(session dbr.SessionRunner, event loginEventEntity) error {
+    _, err := session.
+        InsertInto(db.LoginEventTable).
+        Columns("email", "method", "success", "time_attempted", "ip", "user_agent", "device_id", "failure_reason").
+        Record(event).
+        Exec()
+    return err
+}
+
+func queryLoginEvents(session dbr.SessionRunner, email string, limit uint64) ([]loginEventEntity, error) {
+    var events []loginEventEntity
+    _, err := session.
+        Select("*").
+        From(db.LoginEventTable).
+        Where("email = ?", email).
+        OrderDir("id", false).
+        Limit(limit).
+        Load(&events)
+    return events, err
+}
+
+func insertAccountToken(session dbr.SessionRunner, token accountTokenEntity) error {
+    _, err := session.
+        InsertInto(db.AccountTokenTable).
+        Columns("token_hash", "purpose", "email", "time_issued", "time_expires", "time_used").
+        Record(token).
+        Exec()
+    return err
+}
+
+func queryAccountToken(session dbr.SessionRunner, tokenHash string) (token accountTokenEntity, err error) {
+    err = session.
+        Select("*").
+        From(db.AccountTokenTable).
+        Where("token_hash = ?", tokenHash).
+        LoadOne(&token)
+    return
+}
+
+// markAccountTokenUsed returns the number of updated rows, which is 0 if the token was already used
+func markAccountTokenUsed(session dbr.SessionRunner, tokenHash string) (int64, error) {
+    if result, err := session.
+        Update(db.AccountTokenTable).
+        Set("time_used", db.Now()).
+        Where("token_hash = ? AND time_used IS NULL", tokenHash).
+        Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+func insertStreamTicket(session dbr.SessionRunner, ticket streamTicketEntity) error {
+    _, err := session.
+        InsertInto(db.StreamTicketTable).
+        Columns("token_hash", "email", "access_token_id", "session_id", "time_access_token_expires", "time_issued", "time_expires", "time_used").
+        Record(ticket).
+        Exec()
+    return err
+}
+
+func queryStreamTicket(session dbr.SessionRunner, tokenHash string) (ticket streamTicketEntity, err error) {
+    err = session.
+        Select("*").
+        From(db.StreamTicketTable).
+        Where("token_hash = ?", tokenHash).
+        LoadOne(&ticket)
+    return
+}
+
+// markStreamTicketUsed returns the number of updated rows, which is 0 if the ticket was already used
+func markStreamTicketUsed(session dbr.SessionRunner, tokenHash string) (int64, error) {
+    if result, err := session.
+        Update(db.StreamTicketTable).
+        Set("time_used", db.Now()).
+        Where("token_hash = ? AND time_used IS NULL", tokenHash).
+        Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+// deleteStreamTicketsExpiredBefore removes the tickets of all users that expired before the time
+func deleteStreamTicketsExpiredBefore(session dbr.SessionRunner, before string) error {
+    _, err := session.DeleteFrom(db.StreamTicketTable).Where("time_expires < ?", before).Exec()
+    return err
+}
+
+// deleteUnusedAccountTokens removes all outstanding tokens of the user
+func deleteUnusedAccountTokens(session dbr.SessionRunner, email string) error {
+    _, err := session.
+        DeleteFrom(db.AccountTokenTable).
+        Where("email = ? AND time_used IS NULL", email).
+        Exec()
+    return err
+}
+
+func insertAPIKey(session dbr.SessionRunner, key apiKeyEntity) error {
+    _, err := session.
+        InsertInto(db.ApiKeyTable).
+        Columns("id", "name", "key_hash", "created_by", "time_created", "time_last_used", "revoked").
+        Record(key).
+        Exec()
+    return err
+}
+
+func insertAPIKeyRoles(session dbr.SessionRunner, apiKeyID string, roles []string) error {
+    if len(roles) == 0 {
+        return nil
+    }
+    insert := session.InsertInto(db.ApiKeyRoleTable).Columns("api_key_id", "role_name")
+    for _, role := range roles {
+        insert.Record(apiKeyRoleEntity{APIKeyID: apiKeyID, RoleName: role})
+    }
+    _, err := insert.Exec()
+    return err
+}
+
+func queryAPIKeys(session dbr.SessionRunner) ([]apiKeyEntity, error) {
+    var keys []apiKeyEntity
+    _, err := session.
+        Select("*").
+        From(db.ApiKeyTable).
+        OrderBy("name").
+        Load(&keys)
+    return keys, err
+}
+
+func queryAPIKeyByHash(session dbr.SessionRunner, keyHash string) (key apiKeyEntity, err error) {
+    err = session.
+        Select("*").
+        From(db.ApiKeyTable).
+        Where("key_hash = ?", keyHash).
+        LoadOne(&key)
+    return
+}
+
+func queryAPIKeyRoles(session dbr.SessionRunner) ([]apiKeyRoleEntity, error) {
+    var keyRoles []apiKeyRoleEntity
+    _, err := session.
+        Select("*").
+        From(db.ApiKeyRoleTable).
+        OrderBy("role_name").
+        Load(&keyRoles)
+    return keyRoles, err
+}
+
+func queryRolesOfAPIKey(session dbr.SessionRunner, apiKeyID string) ([]string, error) {
+    var roles = []string{}
+    _, err := session.
+        Select("role_name").
+        From(db.ApiKeyRoleTable).
+        Where("api_key_id = ?", apiKeyID).
+        OrderBy("role_name").
+        Load(&roles)
+    return roles, err
+}
+
+// updateAPIKeyLastUsed only writes when the last use was before notAfter, to avoid a write on every request
+func updateAPIKeyLastUsed(session dbr.SessionRunner, id, now, notAfter string) error {
+    _, err := session.
+        Update(db.ApiKeyTable).
+        Set("time_last_used", now).
+        Where("id = ? AND (time_last_used IS NULL OR time_last_used < ?)", id, notAfter).
+        Exec()
+    return err
+}
+
+func revokeAPIKey(session dbr.SessionRunner, id string) (int64, error) {
+    if result, err := session.
+        Update(db.ApiKeyTable).
+        Set("revoked", true).
+        Where("id = ?", id).
+        Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+func queryUserTotp(session dbr.SessionRunner, email string) (totp userTotpEntity, err error) {
+    err = session.
+        Select("*").
+        From(db.UserTotpTable).
+        Where("email = ?", email).
+        LoadOne(&totp)
+    return
+}
+
+func insertUserTotp(session dbr.SessionRunner, totp userTotpEntity) error {
+    _, err := session.
+        InsertInto(db.UserTotpTable).
+        Columns("email", "secret", "time_created", "time_confirmed", "last_used_step").
+        Record(totp).
+        Exec()
+    return err
+}
+
+// confirmUserTotp enables the authenticator, returns 0 if it was already confirmed
+func confirmUserTotp(session dbr.SessionRunner, email string, step int64) (int64, error) {
+    if result, err := session.
+        Update(db.UserTotpTable).
+        Set("time_confirmed", db.Now()).
+        Set("last_used_step", step).
+        Where("email = ? AND time_confirmed IS NULL AND last_used_step < ?", email, step).
+        Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+// updateTotpLastUsedStep returns 0 if a code of the same or a later step was already accepted
+func updateTotpLastUsedStep(session dbr.SessionRunner, email string, step int64) (int64, error) {
+    if result, err := session.
+        Update(db.UserTotpTable).
+        Set("last_used_step", step).
+        Where("email = ? AND last_used_step < ?", email, step).
+        Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+func deleteUserTotp(session dbr.SessionRunner, email string) (int64, error) {
+    if result, err := session.
+        DeleteFrom(db.UserTotpTable).
+        Where("email = ?", email).
+        Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+func insertRecoveryCodes(session dbr.SessionRunner, email string, codeHashes []string) error {
+    if len(codeHashes) == 0 {
+        return nil
+    }
+    insert := session.InsertInto(db.RecoveryCodeTable).Columns("code_hash", "email")
+    for _, codeHash := range codeHashes {
+        insert.Record(recoveryCodeEntity{CodeHash: codeHash, Email: email})
+    }
+    _, err := insert.Exec()
+    return err
+}
+
+// markRecoveryCodeUsed returns 0 if the code does not belong to the user or was already used
+func markRecoveryCodeUsed(session dbr.SessionRunner, email, codeHash string) (int64, error) {
+    if result, err := session.
+        Update(db.RecoveryCodeTable).
+        Set("time_used", db.Now()).
+        Where("code_hash = ? AND email = ? AND time_used IS NULL", codeHash, email).
+        Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+func countUnusedRecoveryCodes(session dbr.SessionRunner, email string) (count int, err error) {
+    err = session.
+        Select("COUNT(*)").
+        From(db.RecoveryCodeTable).
+        Where("email = ? AND time_used IS NULL", email).
+        LoadOne(&count)
+    return
+}
+
+func deleteRecoveryCodes(session dbr.SessionRunner, email string) error {
+    _, err := session.
+        DeleteFrom(db.RecoveryCodeTable).
+        Where("email = ?", email).
+        Exec()
+    return err
+}
+
+func insertUserSession(session dbr.SessionRunner, userSession userSessionEntity) error {
+    _, err := session.
+        InsertInto(db.UserSessionTable).
+        Columns("id", "email", "current_token_id", "device_id", "ip", "user_agent", "time_created", "time_last_seen", "time_expires", "revoked").
+        Record(userSession).
+        Exec()
+    return err
+}
+
+func queryUserSession(session dbr.SessionRunner, id string) (userSession userSessionEntity, err error) {
+    err = session.
+        Select("*").
+        From(db.UserSessionTable).
+        Where("id = ?", id).
+        LoadOne(&userSession)
+    return
+}
+
+// queryRevokedUserSessionIDs returns the ids of the revoked sessions that have not expired at now
+func queryRevokedUserSessionIDs(session dbr.SessionRunner, now string) ([]string, error) {
+    var ids []string
+    _, err := session.
+        Select("id").
+        From(db.UserSessionTable).
+        Where("revoked = TRUE AND time_expires > ?", now).
+        Load(&ids)
+    return ids, err
+}
+
+// queryActiveUserSessions returns the sessions that are not revoked and not expired, most recently seen first
+func queryActiveUserSessions(session dbr.SessionRunner, email string) ([]userSessionEntity, error) {
+    var sessions []userSessionEntity
+    _, err := session.
+        Select("*").
+        From(db.UserSessionTable).
+        Where("email = ? AND revoked = FALSE AND time_expires > ?", email, db.Now()).
+        OrderDir("time_last_seen", false).
+        Load(&sessions)
+    return sessions, err
+}
+
+// updateUserSessionToken records a new access token of the session, returns 0 if the session does not exist
+func updateUserSessionToken(session dbr.SessionRunner, id, tokenID, now, expires string) (int64, error) {
+    if result, err := session.
+        Update(db.UserSessionTable).
+        Set("current_token_id", tokenID).
+        Set("time_last_seen", now).
+        Set("time_expires", expires).
+        Where("id = ?", id).
+        Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+func updateUserSessionClient(session dbr.SessionRunner, id string, ip, userAgent, deviceID dbr.NullString) error {
+    _, err := session.
+        Update(db.UserSessionTable).
+        Set("ip", ip).
+        Set("user_agent", userAgent).
+        Set("device_id", deviceID).
+        Where("id = ?", id).
+        Exec()
+    return err
+}
+
+// updateUserSessionLastSeen only writes when the session was last seen before notAfter, to avoid a write on every request
+func updateUserSessionLastSeen(session dbr.SessionRunner, id, now, notAfter string) error {
+    _, err := session.
+        Update(db.UserSessionTable).
+        Set("time_last_seen", now).
+        Where("id = ? AND time_last_seen < ?", id, notAfter).
+        Exec()
+    return err
+}
+
+func revokeUserSession(session dbr.SessionRunner, id string) error {
+    _, err := session.
+        Update(db.UserSessionTable).
+        Set("revoked", true).
+        Where("id = ?", id).
+        Exec()
+    return err
+}
+
+func revokeUserSessionsOfUser(session dbr.SessionRunner, email string) error {
+    _, err := session.
+        Update(db.UserSessionTable).
+        Set("revoked", true).
+        Where("email = ? AND revoked = FALSE", email).
+        Exec()
+    return err
+}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+    "errors"
+    "strings"
+    "time"
+
+    "github.com/gocraft/dbr"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+// Invited users and users that forgot their password receive a single-use account token by mail, with which they
+// choose a new password. Like refresh tokens, account tokens are opaque and only stored as sha256 hash. An invited
+// user exists without password until the invitation is accepted, it cannot sign in before that.
+
+var (
+    // ErrInvalidAccountToken indicates that the invitation or reset token is unknown, expired or already used
+    ErrInvalidAccountToken = errors.New("invalid or expired token")
+)
+
+const (
+    // AccountTokenInvite is the purpose of tokens that accept an invitation
+    AccountTokenInvite = "invite"
+    // AccountTokenReset is the purpose of tokens that reset a forgotten password
+    AccountTokenReset = "reset"
+    // InviteTokenValidity is the time in which an invitation can be accepted
+    InviteTokenValidity = time.Hour * 72
+    // ResetTokenValidity is the time in which a password reset token can be used
+    ResetTokenValidity = time.Hour
+)
+
+// InviteUser creates an account without password and returns the token with which the user accepts the invitation.
+// Inviting a user that has not accepted a previous invitation yet issues a new token and replaces the roles of the
+// user with those of the new invitation.
+func InviteUser(sess *dbr.Session, invitation Invitation) (User, string, error) {
+    email := strings.TrimSpace(invitation.Email)
+    if !isValidEmail(email) {
+        return User{}, "", ErrInvalidEmail
+    }
+    roles, err := cleanRoles(invitation.Roles)
+    if err != nil {
+        return User{}, "", err
+    }
+
+    tx, err := sess.Begin()
+    if err != nil {
+        return User{}, "", err
+    }
+    defer tx.RollbackUnlessCommitted()
+    entity, err := QueryUserEntity(tx, email)
+    if err == dbr.ErrNotFound {
+        entity = UserEntity{Email: email, Roles: roles}
+        if err := insertUserWithRoles(tx, entity); err != nil {
+            return User{}, "", err
+        }
+    } else if err != nil {
+        return User{}, "", err
+    } else if entity.PasswordHash != "" {
+        return User{}, "", ErrUserAlreadyExists
+    } else if err := replaceUserRoles(tx, email, roles); db.IsForeignKeyViolation(err) {
+        return User{}, "", ErrUnknownRole
+    } else if err != nil {
+        return User{}, "", err
+    } else {
+        entity.Roles = roles
+    }
+    rawToken, err := issueAccountToken(tx, AccountTokenInvite, email, InviteTokenValidity)
+    if err != nil {
+        return User{}, "", err
+    }
+    if err := tx.Commit(); err != nil {
+        return User{}, "", err
+    }
+    return entity.ToUser(), rawToken, nil
+}
+
+// RequestPasswordReset returns the user and a token with which the user can choose a new password. Fails with
+// ErrUserNotFound, ErrUserDisabled or ErrManagedByIdentityProvider, callers should not reveal these errors to the
+// requester.
+func RequestPasswordReset(sess dbr.SessionRunner, email string) (User, string, error) {
+    user, err := QueryUserEntity(sess, strings.TrimSpace(email))
+    if err == dbr.ErrNotFound {
+        return User{}, "", ErrUserNotFound
+    } else if err != nil {
+        return User{}, "", err
+    } else if user.Disabled {
+        return User{}, "", ErrUserDisabled
+    } else if user.ExternalSubject.Valid && user.PasswordHash == "" {
+        return User{}, "", ErrManagedByIdentityProvider
+    }
+    rawToken, err := issueAccountToken(sess, AccountTokenReset, user.Email, ResetTokenValidity)
+    return user.ToUser(), rawToken, err
+}
+
+// ConsumeAccountToken sets the password of the user that owns the token. The token, and all other outstanding
+// tokens of the user, can not be used again. Existing sessions of the user are revoked and its account is unlocked.
+func ConsumeAccountToken(sess *dbr.Session, revocations *RevocationList, purpose, rawToken, password string) (User, error) {
+    passwordHash, err := newPasswordHash(password)
+    if err != nil {
+        return User{}, err
+    }
+    stored, err := queryAccountToken(sess, hashOpaqueToken(rawToken))
+    if err == dbr.ErrNotFound {
+        return User{}, ErrInvalidAccountToken
+    } else if err != nil {
+        return User{}, err
+    } else if stored.Purpose != purpose || stored.TimeUsed.Valid {
+        return User{}, ErrInvalidAccountToken
+    } else if expires, err := db.ParseTime(stored.TimeExpires); err != nil || time.Now().After(expires) {
+        return User{}, ErrInvalidAccountToken
+    }
+    if user, err := QueryUserEntity(sess, stored.Email); err != nil || user.Disabled {
+        return User{}, ErrInvalidAccountToken
+    }
+
+    tx, err := sess.Begin()
+    if err != nil {
+        return User{}, err
+    }
+    defer tx.RollbackUnlessCommitted()
+    // the condition on time_used makes sure that a token can only be consumed once
+    if marked, err := markAccountTokenUsed(tx, stored.TokenHash); err != nil {
+        return User{}, err
+    } else if marked == 0 {
+        return User{}, ErrInvalidAccountToken
+    }
+    if err := UpdatePasswordHash(tx, stored.Email, passwordHash); err != nil {
+        return User{}, err
+    }
+    if err := deleteUnusedAccountTokens(tx, stored.Email); err != nil {
+        return User{}, err
+    }
+    if err := tx.Commit(); err != nil {
+        return User{}, err
+    }
+
+    if err := RevokeUserTokens(sess, revocations, stored.Email); err != nil {
+        log.WithField("email", stored.Email).WithError(err).Error("could not revoke tokens after password change")
+    }
+    if err := ResetFailedLogins(sess, stored.Email); err != nil {
+        log.WithField("email", stored.Email).WithError(err).Warn("could not reset failed logins after password change")
+    }
+    return FindUser(sess, stored.Email)
+}
+
+// issueAccountToken stores the hash of a new token for the user and returns the token itself
+func issueAccountToken(sess dbr.SessionRunner, purpose, email string, validity time.Duration) (string, error) {
+    rawToken, err := generateOpaqueToken()
+    if err != nil {
+        return "", err
+    }
+    now := time.Now()
+    if err := insertAccountToken(sess, accountTokenEntity{
+        TokenHash:   hashOpaqueToken(rawToken),
+        Purpose:     purpose,
+        Email:       email,
+        TimeIssued:  db.FormatTime(now),
+        TimeExpires: db.FormatTime(now.Add(validity)),
+    }); err != nil {
+        return "", err
+    }
+    return rawToken, nil
+}
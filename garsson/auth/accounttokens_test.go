@@ -0,0 +1,118 @@
+package auth
+
+import (
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// accountTokenRows returns the stored account token "token" of bar@garsson.io
+func accountTokenRows(purpose string, expires time.Time, used bool) *sqlmock.Rows {
+    var timeUsed interface{}
+    if used {
+        timeUsed = db.Now()
+    }
+    return sqlmock.NewRows([]string{"token_hash", "purpose", "email", "time_issued", "time_expires", "time_used"}).
+        AddRow(hashOpaqueToken("token"), purpose, "bar@garsson.io", db.FormatTime(expires.Add(-time.Hour)), db.FormatTime(expires), timeUsed)
+}
+
+func TestConsumeAccountToken(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM account_token WHERE \(token_hash = '` + hashOpaqueToken("token") + `'\)`).
+        WillReturnRows(accountTokenRows(AccountTokenInvite, time.Now().Add(time.Hour), false))
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("bar@garsson.io", "", false))
+    expectUserAccess(mock, "bar")
+    mock.ExpectBegin()
+    mock.ExpectExec(`UPDATE "account_token" SET "time_used" = .* AND time_used IS NULL\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "user_account" SET "password_hash" = '\$argon2id\$.*' WHERE \(email = 'bar@garsson.io'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`DELETE FROM "account_token" WHERE \(email = 'bar@garsson.io' AND time_used IS NULL\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+    mock.ExpectQuery(`SELECT \* FROM refresh_token`).WillReturnRows(refreshTokenRows("refresh", false))
+    mock.ExpectExec(`UPDATE "refresh_token" SET "revoked" = TRUE`).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectExec(`UPDATE "user_session" SET "revoked" = TRUE`).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectExec(`DELETE FROM "failed_login_counter"`).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("bar@garsson.io", "", false))
+    expectUserAccess(mock, "bar")
+
+    user, err := ConsumeAccountToken(dao.NewSession(), NewRevocationList(nil, time.Hour), AccountTokenInvite, "token", "a new password")
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.Equal(t, "bar@garsson.io", user.Email)
+}
+
+func TestConsumeAccountToken_OnlyOnce(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM account_token`).WillReturnRows(accountTokenRows(AccountTokenReset, time.Now().Add(time.Hour), false))
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("bar@garsson.io", "", false))
+    expectUserAccess(mock, "bar")
+    mock.ExpectBegin()
+    // consumed by a concurrent request after it was loaded
+    mock.ExpectExec(`UPDATE "account_token" SET "time_used"`).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectRollback()
+
+    _, err := ConsumeAccountToken(dao.NewSession(), NewRevocationList(nil, time.Hour), AccountTokenReset, "token", "a new password")
+    assert.Equal(t, ErrInvalidAccountToken, err)
+    assert.NoError(t, mock.ExpectationsWereMet(), "the password is not changed")
+}
+
+func TestConsumeAccountToken_Rejected(t *testing.T) {
+    tests := []struct {
+        name    string
+        purpose string
+        expires time.Time
+        used    bool
+    }{
+        {name: "used", purpose: AccountTokenReset, expires: time.Now().Add(time.Hour), used: true},
+        {name: "expired", purpose: AccountTokenReset, expires: time.Now().Add(-time.Second)},
+        {name: "other purpose", purpose: AccountTokenInvite, expires: time.Now().Add(time.Hour)},
+    }
+    for _, test := range tests {
+        dao, mock := dbtest.NewDbMock(t)
+        mock.ExpectQuery(`SELECT \* FROM account_token`).WillReturnRows(accountTokenRows(test.purpose, test.expires, test.used))
+
+        _, err := ConsumeAccountToken(dao.NewSession(), NewRevocationList(nil, time.Hour), AccountTokenReset, "token", "a new password")
+        assert.Equal(t, ErrInvalidAccountToken, err, test.name)
+        assert.NoError(t, mock.ExpectationsWereMet(), test.name)
+    }
+}
+
+func TestConsumeAccountToken_Unknown(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM account_token`).WillReturnRows(dbtest.EmptyRows())
+
+    _, err := ConsumeAccountToken(dao.NewSession(), NewRevocationList(nil, time.Hour), AccountTokenReset, "token", "a new password")
+    assert.Equal(t, ErrInvalidAccountToken, err)
+}
+
+func TestInviteUser_ReinviteReplacesRoles(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("bar@garsson.io", "", false))
+    expectUserAccess(mock, "bar")
+    mock.ExpectExec(`DELETE FROM "user_role" WHERE \(email = 'bar@garsson.io'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`INSERT INTO "user_role" \("email","role_name"\) VALUES \('bar@garsson.io','kitchen'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`INSERT INTO "account_token"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    user, rawToken, err := InviteUser(dao.NewSession(), Invitation{Email: "bar@garsson.io", Roles: []string{" kitchen "}})
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.Equal(t, []string{"kitchen"}, user.Roles)
+    assert.NotEmpty(t, rawToken)
+}
+
+func TestInviteUser_ExistingAccount(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("bar@garsson.io", "$argon2id$...", false))
+    expectUserAccess(mock, "bar")
+    mock.ExpectRollback()
+
+    _, _, err := InviteUser(dao.NewSession(), Invitation{Email: "bar@garsson.io", Roles: []string{"kitchen"}})
+    assert.Equal(t, ErrUserAlreadyExists, err)
+    assert.NoError(t, mock.ExpectationsWereMet(), "the roles of an active account are not replaced")
+}
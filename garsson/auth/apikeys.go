@@ -0,0 +1,227 @@
+package auth
+
+import (
+    "errors"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gocraft/dbr"
+    "github.com/satori/go.uuid"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+// Machine clients such as printers and kitchen displays authenticate with an api key instead of a user password.
+// Api keys are created by an administrator, hold roles like users do and remain valid until they are revoked. The
+// key itself is only shown once at creation and stored as sha256 hash. Machine clients poll, so the principal of a
+// key is cached by the APIKeyCache for a short while instead of loading the key, its roles and their permissions on
+// every request.
+
+var (
+    // ErrInvalidAPIKey indicates that the api key is unknown or revoked
+    ErrInvalidAPIKey = errors.New("invalid or revoked api key")
+    // ErrAPIKeyNotFound indicates that no api key exists with the given id
+    ErrAPIKeyNotFound = errors.New("api key not found")
+    // ErrInvalidAPIKeyName indicates that the api key name is empty or too long
+    ErrInvalidAPIKeyName = errors.New("api key name must have 1 to 128 characters")
+)
+
+const (
+    // APIKeyPrincipalPrefix precedes the api key id in the Email of the principal of an api key
+    APIKeyPrincipalPrefix = "apikey:"
+    // apiKeyLastUsedResolution limits how often the last use of an api key is written
+    apiKeyLastUsedResolution = time.Minute
+    // DefaultAPIKeyCacheTTL is how long an authenticated api key is cached, it is the maximum time it takes before
+    // a key revoked by another instance, or a change of the permissions of its roles, takes effect.
+    DefaultAPIKeyCacheTTL = 30 * time.Second
+)
+
+// APIKey is the public representation of an api key, it never exposes the key
+type APIKey struct {
+    ID           string   `json:"id"`
+    Name         string   `json:"name"`
+    Roles        []string `json:"roles"`
+    CreatedBy    string   `json:"createdBy,omitempty"`
+    TimeCreated  string   `json:"timeCreated"`
+    TimeLastUsed string   `json:"timeLastUsed,omitempty"`
+    Revoked      bool     `json:"revoked"`
+}
+
+// NewAPIKey contains the fields required to create an api key
+type NewAPIKey struct {
+    Name  string   `json:"name"`
+    Roles []string `json:"roles"`
+}
+
+// CreateAPIKey stores a new api key with its roles, the returned key is only available now. createdBy is the email of
+// the administrator, or empty if unknown.
+func CreateAPIKey(sess *dbr.Session, newKey NewAPIKey, createdBy string) (APIKey, string, error) {
+    name := strings.TrimSpace(newKey.Name)
+    if name == "" || len(name) > 128 {
+        return APIKey{}, "", ErrInvalidAPIKeyName
+    }
+    roles, err := cleanRoles(newKey.Roles)
+    if err != nil {
+        return APIKey{}, "", err
+    }
+    rawKey, err := generateOpaqueToken()
+    if err != nil {
+        return APIKey{}, "", err
+    }
+    entity := apiKeyEntity{
+        ID:          uuid.NewV4().String(),
+        Name:        name,
+        KeyHash:     hashOpaqueToken(rawKey),
+        CreatedBy:   nullIfEmpty(createdBy),
+        TimeCreated: db.Now(),
+    }
+
+    tx, err := sess.Begin()
+    if err != nil {
+        return APIKey{}, "", err
+    }
+    defer tx.RollbackUnlessCommitted()
+    if err := insertAPIKey(tx, entity); err != nil {
+        return APIKey{}, "", err
+    }
+    if err := insertAPIKeyRoles(tx, entity.ID, roles); db.IsForeignKeyViolation(err) {
+        return APIKey{}, "", ErrUnknownRole
+    } else if err != nil {
+        return APIKey{}, "", err
+    }
+    if err := tx.Commit(); err != nil {
+        return APIKey{}, "", err
+    }
+    return entity.toAPIKey(roles), rawKey, nil
+}
+
+// ListAPIKeys returns all api keys, including revoked keys
+func ListAPIKeys(sess dbr.SessionRunner) ([]APIKey, error) {
+    entities, err := queryAPIKeys(sess)
+    if err != nil {
+        return nil, err
+    }
+    keyRoles, err := queryAPIKeyRoles(sess)
+    if err != nil {
+        return nil, err
+    }
+    rolesByKey := map[string][]string{}
+    for _, keyRole := range keyRoles {
+        rolesByKey[keyRole.APIKeyID] = append(rolesByKey[keyRole.APIKeyID], keyRole.RoleName)
+    }
+    keys := make([]APIKey, 0, len(entities))
+    for _, entity := range entities {
+        keys = append(keys, entity.toAPIKey(append([]string{}, rolesByKey[entity.ID]...)))
+    }
+    return keys, nil
+}
+
+// RevokeAPIKey rejects the api key from now on
+func RevokeAPIKey(sess dbr.SessionRunner, id string) error {
+    if affected, err := revokeAPIKey(sess, id); err != nil {
+        return err
+    } else if affected == 0 {
+        return ErrAPIKeyNotFound
+    }
+    return nil
+}
+
+// AuthenticateAPIKey returns the principal of the api key, with the permissions of its roles
+func AuthenticateAPIKey(sess dbr.SessionRunner, rawKey string) (UserFromJwt, error) {
+    entity, err := queryAPIKeyByHash(sess, hashOpaqueToken(strings.TrimSpace(rawKey)))
+    if err == dbr.ErrNotFound || (err == nil && entity.Revoked) {
+        return UserFromJwt{}, ErrInvalidAPIKey
+    } else if err != nil {
+        return UserFromJwt{}, err
+    }
+    roles, err := queryRolesOfAPIKey(sess, entity.ID)
+    if err != nil {
+        return UserFromJwt{}, err
+    }
+    permissions, err := loadPermissions(sess, roles)
+    if err != nil {
+        return UserFromJwt{}, err
+    }
+
+    now := time.Now()
+    if err := updateAPIKeyLastUsed(sess, entity.ID, db.FormatTime(now), db.FormatTime(now.Add(-apiKeyLastUsedResolution))); err != nil {
+        log.WithField("apiKey", entity.ID).WithError(err).Warn("could not update last use of api key")
+    }
+    return UserFromJwt{
+        Email:       APIKeyPrincipalPrefix + entity.ID,
+        Roles:       roles,
+        Permissions: permissions,
+        APIKeyID:    entity.ID,
+    }, nil
+}
+
+// APIKeyCache caches the principals of authenticated api keys by the hash of the key
+type APIKeyCache struct {
+    ttl time.Duration
+
+    mutex      sync.RWMutex
+    principals map[string]cachedAPIKey
+}
+
+type cachedAPIKey struct {
+    principal UserFromJwt
+    expires   time.Time
+}
+
+// NewAPIKeyCache creates a cache that keeps authenticated api keys for ttl
+func NewAPIKeyCache(ttl time.Duration) *APIKeyCache {
+    return &APIKeyCache{
+        ttl:        ttl,
+        principals: map[string]cachedAPIKey{},
+    }
+}
+
+// Authenticate returns the principal of the api key from the cache, or authenticates it via AuthenticateAPIKey if
+// it is not cached or the cached principal is outdated. Invalid keys are not cached.
+func (c *APIKeyCache) Authenticate(sess dbr.SessionRunner, rawKey string) (UserFromJwt, error) {
+    keyHash := hashOpaqueToken(strings.TrimSpace(rawKey))
+    c.mutex.RLock()
+    cached, found := c.principals[keyHash]
+    c.mutex.RUnlock()
+    if found && time.Now().Before(cached.expires) {
+        return cached.principal, nil
+    }
+
+    principal, err := AuthenticateAPIKey(sess, rawKey)
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if err != nil {
+        delete(c.principals, keyHash)
+        return UserFromJwt{}, err
+    }
+    c.principals[keyHash] = cachedAPIKey{principal: principal, expires: time.Now().Add(c.ttl)}
+    return principal, nil
+}
+
+// Revoke revokes the api key via RevokeAPIKey and removes it from the cache, so this instance rejects it right away
+func (c *APIKeyCache) Revoke(sess dbr.SessionRunner, id string) error {
+    if err := RevokeAPIKey(sess, id); err != nil {
+        return err
+    }
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    for keyHash, cached := range c.principals {
+        if cached.principal.APIKeyID == id {
+            delete(c.principals, keyHash)
+        }
+    }
+    return nil
+}
+
+func (k apiKeyEntity) toAPIKey(roles []string) APIKey {
+    return APIKey{
+        ID:           k.ID,
+        Name:         k.Name,
+        Roles:        roles,
+        CreatedBy:    k.CreatedBy.String,
+        TimeCreated:  k.TimeCreated,
+        TimeLastUsed: k.TimeLastUsed.String,
+        Revoked:      k.Revoked,
+    }
+}
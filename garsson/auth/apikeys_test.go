@@ -0,0 +1,136 @@
+package auth
+
+import (
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// apiKeyRows returns the api key key-1 with the raw key "secret"
+func apiKeyRows(revoked bool) *sqlmock.Rows {
+    return sqlmock.NewRows([]string{"id", "name", "key_hash", "created_by", "time_created", "time_last_used", "revoked"}).
+        AddRow("key-1", "Kitchen display", hashOpaqueToken("secret"), "admin@garsson.io", db.Now(), nil, revoked)
+}
+
+// expectAPIKeyAuthentication expects the queries of AuthenticateAPIKey for key-1 with the role kitchen
+func expectAPIKeyAuthentication(mock sqlmock.Sqlmock) {
+    mock.ExpectQuery(`SELECT \* FROM api_key WHERE \(key_hash = '` + hashOpaqueToken("secret") + `'\)`).WillReturnRows(apiKeyRows(false))
+    mock.ExpectQuery(`SELECT role_name FROM api_key_role WHERE \(api_key_id = 'key-1'\)`).
+        WillReturnRows(sqlmock.NewRows([]string{"role_name"}).AddRow("kitchen"))
+    mock.ExpectQuery(`SELECT \* FROM role_inheritance`).WillReturnRows(sqlmock.NewRows([]string{"role_name", "inherited_role_name"}))
+    mock.ExpectQuery(`SELECT \* FROM role_permission`).
+        WillReturnRows(sqlmock.NewRows([]string{"role_name", "permission_name"}).AddRow("kitchen", PermissionOrdersRead))
+    mock.ExpectExec(`UPDATE "api_key" SET "time_last_used" = .* WHERE \(id = 'key-1' AND \(time_last_used IS NULL OR time_last_used < `).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    expectAPIKeyAuthentication(mock)
+
+    principal, err := AuthenticateAPIKey(dao.NewSession(), " secret ")
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.Equal(t, APIKeyPrincipalPrefix+"key-1", principal.Email)
+    assert.Equal(t, "key-1", principal.APIKeyID)
+    assert.Equal(t, []string{"kitchen"}, principal.Roles)
+    assert.True(t, principal.HasPermission(PermissionOrdersRead))
+    assert.True(t, principal.IsAPIKey())
+}
+
+func TestAuthenticateAPIKey_Revoked(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM api_key`).WillReturnRows(apiKeyRows(true))
+
+    _, err := AuthenticateAPIKey(dao.NewSession(), "secret")
+    assert.Equal(t, ErrInvalidAPIKey, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuthenticateAPIKey_Unknown(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM api_key`).WillReturnRows(dbtest.EmptyRows())
+
+    _, err := AuthenticateAPIKey(dao.NewSession(), "guessed")
+    assert.Equal(t, ErrInvalidAPIKey, err)
+}
+
+func TestAPIKeyCache_AuthenticatesOncePerTTL(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    cache := NewAPIKeyCache(time.Hour)
+    expectAPIKeyAuthentication(mock)
+
+    for i := 0; i < 3; i++ {
+        principal, err := cache.Authenticate(dao.NewSession(), "secret")
+        assert.NoError(t, err)
+        assert.Equal(t, "key-1", principal.APIKeyID)
+    }
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAPIKeyCache_ReloadsOutdatedKey(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    cache := NewAPIKeyCache(time.Hour)
+    expectAPIKeyAuthentication(mock)
+    mock.ExpectQuery(`SELECT \* FROM api_key`).WillReturnRows(apiKeyRows(true))
+
+    _, err := cache.Authenticate(dao.NewSession(), "secret")
+    assert.NoError(t, err)
+    for keyHash, cached := range cache.principals {
+        cached.expires = time.Now().Add(-time.Second)
+        cache.principals[keyHash] = cached
+    }
+    _, err = cache.Authenticate(dao.NewSession(), "secret")
+    assert.Equal(t, ErrInvalidAPIKey, err, "a key revoked by another instance is rejected once the cache is outdated")
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAPIKeyCache_RevokeEvicts(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    cache := NewAPIKeyCache(time.Hour)
+    expectAPIKeyAuthentication(mock)
+    mock.ExpectExec(`UPDATE "api_key" SET "revoked" = TRUE WHERE \(id = 'key-1'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery(`SELECT \* FROM api_key`).WillReturnRows(apiKeyRows(true))
+
+    _, err := cache.Authenticate(dao.NewSession(), "secret")
+    assert.NoError(t, err)
+    assert.NoError(t, cache.Revoke(dao.NewSession(), "key-1"))
+    _, err = cache.Authenticate(dao.NewSession(), "secret")
+    assert.Equal(t, ErrInvalidAPIKey, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAPIKeyCache_RevokeUnknownKey(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectExec(`UPDATE "api_key" SET "revoked" = TRUE`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+    assert.Equal(t, ErrAPIKeyNotFound, NewAPIKeyCache(time.Hour).Revoke(dao.NewSession(), "key-2"))
+}
+
+func TestCreateAPIKey_InvalidName(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    for _, name := range []string{"", "   ", string(make([]byte, 129))} {
+        _, _, err := CreateAPIKey(dao.NewSession(), NewAPIKey{Name: name, Roles: []string{"kitchen"}}, "admin@garsson.io")
+        assert.Equal(t, ErrInvalidAPIKeyName, err)
+    }
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateAPIKey(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectExec(`INSERT INTO "api_key"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`INSERT INTO "api_key_role" \("api_key_id","role_name"\) VALUES \('.*','kitchen'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    key, rawKey, err := CreateAPIKey(dao.NewSession(), NewAPIKey{Name: " Kitchen display ", Roles: []string{"kitchen"}}, "admin@garsson.io")
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.Equal(t, "Kitchen display", key.Name)
+    assert.Equal(t, []string{"kitchen"}, key.Roles)
+    assert.NotEmpty(t, rawKey)
+}
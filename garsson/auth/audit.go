@@ -0,0 +1,109 @@
+package auth
+
+import (
+    "github.com/gocraft/dbr"
+    "github.com/toefel18/garsson-api/garsson/db"
+)
+
+// Every sign-in attempt, successful or not, is recorded in the login_event table. Events are stored for the email
+// that was attempted, which is not necessarily an existing user, so that staff and administrators can spot misuse.
+
+const (
+    // LoginMethodPassword identifies sign-ins with email and password
+    LoginMethodPassword = "password"
+    // LoginMethodPin identifies sign-ins with a PIN on a registered device
+    LoginMethodPin = "pin"
+    // DefaultLoginEventLimit is the amount of login events returned when no limit is given
+    DefaultLoginEventLimit = 50
+    // MaxLoginEventLimit is the maximum amount of login events returned at once
+    MaxLoginEventLimit = 500
+
+    maxUserAgentLength     = 512
+    maxFailureReasonLength = 128
+)
+
+// LoginAttempt describes a sign-in attempt that should be recorded
+type LoginAttempt struct {
+    Email     string
+    Method    string
+    IP        string
+    UserAgent string
+    // DeviceID is the registered device on which the attempt was made, empty if unknown
+    DeviceID string
+    // FailureReason is empty for successful sign-ins
+    FailureReason string
+}
+
+// LoginEvent is the public representation of a recorded sign-in attempt
+type LoginEvent struct {
+    ID            int64  `json:"id"`
+    Email         string `json:"email"`
+    Method        string `json:"method"`
+    Success       bool   `json:"success"`
+    Time          string `json:"time"`
+    IP            string `json:"ip,omitempty"`
+    UserAgent     string `json:"userAgent,omitempty"`
+    DeviceID      string `json:"deviceId,omitempty"`
+    FailureReason string `json:"failureReason,omitempty"`
+}
+
+// RecordLoginAttempt stores the attempt in the login_event table
+func RecordLoginAttempt(sess dbr.SessionRunner, attempt LoginAttempt) error {
+    return insertLoginEvent(sess, loginEventEntity{
+        Email:         truncate(attempt.Email, maxEmailLength),
+        Method:        attempt.Method,
+        Success:       attempt.FailureReason == "",
+        TimeAttempted: db.Now(),
+        IP:            nullIfEmpty(attempt.IP),
+        UserAgent:     nullIfEmpty(truncate(attempt.UserAgent, maxUserAgentLength)),
+        DeviceID:      nullIfEmpty(attempt.DeviceID),
+        FailureReason: nullIfEmpty(truncate(attempt.FailureReason, maxFailureReasonLength)),
+    })
+}
+
+// ListLoginEvents returns the most recent sign-in attempts for the email, newest first
+func ListLoginEvents(sess dbr.SessionRunner, email string, limit int) ([]LoginEvent, error) {
+    if limit <= 0 {
+        limit = DefaultLoginEventLimit
+    } else if limit > MaxLoginEventLimit {
+        limit = MaxLoginEventLimit
+    }
+    entities, err := queryLoginEvents(sess, email, uint64(limit))
+    if err != nil {
+        return nil, err
+    }
+    events := make([]LoginEvent, 0, len(entities))
+    for _, entity := range entities {
+        events = append(events, entity.toLoginEvent())
+    }
+    return events, nil
+}
+
+func (e loginEventEntity) toLoginEvent() LoginEvent {
+    return LoginEvent{
+        ID:            e.ID,
+        Email:         e.Email,
+        Method:        e.Method,
+        Success:       e.Success,
+        Time:          e.TimeAttempted,
+        IP:            e.IP.String,
+        UserAgent:     e.UserAgent.String,
+        DeviceID:      e.DeviceID.String,
+        FailureReason: e.FailureReason.String,
+    }
+}
+
+func nullIfEmpty(value string) dbr.NullString {
+    if value == "" {
+        return dbr.NullString{}
+    }
+    return dbr.NewNullString(value)
+}
+
+// truncate shortens the value to maxLength characters
+func truncate(value string, maxLength int) string {
+    if runes := []rune(value); len(runes) > maxLength {
+        return string(runes[:maxLength])
+    }
+    return value
+}
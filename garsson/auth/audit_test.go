@@ -0,0 +1,99 @@
+package auth
+
+import (
+    "strings"
+    "testing"
+    "unicode/utf8"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestRecordLoginAttempt_Success(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectExec(`INSERT INTO "login_event" \("email","method","success","time_attempted","ip","user_agent","device_id","failure_reason"\) ` +
+        `VALUES \('bar@garsson.io','pin',TRUE,'[^']+','192.0.2.1','Tablet/1.0','tablet-1',NULL\)`).
+        WillReturnResult(sqlmock.NewResult(1, 1))
+
+    assert.NoError(t, RecordLoginAttempt(dao.NewSession(), LoginAttempt{
+        Email:     "bar@garsson.io",
+        Method:    LoginMethodPin,
+        IP:        "192.0.2.1",
+        UserAgent: "Tablet/1.0",
+        DeviceID:  "tablet-1",
+    }))
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRecordLoginAttempt_Failure(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectExec(`INSERT INTO "login_event" .* VALUES \('bar@garsson.io','password',FALSE,'[^']+','192.0.2.1','` +
+        strings.Repeat("x", maxUserAgentLength) + `',NULL,'invalid password'\)`).
+        WillReturnResult(sqlmock.NewResult(1, 1))
+
+    assert.NoError(t, RecordLoginAttempt(dao.NewSession(), LoginAttempt{
+        Email:         "bar@garsson.io",
+        Method:        LoginMethodPassword,
+        IP:            "192.0.2.1",
+        UserAgent:     strings.Repeat("x", maxUserAgentLength+10),
+        FailureReason: "invalid password",
+    }))
+    assert.NoError(t, mock.ExpectationsWereMet(), "the user agent is truncated and the unknown device is NULL")
+}
+
+func TestListLoginEvents(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM login_event WHERE \(email = 'bar@garsson.io'\) ORDER BY id DESC LIMIT 50`).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "email", "method", "success", "time_attempted", "ip", "user_agent", "device_id", "failure_reason"}).
+            AddRow(2, "bar@garsson.io", "pin", false, "2018-06-01T20:01:00Z", "192.0.2.1", nil, "tablet-1", "invalid pin").
+            AddRow(1, "bar@garsson.io", "password", true, "2018-06-01T20:00:00Z", nil, nil, nil, nil))
+    mock.ExpectQuery(`SELECT \* FROM login_event .* LIMIT 500`).WillReturnRows(dbtest.EmptyRows())
+
+    events, err := ListLoginEvents(dao.NewSession(), "bar@garsson.io", 0)
+    assert.NoError(t, err)
+    if assert.Len(t, events, 2) {
+        assert.Equal(t, LoginEvent{ID: 2, Email: "bar@garsson.io", Method: "pin", Time: "2018-06-01T20:01:00Z", IP: "192.0.2.1",
+            DeviceID: "tablet-1", FailureReason: "invalid pin"}, events[0])
+        assert.True(t, events[1].Success)
+    }
+    events, err = ListLoginEvents(dao.NewSession(), "bar@garsson.io", 10000)
+    assert.NoError(t, err)
+    assert.NotNil(t, events, "serialized as empty list")
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateLastSignInToNow(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectExec(`UPDATE "user_account" SET "last_sign_in" = '[^']+' WHERE \(email = 'bar@garsson.io'\)`).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+
+    assert.NoError(t, UpdateLastSignInToNow(dao.NewSession(), "bar@garsson.io"))
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuthenticate_WritesLastSignIn(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    passwordHash, err := hashPassword("secret")
+    assert.NoError(t, err)
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("bar@garsson.io", passwordHash, false))
+    expectUserAccess(mock, "bar")
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(dbtest.EmptyRows())
+    expectRolesRequireMFA(mock, "bar", false)
+    mock.ExpectExec(`INSERT INTO "refresh_token"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "user_session"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "user_account" SET "last_sign_in" = '[^']+' WHERE \(email = 'bar@garsson.io'\)`).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+
+    _, _, err = Authenticate(dao.NewSession(), "bar@garsson.io", "secret", signingKeys(t))
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTruncate_KeepsMultiByteCharactersIntact(t *testing.T) {
+    truncated := truncate("Mozilla/5.0 (ünïcödé)", 16)
+
+    assert.Equal(t, "Mozilla/5.0 (ünï", truncated)
+    assert.True(t, utf8.ValidString(truncated))
+    assert.Equal(t, "short", truncate("short", 16))
+}
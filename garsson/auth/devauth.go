@@ -0,0 +1,57 @@
+package auth
+
+import (
+    "strings"
+
+    "github.com/gocraft/dbr"
+)
+
+// Development authentication lets frontend developers act as any user, or any set of roles, without signing in.
+// It is only active when explicitly enabled at startup, the api then accepts the impersonation headers instead of
+// a JWT. Never enable it in production.
+
+// ImpersonateUser returns a principal for email without checking credentials. When roles is empty the principal
+// gets the roles of the existing user, otherwise it gets the given roles, which must exist.
+func ImpersonateUser(sess dbr.SessionRunner, email string, roles []string) (UserFromJwt, error) {
+    email = strings.TrimSpace(email)
+    roles, err := cleanRoles(roles)
+    if err != nil {
+        return UserFromJwt{}, err
+    }
+    if len(roles) == 0 {
+        user, err := QueryUserEntity(sess, email)
+        if err == dbr.ErrNotFound {
+            return UserFromJwt{}, ErrUserNotFound
+        } else if err != nil {
+            return UserFromJwt{}, err
+        }
+        return UserFromJwt{Email: user.Email, Roles: user.Roles, Permissions: user.Permissions}, nil
+    }
+
+    if err := checkRolesExist(sess, roles); err != nil {
+        return UserFromJwt{}, err
+    }
+    permissions, err := loadPermissions(sess, roles)
+    if err != nil {
+        return UserFromJwt{}, err
+    }
+    return UserFromJwt{Email: email, Roles: roles, Permissions: permissions}, nil
+}
+
+// checkRolesExist returns ErrUnknownRole if one of the roles is not in the role table
+func checkRolesExist(sess dbr.SessionRunner, roles []string) error {
+    entities, err := queryRoles(sess)
+    if err != nil {
+        return err
+    }
+    existing := make(map[string]bool, len(entities))
+    for _, entity := range entities {
+        existing[entity.Name] = true
+    }
+    for _, role := range roles {
+        if !existing[role] {
+            return ErrUnknownRole
+        }
+    }
+    return nil
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// roleRows returns the existing roles
+func roleRows(names ...string) *sqlmock.Rows {
+    rows := sqlmock.NewRows([]string{"name", "description", "mfa_required"})
+    for _, name := range names {
+        rows.AddRow(name, nil, false)
+    }
+    return rows
+}
+
+func TestValidateJWT_RejectsDevToken(t *testing.T) {
+    key, _ := GenerateEd25519Key("ed-1")
+    keys := NewKeySet()
+    assert.NoError(t, keys.Add(key))
+
+    _, err := ValidateJWT("dev", keys, noRevocations{})
+    assert.Error(t, err)
+}
+
+func TestImpersonateUser_RolesOfUser(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM user_account WHERE \(email = 'bar@garsson.io'\)`).WillReturnRows(userRows("bar@garsson.io", "", false))
+    expectUserAccess(mock, "bar", PermissionOrdersRead)
+
+    principal, err := ImpersonateUser(dao.NewSession(), " bar@garsson.io ", nil)
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.Equal(t, "bar@garsson.io", principal.Email)
+    assert.Equal(t, []string{"bar"}, principal.Roles)
+    assert.Equal(t, []string{PermissionOrdersRead}, principal.Permissions)
+    assert.Nil(t, principal.Claims, "no token was issued")
+}
+
+func TestImpersonateUser_UnknownUser(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(dbtest.EmptyRows())
+
+    _, err := ImpersonateUser(dao.NewSession(), "nobody@garsson.io", nil)
+    assert.Equal(t, ErrUserNotFound, err)
+}
+
+func TestImpersonateUser_RequestedRoles(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM role ORDER BY name`).WillReturnRows(roleRows("bar", "manager"))
+    mock.ExpectQuery(`SELECT \* FROM role_inheritance`).
+        WillReturnRows(sqlmock.NewRows([]string{"role_name", "inherited_role_name"}).AddRow("manager", "bar"))
+    mock.ExpectQuery(`SELECT \* FROM role_permission`).WillReturnRows(sqlmock.NewRows([]string{"role_name", "permission_name"}).
+        AddRow("bar", PermissionOrdersRead).
+        AddRow("manager", PermissionUsersManage).
+        AddRow("admin", PermissionAPIKeysManage))
+
+    principal, err := ImpersonateUser(dao.NewSession(), "someone@garsson.io", []string{"manager"})
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet(), "the user does not need to exist")
+    assert.Equal(t, "someone@garsson.io", principal.Email)
+    assert.Equal(t, []string{"manager"}, principal.Roles)
+    assert.ElementsMatch(t, []string{PermissionOrdersRead, PermissionUsersManage}, principal.Permissions)
+}
+
+func TestImpersonateUser_UnknownRole(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM role ORDER BY name`).WillReturnRows(roleRows("bar"))
+
+    _, err := ImpersonateUser(dao.NewSession(), "bar@garsson.io", []string{"bar", "admin"})
+    assert.Equal(t, ErrUnknownRole, err)
+    assert.NoError(t, mock.ExpectationsWereMet(), "no permissions are loaded")
+}
+
+func TestCheckRolesExist(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM role`).WillReturnRows(roleRows("bar", "manager"))
+    mock.ExpectQuery(`SELECT \* FROM role`).WillReturnRows(roleRows("bar", "manager"))
+    mock.ExpectQuery(`SELECT \* FROM role`).WillReturnRows(roleRows())
+
+    assert.NoError(t, checkRolesExist(dao.NewSession(), []string{"manager", "bar"}))
+    assert.Equal(t, ErrUnknownRole, checkRolesExist(dao.NewSession(), []string{"bar", "Bar"}), "role names are case sensitive")
+    assert.Equal(t, ErrUnknownRole, checkRolesExist(dao.NewSession(), []string{"bar"}))
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+    "crypto/ed25519"
+    "encoding/base64"
+    "errors"
+
+    "github.com/dgrijalva/jwt-go"
+)
+
+// jwt-go v3 does not support EdDSA, SigningMethodEdDSA adds Ed25519 signatures as specified in RFC 8037.
+
+var (
+    // ErrEdDSAVerification indicates that the Ed25519 signature is invalid
+    ErrEdDSAVerification = errors.New("eddsa: verification error")
+    // ErrInvalidEdDSAKey indicates that the key passed to SigningMethodEdDSA is not an Ed25519 key
+    ErrInvalidEdDSAKey = errors.New("eddsa: key is not an ed25519 key")
+)
+
+// SigningMethodEdDSA signs with an ed25519.PrivateKey and verifies with an ed25519.PublicKey
+type SigningMethodEdDSA struct{}
+
+// EdDSA is the singleton instance of SigningMethodEdDSA, registered as alg 'EdDSA'
+var EdDSA = &SigningMethodEdDSA{}
+
+func init() {
+    jwt.RegisterSigningMethod(EdDSA.Alg(), func() jwt.SigningMethod {
+        return EdDSA
+    })
+}
+
+// Alg returns the JWA name of the signing method
+func (m *SigningMethodEdDSA) Alg() string {
+    return "EdDSA"
+}
+
+// Verify checks the signature of signingString, key must be an ed25519.PublicKey
+func (m *SigningMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+    publicKey, ok := key.(ed25519.PublicKey)
+    if !ok || len(publicKey) != ed25519.PublicKeySize {
+        return ErrInvalidEdDSAKey
+    }
+    rawSignature, err := base64.RawURLEncoding.DecodeString(signature)
+    if err != nil {
+        return err
+    }
+    if !ed25519.Verify(publicKey, []byte(signingString), rawSignature) {
+        return ErrEdDSAVerification
+    }
+    return nil
+}
+
+// Sign signs signingString, key must be an ed25519.PrivateKey
+func (m *SigningMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+    privateKey, ok := key.(ed25519.PrivateKey)
+    if !ok || len(privateKey) != ed25519.PrivateKeySize {
+        return "", ErrInvalidEdDSAKey
+    }
+    return base64.RawURLEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
@@ -0,0 +1,321 @@
+package auth
+
+import (
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "math/big"
+    "path/filepath"
+    "sort"
+    "strings"
+
+    "github.com/dgrijalva/jwt-go"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+// JWTs are signed with the active key of a KeySet and carry its key id in the 'kid' header. Verification selects
+// the key by 'kid', so tokens signed by a previous key stay valid during rotation as long as that key is still
+// part of the set. Public keys are published as JWKS so other services can verify tokens without a shared secret.
+//
+// HS256 with a shared secret is only supported as opt-in legacy mode, tokens without a 'kid' are verified with it.
+
+const (
+    // LegacyHMACKeyID is the key id of the legacy HS256 key
+    LegacyHMACKeyID = "legacy-hs256"
+    // minRSAKeyBits is the minimal size of accepted RSA keys
+    minRSAKeyBits = 2048
+)
+
+var (
+    // ErrNoSigningKey indicates that the key set does not contain a private key to sign tokens with
+    ErrNoSigningKey = errors.New("no active signing key")
+    // ErrUnknownKeyID indicates that a token refers to a key that is not in the key set
+    ErrUnknownKeyID = errors.New("token signed with unknown key")
+)
+
+// SigningKey is a key identified by its kid. Keys loaded from a public key only verify tokens.
+type SigningKey struct {
+    Kid    string
+    Method jwt.SigningMethod
+    // signKey is the private key or HMAC secret, nil for verification-only keys
+    signKey interface{}
+    // verifyKey is the public key or HMAC secret
+    verifyKey interface{}
+}
+
+// CanSign returns true if the key contains private key material
+func (k *SigningKey) CanSign() bool {
+    return k.signKey != nil
+}
+
+// KeySet contains all keys that are accepted for verification and the key used for signing new tokens
+type KeySet struct {
+    active *SigningKey
+    keys   map[string]*SigningKey
+    legacy *SigningKey
+}
+
+// NewKeySet creates an empty key set
+func NewKeySet() *KeySet {
+    return &KeySet{keys: map[string]*SigningKey{}}
+}
+
+// Add adds a key to the set, the first key that can sign becomes the active key
+func (k *KeySet) Add(key *SigningKey) error {
+    if _, exists := k.keys[key.Kid]; exists {
+        return fmt.Errorf("duplicate key id %v", key.Kid)
+    }
+    k.keys[key.Kid] = key
+    if key.Method == jwt.SigningMethodHS256 {
+        k.legacy = key
+    }
+    if k.active == nil && key.CanSign() {
+        k.active = key
+    }
+    return nil
+}
+
+// SetActive selects the key that signs new tokens
+func (k *KeySet) SetActive(kid string) error {
+    if key, found := k.keys[kid]; !found {
+        return fmt.Errorf("active key %v is not configured", kid)
+    } else if !key.CanSign() {
+        return fmt.Errorf("active key %v is a public key, a private key is required for signing", kid)
+    } else {
+        k.active = key
+        return nil
+    }
+}
+
+// Sign signs the claims with the active key
+func (k *KeySet) Sign(claims jwt.Claims) (string, error) {
+    if k.active == nil {
+        return "", ErrNoSigningKey
+    }
+    token := jwt.NewWithClaims(k.active.Method, claims)
+    token.Header["kid"] = k.active.Kid
+    return token.SignedString(k.active.signKey)
+}
+
+// verificationKey is a jwt.Keyfunc that selects the key by kid and rejects tokens whose alg does not match the key
+func (k *KeySet) verificationKey(token *jwt.Token) (interface{}, error) {
+    kid, _ := token.Header["kid"].(string)
+    key, found := k.keys[kid]
+    if kid == "" && k.legacy != nil {
+        key, found = k.legacy, true
+    }
+    if !found {
+        log.WithField("kid", kid).Warn("cannot validate JWT signature")
+        return nil, ErrUnknownKeyID
+    }
+    if token.Method.Alg() != key.Method.Alg() {
+        log.WithField("unexpectedSigningMethod", token.Header["alg"]).WithField("kid", kid).Warn("cannot validate JWT signature")
+        return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+    }
+    return key.verifyKey, nil
+}
+
+// JWKS returns the public keys of the set, HMAC secrets are never published
+func (k *KeySet) JWKS() JSONWebKeySet {
+    jwks := JSONWebKeySet{Keys: []JSONWebKey{}}
+    for _, key := range k.keys {
+        switch publicKey := key.verifyKey.(type) {
+        case *rsa.PublicKey:
+            jwks.Keys = append(jwks.Keys, JSONWebKey{
+                Kty: "RSA",
+                Kid: key.Kid,
+                Use: "sig",
+                Alg: key.Method.Alg(),
+                N:   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+                E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+            })
+        case ed25519.PublicKey:
+            jwks.Keys = append(jwks.Keys, JSONWebKey{
+                Kty: "OKP",
+                Kid: key.Kid,
+                Use: "sig",
+                Alg: key.Method.Alg(),
+                Crv: "Ed25519",
+                X:   base64.RawURLEncoding.EncodeToString(publicKey),
+            })
+        }
+    }
+    sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].Kid < jwks.Keys[j].Kid })
+    return jwks
+}
+
+// JSONWebKeySet is a JWK set as defined in RFC 7517
+type JSONWebKeySet struct {
+    Keys []JSONWebKey `json:"keys"`
+}
+
+// JSONWebKey contains the public parameters of an RSA, EC or Ed25519 key
+type JSONWebKey struct {
+    Kty string `json:"kty"`
+    Kid string `json:"kid"`
+    Use string `json:"use"`
+    Alg string `json:"alg"`
+    N   string `json:"n,omitempty"`
+    E   string `json:"e,omitempty"`
+    Crv string `json:"crv,omitempty"`
+    X   string `json:"x,omitempty"`
+    Y   string `json:"y,omitempty"`
+}
+
+// PublicKey returns the *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey described by the JWK
+func (k JSONWebKey) PublicKey() (interface{}, error) {
+    switch {
+    case k.Kty == "RSA":
+        n, nErr := base64.RawURLEncoding.DecodeString(k.N)
+        e, eErr := base64.RawURLEncoding.DecodeString(k.E)
+        if nErr != nil || eErr != nil || len(e) == 0 || len(e) > 4 {
+            return nil, fmt.Errorf("invalid RSA key %v", k.Kid)
+        }
+        return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+    case k.Kty == "EC":
+        var curve elliptic.Curve
+        switch k.Crv {
+        case "P-256":
+            curve = elliptic.P256()
+        case "P-384":
+            curve = elliptic.P384()
+        case "P-521":
+            curve = elliptic.P521()
+        default:
+            return nil, fmt.Errorf("unsupported curve %v of key %v", k.Crv, k.Kid)
+        }
+        x, xErr := base64.RawURLEncoding.DecodeString(k.X)
+        y, yErr := base64.RawURLEncoding.DecodeString(k.Y)
+        if xErr != nil || yErr != nil {
+            return nil, fmt.Errorf("invalid EC key %v", k.Kid)
+        }
+        publicKey := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+        if !curve.IsOnCurve(publicKey.X, publicKey.Y) {
+            return nil, fmt.Errorf("invalid EC key %v", k.Kid)
+        }
+        return publicKey, nil
+    case k.Kty == "OKP" && k.Crv == "Ed25519":
+        x, err := base64.RawURLEncoding.DecodeString(k.X)
+        if err != nil || len(x) != ed25519.PublicKeySize {
+            return nil, fmt.Errorf("invalid Ed25519 key %v", k.Kid)
+        }
+        return ed25519.PublicKey(x), nil
+    default:
+        return nil, fmt.Errorf("unsupported key type %v of key %v", k.Kty, k.Kid)
+    }
+}
+
+// KeyConfig describes where the keys of a KeySet come from
+type KeyConfig struct {
+    // KeyFiles are PEM files with RSA or Ed25519 keys, the file name without extension is used as kid
+    KeyFiles []string
+    // ActiveKid selects the signing key, defaults to the first private key in KeyFiles
+    ActiveKid string
+    // LegacyHMACSecret enables HS256 tokens when not empty
+    LegacyHMACSecret string
+}
+
+// LoadKeySet creates a key set from the configuration. If no signing key is configured an ephemeral Ed25519 key
+// is generated, tokens signed with it become invalid when the application restarts.
+func LoadKeySet(config KeyConfig) (*KeySet, error) {
+    keys := NewKeySet()
+    for _, path := range config.KeyFiles {
+        pemBytes, err := ioutil.ReadFile(path)
+        if err != nil {
+            return nil, err
+        }
+        kid := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+        if key, err := ParsePEMKey(kid, pemBytes); err != nil {
+            return nil, fmt.Errorf("%v: %v", path, err)
+        } else if err := keys.Add(key); err != nil {
+            return nil, err
+        }
+    }
+    if config.LegacyHMACSecret != "" {
+        log.Warn("legacy HS256 JWT signing is enabled")
+        if err := keys.Add(NewHMACKey(LegacyHMACKeyID, []byte(config.LegacyHMACSecret))); err != nil {
+            return nil, err
+        }
+    }
+    if config.ActiveKid != "" {
+        if err := keys.SetActive(config.ActiveKid); err != nil {
+            return nil, err
+        }
+    }
+    if keys.active == nil {
+        log.Warn("no JWT signing key configured, generating an ephemeral key. Tokens become invalid after a restart!")
+        if key, err := GenerateEd25519Key("ephemeral"); err != nil {
+            return nil, err
+        } else if err := keys.Add(key); err != nil {
+            return nil, err
+        }
+    }
+    return keys, nil
+}
+
+// NewHMACKey creates a legacy HS256 key
+func NewHMACKey(kid string, secret []byte) *SigningKey {
+    return &SigningKey{Kid: kid, Method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}
+}
+
+// GenerateEd25519Key generates a new random Ed25519 key
+func GenerateEd25519Key(kid string) (*SigningKey, error) {
+    publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    return &SigningKey{Kid: kid, Method: EdDSA, signKey: privateKey, verifyKey: publicKey}, nil
+}
+
+// ParsePEMKey parses an RSA or Ed25519 private or public key. RSA keys are used with RS256, Ed25519 keys with EdDSA.
+func ParsePEMKey(kid string, pemBytes []byte) (*SigningKey, error) {
+    block, _ := pem.Decode(pemBytes)
+    if block == nil {
+        return nil, errors.New("no PEM data found")
+    }
+
+    var parsed interface{}
+    var err error
+    switch block.Type {
+    case "RSA PRIVATE KEY":
+        parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+    case "PRIVATE KEY":
+        parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+    case "RSA PUBLIC KEY":
+        parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+    case "PUBLIC KEY":
+        parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+    default:
+        return nil, fmt.Errorf("unsupported PEM block type %v", block.Type)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    switch key := parsed.(type) {
+    case *rsa.PrivateKey:
+        if key.N.BitLen() < minRSAKeyBits {
+            return nil, fmt.Errorf("RSA key must have at least %v bits", minRSAKeyBits)
+        }
+        return &SigningKey{Kid: kid, Method: jwt.SigningMethodRS256, signKey: key, verifyKey: &key.PublicKey}, nil
+    case *rsa.PublicKey:
+        if key.N.BitLen() < minRSAKeyBits {
+            return nil, fmt.Errorf("RSA key must have at least %v bits", minRSAKeyBits)
+        }
+        return &SigningKey{Kid: kid, Method: jwt.SigningMethodRS256, verifyKey: key}, nil
+    case ed25519.PrivateKey:
+        return &SigningKey{Kid: kid, Method: EdDSA, signKey: key, verifyKey: key.Public().(ed25519.PublicKey)}, nil
+    case ed25519.PublicKey:
+        return &SigningKey{Kid: kid, Method: EdDSA, verifyKey: key}, nil
+    default:
+        return nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", parsed)
+    }
+}
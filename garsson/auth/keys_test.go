@@ -0,0 +1,111 @@
+package auth
+
+import (
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/pem"
+    "testing"
+    "time"
+
+    "github.com/dgrijalva/jwt-go"
+    "github.com/stretchr/testify/assert"
+)
+
+type noRevocations struct{}
+
+func (noRevocations) IsRevoked(jti string) bool { return false }
+
+func testClaims() JwtClaims {
+    return JwtClaims{
+        StandardClaims: jwt.StandardClaims{
+            Id:        "test-jti",
+            Subject:   "waiter@garsson.nl",
+            ExpiresAt: time.Now().Add(time.Minute).Unix(),
+        },
+        Roles: []string{"waiter"},
+    }
+}
+
+func TestKeySet_SignAndVerifyEdDSA(t *testing.T) {
+    key, err := GenerateEd25519Key("ed-1")
+    assert.NoError(t, err)
+    keys := NewKeySet()
+    assert.NoError(t, keys.Add(key))
+
+    token, err := keys.Sign(testClaims())
+    assert.NoError(t, err)
+    user, err := ValidateJWT(token, keys, noRevocations{})
+    assert.NoError(t, err)
+    assert.Equal(t, "waiter@garsson.nl", user.Email)
+}
+
+func TestKeySet_SignAndVerifyRS256FromPEM(t *testing.T) {
+    rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    assert.NoError(t, err)
+    pemBytes := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+
+    key, err := ParsePEMKey("rsa-1", pemBytes)
+    assert.NoError(t, err)
+    assert.Equal(t, jwt.SigningMethodRS256, key.Method)
+    keys := NewKeySet()
+    assert.NoError(t, keys.Add(key))
+
+    token, err := keys.Sign(testClaims())
+    assert.NoError(t, err)
+    _, err = ValidateJWT(token, keys, noRevocations{})
+    assert.NoError(t, err)
+
+    jwks := keys.JWKS()
+    assert.Len(t, jwks.Keys, 1)
+    assert.Equal(t, "RSA", jwks.Keys[0].Kty)
+    assert.Equal(t, "rsa-1", jwks.Keys[0].Kid)
+    assert.Equal(t, "AQAB", jwks.Keys[0].E)
+}
+
+func TestKeySet_RotationKeepsOldKeyValid(t *testing.T) {
+    oldKey, _ := GenerateEd25519Key("old")
+    newKey, _ := GenerateEd25519Key("new")
+    keys := NewKeySet()
+    assert.NoError(t, keys.Add(oldKey))
+    assert.NoError(t, keys.Add(newKey))
+
+    tokenOfOldKey, _ := keys.Sign(testClaims())
+    assert.NoError(t, keys.SetActive("new"))
+    tokenOfNewKey, _ := keys.Sign(testClaims())
+
+    _, err := ValidateJWT(tokenOfOldKey, keys, noRevocations{})
+    assert.NoError(t, err)
+    _, err = ValidateJWT(tokenOfNewKey, keys, noRevocations{})
+    assert.NoError(t, err)
+}
+
+func TestKeySet_RejectsHMACUnlessLegacyEnabled(t *testing.T) {
+    hmacToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims()).SignedString([]byte("secret"))
+
+    asymmetricOnly := NewKeySet()
+    edKey, _ := GenerateEd25519Key("ed-1")
+    assert.NoError(t, asymmetricOnly.Add(edKey))
+    _, err := ValidateJWT(hmacToken, asymmetricOnly, noRevocations{})
+    assert.Error(t, err)
+
+    withLegacy := NewKeySet()
+    assert.NoError(t, withLegacy.Add(edKey))
+    assert.NoError(t, withLegacy.Add(NewHMACKey(LegacyHMACKeyID, []byte("secret"))))
+    _, err = ValidateJWT(hmacToken, withLegacy, noRevocations{})
+    assert.NoError(t, err)
+    assert.Len(t, withLegacy.JWKS().Keys, 1, "HMAC secrets must not be published")
+}
+
+func TestKeySet_RejectsAlgorithmMismatch(t *testing.T) {
+    edKey, _ := GenerateEd25519Key("ed-1")
+    keys := NewKeySet()
+    assert.NoError(t, keys.Add(edKey))
+
+    token := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims())
+    token.Header["kid"] = "ed-1"
+    forged, _ := token.SignedString([]byte("attacker"))
+
+    _, err := ValidateJWT(forged, keys, noRevocations{})
+    assert.Error(t, err)
+}
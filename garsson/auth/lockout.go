@@ -0,0 +1,144 @@
+package auth
+
+import (
+    "errors"
+    "math"
+    "time"
+
+    "github.com/gocraft/dbr"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+// Failed sign-ins are counted per account and per client IP in the failed_login_counter table. Once a counter
+// reaches the threshold of the LockoutPolicy, further attempts for that account or from that IP are rejected
+// for a period that doubles with every additional failure. A successful sign-in resets the account counter,
+// counters also restart when no failure occurred for ResetAfter.
+
+var (
+    // ErrAccountLocked indicates that too many sign-ins failed for the account or from the client IP
+    ErrAccountLocked = errors.New("too many failed attempts, try again later")
+)
+
+const (
+    // LockoutKindAccount identifies counters of an account, the subject is the email address
+    LockoutKindAccount = "account"
+    // LockoutKindIP identifies counters of a client, the subject is the IP address
+    LockoutKindIP = "ip"
+)
+
+// LockoutPolicy configures when and for how long sign-ins are blocked after failed attempts
+type LockoutPolicy struct {
+    // AccountThreshold is the amount of failed attempts after which an account is locked
+    AccountThreshold int
+    // IPThreshold is the amount of failed attempts after which a client IP is blocked
+    IPThreshold int
+    // BaseLockout is the lock duration when the threshold is reached, it doubles with each further failure
+    BaseLockout time.Duration
+    // MaxLockout caps the lock duration
+    MaxLockout time.Duration
+    // ResetAfter is the period without failures after which counting restarts
+    ResetAfter time.Duration
+}
+
+// DefaultLockoutPolicy locks an account after 5 failures and an IP after 20
+var DefaultLockoutPolicy = LockoutPolicy{
+    AccountThreshold: 5,
+    IPThreshold:      20,
+    BaseLockout:      time.Minute,
+    MaxLockout:       time.Hour,
+    ResetAfter:       time.Hour,
+}
+
+// LockedError is returned when sign-in is blocked, it tells until when
+type LockedError struct {
+    Kind        string
+    LockedUntil time.Time
+}
+
+func (e *LockedError) Error() string {
+    return ErrAccountLocked.Error()
+}
+
+// RetryAfter returns the remaining lock duration
+func (e *LockedError) RetryAfter() time.Duration {
+    return time.Until(e.LockedUntil)
+}
+
+// CheckLoginAllowed returns a *LockedError if the account or the client IP is currently locked
+func CheckLoginAllowed(sess dbr.SessionRunner, email, ip string) error {
+    counters, err := queryFailedLoginCounters(sess, email, ip)
+    if err != nil {
+        return err
+    }
+    now := time.Now()
+    for _, counter := range counters {
+        if !counter.TimeLockedUntil.Valid {
+            continue
+        }
+        if lockedUntil, err := db.ParseTime(counter.TimeLockedUntil.String); err == nil && now.Before(lockedUntil) {
+            return &LockedError{Kind: counter.Kind, LockedUntil: lockedUntil}
+        }
+    }
+    return nil
+}
+
+// RecordFailedLogin increments the counters of the account and the client IP and locks them when the policy
+// threshold is reached. Both counters are updated in one transaction, so a failure cannot be counted for only one.
+func RecordFailedLogin(sess *dbr.Session, policy LockoutPolicy, email, ip string) error {
+    tx, err := sess.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.RollbackUnlessCommitted()
+
+    if err := recordFailure(tx, policy, LockoutKindAccount, email, policy.AccountThreshold); err != nil {
+        return err
+    }
+    if err := recordFailure(tx, policy, LockoutKindIP, ip, policy.IPThreshold); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// ResetFailedLogins clears the counter of the account after a successful sign-in. The IP counter is not reset,
+// otherwise an attacker with one valid account could keep guessing the passwords of others.
+func ResetFailedLogins(sess dbr.SessionRunner, email string) error {
+    return deleteFailedLoginCounter(sess, LockoutKindAccount, email)
+}
+
+// UnlockAccount removes the lock and the failed attempts of the account
+func UnlockAccount(sess dbr.SessionRunner, email string) error {
+    if _, err := QueryUserEntity(sess, email); err == dbr.ErrNotFound {
+        return ErrUserNotFound
+    } else if err != nil {
+        return err
+    }
+    return deleteFailedLoginCounter(sess, LockoutKindAccount, email)
+}
+
+func recordFailure(sess dbr.SessionRunner, policy LockoutPolicy, kind, subject string, threshold int) error {
+    if subject == "" || threshold <= 0 {
+        return nil
+    }
+    now := time.Now()
+    attempts, err := incrementFailedLoginCounter(sess, kind, subject, db.FormatTime(now), db.FormatTime(now.Add(-policy.ResetAfter)))
+    if err != nil {
+        return err
+    }
+    if attempts >= threshold {
+        lockedUntil := now.Add(policy.lockDuration(attempts - threshold))
+        log.WithFields(log.Fields{"kind": kind, "subject": subject, "failedAttempts": attempts, "lockedUntil": db.FormatTime(lockedUntil)}).Warn("locking sign-in")
+        return updateFailedLoginLock(sess, kind, subject, db.FormatTime(lockedUntil))
+    }
+    return nil
+}
+
+// lockDuration returns BaseLockout * 2^failuresAboveThreshold, capped at MaxLockout
+func (p LockoutPolicy) lockDuration(failuresAboveThreshold int) time.Duration {
+    multiplier := math.Pow(2, float64(failuresAboveThreshold))
+    if duration := float64(p.BaseLockout) * multiplier; duration < float64(p.MaxLockout) {
+        return time.Duration(duration)
+    }
+    return p.MaxLockout
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+var testLockoutPolicy = LockoutPolicy{AccountThreshold: 3, IPThreshold: 10, BaseLockout: time.Minute, MaxLockout: time.Hour, ResetAfter: time.Hour}
+
+func failedLoginCounterRows() *sqlmock.Rows {
+    return sqlmock.NewRows([]string{"kind", "subject", "failed_attempts", "time_last_failure", "time_locked_until"})
+}
+
+func failedAttemptsRows(attempts int) *sqlmock.Rows {
+    return sqlmock.NewRows([]string{"failed_attempts"}).AddRow(attempts)
+}
+
+func TestLockoutPolicy_LockDurationDoublesUntilMax(t *testing.T) {
+    policy := LockoutPolicy{BaseLockout: time.Minute, MaxLockout: 10 * time.Minute}
+
+    assert.Equal(t, time.Minute, policy.lockDuration(0))
+    assert.Equal(t, 2*time.Minute, policy.lockDuration(1))
+    assert.Equal(t, 8*time.Minute, policy.lockDuration(3))
+    assert.Equal(t, 10*time.Minute, policy.lockDuration(4))
+    assert.Equal(t, 10*time.Minute, policy.lockDuration(100))
+}
+
+func TestCheckLoginAllowed(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM failed_login_counter WHERE \(\(kind = 'account' AND subject = 'bar@garsson.io'\) OR \(kind = 'ip' AND subject = '192.0.2.1'\)\)`).
+        WillReturnRows(failedLoginCounterRows().
+            AddRow("account", "bar@garsson.io", 2, db.Now(), nil).
+            AddRow("ip", "192.0.2.1", 12, db.Now(), db.FormatTime(time.Now().Add(-time.Minute))))
+
+    assert.NoError(t, CheckLoginAllowed(dao.NewSession(), "bar@garsson.io", "192.0.2.1"), "failures below the threshold and expired locks do not block")
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCheckLoginAllowed_Locked(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    lockedUntil := time.Now().Add(time.Minute).Truncate(time.Second)
+    mock.ExpectQuery(`SELECT \* FROM failed_login_counter`).
+        WillReturnRows(failedLoginCounterRows().AddRow("ip", "192.0.2.1", 10, db.Now(), db.FormatTime(lockedUntil)))
+
+    err := CheckLoginAllowed(dao.NewSession(), "bar@garsson.io", "192.0.2.1")
+    if lockedErr, ok := err.(*LockedError); assert.True(t, ok, "expected a *LockedError, got %v", err) {
+        assert.Equal(t, LockoutKindIP, lockedErr.Kind)
+        assert.True(t, lockedUntil.Equal(lockedErr.LockedUntil))
+        assert.Equal(t, ErrAccountLocked.Error(), lockedErr.Error())
+    }
+}
+
+func TestRecordFailedLogin_CountsAccountAndIPInOneTransaction(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`INSERT INTO failed_login_counter .* VALUES \('account', 'bar@garsson.io', 1, `).WillReturnRows(failedAttemptsRows(1))
+    mock.ExpectQuery(`INSERT INTO failed_login_counter .* VALUES \('ip', '192.0.2.1', 1, `).WillReturnRows(failedAttemptsRows(1))
+    mock.ExpectCommit()
+
+    assert.NoError(t, RecordFailedLogin(dao.NewSession(), testLockoutPolicy, "bar@garsson.io", "192.0.2.1"))
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRecordFailedLogin_LocksAtThreshold(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`INSERT INTO failed_login_counter .* VALUES \('account'`).WillReturnRows(failedAttemptsRows(3))
+    mock.ExpectExec(`UPDATE "failed_login_counter" SET "time_locked_until" = .* WHERE \(kind = 'account' AND subject = 'bar@garsson.io'\)`).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery(`INSERT INTO failed_login_counter .* VALUES \('ip'`).WillReturnRows(failedAttemptsRows(11))
+    mock.ExpectExec(`UPDATE "failed_login_counter" SET "time_locked_until" = .* WHERE \(kind = 'ip' AND subject = '192.0.2.1'\)`).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    assert.NoError(t, RecordFailedLogin(dao.NewSession(), testLockoutPolicy, "bar@garsson.io", "192.0.2.1"))
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRecordFailedLogin_RollsBackWhenACounterFails(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`INSERT INTO failed_login_counter .* VALUES \('account'`).WillReturnRows(failedAttemptsRows(1))
+    mock.ExpectQuery(`INSERT INTO failed_login_counter .* VALUES \('ip'`).WillReturnError(errors.New("connection reset"))
+    mock.ExpectRollback()
+
+    assert.EqualError(t, RecordFailedLogin(dao.NewSession(), testLockoutPolicy, "bar@garsson.io", "192.0.2.1"), "connection reset")
+    assert.NoError(t, mock.ExpectationsWereMet(), "the account failure is not counted without the ip failure")
+}
+
+func TestRecordFailedLogin_SkipsUnknownSubjects(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`INSERT INTO failed_login_counter .* VALUES \('ip'`).WillReturnRows(failedAttemptsRows(1))
+    mock.ExpectCommit()
+
+    assert.NoError(t, RecordFailedLogin(dao.NewSession(), testLockoutPolicy, "", "192.0.2.1"))
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
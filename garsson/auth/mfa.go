@@ -0,0 +1,471 @@
+package auth
+
+import (
+    "crypto/rand"
+    "encoding/base32"
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/dgrijalva/jwt-go"
+    "github.com/gocraft/dbr"
+    "github.com/satori/go.uuid"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+// Users can protect their account with a TOTP authenticator as second factor, administrators can require it for
+// roles. Signing in with a password or via the identity provider then yields a short-lived mfa token instead of
+// access and refresh tokens, the mfa token is exchanged for them together with a code of the authenticator or one
+// of the single-use recovery codes. A user holding a role that requires a second factor without having one sets up
+// the authenticator with the mfa token and an enrollment code issued by an administrator before it can complete the
+// sign-in, otherwise anyone knowing the password could set up an authenticator of its own.
+
+var (
+    // ErrInvalidMFACode indicates that the authenticator or recovery code is wrong or has been used before
+    ErrInvalidMFACode = errors.New("invalid authentication code")
+    // ErrInvalidMFAToken indicates that the mfa token is invalid, expired or already used
+    ErrInvalidMFAToken = errors.New("invalid or expired mfa token")
+    // ErrMFAAlreadyEnabled indicates that the user already confirmed an authenticator
+    ErrMFAAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+    // ErrMFANotEnabled indicates that the user has not set up an authenticator
+    ErrMFANotEnabled = errors.New("two-factor authentication is not set up")
+    // ErrMFARequiredByRole indicates that two-factor authentication cannot be disabled because a role requires it
+    ErrMFARequiredByRole = errors.New("two-factor authentication is required by a role of the user")
+    // ErrInvalidMFAEnrollment indicates that the enrollment code is unknown, expired, already used or of another user
+    ErrInvalidMFAEnrollment = errors.New("invalid or expired enrollment code, ask an administrator for a new one")
+)
+
+const (
+    // LoginMethodMFA identifies the second step of a sign-in, with an authenticator or recovery code
+    LoginMethodMFA = "mfa"
+    // MFATokenValidity is the time in which the second step of a sign-in must be completed
+    MFATokenValidity = time.Minute * 5
+    // RecoveryCodeCount is the amount of recovery codes issued at once
+    RecoveryCodeCount = 10
+    // AccountTokenMFAEnrollment is the purpose of the account tokens that allow setting up an authenticator while
+    // signing in
+    AccountTokenMFAEnrollment = "mfa-enroll"
+    // MFAEnrollmentValidity is the time in which an enrollment code issued by an administrator can be used
+    MFAEnrollmentValidity = time.Hour * 24
+    // mfaTokenAudience distinguishes mfa tokens from access tokens
+    mfaTokenAudience = "garsson-api-mfa"
+    // recoveryCodeBytes is the amount of random bytes in a recovery code, 8 characters in base32
+    recoveryCodeBytes = 5
+)
+
+// MFARequiredError is returned when the password of the user is correct but a second factor is required to complete
+// the sign-in
+type MFARequiredError struct {
+    // MFAToken identifies the user in the second step of the sign-in
+    MFAToken string
+    // EnrollmentRequired is true if a role requires a second factor that the user has not set up yet
+    EnrollmentRequired bool
+}
+
+func (e *MFARequiredError) Error() string {
+    return "second factor required"
+}
+
+// MFAStatus describes the second factor of a user
+type MFAStatus struct {
+    Enabled                bool `json:"enabled"`
+    Required               bool `json:"required"`
+    RecoveryCodesRemaining int  `json:"recoveryCodesRemaining"`
+}
+
+// TOTPEnrollment contains what the user needs to add Garsson to an authenticator app
+type TOTPEnrollment struct {
+    Secret string `json:"secret"`
+    // ProvisioningURI is the otpauth URI which the frontend shows as QR code
+    ProvisioningURI string `json:"provisioningUri"`
+}
+
+// GetMFAStatus returns whether the user enabled a second factor and whether one of its roles requires it
+func GetMFAStatus(sess dbr.SessionRunner, email string) (MFAStatus, error) {
+    user, err := QueryUserEntity(sess, email)
+    if err == dbr.ErrNotFound {
+        return MFAStatus{}, ErrUserNotFound
+    } else if err != nil {
+        return MFAStatus{}, err
+    }
+    var status MFAStatus
+    if status.Enabled, err = isMFAEnabled(sess, user.Email); err != nil {
+        return MFAStatus{}, err
+    }
+    if status.Required, err = rolesRequireMFA(sess, user.Roles); err != nil {
+        return MFAStatus{}, err
+    }
+    if status.RecoveryCodesRemaining, err = countUnusedRecoveryCodes(sess, user.Email); err != nil {
+        return MFAStatus{}, err
+    }
+    return status, nil
+}
+
+// EnrollTOTP generates a new authenticator secret for the user, which is enabled after ConfirmTOTP. Enrolling again
+// before confirming replaces the secret.
+func EnrollTOTP(sess *dbr.Session, email string) (TOTPEnrollment, error) {
+    tx, err := sess.Begin()
+    if err != nil {
+        return TOTPEnrollment{}, err
+    }
+    defer tx.RollbackUnlessCommitted()
+    enrollment, err := enrollTOTP(tx, email)
+    if err != nil {
+        return TOTPEnrollment{}, err
+    }
+    if err := tx.Commit(); err != nil {
+        return TOTPEnrollment{}, err
+    }
+    return enrollment, nil
+}
+
+// ConfirmTOTP enables the enrolled authenticator if the code is valid and returns new recovery codes, which are only
+// available now
+func ConfirmTOTP(sess *dbr.Session, email, code string) ([]string, error) {
+    totp, err := queryUserTotp(sess, email)
+    if err == dbr.ErrNotFound {
+        return nil, ErrMFANotEnabled
+    } else if err != nil {
+        return nil, err
+    } else if totp.TimeConfirmed.Valid {
+        return nil, ErrMFAAlreadyEnabled
+    }
+    step, matches := matchTOTPCode(totp.Secret, code, time.Now())
+    if !matches {
+        return nil, ErrInvalidMFACode
+    }
+
+    tx, err := sess.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.RollbackUnlessCommitted()
+    // the conditions make sure that a concurrent enrollment or confirmation is not overwritten
+    if confirmed, err := confirmUserTotp(tx, email, step); err != nil {
+        return nil, err
+    } else if confirmed == 0 {
+        return nil, ErrInvalidMFACode
+    }
+    recoveryCodes, err := replaceRecoveryCodes(tx, email)
+    if err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    log.WithField("email", email).Info("two-factor authentication enabled")
+    return recoveryCodes, nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user after verifying a code of its second factor
+func RegenerateRecoveryCodes(sess *dbr.Session, email, code string) ([]string, error) {
+    if err := verifySecondFactor(sess, email, code); err != nil {
+        return nil, err
+    }
+    tx, err := sess.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.RollbackUnlessCommitted()
+    recoveryCodes, err := replaceRecoveryCodes(tx, email)
+    if err != nil {
+        return nil, err
+    }
+    return recoveryCodes, tx.Commit()
+}
+
+// DisableMFA removes the second factor of the user after verifying one of its codes, which is refused when a role
+// of the user requires a second factor
+func DisableMFA(sess *dbr.Session, email, code string) error {
+    if status, err := GetMFAStatus(sess, email); err != nil {
+        return err
+    } else if status.Required {
+        return ErrMFARequiredByRole
+    }
+    if err := verifySecondFactor(sess, email, code); err != nil {
+        return err
+    }
+    return ResetMFA(sess, email)
+}
+
+// ResetMFA removes the second factor of the user without verification, for administrators helping users that lost
+// their authenticator and recovery codes
+func ResetMFA(sess *dbr.Session, email string) error {
+    tx, err := sess.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.RollbackUnlessCommitted()
+    if affected, err := deleteUserTotp(tx, email); err != nil {
+        return err
+    } else if affected == 0 {
+        return ErrMFANotEnabled
+    }
+    if err := deleteRecoveryCodes(tx, email); err != nil {
+        return err
+    }
+    if err := tx.Commit(); err != nil {
+        return err
+    }
+    log.WithField("email", email).Info("two-factor authentication removed")
+    return nil
+}
+
+// ValidateMFAToken checks the signature and expiry of the mfa token and whether it has already been used
+func ValidateMFAToken(rawMFAToken string, keys *KeySet, revocations RevocationChecker) (*JwtClaims, error) {
+    parsedJwt, err := jwt.ParseWithClaims(strings.TrimSpace(rawMFAToken), &JwtClaims{}, keys.verificationKey)
+    if err != nil {
+        return nil, ErrInvalidMFAToken
+    }
+    claims, ok := parsedJwt.Claims.(*JwtClaims)
+    if !ok || claims.Audience != mfaTokenAudience || claims.Subject == "" || revocations.IsRevoked(claims.Id) {
+        return nil, ErrInvalidMFAToken
+    }
+    return claims, nil
+}
+
+// IssueMFAEnrollment returns a single-use code with which the user can set up an authenticator while signing in,
+// for users that hold a role requiring a second factor before they set one up
+func IssueMFAEnrollment(sess dbr.SessionRunner, email string) (string, error) {
+    if _, err := QueryUserEntity(sess, email); err == dbr.ErrNotFound {
+        return "", ErrUserNotFound
+    } else if err != nil {
+        return "", err
+    }
+    if enabled, err := isMFAEnabled(sess, email); err != nil {
+        return "", err
+    } else if enabled {
+        return "", ErrMFAAlreadyEnabled
+    }
+    return issueAccountToken(sess, AccountTokenMFAEnrollment, email, MFAEnrollmentValidity)
+}
+
+// EnrollTOTPDuringSignIn enrolls an authenticator for a user that must set up a second factor before it can sign in.
+// The enrollment code must have been issued to the user by IssueMFAEnrollment, it cannot be used again.
+func EnrollTOTPDuringSignIn(sess *dbr.Session, mfaClaims *JwtClaims, enrollmentCode string) (TOTPEnrollment, error) {
+    if user, err := QueryUserEntity(sess, mfaClaims.Subject); err == dbr.ErrNotFound {
+        return TOTPEnrollment{}, ErrInvalidMFAToken
+    } else if err != nil {
+        return TOTPEnrollment{}, err
+    } else if user.Disabled {
+        return TOTPEnrollment{}, ErrUserDisabled
+    }
+
+    tx, err := sess.Begin()
+    if err != nil {
+        return TOTPEnrollment{}, err
+    }
+    defer tx.RollbackUnlessCommitted()
+    if err := consumeMFAEnrollment(tx, mfaClaims.Subject, enrollmentCode); err != nil {
+        return TOTPEnrollment{}, err
+    }
+    enrollment, err := enrollTOTP(tx, mfaClaims.Subject)
+    if err != nil {
+        return TOTPEnrollment{}, err
+    }
+    if err := tx.Commit(); err != nil {
+        return TOTPEnrollment{}, err
+    }
+    return enrollment, nil
+}
+
+// CompleteMFASignIn verifies the code of the second factor and issues the tokens of the user. If the user enrolled an
+// authenticator during this sign-in, the code confirms it and the new recovery codes are returned as well. The mfa
+// token cannot be used again.
+func CompleteMFASignIn(sess *dbr.Session, revocations *RevocationList, mfaClaims *JwtClaims, code string, keys *KeySet) (Tokens, UserEntity, []string, error) {
+    user, err := QueryUserEntity(sess, mfaClaims.Subject)
+    if err == dbr.ErrNotFound {
+        return Tokens{}, UserEntity{}, nil, ErrInvalidMFAToken
+    } else if err != nil {
+        return Tokens{}, UserEntity{}, nil, err
+    } else if user.Disabled {
+        return Tokens{}, UserEntity{}, nil, ErrUserDisabled
+    }
+
+    var recoveryCodes []string
+    if totp, err := queryUserTotp(sess, user.Email); err == nil && !totp.TimeConfirmed.Valid {
+        recoveryCodes, err = ConfirmTOTP(sess, user.Email, code)
+        if err != nil {
+            return Tokens{}, UserEntity{}, nil, err
+        }
+    } else if err := verifySecondFactor(sess, user.Email, code); err != nil {
+        return Tokens{}, UserEntity{}, nil, err
+    }
+    if err := revocations.Revoke(sess, mfaClaims.Id, user.Email, time.Unix(mfaClaims.ExpiresAt, 0)); err != nil {
+        return Tokens{}, UserEntity{}, nil, err
+    }
+
+    tokens, err := issueTokens(sess, user, newTokenFamilyID(), keys)
+    if err != nil {
+        return Tokens{}, UserEntity{}, nil, err
+    }
+    if err := UpdateLastSignInToNow(sess, user.Email); err != nil {
+        log.WithField("email", user.Email).WithError(err).Warn("could not update last sign-in")
+    }
+    user.PasswordHash = "" // no need to expose!
+    return tokens, user, recoveryCodes, nil
+}
+
+// requireSecondFactor returns an *MFARequiredError if the user enabled a second factor or holds a role that
+// requires one, nil if the password suffices
+func requireSecondFactor(sess dbr.SessionRunner, user UserEntity, keys *KeySet) error {
+    enabled, err := isMFAEnabled(sess, user.Email)
+    if err != nil {
+        return err
+    }
+    required := false
+    if !enabled {
+        if required, err = rolesRequireMFA(sess, user.Roles); err != nil {
+            return err
+        }
+    }
+    if !enabled && !required {
+        return nil
+    }
+    mfaToken, err := issueMFAToken(user.Email, keys)
+    if err != nil {
+        return err
+    }
+    return &MFARequiredError{MFAToken: mfaToken, EnrollmentRequired: !enabled}
+}
+
+// needsSecondFactor returns true if the user enabled a second factor or holds a role that requires one
+func needsSecondFactor(sess dbr.SessionRunner, user UserEntity) (bool, error) {
+    if enabled, err := isMFAEnabled(sess, user.Email); err != nil || enabled {
+        return enabled, err
+    }
+    return rolesRequireMFA(sess, user.Roles)
+}
+
+// verifySecondFactor accepts a code of the authenticator, or one of the recovery codes of the user. Each code is
+// accepted once.
+func verifySecondFactor(sess dbr.SessionRunner, email, code string) error {
+    totp, err := queryUserTotp(sess, email)
+    if err == dbr.ErrNotFound || (err == nil && !totp.TimeConfirmed.Valid) {
+        return ErrMFANotEnabled
+    } else if err != nil {
+        return err
+    }
+    if step, matches := matchTOTPCode(totp.Secret, code, time.Now()); matches {
+        // the condition on the step makes sure that an observed code cannot be replayed
+        if updated, err := updateTotpLastUsedStep(sess, email, step); err != nil {
+            return err
+        } else if updated == 0 {
+            return ErrInvalidMFACode
+        }
+        return nil
+    }
+    if used, err := markRecoveryCodeUsed(sess, email, hashOpaqueToken(normalizeRecoveryCode(code))); err != nil {
+        return err
+    } else if used == 0 {
+        return ErrInvalidMFACode
+    }
+    log.WithField("email", email).Warn("recovery code used")
+    return nil
+}
+
+// enrollTOTP replaces an unconfirmed authenticator of the user by a new one
+func enrollTOTP(tx *dbr.Tx, email string) (TOTPEnrollment, error) {
+    secret, err := generateTOTPSecret()
+    if err != nil {
+        return TOTPEnrollment{}, err
+    }
+    if existing, err := queryUserTotp(tx, email); err == nil && existing.TimeConfirmed.Valid {
+        return TOTPEnrollment{}, ErrMFAAlreadyEnabled
+    } else if err != nil && err != dbr.ErrNotFound {
+        return TOTPEnrollment{}, err
+    }
+    if _, err := deleteUserTotp(tx, email); err != nil {
+        return TOTPEnrollment{}, err
+    }
+    if err := insertUserTotp(tx, userTotpEntity{Email: email, Secret: secret, TimeCreated: db.Now()}); db.IsForeignKeyViolation(err) {
+        return TOTPEnrollment{}, ErrUserNotFound
+    } else if err != nil {
+        return TOTPEnrollment{}, err
+    }
+    return TOTPEnrollment{Secret: secret, ProvisioningURI: totpProvisioningURI(secret, email)}, nil
+}
+
+// consumeMFAEnrollment marks the enrollment code of the user as used
+func consumeMFAEnrollment(tx *dbr.Tx, email, enrollmentCode string) error {
+    stored, err := queryAccountToken(tx, hashOpaqueToken(strings.TrimSpace(enrollmentCode)))
+    if err == dbr.ErrNotFound {
+        return ErrInvalidMFAEnrollment
+    } else if err != nil {
+        return err
+    } else if stored.Purpose != AccountTokenMFAEnrollment || stored.Email != email || stored.TimeUsed.Valid {
+        return ErrInvalidMFAEnrollment
+    } else if expires, err := db.ParseTime(stored.TimeExpires); err != nil || time.Now().After(expires) {
+        return ErrInvalidMFAEnrollment
+    }
+    if marked, err := markAccountTokenUsed(tx, stored.TokenHash); err != nil {
+        return err
+    } else if marked == 0 {
+        return ErrInvalidMFAEnrollment
+    }
+    return nil
+}
+
+func isMFAEnabled(sess dbr.SessionRunner, email string) (bool, error) {
+    totp, err := queryUserTotp(sess, email)
+    if err == dbr.ErrNotFound {
+        return false, nil
+    } else if err != nil {
+        return false, err
+    }
+    return totp.TimeConfirmed.Valid, nil
+}
+
+// issueMFAToken creates a token that identifies the user in the second step of the sign-in, it does not grant
+// access to anything else
+func issueMFAToken(email string, keys *KeySet) (string, error) {
+    now := time.Now()
+    return keys.Sign(JwtClaims{
+        StandardClaims: jwt.StandardClaims{
+            Id:        uuid.NewV4().String(),
+            Issuer:    "garsson-api",
+            IssuedAt:  now.Unix(),
+            ExpiresAt: now.Add(MFATokenValidity).Unix(),
+            Audience:  mfaTokenAudience,
+            Subject:   email,
+        },
+    })
+}
+
+// replaceRecoveryCodes invalidates the existing recovery codes of the user and returns new ones
+func replaceRecoveryCodes(sess dbr.SessionRunner, email string) ([]string, error) {
+    recoveryCodes := make([]string, 0, RecoveryCodeCount)
+    codeHashes := make([]string, 0, RecoveryCodeCount)
+    for i := 0; i < RecoveryCodeCount; i++ {
+        recoveryCode, err := generateRecoveryCode()
+        if err != nil {
+            return nil, err
+        }
+        recoveryCodes = append(recoveryCodes, recoveryCode)
+        codeHashes = append(codeHashes, hashOpaqueToken(normalizeRecoveryCode(recoveryCode)))
+    }
+    if err := deleteRecoveryCodes(sess, email); err != nil {
+        return nil, err
+    }
+    if err := insertRecoveryCodes(sess, email, codeHashes); err != nil {
+        return nil, err
+    }
+    return recoveryCodes, nil
+}
+
+// generateRecoveryCode returns a random code formatted as xxxx-xxxx for readability
+func generateRecoveryCode() (string, error) {
+    randomBytes := make([]byte, recoveryCodeBytes)
+    if _, err := rand.Read(randomBytes); err != nil {
+        return "", err
+    }
+    encoded := strings.ToLower(base32.StdEncoding.EncodeToString(randomBytes))
+    return fmt.Sprintf("%v-%v", encoded[:4], encoded[4:]), nil
+}
+
+// normalizeRecoveryCode ignores case, dashes and spaces so that users can type codes as they like
+func normalizeRecoveryCode(code string) string {
+    return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+}
@@ -0,0 +1,303 @@
+package auth
+
+import (
+    "regexp"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// totpRows returns the authenticator of a user with the secret of RFC 6238
+func totpRows(email string, confirmed bool) *sqlmock.Rows {
+    var timeConfirmed interface{}
+    if confirmed {
+        timeConfirmed = db.Now()
+    }
+    return sqlmock.NewRows([]string{"email", "secret", "time_created", "time_confirmed", "last_used_step"}).
+        AddRow(email, rfc6238Secret, db.Now(), timeConfirmed, 0)
+}
+
+// expectRolesRequireMFA expects the queries that determine whether the role requires a second factor
+func expectRolesRequireMFA(mock sqlmock.Sqlmock, role string, required bool) {
+    mock.ExpectQuery(`SELECT \* FROM role ORDER BY name`).
+        WillReturnRows(sqlmock.NewRows([]string{"name", "description", "mfa_required"}).AddRow(role, nil, required))
+    mock.ExpectQuery(`SELECT \* FROM role_inheritance`).WillReturnRows(sqlmock.NewRows([]string{"role_name", "inherited_role_name"}))
+    mock.ExpectQuery(`SELECT \* FROM role_permission`).WillReturnRows(sqlmock.NewRows([]string{"role_name", "permission_name"}))
+}
+
+// expectIssueTokens expects the queries that issue the tokens and record the sign-in
+func expectIssueTokens(mock sqlmock.Sqlmock) {
+    mock.ExpectExec(`INSERT INTO "refresh_token"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "user_session"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "user_account" SET "last_sign_in"`).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func currentTOTPCode(t *testing.T) string {
+    code, err := totpCode(rfc6238Secret, totpStep(time.Now()))
+    assert.NoError(t, err)
+    return code
+}
+
+func mfaClaims(t *testing.T, keys *KeySet, email string) *JwtClaims {
+    mfaToken, err := issueMFAToken(email, keys)
+    assert.NoError(t, err)
+    claims, err := ValidateMFAToken(mfaToken, keys, noRevocations{})
+    assert.NoError(t, err)
+    return claims
+}
+
+func TestMFAToken_IsNotAnAccessToken(t *testing.T) {
+    key, err := GenerateEd25519Key("ed-1")
+    assert.NoError(t, err)
+    keys := NewKeySet()
+    assert.NoError(t, keys.Add(key))
+
+    mfaToken, err := issueMFAToken("admin@garsson.nl", keys)
+    assert.NoError(t, err)
+    claims, err := ValidateMFAToken(mfaToken, keys, noRevocations{})
+    assert.NoError(t, err)
+    assert.Equal(t, "admin@garsson.nl", claims.Subject)
+
+    _, err = ValidateJWT(mfaToken, keys, noRevocations{})
+    assert.Error(t, err)
+}
+
+func TestValidateMFAToken_RejectsAccessToken(t *testing.T) {
+    key, err := GenerateEd25519Key("ed-1")
+    assert.NoError(t, err)
+    keys := NewKeySet()
+    assert.NoError(t, keys.Add(key))
+
+    accessToken, _, err := createToken(UserEntity{Email: "admin@garsson.nl", Roles: []string{"admin"}}, "session-1", keys)
+    assert.NoError(t, err)
+    _, err = ValidateMFAToken(accessToken, keys, noRevocations{})
+    assert.Equal(t, ErrInvalidMFAToken, err)
+}
+
+func TestGenerateRecoveryCode(t *testing.T) {
+    code, err := generateRecoveryCode()
+    assert.NoError(t, err)
+    assert.Regexp(t, regexp.MustCompile("^[a-z2-7]{4}-[a-z2-7]{4}$"), code)
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+    assert.Equal(t, "abcd2345", normalizeRecoveryCode(" ABCD-2345 "))
+    assert.Equal(t, "abcd2345", normalizeRecoveryCode("abcd 2345"))
+}
+
+func TestCompleteMFASignIn(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    keys := signingKeys(t)
+    claims := mfaClaims(t, keys, "admin@garsson.nl")
+    revocations := NewRevocationList(nil, time.Hour)
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("admin@garsson.nl", "", false))
+    expectUserAccess(mock, "admin")
+    mock.ExpectQuery(`SELECT \* FROM user_totp WHERE \(email = 'admin@garsson.nl'\)`).WillReturnRows(totpRows("admin@garsson.nl", true))
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(totpRows("admin@garsson.nl", true))
+    mock.ExpectExec(`UPDATE "user_totp" SET "last_used_step" = [0-9]+ WHERE \(email = 'admin@garsson.nl' AND last_used_step < [0-9]+\)`).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`INSERT INTO "revoked_token" .*'` + claims.Id + `'`).WillReturnResult(sqlmock.NewResult(0, 1))
+    expectIssueTokens(mock)
+
+    tokens, user, recoveryCodes, err := CompleteMFASignIn(dao.NewSession(), revocations, claims, currentTOTPCode(t), keys)
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.Equal(t, "admin@garsson.nl", user.Email)
+    assert.NotEmpty(t, tokens.AccessToken)
+    assert.Empty(t, recoveryCodes)
+    assert.True(t, revocations.revoked[claims.Id], "the mfa token cannot be used again")
+}
+
+func TestCompleteMFASignIn_ReplayedCode(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    keys := signingKeys(t)
+    claims := mfaClaims(t, keys, "admin@garsson.nl")
+    revocations := NewRevocationList(nil, time.Hour)
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("admin@garsson.nl", "", false))
+    expectUserAccess(mock, "admin")
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(totpRows("admin@garsson.nl", true))
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(totpRows("admin@garsson.nl", true))
+    // the code of this step was accepted before
+    mock.ExpectExec(`UPDATE "user_totp" SET "last_used_step"`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+    _, _, _, err := CompleteMFASignIn(dao.NewSession(), revocations, claims, currentTOTPCode(t), keys)
+    assert.Equal(t, ErrInvalidMFACode, err)
+    assert.NoError(t, mock.ExpectationsWereMet(), "no tokens are issued")
+    assert.False(t, revocations.revoked[claims.Id], "the user can retry with the next code")
+}
+
+func TestCompleteMFASignIn_ConfirmsEnrollment(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    keys := signingKeys(t)
+    claims := mfaClaims(t, keys, "admin@garsson.nl")
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("admin@garsson.nl", "", false))
+    expectUserAccess(mock, "admin")
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(totpRows("admin@garsson.nl", false))
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(totpRows("admin@garsson.nl", false))
+    mock.ExpectBegin()
+    mock.ExpectExec(`UPDATE "user_totp" SET .* WHERE \(email = 'admin@garsson.nl' AND time_confirmed IS NULL AND last_used_step < [0-9]+\)`).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`DELETE FROM "recovery_code"`).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectExec(`INSERT INTO "recovery_code"`).WillReturnResult(sqlmock.NewResult(0, RecoveryCodeCount))
+    mock.ExpectCommit()
+    mock.ExpectExec(`INSERT INTO "revoked_token"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    expectIssueTokens(mock)
+
+    _, _, recoveryCodes, err := CompleteMFASignIn(dao.NewSession(), NewRevocationList(nil, time.Hour), claims, currentTOTPCode(t), keys)
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.Len(t, recoveryCodes, RecoveryCodeCount)
+}
+
+func TestCompleteMFASignIn_DisabledUser(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    keys := signingKeys(t)
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("admin@garsson.nl", "", true))
+    expectUserAccess(mock, "admin")
+
+    _, _, _, err := CompleteMFASignIn(dao.NewSession(), NewRevocationList(nil, time.Hour), mfaClaims(t, keys, "admin@garsson.nl"), currentTOTPCode(t), keys)
+    assert.Equal(t, ErrUserDisabled, err)
+    assert.NoError(t, mock.ExpectationsWereMet(), "the code is not verified")
+}
+
+func TestVerifySecondFactor_RecoveryCode(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(totpRows("admin@garsson.nl", true))
+    mock.ExpectExec(`UPDATE "recovery_code" SET "time_used" = .* WHERE \(code_hash = '` + hashOpaqueToken("abcd2345") + `' AND email = 'admin@garsson.nl' AND time_used IS NULL\)`).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(totpRows("admin@garsson.nl", true))
+    mock.ExpectExec(`UPDATE "recovery_code" SET "time_used"`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+    assert.NoError(t, verifySecondFactor(dao.NewSession(), "admin@garsson.nl", "ABCD-2345"))
+    assert.Equal(t, ErrInvalidMFACode, verifySecondFactor(dao.NewSession(), "admin@garsson.nl", "abcd-2345"), "a recovery code is accepted once")
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestVerifySecondFactor_NotEnabled(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(totpRows("admin@garsson.nl", false))
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(dbtest.EmptyRows())
+
+    assert.Equal(t, ErrMFANotEnabled, verifySecondFactor(dao.NewSession(), "admin@garsson.nl", currentTOTPCode(t)), "an unconfirmed authenticator is no second factor")
+    assert.Equal(t, ErrMFANotEnabled, verifySecondFactor(dao.NewSession(), "admin@garsson.nl", currentTOTPCode(t)))
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// expectMFAStatus expects the queries of GetMFAStatus for a user with a confirmed authenticator
+func expectMFAStatus(mock sqlmock.Sqlmock, required bool) {
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("admin@garsson.nl", "", false))
+    expectUserAccess(mock, "admin")
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(totpRows("admin@garsson.nl", true))
+    expectRolesRequireMFA(mock, "admin", required)
+    mock.ExpectQuery(`SELECT COUNT\(\*\) FROM recovery_code`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(8))
+}
+
+func TestDisableMFA(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    expectMFAStatus(mock, false)
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(totpRows("admin@garsson.nl", true))
+    mock.ExpectExec(`UPDATE "user_totp" SET "last_used_step"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectBegin()
+    mock.ExpectExec(`DELETE FROM "user_totp" WHERE \(email = 'admin@garsson.nl'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`DELETE FROM "recovery_code" WHERE \(email = 'admin@garsson.nl'\)`).WillReturnResult(sqlmock.NewResult(0, 8))
+    mock.ExpectCommit()
+
+    assert.NoError(t, DisableMFA(dao.NewSession(), "admin@garsson.nl", currentTOTPCode(t)))
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDisableMFA_RequiredByRole(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    expectMFAStatus(mock, true)
+
+    assert.Equal(t, ErrMFARequiredByRole, DisableMFA(dao.NewSession(), "admin@garsson.nl", currentTOTPCode(t)))
+    assert.NoError(t, mock.ExpectationsWereMet(), "the authenticator is not removed")
+}
+
+func TestDisableMFA_WrongCode(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    expectMFAStatus(mock, false)
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(totpRows("admin@garsson.nl", true))
+    mock.ExpectExec(`UPDATE "recovery_code" SET "time_used"`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+    assert.Equal(t, ErrInvalidMFACode, DisableMFA(dao.NewSession(), "admin@garsson.nl", "guess-1234"))
+    assert.NoError(t, mock.ExpectationsWereMet(), "the authenticator is not removed")
+}
+
+// mfaEnrollmentRows returns a stored enrollment code "enroll" of the user
+func mfaEnrollmentRows(email, purpose string, expires time.Time) *sqlmock.Rows {
+    return sqlmock.NewRows([]string{"token_hash", "purpose", "email", "time_issued", "time_expires", "time_used"}).
+        AddRow(hashOpaqueToken("enroll"), purpose, email, db.FormatTime(expires.Add(-MFAEnrollmentValidity)), db.FormatTime(expires), nil)
+}
+
+func TestEnrollTOTPDuringSignIn(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    keys := signingKeys(t)
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("admin@garsson.nl", "", false))
+    expectUserAccess(mock, "admin")
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM account_token WHERE \(token_hash = '` + hashOpaqueToken("enroll") + `'\)`).
+        WillReturnRows(mfaEnrollmentRows("admin@garsson.nl", AccountTokenMFAEnrollment, time.Now().Add(time.Hour)))
+    mock.ExpectExec(`UPDATE "account_token" SET "time_used"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(dbtest.EmptyRows())
+    mock.ExpectExec(`DELETE FROM "user_totp"`).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectExec(`INSERT INTO "user_totp"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    enrollment, err := EnrollTOTPDuringSignIn(dao.NewSession(), mfaClaims(t, keys, "admin@garsson.nl"), " enroll ")
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.NotEmpty(t, enrollment.Secret)
+}
+
+func TestEnrollTOTPDuringSignIn_RequiresEnrollmentOfAdministrator(t *testing.T) {
+    tests := []struct {
+        name string
+        rows *sqlmock.Rows
+    }{
+        {name: "no enrollment", rows: dbtest.EmptyRows()},
+        {name: "enrollment of other user", rows: mfaEnrollmentRows("other@garsson.nl", AccountTokenMFAEnrollment, time.Now().Add(time.Hour))},
+        {name: "expired", rows: mfaEnrollmentRows("admin@garsson.nl", AccountTokenMFAEnrollment, time.Now().Add(-time.Second))},
+        {name: "password reset token", rows: mfaEnrollmentRows("admin@garsson.nl", AccountTokenReset, time.Now().Add(time.Hour))},
+    }
+    keys := signingKeys(t)
+    for _, test := range tests {
+        dao, mock := dbtest.NewDbMock(t)
+        mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("admin@garsson.nl", "", false))
+        expectUserAccess(mock, "admin")
+        mock.ExpectBegin()
+        mock.ExpectQuery(`SELECT \* FROM account_token`).WillReturnRows(test.rows)
+        mock.ExpectRollback()
+
+        _, err := EnrollTOTPDuringSignIn(dao.NewSession(), mfaClaims(t, keys, "admin@garsson.nl"), "enroll")
+        assert.Equal(t, ErrInvalidMFAEnrollment, err, test.name)
+        assert.NoError(t, mock.ExpectationsWereMet(), "%v: no authenticator is enrolled", test.name)
+    }
+}
+
+func TestIssueMFAEnrollment(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("admin@garsson.nl", "", false))
+    expectUserAccess(mock, "admin")
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(dbtest.EmptyRows())
+    mock.ExpectExec(`INSERT INTO "account_token" .* VALUES \('[0-9a-f]{64}','mfa-enroll','admin@garsson.nl'`).WillReturnResult(sqlmock.NewResult(0, 1))
+
+    enrollmentCode, err := IssueMFAEnrollment(dao.NewSession(), "admin@garsson.nl")
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.NotEmpty(t, enrollmentCode)
+}
+
+func TestIssueMFAEnrollment_AlreadyEnabled(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("admin@garsson.nl", "", false))
+    expectUserAccess(mock, "admin")
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(totpRows("admin@garsson.nl", true))
+
+    _, err := IssueMFAEnrollment(dao.NewSession(), "admin@garsson.nl")
+    assert.Equal(t, ErrMFAAlreadyEnabled, err)
+}
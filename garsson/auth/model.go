@@ -1,9 +1,8 @@
 package auth
 
 import (
-    "strings"
-
     "github.com/dgrijalva/jwt-go"
+    "github.com/gocraft/dbr"
     "github.com/kubernetes/kubernetes/pkg/util/slice"
 )
 
@@ -16,24 +15,229 @@ const (
 type UserEntity struct {
     // Email acts as the main user identifier
     Email string `json:"email,omitempty"`
-    // PasswordHash is the sha3 hash, hex encoded
+    // PasswordHash is a self-describing argon2id hash, or a legacy unsalted sha3 hash in hex (see password.go)
     PasswordHash string `json:"passwordHash,omitempty"`
-    // Roles is a csv string with all the roles owned by the user
-    Roles string `json:"roles"`
-    // LastSignIn contains the timestamp of last sign-in.
-    LastSignIn string `json:"lastSignIn,omitempty"`
-}
-
-// GetRoles returns all the roles of the user as an array
-func (u UserEntity) GetRoles() []string {
-    cleanedRoles := make([]string, 0)
-    for _, v := range strings.Split(u.Roles, ",") {
-        trimmedRole := strings.Trim(v, "\t \n")
-        if trimmedRole != "" {
-            cleanedRoles = append(cleanedRoles, trimmedRole)
-        }
+    // LastSignIn contains the timestamp of last sign-in, NULL if the user never signed in.
+    LastSignIn dbr.NullString `json:"lastSignIn,omitempty"`
+    // Disabled users cannot sign in
+    Disabled bool `json:"disabled"`
+    // PinHash is the argon2id hash of the PIN for quick sign-in on registered devices, NULL if no PIN is set
+    PinHash dbr.NullString `json:"-"`
+    // ExternalSubject is the subject of the user at the OpenID Connect identity provider, NULL if never signed in there
+    ExternalSubject dbr.NullString `json:"-"`
+    // Roles granted to the user, stored in the user_role table
+    Roles []string `db:"-" json:"roles"`
+    // Permissions are the effective permissions of the roles, including those of inherited roles
+    Permissions []string `db:"-" json:"permissions,omitempty"`
+}
+
+// roleEntity is a role as stored in the db
+type roleEntity struct {
+    Name        string
+    Description dbr.NullString
+    // MFARequired makes a second factor mandatory for users holding the role
+    MFARequired bool
+}
+
+// rolePermissionEntity grants a permission to a role
+type rolePermissionEntity struct {
+    RoleName       string
+    PermissionName string
+}
+
+// roleInheritanceEntity makes a role include all permissions of the inherited role
+type roleInheritanceEntity struct {
+    RoleName          string
+    InheritedRoleName string
+}
+
+// userRoleEntity grants a role to a user
+type userRoleEntity struct {
+    Email    string
+    RoleName string
+}
+
+// refreshTokenEntity is a refresh token as stored in the db, the token itself is only stored as sha256 hash
+type refreshTokenEntity struct {
+    TokenHash string
+    // FamilyID groups all refresh tokens that descend from the same sign-in
+    FamilyID string
+    Email    string
+    // AccessTokenID is the jti of the access token that was issued together with this refresh token
+    AccessTokenID string
+    TimeIssued    string
+    TimeExpires   string
+    // TimeUsed is set once the token has been exchanged for new tokens
+    TimeUsed dbr.NullString
+    Revoked  bool
+}
+
+// revokedTokenEntity is a revoked access token, kept until the access token would have expired
+type revokedTokenEntity struct {
+    Jti         string
+    Email       string
+    TimeRevoked string
+    TimeExpires string
+}
+
+// deviceEntity is a shared device, such as a tablet, on which waiters can sign in with their PIN
+type deviceEntity struct {
+    ID             string
+    Name           string
+    TokenHash      string
+    RegisteredBy   dbr.NullString
+    TimeRegistered string
+    TimeLastUsed   dbr.NullString
+    Revoked        bool
+}
+
+// Device is the public representation of a registered device
+type Device struct {
+    ID             string `json:"id"`
+    Name           string `json:"name"`
+    RegisteredBy   string `json:"registeredBy,omitempty"`
+    TimeRegistered string `json:"timeRegistered"`
+    TimeLastUsed   string `json:"timeLastUsed,omitempty"`
+    Revoked        bool   `json:"revoked"`
+}
+
+// failedLoginCounterEntity counts the failed sign-ins of an account or client IP
+type failedLoginCounterEntity struct {
+    Kind            string
+    Subject         string
+    FailedAttempts  int
+    TimeLastFailure string
+    TimeLockedUntil dbr.NullString
+}
+
+// loginEventEntity is a sign-in attempt as stored in the db
+type loginEventEntity struct {
+    ID            int64
+    Email         string
+    Method        string
+    Success       bool
+    TimeAttempted string
+    IP            dbr.NullString
+    UserAgent     dbr.NullString
+    DeviceID      dbr.NullString
+    FailureReason dbr.NullString
+}
+
+// accountTokenEntity is an invitation or password reset token, the token itself is only stored as sha256 hash
+type accountTokenEntity struct {
+    TokenHash   string
+    Purpose     string
+    Email       string
+    TimeIssued  string
+    TimeExpires string
+    // TimeUsed is set once the token has been consumed
+    TimeUsed dbr.NullString
+}
+
+// streamTicketEntity is a ticket that opens the order event source, the ticket itself is only stored as sha256 hash
+type streamTicketEntity struct {
+    TokenHash string
+    Email     string
+    // AccessTokenID is the jti of the access token that requested the ticket
+    AccessTokenID string
+    SessionID     dbr.NullString
+    // TimeAccessTokenExpires is when the access token that requested the ticket expires, the stream ends at that time
+    TimeAccessTokenExpires string
+    TimeIssued             string
+    TimeExpires            string
+    // TimeUsed is set once the ticket has opened a stream
+    TimeUsed dbr.NullString
+}
+
+// apiKeyEntity is an api key as stored in the db, the key itself is only stored as sha256 hash
+type apiKeyEntity struct {
+    ID           string
+    Name         string
+    KeyHash      string
+    CreatedBy    dbr.NullString
+    TimeCreated  string
+    TimeLastUsed dbr.NullString
+    Revoked      bool
+}
+
+// apiKeyRoleEntity grants a role to an api key
+type apiKeyRoleEntity struct {
+    APIKeyID string
+    RoleName string
+}
+
+// userSessionEntity is a sign-in of a user, its id is the id of the token family that was started by the sign-in
+type userSessionEntity struct {
+    ID    string
+    Email string
+    // CurrentTokenID is the jti of the most recent access token of the session
+    CurrentTokenID string
+    DeviceID       dbr.NullString
+    IP             dbr.NullString
+    UserAgent      dbr.NullString
+    TimeCreated    string
+    TimeLastSeen   string
+    // TimeExpires is the expiry of the most recent refresh token, the session ends then
+    TimeExpires string
+    Revoked     bool
+}
+
+// userTotpEntity is the TOTP authenticator of a user, it is enabled once the user confirmed it with a valid code
+type userTotpEntity struct {
+    Email         string
+    Secret        string
+    TimeCreated   string
+    TimeConfirmed dbr.NullString
+    // LastUsedStep is the time step of the last accepted code, codes of that step or earlier are rejected
+    LastUsedStep int64
+}
+
+// recoveryCodeEntity is a single-use recovery code, the code itself is only stored as sha256 hash
+type recoveryCodeEntity struct {
+    CodeHash string
+    Email    string
+    TimeUsed dbr.NullString
+}
+
+// User is the public representation of a user account, it never exposes the password hash
+type User struct {
+    Email             string   `json:"email"`
+    Roles             []string `json:"roles"`
+    Disabled          bool     `json:"disabled"`
+    LastSignIn        string   `json:"lastSignIn,omitempty"`
+    // InvitationPending is true until the user has accepted the invitation and chosen a password
+    InvitationPending bool     `json:"invitationPending"`
+}
+
+// Invitation contains the fields required to invite a new user, the user chooses its own password
+type Invitation struct {
+    Email string   `json:"email"`
+    Roles []string `json:"roles"`
+}
+
+// NewUser contains the fields required to create a user account
+type NewUser struct {
+    Email    string   `json:"email"`
+    Password string   `json:"password"`
+    Roles    []string `json:"roles"`
+}
+
+// UserUpdate contains the changes to apply to a user account, nil fields are left unchanged
+type UserUpdate struct {
+    Roles    *[]string `json:"roles"`
+    Disabled *bool     `json:"disabled"`
+    Password *string   `json:"password"`
+}
+
+// ToUser maps the entity to its public representation
+func (u UserEntity) ToUser() User {
+    return User{
+        Email:             u.Email,
+        Roles:             u.Roles,
+        Disabled:          u.Disabled,
+        LastSignIn:        u.LastSignIn.String,
+        InvitationPending: u.PasswordHash == "" && !u.ExternalSubject.Valid,
     }
-    return cleanedRoles
 }
 
 // UserFromJwt holds the fields found in a JWT
@@ -42,23 +246,31 @@ type UserFromJwt struct {
     Email   string
     // Roles that are listed in the jwt
     Roles  []string
-    // Claims contains a reference to the other claims found in the JWT
+    // Permissions that are listed in the jwt
+    Permissions []string
+    // Claims contains a reference to the other claims found in the JWT, nil when authenticated with an api key
     Claims *JwtClaims
+    // APIKeyID is the id of the api key that authenticated the request, empty for users
+    APIKeyID string
 }
 
-// HasRole checks if the user owns a given role. Returns true for every role if the user also has the role admin!
-// also returns the role that granted access (either the role, or admin)
-func (u UserFromJwt) HasRole(role string) (bool, string) {
-    if slice.ContainsString(u.Roles, RoleAdmin, nil) {
-        return true, RoleAdmin
-    } else if slice.ContainsString(u.Roles, role, nil) {
-        return true, role
-    }
-    return false, ""
+// IsAPIKey returns true if the principal is a machine client authenticated with an api key
+func (u UserFromJwt) IsAPIKey() bool {
+    return u.APIKeyID != ""
+}
+
+// HasPermission checks if the permission was granted to the user by one of its roles
+func (u UserFromJwt) HasPermission(permission string) bool {
+    return slice.ContainsString(u.Permissions, permission, nil)
 }
 
-//JwtClaims extends the standard set of claims with roles
+//JwtClaims extends the standard set of claims with roles and the permissions they grant
 type JwtClaims struct {
     jwt.StandardClaims
     Roles []string `json:"roles,omitempty"`
+    Permissions []string `json:"permissions,omitempty"`
+    // Device is the id of the registered device on which the user signed in with a PIN
+    Device string `json:"device,omitempty"`
+    // SessionID identifies the sign-in that issued the token, all tokens of the session can be revoked at once
+    SessionID string `json:"sid,omitempty"`
 }
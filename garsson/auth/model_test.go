@@ -1,17 +1,35 @@
 package auth
 
 import (
+    "testing"
 
-"testing"
+    "github.com/stretchr/testify/assert"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
 
-"github.com/stretchr/testify/assert"
+// userRows returns the row of a user account as selected from the database
+func userRows(email, passwordHash string, disabled bool) *sqlmock.Rows {
+    return sqlmock.NewRows([]string{"email", "password_hash", "disabled"}).AddRow(email, passwordHash, disabled)
+}
 
-)
+// expectUserAccess expects the queries that load the role of a user and the permissions that it grants
+func expectUserAccess(mock sqlmock.Sqlmock, role string, permissions ...string) {
+    roles := sqlmock.NewRows([]string{"role_name"})
+    if role != "" {
+        roles.AddRow(role)
+    }
+    mock.ExpectQuery(`SELECT role_name FROM user_role`).WillReturnRows(roles)
+    mock.ExpectQuery(`SELECT \* FROM role_inheritance`).WillReturnRows(sqlmock.NewRows([]string{"role_name", "inherited_role_name"}))
+    grants := sqlmock.NewRows([]string{"role_name", "permission_name"})
+    for _, permission := range permissions {
+        grants.AddRow(role, permission)
+    }
+    mock.ExpectQuery(`SELECT \* FROM role_permission`).WillReturnRows(grants)
+}
 
-func TestUserEntity_GetRoles(t *testing.T) {
-    configuredRoles := "admin, cs,    dev ,"
-    expectedRoles := []string{"admin", "cs", "dev"}
+func TestUserFromJwt_HasPermission(t *testing.T) {
+    user := UserFromJwt{Roles: []string{RoleAdmin}, Permissions: []string{PermissionOrdersRead}}
 
-    actualRoles := UserEntity{"","", configuredRoles, ""}.GetRoles()
-    assert.EqualValues(t, actualRoles, expectedRoles, "expectedRoles %v configuredRoles, but got %v", expectedRoles, actualRoles)
+    assert.True(t, user.HasPermission(PermissionOrdersRead))
+    assert.False(t, user.HasPermission(PermissionOrdersWrite), "roles must not act as a wildcard")
 }
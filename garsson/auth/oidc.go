@@ -0,0 +1,533 @@
+package auth
+
+import (
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/dgrijalva/jwt-go"
+    "github.com/gocraft/dbr"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+// Staff can sign in with the identity provider (IdP) of their company using the OpenID Connect authorization code
+// flow with PKCE. After the callback the ID token of the IdP is verified against the JWKS of the IdP, the user is
+// provisioned just in time and receives our own access and refresh tokens, just like after a password sign-in.
+// The groups of the user at the IdP are mapped to Garsson roles, the IdP is the source of truth for the roles of
+// users that sign in this way, unless none of their groups is mapped.
+//
+// Users are identified by the subject of the IdP, never by email address alone. An existing local account is only
+// used after it has been linked to a subject, either by an administrator or by the user itself: a signed-in user
+// starts a link via StartOIDCLink and completes the sign-in at the IdP, the callback then links the subject.
+
+var (
+    // ErrInvalidIDToken indicates that the ID token of the identity provider is invalid
+    ErrInvalidIDToken = errors.New("invalid id token")
+    // ErrEmailNotVerified indicates that the identity provider did not verify the email address of the user
+    ErrEmailNotVerified = errors.New("email address not verified by identity provider")
+    // ErrManagedByIdentityProvider indicates that the user signs in via the identity provider and has no password
+    ErrManagedByIdentityProvider = errors.New("user is managed by the identity provider")
+    // ErrAccountNotLinked indicates that an account with the email of the identity exists, but it has not been linked
+    // to the identity provider
+    ErrAccountNotLinked = errors.New("account is not linked to the identity provider, sign in with your password and link it first")
+    // ErrIdentityAlreadyLinked indicates that the subject of the identity provider is linked to another account
+    ErrIdentityAlreadyLinked = errors.New("identity is already linked to another account")
+    // ErrInvalidExternalSubject indicates that the subject to link an account to is empty
+    ErrInvalidExternalSubject = errors.New("subject of the identity provider must not be empty")
+    // ErrInvalidOIDCLink indicates that the link of the account to the identity provider is unknown or expired
+    ErrInvalidOIDCLink = errors.New("link to identity provider expired or invalid, start again")
+)
+
+const (
+    // LoginMethodOIDC identifies sign-ins via an external OpenID Connect identity provider
+    LoginMethodOIDC = "oidc"
+    // DefaultOIDCGroupsClaim is the claim of the ID token that lists the groups of the user
+    DefaultOIDCGroupsClaim = "groups"
+    // AccountTokenOIDCLink is the purpose of the account tokens that bind a link to the user that started it
+    AccountTokenOIDCLink = "oidc-link"
+    // OIDCLinkValidity is the time in which the user must complete the sign-in at the IdP to link its account
+    OIDCLinkValidity = 10 * time.Minute
+    // oidcJWKSMinRefreshInterval prevents fetching the JWKS of the IdP for every token with an unknown kid
+    oidcJWKSMinRefreshInterval = time.Minute
+)
+
+// oidcSigningAlgorithms are the accepted algorithms of ID tokens, symmetric algorithms are never accepted
+var oidcSigningAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// OIDCConfig configures the identity provider
+type OIDCConfig struct {
+    // IssuerURL identifies the IdP, the discovery document is served at IssuerURL/.well-known/openid-configuration
+    IssuerURL    string
+    ClientID     string
+    ClientSecret string
+    // RedirectURL is our callback endpoint, as registered at the IdP
+    RedirectURL string
+    // Scopes to request, openid is always requested
+    Scopes []string
+    // GroupsClaim is the claim that lists the groups of the user, DefaultOIDCGroupsClaim if empty
+    GroupsClaim string
+    // GroupRoles maps IdP groups to Garsson roles
+    GroupRoles map[string][]string
+}
+
+// OIDCIdentity is the verified identity of a user at the IdP
+type OIDCIdentity struct {
+    // Subject is the stable identifier of the user at the IdP
+    Subject string
+    Email   string
+    Groups  []string
+}
+
+// OIDCAuthRequest contains the values that must be remembered between starting the sign-in and the callback
+type OIDCAuthRequest struct {
+    State        string `json:"state"`
+    Nonce        string `json:"nonce"`
+    CodeVerifier string `json:"codeVerifier"`
+    // Link is true if the sign-in links the account that started it, only honoured if StartOIDCLink stored the state
+    Link bool `json:"link,omitempty"`
+}
+
+// oidcDiscovery contains the fields of the discovery document that we use
+type oidcDiscovery struct {
+    Issuer                string `json:"issuer"`
+    AuthorizationEndpoint string `json:"authorization_endpoint"`
+    TokenEndpoint         string `json:"token_endpoint"`
+    JwksURI               string `json:"jwks_uri"`
+}
+
+// OIDCProvider talks to the IdP. The discovery document is loaded on first use, so the api can start while the
+// IdP is unavailable.
+type OIDCProvider struct {
+    config OIDCConfig
+    client *http.Client
+
+    mutex         sync.Mutex
+    discovery     *oidcDiscovery
+    keys          map[string]interface{}
+    keysRefreshed time.Time
+}
+
+// NewOIDCProvider creates a provider, uses http.DefaultClient if client is nil
+func NewOIDCProvider(config OIDCConfig, client *http.Client) *OIDCProvider {
+    if client == nil {
+        client = http.DefaultClient
+    }
+    if config.GroupsClaim == "" {
+        config.GroupsClaim = DefaultOIDCGroupsClaim
+    }
+    config.IssuerURL = strings.TrimSuffix(config.IssuerURL, "/")
+    return &OIDCProvider{config: config, client: client, keys: map[string]interface{}{}}
+}
+
+// NewOIDCAuthRequest generates the random state, nonce and PKCE code verifier of a new sign-in
+func NewOIDCAuthRequest() (OIDCAuthRequest, error) {
+    var request OIDCAuthRequest
+    var err error
+    if request.State, err = generateOpaqueToken(); err != nil {
+        return request, err
+    }
+    if request.Nonce, err = generateOpaqueToken(); err != nil {
+        return request, err
+    }
+    request.CodeVerifier, err = generateOpaqueToken()
+    return request, err
+}
+
+// AuthCodeURL returns the URL of the IdP to which the browser is redirected to sign in
+func (p *OIDCProvider) AuthCodeURL(request OIDCAuthRequest) (string, error) {
+    discovery, err := p.loadDiscovery()
+    if err != nil {
+        return "", err
+    }
+    challenge := sha256.Sum256([]byte(request.CodeVerifier))
+    params := url.Values{
+        "response_type":         {"code"},
+        "client_id":             {p.config.ClientID},
+        "redirect_uri":          {p.config.RedirectURL},
+        "scope":                 {strings.Join(p.scopes(), " ")},
+        "state":                 {request.State},
+        "nonce":                 {request.Nonce},
+        "code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+        "code_challenge_method": {"S256"},
+    }
+    separator := "?"
+    if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+        separator = "&"
+    }
+    return discovery.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange redeems the authorization code at the token endpoint and returns the verified identity of the user
+func (p *OIDCProvider) Exchange(code string, request OIDCAuthRequest) (OIDCIdentity, error) {
+    discovery, err := p.loadDiscovery()
+    if err != nil {
+        return OIDCIdentity{}, err
+    }
+    response, err := p.client.PostForm(discovery.TokenEndpoint, url.Values{
+        "grant_type":    {"authorization_code"},
+        "code":          {code},
+        "redirect_uri":  {p.config.RedirectURL},
+        "client_id":     {p.config.ClientID},
+        "client_secret": {p.config.ClientSecret},
+        "code_verifier": {request.CodeVerifier},
+    })
+    if err != nil {
+        return OIDCIdentity{}, err
+    }
+    defer response.Body.Close()
+    if response.StatusCode != http.StatusOK {
+        return OIDCIdentity{}, fmt.Errorf("token endpoint of identity provider responded with %v", response.Status)
+    }
+    var tokenResponse struct {
+        IDToken string `json:"id_token"`
+    }
+    if err := json.NewDecoder(response.Body).Decode(&tokenResponse); err != nil {
+        return OIDCIdentity{}, err
+    } else if tokenResponse.IDToken == "" {
+        return OIDCIdentity{}, ErrInvalidIDToken
+    }
+    return p.VerifyIDToken(tokenResponse.IDToken, request.Nonce)
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry, issue time and nonce of the ID token, and that the
+// identity provider verified the email address
+func (p *OIDCProvider) VerifyIDToken(rawIDToken, nonce string) (OIDCIdentity, error) {
+    discovery, err := p.loadDiscovery()
+    if err != nil {
+        return OIDCIdentity{}, err
+    }
+    parser := jwt.Parser{ValidMethods: oidcSigningAlgorithms}
+    token, err := parser.ParseWithClaims(rawIDToken, jwt.MapClaims{}, p.verificationKey)
+    if err != nil {
+        log.WithError(err).Warn("rejected id token")
+        return OIDCIdentity{}, ErrInvalidIDToken
+    }
+    claims := token.Claims.(jwt.MapClaims)
+    if !claims.VerifyIssuer(discovery.Issuer, true) || !hasAudience(claims["aud"], p.config.ClientID) {
+        return OIDCIdentity{}, ErrInvalidIDToken
+    }
+    // the parser only checks exp and iat when present, an ID token without them would never expire
+    if now := time.Now().Unix(); !claims.VerifyExpiresAt(now, true) || !claims.VerifyIssuedAt(now, true) {
+        return OIDCIdentity{}, ErrInvalidIDToken
+    }
+    if tokenNonce, _ := claims["nonce"].(string); tokenNonce == "" || tokenNonce != nonce {
+        return OIDCIdentity{}, ErrInvalidIDToken
+    }
+
+    identity := OIDCIdentity{
+        Subject: stringClaim(claims, "sub"),
+        Email:   strings.TrimSpace(stringClaim(claims, "email")),
+        Groups:  stringListClaim(claims, p.config.GroupsClaim),
+    }
+    if identity.Subject == "" || !isValidEmail(identity.Email) {
+        return OIDCIdentity{}, ErrInvalidIDToken
+    }
+    if verified, _ := claims["email_verified"].(bool); !verified {
+        return OIDCIdentity{}, ErrEmailNotVerified
+    }
+    return identity, nil
+}
+
+// RolesOf maps the IdP groups of the identity to Garsson roles
+func (p *OIDCProvider) RolesOf(identity OIDCIdentity) []string {
+    return mapGroupsToRoles(identity.Groups, p.config.GroupRoles)
+}
+
+// StartOIDCLink starts the sign-in at the IdP that links the account of email to the identity of the user at the
+// IdP. The state of the returned request is stored as account token, so the callback only links for the user that
+// started the link.
+func StartOIDCLink(sess dbr.SessionRunner, email string) (OIDCAuthRequest, error) {
+    request, err := NewOIDCAuthRequest()
+    if err != nil {
+        return request, err
+    }
+    request.Link = true
+    now := time.Now()
+    err = insertAccountToken(sess, accountTokenEntity{
+        TokenHash:   hashOpaqueToken(request.State),
+        Purpose:     AccountTokenOIDCLink,
+        Email:       email,
+        TimeIssued:  db.FormatTime(now),
+        TimeExpires: db.FormatTime(now.Add(OIDCLinkValidity)),
+    })
+    return request, err
+}
+
+// CompleteOIDCLink links the verified identity to the account that started the link with the state of the request
+func CompleteOIDCLink(sess *dbr.Session, request OIDCAuthRequest, identity OIDCIdentity) (User, error) {
+    tx, err := sess.Begin()
+    if err != nil {
+        return User{}, err
+    }
+    defer tx.RollbackUnlessCommitted()
+
+    stored, err := queryAccountToken(tx, hashOpaqueToken(request.State))
+    if err == dbr.ErrNotFound {
+        return User{}, ErrInvalidOIDCLink
+    } else if err != nil {
+        return User{}, err
+    } else if stored.Purpose != AccountTokenOIDCLink || stored.TimeUsed.Valid {
+        return User{}, ErrInvalidOIDCLink
+    } else if expires, err := db.ParseTime(stored.TimeExpires); err != nil || time.Now().After(expires) {
+        return User{}, ErrInvalidOIDCLink
+    }
+    if marked, err := markAccountTokenUsed(tx, stored.TokenHash); err != nil {
+        return User{}, err
+    } else if marked == 0 {
+        return User{}, ErrInvalidOIDCLink
+    }
+    if err := linkExternalSubject(tx, stored.Email, identity.Subject); err != nil {
+        return User{}, err
+    }
+    if err := tx.Commit(); err != nil {
+        return User{}, err
+    }
+    log.WithField("email", stored.Email).Info("user linked its account to identity provider")
+    return FindUser(sess, stored.Email)
+}
+
+// LinkExternalSubject links the account of email to the subject of the user at the IdP, used by administrators
+func LinkExternalSubject(sess dbr.SessionRunner, email, subject string) (User, error) {
+    subject = strings.TrimSpace(subject)
+    if subject == "" {
+        return User{}, ErrInvalidExternalSubject
+    }
+    if err := linkExternalSubject(sess, email, subject); err != nil {
+        return User{}, err
+    }
+    log.WithField("email", email).Info("linked user to identity provider")
+    return FindUser(sess, email)
+}
+
+func linkExternalSubject(sess dbr.SessionRunner, email, subject string) error {
+    if linked, err := updateExternalSubject(sess, email, subject); db.IsUniqueViolation(err) {
+        return ErrIdentityAlreadyLinked
+    } else if err != nil {
+        return err
+    } else if linked == 0 {
+        return ErrUserNotFound
+    }
+    return nil
+}
+
+// AuthenticateOIDC signs in the user that is linked to the subject of a verified identity. Unknown users are
+// provisioned, but an existing account with the same email is never used before it has been linked. When groups of
+// the user are mapped to roles, the roles of the user are replaced by them. Like Authenticate, users that need a
+// second factor receive an *MFARequiredError instead of tokens.
+func AuthenticateOIDC(sess *dbr.Session, provider *OIDCProvider, identity OIDCIdentity, keys *KeySet) (Tokens, UserEntity, error) {
+    roles := provider.RolesOf(identity)
+    tx, err := sess.Begin()
+    if err != nil {
+        return Tokens{}, UserEntity{}, err
+    }
+    defer tx.RollbackUnlessCommitted()
+
+    email, err := queryEmailByExternalSubject(tx, identity.Subject)
+    if err == dbr.ErrNotFound {
+        if _, err := QueryUserEntity(tx, identity.Email); err == nil {
+            log.WithField("email", identity.Email).Warn("identity provider sign-in for an account that is not linked")
+            return Tokens{}, UserEntity{}, ErrAccountNotLinked
+        } else if err != dbr.ErrNotFound {
+            return Tokens{}, UserEntity{}, err
+        }
+        user := UserEntity{Email: identity.Email, ExternalSubject: dbr.NewNullString(identity.Subject), Roles: roles}
+        if err := insertUserWithRoles(tx, user); err != nil {
+            return Tokens{}, UserEntity{}, err
+        }
+        email = user.Email
+        log.WithField("email", user.Email).WithField("roles", roles).Info("provisioned user from identity provider")
+    } else if err != nil {
+        return Tokens{}, UserEntity{}, err
+    } else if linkedUser, err := QueryUserEntity(tx, email); err != nil {
+        return Tokens{}, UserEntity{}, err
+    } else if linkedUser.Disabled {
+        return Tokens{}, UserEntity{}, ErrUserDisabled
+    } else if len(roles) > 0 {
+        if err := replaceUserRoles(tx, email, roles); db.IsForeignKeyViolation(err) {
+            return Tokens{}, UserEntity{}, ErrUnknownRole
+        } else if err != nil {
+            return Tokens{}, UserEntity{}, err
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        return Tokens{}, UserEntity{}, err
+    }
+
+    user, err := QueryUserEntity(sess, email)
+    if err != nil {
+        return Tokens{}, UserEntity{}, err
+    }
+    if err := requireSecondFactor(sess, user, keys); err != nil {
+        return Tokens{}, UserEntity{}, err
+    }
+    tokens, err := issueTokens(sess, user, newTokenFamilyID(), keys)
+    if err != nil {
+        return Tokens{}, UserEntity{}, err
+    }
+    if err := UpdateLastSignInToNow(sess, user.Email); err != nil {
+        log.WithField("email", user.Email).WithError(err).Warn("could not update last sign-in")
+    }
+    user.PasswordHash = "" // no need to expose!
+    return tokens, user, nil
+}
+
+func (p *OIDCProvider) scopes() []string {
+    scopes := []string{"openid"}
+    for _, scope := range p.config.Scopes {
+        if scope != "openid" {
+            scopes = append(scopes, scope)
+        }
+    }
+    return scopes
+}
+
+func (p *OIDCProvider) loadDiscovery() (*oidcDiscovery, error) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    if p.discovery != nil {
+        return p.discovery, nil
+    }
+    var discovery oidcDiscovery
+    if err := p.getJSON(p.config.IssuerURL+"/.well-known/openid-configuration", &discovery); err != nil {
+        return nil, err
+    }
+    if strings.TrimSuffix(discovery.Issuer, "/") != p.config.IssuerURL {
+        return nil, fmt.Errorf("issuer %v of discovery document does not match %v", discovery.Issuer, p.config.IssuerURL)
+    }
+    p.discovery = &discovery
+    return p.discovery, nil
+}
+
+// verificationKey selects the key of the IdP by kid, the JWKS is reloaded when the kid is unknown because the
+// IdP may have rotated its keys
+func (p *OIDCProvider) verificationKey(token *jwt.Token) (interface{}, error) {
+    kid, _ := token.Header["kid"].(string)
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    key, found := p.keys[kid]
+    if !found && time.Since(p.keysRefreshed) > oidcJWKSMinRefreshInterval {
+        if err := p.refreshKeys(); err != nil {
+            return nil, err
+        }
+        key, found = p.keys[kid]
+    }
+    if !found {
+        return nil, fmt.Errorf("unknown key id %v", kid)
+    }
+    if !keyMatchesMethod(key, token.Method) {
+        return nil, fmt.Errorf("key %v cannot verify %v", kid, token.Method.Alg())
+    }
+    return key, nil
+}
+
+// refreshKeys loads the JWKS of the IdP, must be called with the mutex locked
+func (p *OIDCProvider) refreshKeys() error {
+    var jwks JSONWebKeySet
+    if err := p.getJSON(p.discovery.JwksURI, &jwks); err != nil {
+        return err
+    }
+    keys := map[string]interface{}{}
+    for _, jwk := range jwks.Keys {
+        if jwk.Use != "" && jwk.Use != "sig" {
+            continue
+        }
+        if key, err := jwk.PublicKey(); err != nil {
+            log.WithError(err).Warn("ignoring key of identity provider")
+        } else {
+            keys[jwk.Kid] = key
+        }
+    }
+    p.keys = keys
+    p.keysRefreshed = time.Now()
+    return nil
+}
+
+func (p *OIDCProvider) getJSON(url string, target interface{}) error {
+    response, err := p.client.Get(url)
+    if err != nil {
+        return err
+    }
+    defer response.Body.Close()
+    if response.StatusCode != http.StatusOK {
+        return fmt.Errorf("identity provider responded with %v for %v", response.Status, url)
+    }
+    return json.NewDecoder(response.Body).Decode(target)
+}
+
+func keyMatchesMethod(key interface{}, method jwt.SigningMethod) bool {
+    switch key.(type) {
+    case *rsa.PublicKey:
+        _, isRSA := method.(*jwt.SigningMethodRSA)
+        _, isPSS := method.(*jwt.SigningMethodRSAPSS)
+        return isRSA || isPSS
+    case *ecdsa.PublicKey:
+        _, isECDSA := method.(*jwt.SigningMethodECDSA)
+        return isECDSA
+    case ed25519.PublicKey:
+        _, isEdDSA := method.(*SigningMethodEdDSA)
+        return isEdDSA
+    }
+    return false
+}
+
+// hasAudience checks the aud claim, which is either a string or an array of strings
+func hasAudience(aud interface{}, clientID string) bool {
+    switch audience := aud.(type) {
+    case string:
+        return audience == clientID
+    case []interface{}:
+        for _, element := range audience {
+            if element == clientID {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func stringClaim(claims jwt.MapClaims, name string) string {
+    value, _ := claims[name].(string)
+    return value
+}
+
+// stringListClaim returns the claim as list, the claim can be an array of strings or a single string
+func stringListClaim(claims jwt.MapClaims, name string) []string {
+    values := []string{}
+    switch claim := claims[name].(type) {
+    case string:
+        values = append(values, claim)
+    case []interface{}:
+        for _, element := range claim {
+            if value, ok := element.(string); ok {
+                values = append(values, value)
+            }
+        }
+    }
+    return values
+}
+
+// mapGroupsToRoles returns the distinct roles of all groups, groups without mapping are ignored
+func mapGroupsToRoles(groups []string, groupRoles map[string][]string) []string {
+    roles := []string{}
+    seen := map[string]bool{}
+    for _, group := range groups {
+        for _, role := range groupRoles[group] {
+            if !seen[role] {
+                seen[role] = true
+                roles = append(roles, role)
+            }
+        }
+    }
+    return roles
+}
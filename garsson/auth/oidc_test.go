@@ -0,0 +1,371 @@
+package auth
+
+import (
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/json"
+    "encoding/pem"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "testing"
+    "time"
+
+    "github.com/dgrijalva/jwt-go"
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// mockIdP serves discovery, JWKS and a token endpoint that returns the ID token produced by idToken
+type mockIdP struct {
+    server  *httptest.Server
+    keys    *KeySet
+    idToken func(code string) jwt.MapClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+    rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    assert.NoError(t, err)
+    key, err := ParsePEMKey("idp-1", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+    assert.NoError(t, err)
+    idp := &mockIdP{keys: NewKeySet()}
+    assert.NoError(t, idp.keys.Add(key))
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(map[string]string{
+            "issuer":                 idp.server.URL,
+            "authorization_endpoint": idp.server.URL + "/authorize",
+            "token_endpoint":         idp.server.URL + "/token",
+            "jwks_uri":               idp.server.URL + "/jwks",
+        })
+    })
+    mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(idp.keys.JWKS())
+    })
+    mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+        if r.PostFormValue("client_secret") != "secret" || r.PostFormValue("code_verifier") == "" {
+            w.WriteHeader(http.StatusUnauthorized)
+            return
+        }
+        idToken, err := idp.keys.Sign(idp.idToken(r.PostFormValue("code")))
+        assert.NoError(t, err)
+        json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+    })
+    idp.server = httptest.NewServer(mux)
+    return idp
+}
+
+func (idp *mockIdP) provider() *OIDCProvider {
+    return NewOIDCProvider(OIDCConfig{
+        IssuerURL:    idp.server.URL,
+        ClientID:     "garsson",
+        ClientSecret: "secret",
+        RedirectURL:  "http://localhost:8080/api/v1/login/oidc/callback",
+        Scopes:       []string{"email"},
+        GroupRoles:   map[string][]string{"staff": {"waiter", "bartender"}, "bar": {"bartender"}},
+    }, idp.server.Client())
+}
+
+func (idp *mockIdP) claims(nonce string) jwt.MapClaims {
+    return jwt.MapClaims{
+        "iss":            idp.server.URL,
+        "aud":            []string{"garsson"},
+        "sub":            "subject-1",
+        "email":          "waiter@garsson.nl",
+        "email_verified": true,
+        "nonce":          nonce,
+        "groups":         []string{"staff", "bar", "unmapped"},
+        "exp":            time.Now().Add(time.Minute).Unix(),
+        "iat":            time.Now().Unix(),
+    }
+}
+
+func TestOIDCProvider_AuthCodeURL(t *testing.T) {
+    idp := newMockIdP(t)
+    defer idp.server.Close()
+    request, err := NewOIDCAuthRequest()
+    assert.NoError(t, err)
+
+    authURL, err := idp.provider().AuthCodeURL(request)
+    assert.NoError(t, err)
+    parsed, err := url.Parse(authURL)
+    assert.NoError(t, err)
+    assert.Equal(t, "/authorize", parsed.Path)
+    params := parsed.Query()
+    assert.Equal(t, "code", params.Get("response_type"))
+    assert.Equal(t, "garsson", params.Get("client_id"))
+    assert.Equal(t, "openid email", params.Get("scope"))
+    assert.Equal(t, request.State, params.Get("state"))
+    assert.Equal(t, request.Nonce, params.Get("nonce"))
+    assert.Equal(t, "S256", params.Get("code_challenge_method"))
+    assert.NotEqual(t, request.CodeVerifier, params.Get("code_challenge"))
+}
+
+func TestOIDCProvider_Exchange(t *testing.T) {
+    idp := newMockIdP(t)
+    defer idp.server.Close()
+    request, err := NewOIDCAuthRequest()
+    assert.NoError(t, err)
+    idp.idToken = func(code string) jwt.MapClaims { return idp.claims(request.Nonce) }
+    provider := idp.provider()
+
+    identity, err := provider.Exchange("code", request)
+    assert.NoError(t, err)
+    assert.Equal(t, "subject-1", identity.Subject)
+    assert.Equal(t, "waiter@garsson.nl", identity.Email)
+    assert.Equal(t, []string{"staff", "bar", "unmapped"}, identity.Groups)
+    assert.Equal(t, []string{"waiter", "bartender"}, provider.RolesOf(identity))
+}
+
+func TestOIDCProvider_RejectsInvalidIDTokens(t *testing.T) {
+    idp := newMockIdP(t)
+    defer idp.server.Close()
+    request, err := NewOIDCAuthRequest()
+    assert.NoError(t, err)
+    provider := idp.provider()
+
+    tests := []struct {
+        name     string
+        modify   func(claims jwt.MapClaims)
+        expected error
+    }{
+        {"wrong nonce", func(claims jwt.MapClaims) { claims["nonce"] = "replayed" }, ErrInvalidIDToken},
+        {"wrong audience", func(claims jwt.MapClaims) { claims["aud"] = "other-client" }, ErrInvalidIDToken},
+        {"wrong issuer", func(claims jwt.MapClaims) { claims["iss"] = "https://evil.example.com" }, ErrInvalidIDToken},
+        {"expired", func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Minute).Unix() }, ErrInvalidIDToken},
+        {"no subject", func(claims jwt.MapClaims) { delete(claims, "sub") }, ErrInvalidIDToken},
+        {"no expiry", func(claims jwt.MapClaims) { delete(claims, "exp") }, ErrInvalidIDToken},
+        {"no issue time", func(claims jwt.MapClaims) { delete(claims, "iat") }, ErrInvalidIDToken},
+        {"unverified email", func(claims jwt.MapClaims) { claims["email_verified"] = false }, ErrEmailNotVerified},
+        {"email verification unknown", func(claims jwt.MapClaims) { delete(claims, "email_verified") }, ErrEmailNotVerified},
+        {"email verification as string", func(claims jwt.MapClaims) { claims["email_verified"] = "true" }, ErrEmailNotVerified},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            idp.idToken = func(code string) jwt.MapClaims {
+                claims := idp.claims(request.Nonce)
+                test.modify(claims)
+                return claims
+            }
+            _, err := provider.Exchange("code", request)
+            assert.Equal(t, test.expected, err)
+        })
+    }
+}
+
+func TestOIDCProvider_RejectsTokenOfUnknownKey(t *testing.T) {
+    idp := newMockIdP(t)
+    defer idp.server.Close()
+    request, err := NewOIDCAuthRequest()
+    assert.NoError(t, err)
+    provider := idp.provider()
+
+    otherKey, err := GenerateEd25519Key("other")
+    assert.NoError(t, err)
+    otherKeys := NewKeySet()
+    assert.NoError(t, otherKeys.Add(otherKey))
+    idToken, err := otherKeys.Sign(idp.claims(request.Nonce))
+    assert.NoError(t, err)
+
+    _, err = provider.VerifyIDToken(idToken, request.Nonce)
+    assert.Equal(t, ErrInvalidIDToken, err)
+}
+
+var waiterIdentity = OIDCIdentity{Subject: "subject-1", Email: "waiter@garsson.nl", Groups: []string{"bar"}}
+
+// expectOIDCSignIn expects the queries that issue the tokens after the user account is known
+func expectOIDCSignIn(mock sqlmock.Sqlmock) {
+    mock.ExpectQuery(`SELECT \* FROM user_account WHERE \(email = 'waiter@garsson.nl'\)`).WillReturnRows(userRows("waiter@garsson.nl", "", false))
+    expectUserAccess(mock, "bartender")
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(dbtest.EmptyRows())
+    expectRolesRequireMFA(mock, "bartender", false)
+    expectIssueTokens(mock)
+}
+
+func TestAuthenticateOIDC_ProvisionsUnknownUser(t *testing.T) {
+    idp := newMockIdP(t)
+    defer idp.server.Close()
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT email FROM user_account WHERE \(external_subject = 'subject-1'\)`).WillReturnRows(dbtest.EmptyRows())
+    mock.ExpectQuery(`SELECT \* FROM user_account WHERE \(email = 'waiter@garsson.nl'\)`).WillReturnRows(dbtest.EmptyRows())
+    mock.ExpectExec(`INSERT INTO "user_account" .*'subject-1'`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`DELETE FROM "user_role"`).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectExec(`INSERT INTO "user_role" .* VALUES \('waiter@garsson.nl','bartender'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+    expectOIDCSignIn(mock)
+
+    tokens, user, err := AuthenticateOIDC(dao.NewSession(), idp.provider(), waiterIdentity, signingKeys(t))
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.Equal(t, "waiter@garsson.nl", user.Email)
+    assert.NotEmpty(t, tokens.AccessToken)
+}
+
+func TestAuthenticateOIDC_DoesNotLinkExistingAccountByEmail(t *testing.T) {
+    idp := newMockIdP(t)
+    defer idp.server.Close()
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT email FROM user_account WHERE \(external_subject = 'subject-1'\)`).WillReturnRows(dbtest.EmptyRows())
+    mock.ExpectQuery(`SELECT \* FROM user_account WHERE \(email = 'waiter@garsson.nl'\)`).WillReturnRows(userRows("waiter@garsson.nl", "$argon2id$...", false))
+    expectUserAccess(mock, "manager")
+    mock.ExpectRollback()
+
+    _, _, err := AuthenticateOIDC(dao.NewSession(), idp.provider(), waiterIdentity, signingKeys(t))
+    assert.Equal(t, ErrAccountNotLinked, err)
+    assert.NoError(t, mock.ExpectationsWereMet(), "neither the subject nor the roles of the account are changed")
+}
+
+func TestAuthenticateOIDC_ReplacesRolesOfLinkedUser(t *testing.T) {
+    idp := newMockIdP(t)
+    defer idp.server.Close()
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT email FROM user_account WHERE \(external_subject = 'subject-1'\)`).
+        WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("waiter@garsson.nl"))
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("waiter@garsson.nl", "", false))
+    expectUserAccess(mock, "waiter")
+    mock.ExpectExec(`DELETE FROM "user_role" WHERE \(email = 'waiter@garsson.nl'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`INSERT INTO "user_role" .* VALUES \('waiter@garsson.nl','bartender'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+    expectOIDCSignIn(mock)
+
+    _, _, err := AuthenticateOIDC(dao.NewSession(), idp.provider(), waiterIdentity, signingKeys(t))
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuthenticateOIDC_KeepsRolesWithoutMappedGroup(t *testing.T) {
+    idp := newMockIdP(t)
+    defer idp.server.Close()
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT email FROM user_account`).WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("waiter@garsson.nl"))
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("waiter@garsson.nl", "", false))
+    expectUserAccess(mock, "bartender")
+    mock.ExpectCommit()
+    expectOIDCSignIn(mock)
+
+    identity := waiterIdentity
+    identity.Groups = []string{"unmapped"}
+    _, _, err := AuthenticateOIDC(dao.NewSession(), idp.provider(), identity, signingKeys(t))
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet(), "the roles are not removed")
+}
+
+func TestAuthenticateOIDC_RequiresSecondFactor(t *testing.T) {
+    idp := newMockIdP(t)
+    defer idp.server.Close()
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT email FROM user_account`).WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("waiter@garsson.nl"))
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("waiter@garsson.nl", "", false))
+    expectUserAccess(mock, "bartender")
+    mock.ExpectExec(`DELETE FROM "user_role"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`INSERT INTO "user_role"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("waiter@garsson.nl", "", false))
+    expectUserAccess(mock, "bartender")
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(dbtest.EmptyRows())
+    expectRolesRequireMFA(mock, "bartender", true)
+
+    tokens, _, err := AuthenticateOIDC(dao.NewSession(), idp.provider(), waiterIdentity, signingKeys(t))
+    if mfaRequired, ok := err.(*MFARequiredError); assert.True(t, ok, "expected *MFARequiredError, got %v", err) {
+        assert.NotEmpty(t, mfaRequired.MFAToken)
+        assert.True(t, mfaRequired.EnrollmentRequired)
+    }
+    assert.Empty(t, tokens.AccessToken)
+    assert.NoError(t, mock.ExpectationsWereMet(), "no tokens are issued")
+}
+
+func TestAuthenticateOIDC_DisabledUser(t *testing.T) {
+    idp := newMockIdP(t)
+    defer idp.server.Close()
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT email FROM user_account`).WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("waiter@garsson.nl"))
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("waiter@garsson.nl", "", true))
+    expectUserAccess(mock, "waiter")
+    mock.ExpectRollback()
+
+    _, _, err := AuthenticateOIDC(dao.NewSession(), idp.provider(), waiterIdentity, signingKeys(t))
+    assert.Equal(t, ErrUserDisabled, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// oidcLinkRows returns the account token that StartOIDCLink stored for the state
+func oidcLinkRows(state, purpose string, expires time.Time) *sqlmock.Rows {
+    return sqlmock.NewRows([]string{"token_hash", "purpose", "email", "time_issued", "time_expires", "time_used"}).
+        AddRow(hashOpaqueToken(state), purpose, "bar@garsson.io", db.FormatTime(expires.Add(-OIDCLinkValidity)), db.FormatTime(expires), nil)
+}
+
+func TestStartOIDCLink(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectExec(`INSERT INTO "account_token" .* VALUES \('[0-9a-f]{64}','oidc-link','bar@garsson.io'`).WillReturnResult(sqlmock.NewResult(0, 1))
+
+    request, err := StartOIDCLink(dao.NewSession(), "bar@garsson.io")
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.True(t, request.Link)
+    assert.NotEmpty(t, request.State)
+}
+
+func TestCompleteOIDCLink(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM account_token WHERE \(token_hash = '` + hashOpaqueToken("state") + `'\)`).
+        WillReturnRows(oidcLinkRows("state", AccountTokenOIDCLink, time.Now().Add(time.Minute)))
+    mock.ExpectExec(`UPDATE "account_token" SET "time_used"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "user_account" SET "external_subject" = 'subject-1' WHERE \(email = 'bar@garsson.io'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("bar@garsson.io", "", false))
+    expectUserAccess(mock, "bar")
+
+    user, err := CompleteOIDCLink(dao.NewSession(), OIDCAuthRequest{State: "state", Link: true}, waiterIdentity)
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.Equal(t, "bar@garsson.io", user.Email, "the account that started the link is linked, not the account of the email at the IdP")
+}
+
+func TestCompleteOIDCLink_Rejected(t *testing.T) {
+    tests := []struct {
+        name string
+        rows *sqlmock.Rows
+    }{
+        {name: "not started", rows: dbtest.EmptyRows()},
+        {name: "expired", rows: oidcLinkRows("state", AccountTokenOIDCLink, time.Now().Add(-time.Second))},
+        {name: "other purpose", rows: oidcLinkRows("state", AccountTokenReset, time.Now().Add(time.Minute))},
+    }
+    for _, test := range tests {
+        dao, mock := dbtest.NewDbMock(t)
+        mock.ExpectBegin()
+        mock.ExpectQuery(`SELECT \* FROM account_token`).WillReturnRows(test.rows)
+        mock.ExpectRollback()
+
+        _, err := CompleteOIDCLink(dao.NewSession(), OIDCAuthRequest{State: "state", Link: true}, waiterIdentity)
+        assert.Equal(t, ErrInvalidOIDCLink, err, test.name)
+        assert.NoError(t, mock.ExpectationsWereMet(), test.name)
+    }
+}
+
+func TestLinkExternalSubject(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectExec(`UPDATE "user_account" SET "external_subject" = 'subject-1' WHERE \(email = 'nobody@garsson.io'\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+    _, err := LinkExternalSubject(dao.NewSession(), "nobody@garsson.io", " subject-1 ")
+    assert.Equal(t, ErrUserNotFound, err)
+    _, err = LinkExternalSubject(dao.NewSession(), "bar@garsson.io", "  ")
+    assert.Equal(t, ErrInvalidExternalSubject, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMapGroupsToRoles(t *testing.T) {
+    groupRoles := map[string][]string{"staff": {"waiter"}, "managers": {"manager", "waiter"}}
+    assert.Equal(t, []string{"manager", "waiter"}, mapGroupsToRoles([]string{"managers", "staff", "guests"}, groupRoles))
+    assert.Equal(t, []string{}, mapGroupsToRoles(nil, groupRoles))
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/sha3"
+)
+
+// Passwords are stored as self-describing argon2id hashes in the PHC string format:
+//
+//    $argon2id$v=19$m=65536,t=1,p=4$<base64 salt>$<base64 key>
+//
+// Hashes created before argon2id was introduced are unsalted sha3-512 hex digests. They are still accepted
+// by verifyPassword, which reports that they need to be rehashed so Authenticate can upgrade them.
+
+const (
+    argon2idPrefix = "$argon2id$"
+    // legacySha3HexLength is the length of a hex encoded sha3-512 digest
+    legacySha3HexLength = 128
+)
+
+var (
+    // ErrMalformedPasswordHash indicates that a stored password hash could not be parsed
+    ErrMalformedPasswordHash = errors.New("malformed password hash")
+)
+
+var (
+    // dummyPasswordHash is verified instead of a stored hash when an account does not exist or cannot sign in with a
+    // password, so that the response time does not reveal which accounts exist
+    dummyPasswordHash     string
+    dummyPasswordHashOnce sync.Once
+)
+
+// argon2idParams contains the cost parameters of an argon2id hash
+type argon2idParams struct {
+    Memory  uint32
+    Time    uint32
+    Threads uint8
+    SaltLen uint32
+    KeyLen  uint32
+}
+
+// currentArgon2idParams are used for every new hash, hashes with other parameters are upgraded on sign-in
+var currentArgon2idParams = argon2idParams{
+    Memory:  64 * 1024,
+    Time:    1,
+    Threads: 4,
+    SaltLen: 16,
+    KeyLen:  32,
+}
+
+// hashPassword creates a salted argon2id hash of the password using the current parameters
+func hashPassword(password string) (string, error) {
+    return hashPasswordWithParams(password, currentArgon2idParams)
+}
+
+func hashPasswordWithParams(password string, params argon2idParams) (string, error) {
+    salt := make([]byte, params.SaltLen)
+    if _, err := rand.Read(salt); err != nil {
+        return "", fmt.Errorf("could not generate salt: %v", err)
+    }
+    key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+    return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+        argon2idPrefix,
+        argon2.Version,
+        params.Memory,
+        params.Time,
+        params.Threads,
+        base64.RawStdEncoding.EncodeToString(salt),
+        base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyDummyPassword takes as long as verifying the password against a stored hash with the current parameters
+func verifyDummyPassword(password string) {
+    dummyPasswordHashOnce.Do(func() {
+        dummyPasswordHash, _ = hashPassword("garsson dummy password")
+    })
+    verifyPassword(password, dummyPasswordHash)
+}
+
+// verifyPassword checks the password against the encoded hash. needsRehash is true when the password matches
+// but the hash uses a legacy algorithm or outdated parameters.
+func verifyPassword(password, encodedHash string) (matches bool, needsRehash bool, err error) {
+    if strings.HasPrefix(encodedHash, argon2idPrefix) {
+        return verifyArgon2id(password, encodedHash)
+    } else if len(encodedHash) == legacySha3HexLength {
+        return verifyLegacySha3(password, encodedHash), true, nil
+    }
+    return false, false, ErrMalformedPasswordHash
+}
+
+func verifyArgon2id(password, encodedHash string) (bool, bool, error) {
+    // "", "argon2id", "v=19", "m=65536,t=1,p=4", salt, key
+    parts := strings.Split(encodedHash, "$")
+    if len(parts) != 6 {
+        return false, false, ErrMalformedPasswordHash
+    }
+
+    var version int
+    if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+        return false, false, ErrMalformedPasswordHash
+    }
+    var params argon2idParams
+    if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+        return false, false, ErrMalformedPasswordHash
+    }
+    salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+    if err != nil {
+        return false, false, ErrMalformedPasswordHash
+    }
+    expectedKey, err := base64.RawStdEncoding.DecodeString(parts[5])
+    if err != nil {
+        return false, false, ErrMalformedPasswordHash
+    }
+    params.SaltLen = uint32(len(salt))
+    params.KeyLen = uint32(len(expectedKey))
+
+    actualKey := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+    if subtle.ConstantTimeCompare(actualKey, expectedKey) != 1 {
+        return false, false, nil
+    }
+    return true, params != currentArgon2idParams, nil
+}
+
+func verifyLegacySha3(password, encodedHash string) bool {
+    rawHash := sha3.Sum512([]byte(password))
+    actualHash := hex.EncodeToString(rawHash[:])
+    return subtle.ConstantTimeCompare([]byte(actualHash), []byte(strings.ToLower(encodedHash))) == 1
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestHashPassword_IsSaltedAndSelfDescribing(t *testing.T) {
+    first, err := hashPassword("secret")
+    assert.NoError(t, err)
+    second, err := hashPassword("secret")
+    assert.NoError(t, err)
+
+    assert.True(t, strings.HasPrefix(first, "$argon2id$v=19$m=65536,t=1,p=4$"), "unexpected hash format %v", first)
+    assert.NotEqual(t, first, second, "hashing the same password twice should use different salts")
+    assert.True(t, len(first) <= 256, "hash does not fit in password_hash column")
+}
+
+func TestVerifyPassword_Argon2id(t *testing.T) {
+    hash, _ := hashPassword("secret")
+
+    matches, needsRehash, err := verifyPassword("secret", hash)
+    assert.NoError(t, err)
+    assert.True(t, matches)
+    assert.False(t, needsRehash)
+
+    matches, _, err = verifyPassword("Secret", hash)
+    assert.NoError(t, err)
+    assert.False(t, matches)
+}
+
+func TestVerifyPassword_OutdatedParamsNeedRehash(t *testing.T) {
+    weakParams := currentArgon2idParams
+    weakParams.Memory = 8 * 1024
+    hash, _ := hashPasswordWithParams("secret", weakParams)
+
+    matches, needsRehash, err := verifyPassword("secret", hash)
+    assert.NoError(t, err)
+    assert.True(t, matches)
+    assert.True(t, needsRehash)
+}
+
+func TestVerifyPassword_LegacySha3(t *testing.T) {
+    // unsalted sha3-512 of "secret", as stored before argon2id was introduced
+    legacyHash := "b778a39a3663719dfc5e48c9d78431b1e45c2af9df538782bf199c189dabeac7" +
+        "680ada57dcec8eee91c4e3bf3bfa9af6ffde90cd1d249d1c6121d7b759a001b1"
+
+    matches, needsRehash, err := verifyPassword("secret", legacyHash)
+    assert.NoError(t, err)
+    assert.True(t, matches)
+    assert.True(t, needsRehash)
+
+    matches, _, err = verifyPassword("wrong", legacyHash)
+    assert.NoError(t, err)
+    assert.False(t, matches)
+}
+
+func TestVerifyPassword_Malformed(t *testing.T) {
+    for _, hash := range []string{"", "plaintext", "$argon2id$v=19$m=1$salt", "$argon2id$v=19$m=x,t=1,p=1$c2FsdA$a2V5"} {
+        matches, _, err := verifyPassword("secret", hash)
+        assert.Equal(t, ErrMalformedPasswordHash, err, "hash %q", hash)
+        assert.False(t, matches)
+    }
+}
@@ -0,0 +1,183 @@
+package auth
+
+import (
+    "errors"
+    "sort"
+
+    "github.com/gocraft/dbr"
+)
+
+// Users are granted roles and roles grant permissions. A role can inherit other roles, a manager for example includes
+// everything a waiter and a bartender may do. The effective permissions are resolved when a token is issued and
+// listed in the JWT, changing the roles of a user therefore takes effect on the next sign-in or token refresh.
+
+const (
+    // PermissionOrdersRead allows viewing orders
+    PermissionOrdersRead = "orders:read"
+    // PermissionOrdersWrite allows creating and changing orders
+    PermissionOrdersWrite = "orders:write"
+    // PermissionOrdersPrepare allows starting and finishing the preparation of orders
+    PermissionOrdersPrepare = "orders:prepare"
+    // PermissionOrdersCancel allows cancelling orders that have not been served
+    PermissionOrdersCancel = "orders:cancel"
+    // PermissionProductsRead allows viewing products
+    PermissionProductsRead = "products:read"
+    // PermissionUsersManage allows managing user accounts
+    PermissionUsersManage = "users:manage"
+    // PermissionDevicesManage allows registering and revoking shared devices
+    PermissionDevicesManage = "devices:manage"
+    // PermissionDatabaseRead allows viewing database information
+    PermissionDatabaseRead = "db:read"
+    // PermissionAPIKeysManage allows creating and revoking api keys
+    PermissionAPIKeysManage = "apikeys:manage"
+    // PermissionTablesManage allows adding tables and changing their number, area, capacity and status
+    PermissionTablesManage = "tables:manage"
+    // PermissionStationsManage allows adding preparation stations and choosing where products are prepared
+    PermissionStationsManage = "stations:manage"
+)
+
+var (
+    // ErrUnknownRole indicates that a role does not exist in the role table
+    ErrUnknownRole = errors.New("unknown role")
+)
+
+// Role is the public representation of a role
+type Role struct {
+    Name        string   `json:"name"`
+    Description string   `json:"description,omitempty"`
+    // Inherits lists the roles whose permissions are included in this role
+    Inherits    []string `json:"inherits"`
+    // Permissions lists the permissions granted directly to this role, without those of inherited roles
+    Permissions []string `json:"permissions"`
+    // MFARequired forces users holding this role, or a role inheriting it, to sign in with a second factor
+    MFARequired bool     `json:"mfaRequired"`
+}
+
+// ListRoles returns all roles with the roles they inherit and the permissions granted to them
+func ListRoles(sess dbr.SessionRunner) ([]Role, error) {
+    entities, err := queryRoles(sess)
+    if err != nil {
+        return nil, err
+    }
+    inherits, grants, err := loadRoleGraph(sess)
+    if err != nil {
+        return nil, err
+    }
+    roles := make([]Role, 0, len(entities))
+    for _, entity := range entities {
+        roles = append(roles, Role{
+            Name:        entity.Name,
+            Description: entity.Description.String,
+            Inherits:    append([]string{}, inherits[entity.Name]...),
+            Permissions: append([]string{}, grants[entity.Name]...),
+            MFARequired: entity.MFARequired,
+        })
+    }
+    return roles, nil
+}
+
+// SetRoleMFARequired changes whether users holding the role must sign in with a second factor, the requirement applies
+// from the next sign-in
+func SetRoleMFARequired(sess dbr.SessionRunner, role string, required bool) error {
+    if affected, err := updateRoleMFARequired(sess, role, required); err != nil {
+        return err
+    } else if affected == 0 {
+        return ErrUnknownRole
+    }
+    return nil
+}
+
+// rolesRequireMFA returns true if any of the roles, or a role they inherit, requires a second factor. A role that
+// inherits a role requiring a second factor grants at least the same permissions, so it is held to the same standard.
+func rolesRequireMFA(sess dbr.SessionRunner, roles []string) (bool, error) {
+    entities, err := queryRoles(sess)
+    if err != nil {
+        return false, err
+    }
+    inherits, _, err := loadRoleGraph(sess)
+    if err != nil {
+        return false, err
+    }
+    included := includedRoles(roles, inherits)
+    for _, entity := range entities {
+        if entity.MFARequired && included[entity.Name] {
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+// loadUserAccess sets the roles and effective permissions of the user
+func loadUserAccess(sess dbr.SessionRunner, user *UserEntity) error {
+    roles, err := queryUserRoles(sess, user.Email)
+    if err != nil {
+        return err
+    }
+    user.Roles = roles
+    user.Permissions, err = loadPermissions(sess, roles)
+    return err
+}
+
+// loadPermissions returns the effective permissions of the roles
+func loadPermissions(sess dbr.SessionRunner, roles []string) ([]string, error) {
+    inherits, grants, err := loadRoleGraph(sess)
+    if err != nil {
+        return nil, err
+    }
+    return resolvePermissions(roles, inherits, grants), nil
+}
+
+// loadRoleGraph returns the inherited roles and the granted permissions, both keyed by role name
+func loadRoleGraph(sess dbr.SessionRunner) (inherits map[string][]string, grants map[string][]string, err error) {
+    inheritances, err := queryRoleInheritances(sess)
+    if err != nil {
+        return nil, nil, err
+    }
+    rolePermissions, err := queryRolePermissions(sess)
+    if err != nil {
+        return nil, nil, err
+    }
+    inherits = map[string][]string{}
+    for _, inheritance := range inheritances {
+        inherits[inheritance.RoleName] = append(inherits[inheritance.RoleName], inheritance.InheritedRoleName)
+    }
+    grants = map[string][]string{}
+    for _, rolePermission := range rolePermissions {
+        grants[rolePermission.RoleName] = append(grants[rolePermission.RoleName], rolePermission.PermissionName)
+    }
+    return inherits, grants, nil
+}
+
+// resolvePermissions returns the sorted permissions granted to the roles and all roles they inherit, directly or
+// indirectly
+func resolvePermissions(roles []string, inherits map[string][]string, grants map[string][]string) []string {
+    granted := map[string]bool{}
+    for role := range includedRoles(roles, inherits) {
+        for _, permission := range grants[role] {
+            granted[permission] = true
+        }
+    }
+
+    permissions := make([]string, 0, len(granted))
+    for permission := range granted {
+        permissions = append(permissions, permission)
+    }
+    sort.Strings(permissions)
+    return permissions
+}
+
+// includedRoles returns the roles and all roles they inherit, directly or indirectly. Cycles in the inheritance are
+// tolerated, each role is visited once.
+func includedRoles(roles []string, inherits map[string][]string) map[string]bool {
+    visited := map[string]bool{}
+    pending := append([]string{}, roles...)
+    for len(pending) > 0 {
+        role := pending[len(pending)-1]
+        pending = pending[:len(pending)-1]
+        if !visited[role] {
+            visited[role] = true
+            pending = append(pending, inherits[role]...)
+        }
+    }
+    return visited
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestResolvePermissions_IncludesInheritedRoles(t *testing.T) {
+    inherits := map[string][]string{
+        "admin":   {"manager"},
+        "manager": {"waiter", "bartender"},
+    }
+    grants := map[string][]string{
+        "waiter":    {PermissionOrdersWrite, PermissionProductsRead},
+        "bartender": {PermissionOrdersRead, PermissionOrdersWrite},
+        "admin":     {PermissionUsersManage},
+    }
+
+    assert.Equal(t, []string{PermissionOrdersWrite, PermissionProductsRead}, resolvePermissions([]string{"waiter"}, inherits, grants))
+    assert.Equal(t, []string{PermissionOrdersRead, PermissionOrdersWrite, PermissionProductsRead},
+        resolvePermissions([]string{"manager"}, inherits, grants))
+    assert.Equal(t, []string{PermissionOrdersRead, PermissionOrdersWrite, PermissionProductsRead, PermissionUsersManage},
+        resolvePermissions([]string{"admin"}, inherits, grants))
+}
+
+func TestResolvePermissions_ToleratesCycles(t *testing.T) {
+    inherits := map[string][]string{
+        "a": {"b"},
+        "b": {"a"},
+    }
+    grants := map[string][]string{"b": {PermissionOrdersRead}}
+
+    assert.Equal(t, []string{PermissionOrdersRead}, resolvePermissions([]string{"a"}, inherits, grants))
+}
+
+func TestResolvePermissions_UnknownRoleGrantsNothing(t *testing.T) {
+    assert.Empty(t, resolvePermissions([]string{"sjonnie"}, map[string][]string{}, map[string][]string{}))
+}
+
+func TestIncludedRoles(t *testing.T) {
+    inherits := map[string][]string{
+        "admin":   {"manager"},
+        "manager": {"waiter", "bartender"},
+    }
+
+    assert.Equal(t, map[string]bool{"admin": true, "manager": true, "waiter": true, "bartender": true},
+        includedRoles([]string{"admin"}, inherits))
+    assert.Equal(t, map[string]bool{"waiter": true}, includedRoles([]string{"waiter"}, inherits))
+}
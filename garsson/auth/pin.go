@@ -0,0 +1,181 @@
+package auth
+
+import (
+    "errors"
+    "regexp"
+    "strings"
+    "time"
+
+    "github.com/gocraft/dbr"
+    "github.com/satori/go.uuid"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+// Waiters on shared tablets sign in with a short PIN instead of their password. A PIN is only accepted together
+// with the token of a device that an administrator registered, and yields a short-lived JWT without refresh token
+// that records the device in its claims. A PIN cannot replace a second factor, so users that enabled one or hold a
+// role that requires one cannot sign in with a PIN.
+
+var (
+    // ErrInvalidPinFormat indicates that a new PIN does not consist of 4 to 6 digits
+    ErrInvalidPinFormat = errors.New("pin must consist of 4 to 6 digits")
+    // ErrInvalidPin indicates that the PIN is incorrect or the user has no PIN
+    ErrInvalidPin = errors.New("invalid pin")
+    // ErrUnknownDevice indicates that the device token is missing, unknown or revoked
+    ErrUnknownDevice = errors.New("unknown or revoked device")
+    // ErrDeviceNotFound indicates that no device exists with the given id
+    ErrDeviceNotFound = errors.New("device not found")
+    // ErrPinNotAllowed indicates that the user must sign in with a second factor, which a PIN sign-in cannot provide
+    ErrPinNotAllowed = errors.New("pin sign-in is not allowed with two-factor authentication, sign in with password")
+    // ErrInvalidDeviceName indicates that the device name is empty or too long
+    ErrInvalidDeviceName = errors.New("device name must have 1 to 128 characters")
+)
+
+const (
+    // PinTokenValidity is the time in which a token obtained with a PIN is valid, shorter than TokenValidity
+    // because the device is shared
+    PinTokenValidity = time.Minute * 5
+)
+
+var pinFormat = regexp.MustCompile(`^[0-9]{4,6}$`)
+
+// AuthenticateWithPin checks the device token and the PIN of the user, and provides a JWT that is bound to the device
+func AuthenticateWithPin(sess dbr.SessionRunner, rawDeviceToken, email, pin string, keys *KeySet) (string, UserEntity, error) {
+    device, err := queryDeviceByTokenHash(sess, hashOpaqueToken(rawDeviceToken))
+    if err == dbr.ErrNotFound || (err == nil && device.Revoked) {
+        return "", UserEntity{}, ErrUnknownDevice
+    } else if err != nil {
+        return "", UserEntity{}, err
+    }
+
+    user, err := QueryUserEntity(sess, email)
+    if err == dbr.ErrNotFound {
+        return "", UserEntity{}, ErrUserNotFound
+    } else if err != nil {
+        return "", UserEntity{}, err
+    } else if user.Disabled {
+        return "", UserEntity{}, ErrUserDisabled
+    } else if !user.PinHash.Valid {
+        return "", UserEntity{}, ErrInvalidPin
+    }
+
+    if matches, _, err := verifyPassword(pin, user.PinHash.String); err != nil {
+        log.WithField("email", email).WithError(err).Error("stored pin hash cannot be verified")
+        return "", UserEntity{}, ErrInvalidPin
+    } else if !matches {
+        return "", UserEntity{}, ErrInvalidPin
+    }
+    if required, err := needsSecondFactor(sess, user); err != nil {
+        return "", UserEntity{}, err
+    } else if required {
+        return "", UserEntity{}, ErrPinNotAllowed
+    }
+
+    now := time.Now()
+    claims := newClaims(user, PinTokenValidity)
+    claims.Device = device.ID
+    claims.SessionID = newTokenFamilyID()
+    signedToken, err := keys.Sign(claims)
+    if err != nil {
+        return "", UserEntity{}, err
+    }
+    if err := storeSession(sess, claims.SessionID, user.Email, claims.Id, now, now.Add(PinTokenValidity)); err != nil {
+        return "", UserEntity{}, err
+    }
+    if err := updateDeviceLastUsed(sess, device.ID); err != nil {
+        log.WithField("device", device.ID).WithError(err).Warn("could not update last use of device")
+    }
+    if err := UpdateLastSignInToNow(sess, user.Email); err != nil {
+        log.WithField("email", user.Email).WithError(err).Warn("could not update last sign-in")
+    }
+    user.PasswordHash = "" // no need to expose!
+    return signedToken, user, nil
+}
+
+// DeviceIDOfToken returns the id of the device that owns the token, or an empty string if the token is unknown
+func DeviceIDOfToken(sess dbr.SessionRunner, rawDeviceToken string) string {
+    if device, err := queryDeviceByTokenHash(sess, hashOpaqueToken(rawDeviceToken)); err == nil {
+        return device.ID
+    }
+    return ""
+}
+
+// SetPin sets the PIN of the user after verifying the current password
+func SetPin(sess dbr.SessionRunner, email, password, pin string) error {
+    if !pinFormat.MatchString(pin) {
+        return ErrInvalidPinFormat
+    }
+    user, err := QueryUserEntity(sess, email)
+    if err == dbr.ErrNotFound {
+        return ErrUserNotFound
+    } else if err != nil {
+        return err
+    }
+    if matches, _, err := verifyPassword(password, user.PasswordHash); err != nil || !matches {
+        return ErrInvalidPassword
+    }
+    pinHash, err := hashPassword(pin)
+    if err != nil {
+        return err
+    }
+    return updatePinHash(sess, email, dbr.NewNullString(pinHash))
+}
+
+// RegisterDevice registers a shared device, the returned token is only available now and must be configured on
+// the device
+func RegisterDevice(sess dbr.SessionRunner, name, registeredBy string) (Device, string, error) {
+    name = strings.TrimSpace(name)
+    if name == "" || len(name) > 128 {
+        return Device{}, "", ErrInvalidDeviceName
+    }
+    rawToken, err := generateOpaqueToken()
+    if err != nil {
+        return Device{}, "", err
+    }
+    entity := deviceEntity{
+        ID:             uuid.NewV4().String(),
+        Name:           name,
+        TokenHash:      hashOpaqueToken(rawToken),
+        RegisteredBy:   nullIfEmpty(registeredBy),
+        TimeRegistered: db.Now(),
+    }
+    if err := insertDevice(sess, entity); err != nil {
+        return Device{}, "", err
+    }
+    return entity.toDevice(), rawToken, nil
+}
+
+// ListDevices returns all registered devices, including revoked devices
+func ListDevices(sess dbr.SessionRunner) ([]Device, error) {
+    entities, err := queryDevices(sess)
+    if err != nil {
+        return nil, err
+    }
+    devices := make([]Device, 0, len(entities))
+    for _, entity := range entities {
+        devices = append(devices, entity.toDevice())
+    }
+    return devices, nil
+}
+
+// RevokeDevice prevents further PIN sign-ins on the device
+func RevokeDevice(sess dbr.SessionRunner, id string) error {
+    if affected, err := revokeDevice(sess, id); err != nil {
+        return err
+    } else if affected == 0 {
+        return ErrDeviceNotFound
+    }
+    return nil
+}
+
+func (d deviceEntity) toDevice() Device {
+    return Device{
+        ID:             d.ID,
+        Name:           d.Name,
+        RegisteredBy:   d.RegisteredBy.String,
+        TimeRegistered: d.TimeRegistered,
+        TimeLastUsed:   d.TimeLastUsed.String,
+        Revoked:        d.Revoked,
+    }
+}
@@ -0,0 +1,148 @@
+package auth
+
+import (
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// deviceRows returns the registered device tablet-1 with the raw token "device"
+func deviceRows(revoked bool) *sqlmock.Rows {
+    return sqlmock.NewRows([]string{"id", "name", "token_hash", "registered_by", "time_registered", "time_last_used", "revoked"}).
+        AddRow("tablet-1", "Tablet at the bar", hashOpaqueToken("device"), "admin@garsson.io", db.Now(), nil, revoked)
+}
+
+// pinUserRows returns the account of bar@garsson.io with the given PIN, or without PIN if it is empty
+func pinUserRows(t *testing.T, pin string) *sqlmock.Rows {
+    var pinHash interface{}
+    if pin != "" {
+        hash, err := hashPassword(pin)
+        assert.NoError(t, err)
+        pinHash = hash
+    }
+    return sqlmock.NewRows([]string{"email", "password_hash", "pin_hash", "disabled"}).AddRow("bar@garsson.io", "", pinHash, false)
+}
+
+func TestAuthenticateWithPin(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    keys := signingKeys(t)
+    mock.ExpectQuery(`SELECT \* FROM device WHERE \(token_hash = '` + hashOpaqueToken("device") + `'\)`).WillReturnRows(deviceRows(false))
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(pinUserRows(t, "4321"))
+    expectUserAccess(mock, "bar", PermissionOrdersRead)
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(dbtest.EmptyRows())
+    expectRolesRequireMFA(mock, "bar", false)
+    mock.ExpectExec(`UPDATE "user_session" SET`).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectExec(`INSERT INTO "user_session"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "device" SET "time_last_used" = .* WHERE \(id = 'tablet-1'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "user_account" SET "last_sign_in"`).WillReturnResult(sqlmock.NewResult(0, 1))
+
+    token, user, err := AuthenticateWithPin(dao.NewSession(), "device", "bar@garsson.io", "4321", keys)
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.Equal(t, "bar@garsson.io", user.Email)
+    if validated, err := ValidateJWT(token, keys, noRevocations{}); assert.NoError(t, err) {
+        assert.Equal(t, "tablet-1", validated.Claims.Device, "the token is bound to the device")
+        assert.NotEmpty(t, validated.Claims.SessionID)
+    }
+}
+
+func TestAuthenticateWithPin_WrongPin(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM device`).WillReturnRows(deviceRows(false))
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(pinUserRows(t, "4321"))
+    expectUserAccess(mock, "bar")
+
+    _, _, err := AuthenticateWithPin(dao.NewSession(), "device", "bar@garsson.io", "1234", signingKeys(t))
+    assert.Equal(t, ErrInvalidPin, err)
+    assert.NoError(t, mock.ExpectationsWereMet(), "no session is stored")
+}
+
+func TestAuthenticateWithPin_RoleRequiresSecondFactor(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM device`).WillReturnRows(deviceRows(false))
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(pinUserRows(t, "4321"))
+    expectUserAccess(mock, "manager", PermissionUsersManage)
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(dbtest.EmptyRows())
+    expectRolesRequireMFA(mock, "manager", true)
+
+    token, _, err := AuthenticateWithPin(dao.NewSession(), "device", "bar@garsson.io", "4321", signingKeys(t))
+    assert.Equal(t, ErrPinNotAllowed, err)
+    assert.Empty(t, token)
+    assert.NoError(t, mock.ExpectationsWereMet(), "no session is stored")
+}
+
+func TestAuthenticateWithPin_SecondFactorEnabled(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM device`).WillReturnRows(deviceRows(false))
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(pinUserRows(t, "4321"))
+    expectUserAccess(mock, "bar")
+    mock.ExpectQuery(`SELECT \* FROM user_totp`).WillReturnRows(totpRows("bar@garsson.io", true))
+
+    _, _, err := AuthenticateWithPin(dao.NewSession(), "device", "bar@garsson.io", "4321", signingKeys(t))
+    assert.Equal(t, ErrPinNotAllowed, err)
+    assert.NoError(t, mock.ExpectationsWereMet(), "no session is stored")
+}
+
+func TestAuthenticateWithPin_UserWithoutPin(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM device`).WillReturnRows(deviceRows(false))
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(pinUserRows(t, ""))
+    expectUserAccess(mock, "bar")
+
+    _, _, err := AuthenticateWithPin(dao.NewSession(), "device", "bar@garsson.io", "", signingKeys(t))
+    assert.Equal(t, ErrInvalidPin, err)
+}
+
+func TestAuthenticateWithPin_RevokedDevice(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM device`).WillReturnRows(deviceRows(true))
+
+    _, _, err := AuthenticateWithPin(dao.NewSession(), "device", "bar@garsson.io", "4321", signingKeys(t))
+    assert.Equal(t, ErrUnknownDevice, err)
+    assert.NoError(t, mock.ExpectationsWereMet(), "the pin of the user is not checked")
+}
+
+func TestAuthenticateWithPin_UnknownDevice(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM device`).WillReturnRows(dbtest.EmptyRows())
+
+    _, _, err := AuthenticateWithPin(dao.NewSession(), "", "bar@garsson.io", "4321", signingKeys(t))
+    assert.Equal(t, ErrUnknownDevice, err)
+}
+
+func TestSetPin_Format(t *testing.T) {
+    for _, pin := range []string{"", "123", "1234567", "12a4", " 1234", "1234\n", "-1234", "１２３４"} {
+        dao, mock := dbtest.NewDbMock(t)
+        assert.Equal(t, ErrInvalidPinFormat, SetPin(dao.NewSession(), "bar@garsson.io", "secret", pin), "pin %q", pin)
+        assert.NoError(t, mock.ExpectationsWereMet(), "pin %q is rejected before the account is loaded", pin)
+    }
+    for _, pin := range []string{"1234", "00000", "123456"} {
+        assert.True(t, pinFormat.MatchString(pin), "pin %q", pin)
+    }
+}
+
+func TestSetPin_RequiresPassword(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    passwordHash, err := hashPassword("secret")
+    assert.NoError(t, err)
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("bar@garsson.io", passwordHash, false))
+    expectUserAccess(mock, "bar")
+
+    assert.Equal(t, ErrInvalidPassword, SetPin(dao.NewSession(), "bar@garsson.io", "wrong", "1234"))
+    assert.NoError(t, mock.ExpectationsWereMet(), "the pin is not stored")
+}
+
+func TestSetPin_StoresHash(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    passwordHash, err := hashPassword("secret")
+    assert.NoError(t, err)
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("bar@garsson.io", passwordHash, false))
+    expectUserAccess(mock, "bar")
+    mock.ExpectExec(`UPDATE "user_account" SET "pin_hash" = '\$argon2id\$.*' WHERE \(email = 'bar@garsson.io'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+
+    assert.NoError(t, SetPin(dao.NewSession(), "bar@garsson.io", "secret", "1234"))
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,97 @@
+package auth
+
+import (
+    "sync"
+    "time"
+
+    "github.com/gocraft/dbr"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+// DefaultRevocationRefreshInterval is how often the revocation list is reloaded from the database, it is the maximum
+// time it takes before a token revoked by another instance is rejected.
+const DefaultRevocationRefreshInterval = 30 * time.Second
+
+// RevocationChecker tells if a token, identified by its jti, has been revoked
+type RevocationChecker interface {
+    IsRevoked(jti string) bool
+}
+
+// RevocationList caches the revoked token ids of the revoked_token table so that validating a JWT does not require
+// a database query. Revoked tokens are kept until they expire, because access tokens are short-lived the list
+// remains small.
+type RevocationList struct {
+    dao             *db.Dao
+    refreshInterval time.Duration
+
+    mutex      sync.RWMutex
+    revoked    map[string]bool
+    lastLoaded time.Time
+}
+
+// NewRevocationList creates a revocation list that reloads from the database every refreshInterval
+func NewRevocationList(dao *db.Dao, refreshInterval time.Duration) *RevocationList {
+    return &RevocationList{
+        dao:             dao,
+        refreshInterval: refreshInterval,
+        revoked:         map[string]bool{},
+    }
+}
+
+// IsRevoked returns true if the token with the given jti has been revoked. Reloads the list if it is outdated,
+// if reloading fails the previously loaded list is used.
+func (r *RevocationList) IsRevoked(jti string) bool {
+    r.mutex.RLock()
+    outdated := time.Since(r.lastLoaded) > r.refreshInterval
+    revoked := r.revoked[jti]
+    r.mutex.RUnlock()
+
+    if outdated {
+        r.reload()
+        r.mutex.RLock()
+        revoked = r.revoked[jti]
+        r.mutex.RUnlock()
+    }
+    return revoked
+}
+
+// Revoke stores the revocation in the database and adds it to the cache, expiresAt is the expiry of the token
+// after which the revocation no longer needs to be remembered.
+func (r *RevocationList) Revoke(sess dbr.SessionRunner, jti, email string, expiresAt time.Time) error {
+    if err := insertRevokedToken(sess, revokedTokenEntity{
+        Jti:         jti,
+        Email:       email,
+        TimeRevoked: db.Now(),
+        TimeExpires: db.FormatTime(expiresAt),
+    }); err != nil {
+        return err
+    }
+    r.mutex.Lock()
+    r.revoked[jti] = true
+    r.mutex.Unlock()
+    return nil
+}
+
+func (r *RevocationList) reload() {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if time.Since(r.lastLoaded) <= r.refreshInterval {
+        return // reloaded by another goroutine while waiting for the lock
+    }
+
+    sess := r.dao.NewSession()
+    if err := deleteExpiredRevokedTokens(sess); err != nil {
+        log.WithError(err).Warn("could not prune expired revoked tokens")
+    }
+    if jtis, err := queryRevokedTokenIDs(sess); err != nil {
+        log.WithError(err).Error("could not reload token revocation list, using previous list")
+    } else {
+        revoked := make(map[string]bool, len(jtis))
+        for _, jti := range jtis {
+            revoked[jti] = true
+        }
+        r.revoked = revoked
+        r.lastLoaded = time.Now()
+    }
+}
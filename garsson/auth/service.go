@@ -1,7 +1,6 @@
 package auth
 
 import (
-    "encoding/hex"
     "errors"
     "fmt"
     "strings"
@@ -9,9 +8,10 @@ import (
 
     "github.com/dgrijalva/jwt-go"
     "github.com/gocraft/dbr"
+    "github.com/kubernetes/kubernetes/pkg/util/slice"
     "github.com/satori/go.uuid"
+    "github.com/toefel18/garsson-api/garsson/db"
     "github.com/toefel18/garsson-api/garsson/log"
-    "golang.org/x/crypto/sha3"
 )
 
 var (
@@ -19,76 +19,300 @@ var (
     ErrUserNotFound = errors.New("user not found")
     // ErrInvalidPassword indicates that the passwords was incorrect
     ErrInvalidPassword = errors.New("invalid password")
+    // ErrUserDisabled indicates that the user account has been disabled by an administrator
+    ErrUserDisabled = errors.New("user disabled")
+    // ErrUserAlreadyExists indicates that a user with the same email already exists
+    ErrUserAlreadyExists = errors.New("user already exists")
+    // ErrUserStillReferenced indicates that the user cannot be deleted because other records refer to it, disable it instead
+    ErrUserStillReferenced = errors.New("user is still referenced by other records, disable the user instead")
+    // ErrInvalidEmail indicates that the email address is not valid
+    ErrInvalidEmail = errors.New("invalid email address")
+    // ErrPasswordTooShort indicates that a new password does not have the minimal length
+    ErrPasswordTooShort = fmt.Errorf("password must have at least %v characters", MinPasswordLength)
+    // ErrTokenRevoked indicates that the JWT has been revoked, for example because the user logged out
+    ErrTokenRevoked = errors.New("token has been revoked")
+    // ErrInvalidRole indicates that a role name is empty
+    ErrInvalidRole = errors.New("role names must not be empty")
 )
 
 const (
-    // TokenValidity is the time in which the token is valid
-    TokenValidity = time.Hour * 8
+    // TokenValidity is the time in which the access token is valid, use a refresh token to obtain a new one
+    TokenValidity = time.Minute * 15
     // TokenGenerationErrorFmt contains the error format when token generation does not work
     TokenGenerationErrorFmt = "could not generate token: %v"
+    // MinPasswordLength is the minimal amount of characters of a new password
+    MinPasswordLength = 8
+    // maxEmailLength is the size of the email column
+    maxEmailLength = 128
 )
 
-// Authenticate checks if a user has the right credentials and provides a JWT token, along with the users entity
-func Authenticate(sess dbr.SessionRunner, email, password string, signingSecret []byte) (string, UserEntity, error) {
-    if user, err := QueryUserEntity(sess, email); err == dbr.ErrNotFound {
-        return "", UserEntity{}, ErrUserNotFound
-    } else if hashPassword(password) != user.PasswordHash {
-        return "", UserEntity{}, ErrInvalidPassword
-    } else if jwtToken, err := createToken(user, signingSecret); err != nil {
-        return "", UserEntity{}, fmt.Errorf(TokenGenerationErrorFmt, err.Error())
+// Authenticate checks if a user has the right credentials and provides an access and refresh token, along with the
+// users entity. Password hashes using a legacy algorithm or outdated parameters are upgraded after a successful sign-in.
+// Users that need a second factor receive an *MFARequiredError instead of tokens, see CompleteMFASignIn. An unknown
+// email fails with ErrInvalidPassword after the same amount of work as a wrong password.
+func Authenticate(sess dbr.SessionRunner, email, password string, keys *KeySet) (Tokens, UserEntity, error) {
+    user, err := QueryUserEntity(sess, email)
+    if err == dbr.ErrNotFound {
+        verifyDummyPassword(password)
+        return Tokens{}, UserEntity{}, ErrInvalidPassword
+    } else if err != nil {
+        return Tokens{}, UserEntity{}, err
+    } else if user.Disabled {
+        verifyDummyPassword(password)
+        return Tokens{}, UserEntity{}, ErrUserDisabled
+    } else if user.PasswordHash == "" {
+        verifyDummyPassword(password)
+        return Tokens{}, UserEntity{}, ErrInvalidPassword // invitation not accepted yet
+    }
+
+    if matches, needsRehash, err := verifyPassword(password, user.PasswordHash); err != nil {
+        log.WithField("email", email).WithError(err).Error("stored password hash cannot be verified")
+        return Tokens{}, UserEntity{}, ErrInvalidPassword
+    } else if !matches {
+        return Tokens{}, UserEntity{}, ErrInvalidPassword
+    } else if needsRehash {
+        rehashPassword(sess, user.Email, password)
+    }
+    if err := requireSecondFactor(sess, user, keys); err != nil {
+        return Tokens{}, UserEntity{}, err
+    }
+
+    if tokens, err := issueTokens(sess, user, newTokenFamilyID(), keys); err != nil {
+        return Tokens{}, UserEntity{}, err
     } else {
-        UpdateLastSignInToNow(sess, user.Email)
+        if err := UpdateLastSignInToNow(sess, user.Email); err != nil {
+            log.WithField("email", user.Email).WithError(err).Warn("could not update last sign-in")
+        }
         user.PasswordHash = "" // no need to expose!
-        return jwtToken, user, nil
+        return tokens, user, nil
     }
 }
 
-// ValidateJWT parses the JWT and checks if the signature, returns a user object which includes the claims
-func ValidateJWT(rawJWT string, signingSecret []byte) (UserFromJwt, error) {
-    if rawJWT == "dev" { //TODO remove this line, which just makes for easy testing
-        return UserFromJwt{Email: "dev@dev.nl", Roles: []string{"admin"}, Claims: nil}, nil
+// rehashPassword replaces the stored hash with one using the current algorithm, failures are logged but do
+// not prevent the sign-in because the old hash remains valid.
+func rehashPassword(sess dbr.SessionRunner, email, password string) {
+    if newHash, err := hashPassword(password); err != nil {
+        log.WithField("email", email).WithError(err).Warn("could not rehash password")
+    } else if err := UpdatePasswordHash(sess, email, newHash); err != nil {
+        log.WithField("email", email).WithError(err).Warn("could not store rehashed password")
+    } else {
+        log.WithField("email", email).Info("upgraded password hash")
     }
-    parsedJwt, err := jwt.ParseWithClaims(strings.TrimSpace(rawJWT), &JwtClaims{}, signatureAndAlgorithmVerifier(signingSecret))
+}
+
+// ListUsers returns all user accounts
+func ListUsers(sess dbr.SessionRunner) ([]User, error) {
+    entities, err := QueryUserEntities(sess)
     if err != nil {
-        return UserFromJwt{}, err
+        return nil, err
+    }
+    users := make([]User, 0, len(entities))
+    for _, entity := range entities {
+        users = append(users, entity.ToUser())
     }
-    if claims, ok := parsedJwt.Claims.(*JwtClaims); ok {
-        return UserFromJwt{Email: claims.Subject, Roles: claims.Roles, Claims: claims}, nil
+    return users, nil
+}
+
+// FindUser returns the user account with the given email, or ErrUserNotFound
+func FindUser(sess dbr.SessionRunner, email string) (User, error) {
+    if entity, err := QueryUserEntity(sess, email); err == dbr.ErrNotFound {
+        return User{}, ErrUserNotFound
+    } else if err != nil {
+        return User{}, err
     } else {
-        return UserFromJwt{}, fmt.Errorf("jwt did not have expected claims")
+        return entity.ToUser(), nil
+    }
+}
+
+// CreateUser validates and stores a new user account with a hashed initial password and its roles
+func CreateUser(sess *dbr.Session, newUser NewUser) (User, error) {
+    email := strings.TrimSpace(newUser.Email)
+    if !isValidEmail(email) {
+        return User{}, ErrInvalidEmail
     }
+    roles, err := cleanRoles(newUser.Roles)
+    if err != nil {
+        return User{}, err
+    }
+    passwordHash, err := newPasswordHash(newUser.Password)
+    if err != nil {
+        return User{}, err
+    }
+
+    tx, err := sess.Begin()
+    if err != nil {
+        return User{}, err
+    }
+    defer tx.RollbackUnlessCommitted()
+    entity := UserEntity{Email: email, PasswordHash: passwordHash, Roles: roles}
+    if err := insertUserWithRoles(tx, entity); err != nil {
+        return User{}, err
+    }
+    if err := tx.Commit(); err != nil {
+        return User{}, err
+    }
+    return entity.ToUser(), nil
 }
 
-func signatureAndAlgorithmVerifier(secret []byte) func(token *jwt.Token) (interface{}, error) {
-    return func(token *jwt.Token) (interface{}, error) {
-        // Don't forget to validate the alg is what you expect:
-        if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-            log.WithField("unexpectedSigningMethod", token.Header["alg"]).Warn("cannot validate JWT signature")
-            return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+// insertUserWithRoles stores the user and grants its roles
+func insertUserWithRoles(tx *dbr.Tx, entity UserEntity) error {
+    if err := insertUserEntity(tx, entity); db.IsUniqueViolation(err) {
+        return ErrUserAlreadyExists
+    } else if err != nil {
+        return err
+    }
+    if err := replaceUserRoles(tx, entity.Email, entity.Roles); db.IsForeignKeyViolation(err) {
+        return ErrUnknownRole
+    } else if err != nil {
+        return err
+    }
+    return nil
+}
+
+// UpdateUser applies the non-nil fields of update to the user account. Disabling a user or changing its password
+// revokes all tokens of the user. Changed roles take effect on the next sign-in or token refresh.
+func UpdateUser(sess *dbr.Session, revocations *RevocationList, email string, update UserUpdate) (User, error) {
+    var roles []string
+    if update.Roles != nil {
+        var err error
+        if roles, err = cleanRoles(*update.Roles); err != nil {
+            return User{}, err
         }
+    }
+    changes := map[string]interface{}{}
+    if update.Disabled != nil {
+        changes["disabled"] = *update.Disabled
+    }
+    if update.Password != nil {
+        if passwordHash, err := newPasswordHash(*update.Password); err != nil {
+            return User{}, err
+        } else {
+            changes["password_hash"] = passwordHash
+        }
+    }
 
-        return secret, nil
+    if err := updateUserAndRoles(sess, email, changes, update.Roles != nil, roles); err != nil {
+        return User{}, err
+    }
+    if (update.Disabled != nil && *update.Disabled) || update.Password != nil {
+        if err := RevokeUserTokens(sess, revocations, email); err != nil {
+            return User{}, err
+        }
+    }
+    return FindUser(sess, email)
+}
+
+// updateUserAndRoles applies the column changes and, if replaceRoles is set, replaces the roles in one transaction
+func updateUserAndRoles(sess *dbr.Session, email string, changes map[string]interface{}, replaceRoles bool, roles []string) error {
+    tx, err := sess.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.RollbackUnlessCommitted()
+    if len(changes) > 0 {
+        if affected, err := updateUserEntity(tx, email, changes); err != nil {
+            return err
+        } else if affected == 0 {
+            return ErrUserNotFound
+        }
+    } else if _, err := QueryUserEntity(tx, email); err == dbr.ErrNotFound {
+        return ErrUserNotFound
+    } else if err != nil {
+        return err
+    }
+    if replaceRoles {
+        if err := replaceUserRoles(tx, email, roles); db.IsForeignKeyViolation(err) {
+            return ErrUnknownRole
+        } else if err != nil {
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+// DeleteUser removes the user account. Users that are referenced by orders cannot be deleted, they should be disabled.
+func DeleteUser(sess dbr.SessionRunner, email string) error {
+    if affected, err := deleteUserEntity(sess, email); db.IsForeignKeyViolation(err) {
+        return ErrUserStillReferenced
+    } else if err != nil {
+        return err
+    } else if affected == 0 {
+        return ErrUserNotFound
+    }
+    return nil
+}
+
+// IsValidationError returns true if err is caused by invalid input of the caller
+func IsValidationError(err error) bool {
+    return err == ErrInvalidEmail || err == ErrPasswordTooShort || err == ErrInvalidRole || err == ErrUnknownRole ||
+        err == ErrInvalidAccountToken || err == ErrInvalidMFACode || err == ErrInvalidExternalSubject
+}
+
+func newPasswordHash(password string) (string, error) {
+    if len(password) < MinPasswordLength {
+        return "", ErrPasswordTooShort
+    }
+    return hashPassword(password)
+}
+
+// cleanRoles trims the role names and removes duplicates
+func cleanRoles(roles []string) ([]string, error) {
+    cleanedRoles := make([]string, 0, len(roles))
+    for _, role := range roles {
+        trimmedRole := strings.TrimSpace(role)
+        if trimmedRole == "" {
+            return nil, ErrInvalidRole
+        }
+        if !slice.ContainsString(cleanedRoles, trimmedRole, nil) {
+            cleanedRoles = append(cleanedRoles, trimmedRole)
+        }
+    }
+    return cleanedRoles, nil
+}
+
+func isValidEmail(email string) bool {
+    at := strings.Index(email, "@")
+    return at > 0 && at < len(email)-1 && len(email) <= maxEmailLength && !strings.ContainsAny(email, " \t\n,")
+}
+
+// ValidateJWT parses the JWT and checks the signature and whether it has been revoked, returns a user object which
+// includes the claims
+func ValidateJWT(rawJWT string, keys *KeySet, revocations RevocationChecker) (UserFromJwt, error) {
+    parsedJwt, err := jwt.ParseWithClaims(strings.TrimSpace(rawJWT), &JwtClaims{}, keys.verificationKey)
+    if err != nil {
+        return UserFromJwt{}, err
+    }
+    if claims, ok := parsedJwt.Claims.(*JwtClaims); !ok {
+        return UserFromJwt{}, fmt.Errorf("jwt did not have expected claims")
+    } else if claims.Audience == mfaTokenAudience {
+        return UserFromJwt{}, fmt.Errorf("mfa token cannot be used as access token")
+    } else if revocations.IsRevoked(claims.Id) {
+        return UserFromJwt{}, ErrTokenRevoked
+    } else {
+        return UserFromJwt{Email: claims.Subject, Roles: claims.Roles, Permissions: claims.Permissions, Claims: claims}, nil
     }
 }
 
-func hashPassword(password string) string {
-    rawHash := sha3.Sum512([]byte(password))
-    return hex.EncodeToString(rawHash[:])
+func createToken(user UserEntity, sessionID string, keys *KeySet) (string, *JwtClaims, error) {
+    claims := newClaims(user, TokenValidity)
+    claims.SessionID = sessionID
+    signedToken, err := keys.Sign(claims)
+    return signedToken, &claims, err
 }
 
-func createToken(user UserEntity, signingSecret []byte) (string, error) {
-    claims := JwtClaims{
+// newClaims creates the claims of a token for the user that expires after validity
+func newClaims(user UserEntity, validity time.Duration) JwtClaims {
+    return JwtClaims{
         StandardClaims: jwt.StandardClaims{
             Id:        uuid.NewV4().String(),
             Issuer:    "garsson-api",
             IssuedAt:  time.Now().Unix(),
             NotBefore: time.Now().Add(-2 * time.Minute).Unix(), // -2 minutes to allow for clock drift
-            ExpiresAt: time.Now().Add(TokenValidity).Unix(),
+            ExpiresAt: time.Now().Add(validity).Unix(),
             Audience:  "garsson-api-users",
             Subject:   user.Email,
         },
-        Roles: user.GetRoles(),
+        Roles:       user.Roles,
+        Permissions: user.Permissions,
     }
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    return token.SignedString(signingSecret)
 }
@@ -0,0 +1,144 @@
+package auth
+
+import (
+    "encoding/json"
+    "testing"
+    "time"
+
+    "github.com/lib/pq"
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestAuthenticate_UnknownUserFailsLikeWrongPassword(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM user_account WHERE \(email = 'nobody@garsson.io'\)`).WillReturnRows(dbtest.EmptyRows())
+    hash, _ := hashPassword("secret")
+    mock.ExpectQuery(`SELECT \* FROM user_account WHERE \(email = 'bar@garsson.io'\)`).WillReturnRows(userRows("bar@garsson.io", hash, false))
+    expectUserAccess(mock, "bar")
+
+    _, _, unknownErr := Authenticate(dao.NewSession(), "nobody@garsson.io", "secret", nil)
+    _, _, wrongErr := Authenticate(dao.NewSession(), "bar@garsson.io", "wrong", nil)
+    assert.Equal(t, ErrInvalidPassword, unknownErr)
+    assert.Equal(t, wrongErr, unknownErr)
+    assert.NotEmpty(t, dummyPasswordHash, "a password was verified for the unknown user")
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateUser(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectExec(`INSERT INTO "user_account" \("email","password_hash","disabled","external_subject"\) VALUES \('bar@garsson.io','\$argon2id\$[^']+',FALSE,NULL\)`).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`DELETE FROM "user_role" WHERE \(email = 'bar@garsson.io'\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectExec(`INSERT INTO "user_role" \("email","role_name"\) VALUES \('bar@garsson.io','bar'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    user, err := CreateUser(dao.NewSession(), NewUser{Email: " bar@garsson.io ", Password: "correct horse", Roles: []string{"bar", " bar"}})
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.Equal(t, User{Email: "bar@garsson.io", Roles: []string{"bar"}}, user)
+}
+
+func TestCreateUser_DuplicateEmail(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectExec(`INSERT INTO "user_account"`).WillReturnError(&pq.Error{Code: "23505"})
+    mock.ExpectRollback()
+
+    _, err := CreateUser(dao.NewSession(), NewUser{Email: "bar@garsson.io", Password: "correct horse", Roles: []string{"bar"}})
+    assert.Equal(t, ErrUserAlreadyExists, err)
+    assert.NoError(t, mock.ExpectationsWereMet(), "no roles are granted")
+}
+
+func TestCreateUser_UnknownRole(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectExec(`INSERT INTO "user_account"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`DELETE FROM "user_role"`).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectExec(`INSERT INTO "user_role"`).WillReturnError(&pq.Error{Code: "23503"})
+    mock.ExpectRollback()
+
+    _, err := CreateUser(dao.NewSession(), NewUser{Email: "bar@garsson.io", Password: "correct horse", Roles: []string{"superuser"}})
+    assert.Equal(t, ErrUnknownRole, err)
+    assert.NoError(t, mock.ExpectationsWereMet(), "the user is not created")
+}
+
+func TestUpdateUser_ReplacesRoles(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM user_account WHERE \(email = 'bar@garsson.io'\)`).WillReturnRows(userRows("bar@garsson.io", "hash", false))
+    expectUserAccess(mock, "bar")
+    mock.ExpectExec(`DELETE FROM "user_role" WHERE \(email = 'bar@garsson.io'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`INSERT INTO "user_role" \("email","role_name"\) VALUES \('bar@garsson.io','waiter'\), \('bar@garsson.io','manager'\)`).
+        WillReturnResult(sqlmock.NewResult(0, 2))
+    mock.ExpectCommit()
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("bar@garsson.io", "hash", false))
+    mock.ExpectQuery(`SELECT role_name FROM user_role`).WillReturnRows(sqlmock.NewRows([]string{"role_name"}).AddRow("manager").AddRow("waiter"))
+    mock.ExpectQuery(`SELECT \* FROM role_inheritance`).WillReturnRows(sqlmock.NewRows([]string{"role_name", "inherited_role_name"}))
+    mock.ExpectQuery(`SELECT \* FROM role_permission`).WillReturnRows(sqlmock.NewRows([]string{"role_name", "permission_name"}))
+
+    roles := []string{"waiter", "manager"}
+    user, err := UpdateUser(dao.NewSession(), NewRevocationList(nil, time.Hour), "bar@garsson.io", UserUpdate{Roles: &roles})
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet(), "changing roles does not revoke tokens")
+    assert.ElementsMatch(t, roles, user.Roles)
+}
+
+func TestUpdateUser_DisablingRevokesTokens(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    revocations := NewRevocationList(nil, time.Hour)
+    mock.ExpectBegin()
+    mock.ExpectExec(`UPDATE "user_account" SET "disabled" = TRUE WHERE \(email = 'bar@garsson.io'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+    mock.ExpectQuery(`SELECT \* FROM refresh_token WHERE \(email = 'bar@garsson.io'`).WillReturnRows(refreshTokenRows("refresh", false, "jti-1"))
+    mock.ExpectExec(`INSERT INTO "revoked_token" .*'jti-1'`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "refresh_token" SET "revoked" = TRUE WHERE \(email = 'bar@garsson.io'`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "user_session" SET "revoked" = TRUE WHERE \(email = 'bar@garsson.io'`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("bar@garsson.io", "hash", true))
+    expectUserAccess(mock, "bar")
+
+    disabled := true
+    user, err := UpdateUser(dao.NewSession(), revocations, "bar@garsson.io", UserUpdate{Disabled: &disabled})
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.True(t, user.Disabled)
+    assert.True(t, revocations.revoked["jti-1"], "the access token of the user is rejected")
+}
+
+func TestUpdateUser_UnknownUser(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectExec(`UPDATE "user_account"`).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectRollback()
+
+    disabled := true
+    _, err := UpdateUser(dao.NewSession(), NewRevocationList(nil, time.Hour), "nobody@garsson.io", UserUpdate{Disabled: &disabled})
+    assert.Equal(t, ErrUserNotFound, err)
+    assert.NoError(t, mock.ExpectationsWereMet(), "no tokens are revoked")
+}
+
+func TestDeleteUser(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectExec(`DELETE FROM "user_account" WHERE \(email = 'bar@garsson.io'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`DELETE FROM "user_account"`).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectExec(`DELETE FROM "user_account"`).WillReturnError(&pq.Error{Code: "23503"})
+
+    assert.NoError(t, DeleteUser(dao.NewSession(), "bar@garsson.io"))
+    assert.Equal(t, ErrUserNotFound, DeleteUser(dao.NewSession(), "nobody@garsson.io"))
+    assert.Equal(t, ErrUserStillReferenced, DeleteUser(dao.NewSession(), "waiter@garsson.io"))
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListUsers_NeverExposesPasswordHash(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM user_account ORDER BY email`).WillReturnRows(userRows("bar@garsson.io", "$argon2id$secret-hash", false))
+    mock.ExpectQuery(`SELECT \* FROM user_role ORDER BY role_name`).WillReturnRows(sqlmock.NewRows([]string{"email", "role_name"}).AddRow("bar@garsson.io", "bar"))
+
+    users, err := ListUsers(dao.NewSession())
+    assert.NoError(t, err)
+    serialized, err := json.Marshal(users)
+    assert.NoError(t, err)
+    assert.Equal(t, `[{"email":"bar@garsson.io","roles":["bar"],"disabled":false,"invitationPending":false}]`, string(serialized))
+}
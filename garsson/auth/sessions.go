@@ -0,0 +1,237 @@
+package auth
+
+import (
+    "errors"
+    "sync"
+    "time"
+
+    "github.com/gocraft/dbr"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+// Every sign-in starts a session that lasts as long as its tokens can be refreshed. Access tokens carry the session
+// id in the sid claim and are rejected once their session is revoked, so users and administrators can sign out a
+// lost phone or a forgotten browser without waiting for its tokens to expire. The session id of a sign-in with
+// password is the id of its token family.
+//
+// Checking the session must not cost a query per request, so a SessionCache keeps the ids of the revoked sessions in
+// memory and reloads them from the database like the RevocationList does. The last activity of a session is written
+// at most once per sessionLastSeenResolution.
+
+var (
+    // ErrSessionNotFound indicates that the user has no session with the given id
+    ErrSessionNotFound = errors.New("session not found")
+    // ErrSessionRevoked indicates that the session of the token has been revoked
+    ErrSessionRevoked = errors.New("session has been revoked")
+)
+
+const (
+    // DefaultSessionRefreshInterval is how often the revoked sessions are reloaded from the database, it is the
+    // maximum time it takes before a session revoked by another instance is rejected.
+    DefaultSessionRefreshInterval = 30 * time.Second
+    // sessionLastSeenResolution limits how often the last activity of a session is written
+    sessionLastSeenResolution = time.Minute
+)
+
+// SessionCache caches the ids of the revoked sessions of the user_session table, so that checking the session of a
+// token does not require a database query. Revoked sessions are kept until they expire.
+type SessionCache struct {
+    dao             *db.Dao
+    refreshInterval time.Duration
+
+    mutex      sync.RWMutex
+    revoked    map[string]bool
+    lastSeen   map[string]time.Time
+    lastLoaded time.Time
+}
+
+// Session is the public representation of a session
+type Session struct {
+    ID           string `json:"id"`
+    DeviceID     string `json:"deviceId,omitempty"`
+    IP           string `json:"ip,omitempty"`
+    UserAgent    string `json:"userAgent,omitempty"`
+    TimeCreated  string `json:"timeCreated"`
+    TimeLastSeen string `json:"timeLastSeen"`
+    TimeExpires  string `json:"timeExpires"`
+    // Current is true for the session of the token that made the request
+    Current bool `json:"current"`
+}
+
+// SessionClient describes the client that holds the tokens of a session
+type SessionClient struct {
+    IP        string
+    UserAgent string
+    // DeviceID is the registered device of a PIN sign-in, empty otherwise
+    DeviceID string
+}
+
+// DescribeSession records the client to which the tokens of the session were issued
+func DescribeSession(sess dbr.SessionRunner, sessionID string, client SessionClient) error {
+    return updateUserSessionClient(sess, sessionID,
+        nullIfEmpty(client.IP),
+        nullIfEmpty(truncate(client.UserAgent, maxUserAgentLength)),
+        nullIfEmpty(client.DeviceID))
+}
+
+// NewSessionCache creates a session cache that reloads the revoked sessions from the database every refreshInterval
+func NewSessionCache(dao *db.Dao, refreshInterval time.Duration) *SessionCache {
+    return &SessionCache{
+        dao:             dao,
+        refreshInterval: refreshInterval,
+        revoked:         map[string]bool{},
+        lastSeen:        map[string]time.Time{},
+    }
+}
+
+// IsRevoked returns true if the session has been revoked. Reloads the revoked sessions if they are outdated, if
+// reloading fails the previously loaded sessions are used.
+func (c *SessionCache) IsRevoked(sessionID string) bool {
+    c.mutex.RLock()
+    outdated := time.Since(c.lastLoaded) > c.refreshInterval
+    revoked := c.revoked[sessionID]
+    c.mutex.RUnlock()
+
+    if outdated {
+        c.reload()
+        c.mutex.RLock()
+        revoked = c.revoked[sessionID]
+        c.mutex.RUnlock()
+    }
+    return revoked
+}
+
+// Check returns ErrSessionRevoked if the session has been revoked, and records the activity of the session
+func (c *SessionCache) Check(sess dbr.SessionRunner, sessionID string) error {
+    if c.IsRevoked(sessionID) {
+        return ErrSessionRevoked
+    }
+    now := time.Now()
+    c.mutex.Lock()
+    seen := now.Sub(c.lastSeen[sessionID]) < sessionLastSeenResolution
+    if !seen {
+        c.lastSeen[sessionID] = now
+    }
+    c.mutex.Unlock()
+    if seen {
+        return nil
+    }
+    if err := updateUserSessionLastSeen(sess, sessionID, db.FormatTime(now), db.FormatTime(now.Add(-sessionLastSeenResolution))); err != nil {
+        log.WithField("session", sessionID).WithError(err).Warn("could not update last activity of session")
+    }
+    return nil
+}
+
+// Revoke signs out a single session of the user like RevokeSession, and rejects the session immediately
+func (c *SessionCache) Revoke(sess *dbr.Session, revocations *RevocationList, email, sessionID string) error {
+    if err := RevokeSession(sess, revocations, email, sessionID); err != nil {
+        return err
+    }
+    c.mutex.Lock()
+    c.revoked[sessionID] = true
+    delete(c.lastSeen, sessionID)
+    c.mutex.Unlock()
+    return nil
+}
+
+func (c *SessionCache) reload() {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if time.Since(c.lastLoaded) <= c.refreshInterval {
+        return // reloaded by another goroutine while waiting for the lock
+    }
+
+    if ids, err := queryRevokedUserSessionIDs(c.dao.NewSession(), db.Now()); err != nil {
+        log.WithError(err).Error("could not reload revoked sessions, using previous sessions")
+    } else {
+        revoked := make(map[string]bool, len(ids))
+        for _, id := range ids {
+            revoked[id] = true
+        }
+        c.revoked = revoked
+        c.lastLoaded = time.Now()
+    }
+    for sessionID, seen := range c.lastSeen {
+        if time.Since(seen) >= sessionLastSeenResolution {
+            delete(c.lastSeen, sessionID)
+        }
+    }
+}
+
+// ListSessions returns the active sessions of the user, currentSessionID marks the session of the caller
+func ListSessions(sess dbr.SessionRunner, email, currentSessionID string) ([]Session, error) {
+    entities, err := queryActiveUserSessions(sess, email)
+    if err != nil {
+        return nil, err
+    }
+    sessions := make([]Session, 0, len(entities))
+    for _, entity := range entities {
+        sessions = append(sessions, entity.toSession(currentSessionID))
+    }
+    return sessions, nil
+}
+
+// RevokeSession signs out a single session of the user, its refresh tokens and its current access token are revoked
+// in one transaction. Revoking a revoked session again succeeds without changes.
+func RevokeSession(sess *dbr.Session, revocations *RevocationList, email, sessionID string) error {
+    tx, err := sess.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.RollbackUnlessCommitted()
+
+    userSession, err := queryUserSession(tx, sessionID)
+    if err == dbr.ErrNotFound || (err == nil && userSession.Email != email) {
+        return ErrSessionNotFound
+    } else if err != nil {
+        return err
+    } else if userSession.Revoked {
+        return nil // its tokens have been revoked with it
+    }
+    if err := revokeUserSession(tx, sessionID); err != nil {
+        return err
+    }
+    if _, err := revokeRefreshTokenFamily(tx, sessionID); err != nil {
+        return err
+    }
+    // the session outlives its access tokens, so its expiry bounds the expiry of the current access token
+    expires, err := db.ParseTime(userSession.TimeExpires)
+    if err != nil {
+        expires = time.Now().Add(RefreshTokenValidity)
+    }
+    if err := revocations.Revoke(tx, userSession.CurrentTokenID, email, expires); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// storeSession starts the session on its first token and records every later token, which extends the session
+func storeSession(sess dbr.SessionRunner, sessionID, email, tokenID string, now, expires time.Time) error {
+    if updated, err := updateUserSessionToken(sess, sessionID, tokenID, db.FormatTime(now), db.FormatTime(expires)); err != nil {
+        return err
+    } else if updated > 0 {
+        return nil
+    }
+    return insertUserSession(sess, userSessionEntity{
+        ID:             sessionID,
+        Email:          email,
+        CurrentTokenID: tokenID,
+        TimeCreated:    db.FormatTime(now),
+        TimeLastSeen:   db.FormatTime(now),
+        TimeExpires:    db.FormatTime(expires),
+    })
+}
+
+func (s userSessionEntity) toSession(currentSessionID string) Session {
+    return Session{
+        ID:           s.ID,
+        DeviceID:     s.DeviceID.String,
+        IP:           s.IP.String,
+        UserAgent:    s.UserAgent.String,
+        TimeCreated:  s.TimeCreated,
+        TimeLastSeen: s.TimeLastSeen,
+        TimeExpires:  s.TimeExpires,
+        Current:      s.ID == currentSessionID,
+    }
+}
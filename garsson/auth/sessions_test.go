@@ -0,0 +1,171 @@
+package auth
+
+import (
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/gocraft/dbr"
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// userSessionRows returns the session family-1 of waiter@garsson.nl with the current access token jti-1
+func userSessionRows(revoked bool) *sqlmock.Rows {
+    now := time.Now()
+    return sqlmock.NewRows([]string{"id", "email", "current_token_id", "device_id", "ip", "user_agent", "time_created", "time_last_seen", "time_expires", "revoked"}).
+        AddRow("family-1", "waiter@garsson.nl", "jti-1", nil, nil, nil, db.FormatTime(now), db.FormatTime(now), db.FormatTime(now.Add(RefreshTokenValidity)), revoked)
+}
+
+// revokedSessionRows returns the ids of revoked sessions as loaded by the SessionCache
+func revokedSessionRows(ids ...string) *sqlmock.Rows {
+    rows := sqlmock.NewRows([]string{"id"})
+    for _, id := range ids {
+        rows.AddRow(id)
+    }
+    return rows
+}
+
+func TestCreateToken_CarriesSessionID(t *testing.T) {
+    key, err := GenerateEd25519Key("ed-1")
+    assert.NoError(t, err)
+    keys := NewKeySet()
+    assert.NoError(t, keys.Add(key))
+
+    token, claims, err := createToken(UserEntity{Email: "waiter@garsson.nl", Roles: []string{"waiter"}}, "family-1", keys)
+    assert.NoError(t, err)
+    assert.Equal(t, "family-1", claims.SessionID)
+    user, err := ValidateJWT(token, keys, noRevocations{})
+    assert.NoError(t, err)
+    assert.Equal(t, "family-1", user.Claims.SessionID)
+}
+
+func TestUserSessionEntity_ToSession(t *testing.T) {
+    entity := userSessionEntity{
+        ID:           "family-1",
+        Email:        "waiter@garsson.nl",
+        DeviceID:     dbr.NewNullString("tablet-1"),
+        UserAgent:    dbr.NewNullString("Mozilla/5.0"),
+        TimeCreated:  "2018-06-01T10:00:00Z",
+        TimeLastSeen: "2018-06-01T10:05:00Z",
+        TimeExpires:  "2018-06-01T18:00:00Z",
+    }
+
+    session := entity.toSession("family-1")
+    assert.True(t, session.Current)
+    assert.Equal(t, "tablet-1", session.DeviceID)
+    assert.Equal(t, "", session.IP)
+    assert.False(t, entity.toSession("family-2").Current)
+}
+
+func TestRevokeSession(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    revocations := NewRevocationList(nil, time.Hour)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM user_session WHERE \(id = 'family-1'\)`).WillReturnRows(userSessionRows(false))
+    mock.ExpectExec(`UPDATE "user_session" SET "revoked" = TRUE WHERE \(id = 'family-1'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "refresh_token" SET "revoked" = TRUE WHERE \(family_id = 'family-1'\)`).WillReturnResult(sqlmock.NewResult(0, 2))
+    mock.ExpectExec(`INSERT INTO "revoked_token" .*'jti-1','waiter@garsson.nl'`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    assert.NoError(t, RevokeSession(dao.NewSession(), revocations, "waiter@garsson.nl", "family-1"))
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.True(t, revocations.revoked["jti-1"], "the current access token is rejected")
+}
+
+func TestRevokeSession_RollsBackOnFailure(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM user_session`).WillReturnRows(userSessionRows(false))
+    mock.ExpectExec(`UPDATE "user_session" SET "revoked"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "refresh_token" SET "revoked"`).WillReturnError(errors.New("connection lost"))
+    mock.ExpectRollback()
+
+    assert.Error(t, RevokeSession(dao.NewSession(), NewRevocationList(nil, time.Hour), "waiter@garsson.nl", "family-1"))
+    assert.NoError(t, mock.ExpectationsWereMet(), "the session is not revoked without its refresh tokens")
+}
+
+func TestRevokeSession_SessionOfOtherUser(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM user_session`).WillReturnRows(userSessionRows(false))
+    mock.ExpectRollback()
+
+    assert.Equal(t, ErrSessionNotFound, RevokeSession(dao.NewSession(), NewRevocationList(nil, time.Hour), "bar@garsson.io", "family-1"))
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeSession_UnknownSession(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM user_session`).WillReturnRows(dbtest.EmptyRows())
+    mock.ExpectRollback()
+
+    assert.Equal(t, ErrSessionNotFound, RevokeSession(dao.NewSession(), NewRevocationList(nil, time.Hour), "waiter@garsson.nl", "family-1"))
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeSession_AlreadyRevoked(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM user_session`).WillReturnRows(userSessionRows(true))
+    mock.ExpectRollback()
+
+    assert.NoError(t, RevokeSession(dao.NewSession(), NewRevocationList(nil, time.Hour), "waiter@garsson.nl", "family-1"))
+    assert.NoError(t, mock.ExpectationsWereMet(), "the access token is not revoked twice")
+}
+
+func TestSessionCache_LoadsRevokedSessionsOncePerInterval(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    cache := NewSessionCache(dao, time.Hour)
+    mock.ExpectQuery(`SELECT id FROM user_session WHERE \(revoked = TRUE AND time_expires > '.*'\)`).WillReturnRows(revokedSessionRows("family-2"))
+    mock.ExpectExec(`UPDATE "user_session" SET "time_last_seen" = .* WHERE \(id = 'family-1' AND time_last_seen < '.*'\)`).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+
+    assert.NoError(t, cache.Check(dao.NewSession(), "family-1"))
+    assert.NoError(t, cache.Check(dao.NewSession(), "family-1"), "the activity is written once per resolution")
+    assert.Equal(t, ErrSessionRevoked, cache.Check(dao.NewSession(), "family-2"))
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSessionCache_ReloadsOutdatedSessions(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    cache := NewSessionCache(dao, time.Hour)
+    mock.ExpectQuery(`SELECT id FROM user_session`).WillReturnRows(revokedSessionRows())
+    mock.ExpectQuery(`SELECT id FROM user_session`).WillReturnRows(revokedSessionRows("family-1"))
+
+    assert.False(t, cache.IsRevoked("family-1"))
+    cache.lastLoaded = time.Now().Add(-2 * time.Hour)
+    assert.True(t, cache.IsRevoked("family-1"), "revoked by another instance")
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSessionCache_KeepsSessionsWhenReloadFails(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    cache := NewSessionCache(dao, time.Hour)
+    mock.ExpectQuery(`SELECT id FROM user_session`).WillReturnRows(revokedSessionRows("family-1"))
+    mock.ExpectQuery(`SELECT id FROM user_session`).WillReturnError(errors.New("connection lost"))
+
+    assert.True(t, cache.IsRevoked("family-1"))
+    cache.lastLoaded = time.Now().Add(-2 * time.Hour)
+    assert.True(t, cache.IsRevoked("family-1"))
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSessionCache_RevokeRejectsSessionImmediately(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    cache := NewSessionCache(dao, time.Hour)
+    cache.lastLoaded = time.Now()
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM user_session`).WillReturnRows(userSessionRows(false))
+    mock.ExpectExec(`UPDATE "user_session" SET "revoked"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "refresh_token" SET "revoked"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`INSERT INTO "revoked_token"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    assert.NoError(t, cache.Revoke(dao.NewSession(), NewRevocationList(nil, time.Hour), "waiter@garsson.nl", "family-1"))
+    assert.Equal(t, ErrSessionRevoked, cache.Check(dao.NewSession(), "family-1"))
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+    "errors"
+    "time"
+
+    "github.com/dgrijalva/jwt-go"
+    "github.com/gocraft/dbr"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+// A browser EventSource cannot send the Authorization header, so a signed-in client first exchanges its access token
+// for a stream ticket and opens the event source with the ticket in the URL. A ticket is valid for a few seconds and
+// opens a single stream, so a ticket that ends up in a proxy log or the browser history is worthless. The stream
+// belongs to the session of the access token and ends when that access token would have expired.
+
+var (
+    // ErrInvalidStreamTicket indicates that the stream ticket is unknown, expired or already used
+    ErrInvalidStreamTicket = errors.New("invalid or expired stream ticket")
+)
+
+const (
+    // StreamTicketValidity is the time in which a stream ticket must be used
+    StreamTicketValidity = 30 * time.Second
+)
+
+// IssueStreamTicket returns a single-use ticket that opens an event stream on behalf of the access token
+func IssueStreamTicket(sess dbr.SessionRunner, email string, claims JwtClaims) (string, error) {
+    rawTicket, err := generateOpaqueToken()
+    if err != nil {
+        return "", err
+    }
+    now := time.Now()
+    if err := deleteStreamTicketsExpiredBefore(sess, db.FormatTime(now)); err != nil {
+        log.WithError(err).Warn("could not delete expired stream tickets")
+    }
+    if err := insertStreamTicket(sess, streamTicketEntity{
+        TokenHash:              hashOpaqueToken(rawTicket),
+        Email:                  email,
+        AccessTokenID:          claims.Id,
+        SessionID:              nullIfEmpty(claims.SessionID),
+        TimeAccessTokenExpires: db.FormatTime(time.Unix(claims.ExpiresAt, 0)),
+        TimeIssued:             db.FormatTime(now),
+        TimeExpires:            db.FormatTime(now.Add(StreamTicketValidity)),
+    }); err != nil {
+        return "", err
+    }
+    return rawTicket, nil
+}
+
+// RedeemStreamTicket returns the user to whom the ticket was issued, with the claims of the access token that
+// requested it. The ticket can not be used again. The caller must still check the session of the claims.
+func RedeemStreamTicket(sess dbr.SessionRunner, revocations RevocationChecker, rawTicket string) (UserFromJwt, error) {
+    stored, err := queryStreamTicket(sess, hashOpaqueToken(rawTicket))
+    if err == dbr.ErrNotFound {
+        return UserFromJwt{}, ErrInvalidStreamTicket
+    } else if err != nil {
+        return UserFromJwt{}, err
+    } else if stored.TimeUsed.Valid || revocations.IsRevoked(stored.AccessTokenID) {
+        return UserFromJwt{}, ErrInvalidStreamTicket
+    } else if expires, err := db.ParseTime(stored.TimeExpires); err != nil || time.Now().After(expires) {
+        return UserFromJwt{}, ErrInvalidStreamTicket
+    }
+    tokenExpires, err := db.ParseTime(stored.TimeAccessTokenExpires)
+    if err != nil || time.Now().After(tokenExpires) {
+        return UserFromJwt{}, ErrInvalidStreamTicket
+    }
+
+    // the condition on time_used makes sure that a ticket opens only one stream
+    if marked, err := markStreamTicketUsed(sess, stored.TokenHash); err != nil {
+        return UserFromJwt{}, err
+    } else if marked == 0 {
+        return UserFromJwt{}, ErrInvalidStreamTicket
+    }
+    user, err := QueryUserEntity(sess, stored.Email)
+    if err == dbr.ErrNotFound || (err == nil && user.Disabled) {
+        return UserFromJwt{}, ErrInvalidStreamTicket
+    } else if err != nil {
+        return UserFromJwt{}, err
+    }
+    return UserFromJwt{
+        Email:       user.Email,
+        Roles:       user.Roles,
+        Permissions: user.Permissions,
+        Claims: &JwtClaims{
+            StandardClaims: jwt.StandardClaims{Id: stored.AccessTokenID, Subject: user.Email, ExpiresAt: tokenExpires.Unix()},
+            Roles:          user.Roles,
+            Permissions:    user.Permissions,
+            SessionID:      stored.SessionID.String,
+        },
+    }, nil
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// revokedTokens is a revocation list that does not need a database
+type revokedTokens map[string]bool
+
+func (r revokedTokens) IsRevoked(jti string) bool {
+    return r[jti]
+}
+
+// streamTicketRows returns a stored ticket that expires after expiresIn, used is empty if it was not used yet
+func streamTicketRows(rawTicket string, expiresIn time.Duration, used string) *sqlmock.Rows {
+    now := time.Now()
+    rows := sqlmock.NewRows([]string{"token_hash", "email", "access_token_id", "session_id", "time_access_token_expires", "time_issued", "time_expires", "time_used"})
+    var timeUsed interface{}
+    if used != "" {
+        timeUsed = used
+    }
+    return rows.AddRow(hashOpaqueToken(rawTicket), "bar@garsson.io", "jti-1", "session-1",
+        db.FormatTime(now.Add(5*time.Minute)), db.FormatTime(now), db.FormatTime(now.Add(expiresIn)), timeUsed)
+}
+
+func TestRedeemStreamTicket(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM stream_ticket WHERE \(token_hash = '` + hashOpaqueToken("ticket") + `'\)`).
+        WillReturnRows(streamTicketRows("ticket", StreamTicketValidity, ""))
+    mock.ExpectExec(`UPDATE "stream_ticket" SET "time_used" = .* WHERE \(token_hash = '[0-9a-f]+' AND time_used IS NULL\)`).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery(`SELECT \* FROM user_account WHERE \(email = 'bar@garsson.io'\)`).WillReturnRows(userRows("bar@garsson.io", "", false))
+    expectUserAccess(mock, "bar", PermissionOrdersRead)
+
+    user, err := RedeemStreamTicket(dao.NewSession(), revokedTokens{}, "ticket")
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.Equal(t, "bar@garsson.io", user.Email)
+    assert.True(t, user.HasPermission(PermissionOrdersRead))
+    if assert.NotNil(t, user.Claims) {
+        assert.Equal(t, "jti-1", user.Claims.Id)
+        assert.Equal(t, "session-1", user.Claims.SessionID)
+        assert.True(t, user.Claims.ExpiresAt > time.Now().Unix(), "the stream ends when the access token expires")
+    }
+}
+
+func TestRedeemStreamTicket_SingleUse(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM stream_ticket`).WillReturnRows(streamTicketRows("ticket", StreamTicketValidity, db.Now()))
+
+    _, err := RedeemStreamTicket(dao.NewSession(), revokedTokens{}, "ticket")
+    assert.Equal(t, ErrInvalidStreamTicket, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRedeemStreamTicket_ConcurrentlyUsed(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM stream_ticket`).WillReturnRows(streamTicketRows("ticket", StreamTicketValidity, ""))
+    mock.ExpectExec(`UPDATE "stream_ticket" SET "time_used"`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+    _, err := RedeemStreamTicket(dao.NewSession(), revokedTokens{}, "ticket")
+    assert.Equal(t, ErrInvalidStreamTicket, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRedeemStreamTicket_ExpiredOrRevoked(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM stream_ticket`).WillReturnRows(streamTicketRows("ticket", -time.Second, ""))
+    mock.ExpectQuery(`SELECT \* FROM stream_ticket`).WillReturnRows(streamTicketRows("ticket", StreamTicketValidity, ""))
+    mock.ExpectQuery(`SELECT \* FROM stream_ticket`).WillReturnRows(sqlmock.NewRows([]string{"token_hash"}))
+
+    _, err := RedeemStreamTicket(dao.NewSession(), revokedTokens{}, "ticket")
+    assert.Equal(t, ErrInvalidStreamTicket, err, "expired")
+    _, err = RedeemStreamTicket(dao.NewSession(), revokedTokens{"jti-1": true}, "ticket")
+    assert.Equal(t, ErrInvalidStreamTicket, err, "access token revoked")
+    _, err = RedeemStreamTicket(dao.NewSession(), revokedTokens{}, "unknown")
+    assert.Equal(t, ErrInvalidStreamTicket, err, "unknown")
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,212 @@
+package auth
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/gocraft/dbr"
+    "github.com/satori/go.uuid"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+// Every sign-in starts a token family. The refresh token of a family can be used exactly once to obtain a new access
+// token and a new refresh token of the same family. When a refresh token is presented a second time it has been
+// stolen or leaked, the whole family is then revoked so that neither party can continue.
+
+var (
+    // ErrInvalidRefreshToken indicates that the refresh token is unknown, expired, already used or revoked
+    ErrInvalidRefreshToken = errors.New("invalid refresh token")
+)
+
+const (
+    // RefreshTokenValidity is the time in which a refresh token can be exchanged for new tokens
+    RefreshTokenValidity = time.Hour * 8
+    // opaqueTokenBytes is the amount of random bytes in refresh tokens and other opaque tokens
+    opaqueTokenBytes = 32
+)
+
+// Tokens is the result of a successful sign-in or refresh
+type Tokens struct {
+    // AccessToken is a short-lived JWT
+    AccessToken string
+    // RefreshToken is an opaque token which can be exchanged for new tokens via RefreshTokens
+    RefreshToken string
+}
+
+// RefreshTokens exchanges a refresh token for a new access and refresh token. The presented refresh token can not be
+// used again. Marking it used and issuing its successors happens in one transaction, so a failure leaves the
+// presented token usable instead of signing the user out.
+func RefreshTokens(sess *dbr.Session, revocations *RevocationList, rawRefreshToken string, keys *KeySet) (Tokens, UserEntity, error) {
+    stored, err := queryRefreshToken(sess, hashOpaqueToken(rawRefreshToken))
+    if err == dbr.ErrNotFound {
+        return Tokens{}, UserEntity{}, ErrInvalidRefreshToken
+    } else if err != nil {
+        return Tokens{}, UserEntity{}, err
+    }
+
+    if stored.Revoked {
+        return Tokens{}, UserEntity{}, ErrInvalidRefreshToken
+    } else if stored.TimeUsed.Valid {
+        log.WithField("email", stored.Email).WithField("family", stored.FamilyID).Warn("refresh token reused, revoking token family")
+        revokeFamily(sess, revocations, stored.FamilyID)
+        return Tokens{}, UserEntity{}, ErrInvalidRefreshToken
+    } else if expires, err := db.ParseTime(stored.TimeExpires); err != nil || time.Now().After(expires) {
+        return Tokens{}, UserEntity{}, ErrInvalidRefreshToken
+    }
+
+    user, err := QueryUserEntity(sess, stored.Email)
+    if err == dbr.ErrNotFound {
+        return Tokens{}, UserEntity{}, ErrInvalidRefreshToken
+    } else if err != nil {
+        return Tokens{}, UserEntity{}, err
+    } else if user.Disabled {
+        revokeFamily(sess, revocations, stored.FamilyID)
+        return Tokens{}, UserEntity{}, ErrUserDisabled
+    }
+
+    tx, err := sess.Begin()
+    if err != nil {
+        return Tokens{}, UserEntity{}, err
+    }
+    defer tx.RollbackUnlessCommitted()
+    // the condition on time_used makes sure that only one of two concurrent refreshes succeeds
+    if marked, err := markRefreshTokenUsed(tx, stored.TokenHash); err != nil {
+        return Tokens{}, UserEntity{}, err
+    } else if marked == 0 {
+        return Tokens{}, UserEntity{}, ErrInvalidRefreshToken
+    }
+    tokens, err := issueTokens(tx, user, stored.FamilyID, keys)
+    if err != nil {
+        return Tokens{}, UserEntity{}, err
+    }
+    if err := tx.Commit(); err != nil {
+        return Tokens{}, UserEntity{}, err
+    }
+    user.PasswordHash = "" // no need to expose!
+    return tokens, user, nil
+}
+
+// Logout revokes the access token of the user, its session and the token family it was issued in
+func Logout(sess dbr.SessionRunner, revocations *RevocationList, user UserFromJwt) error {
+    if user.Claims == nil {
+        return nil
+    }
+    if err := revocations.Revoke(sess, user.Claims.Id, user.Email, time.Unix(user.Claims.ExpiresAt, 0)); err != nil {
+        return err
+    }
+    if user.Claims.SessionID != "" {
+        if err := revokeUserSession(sess, user.Claims.SessionID); err != nil {
+            return err
+        }
+    }
+    if familyID, err := queryFamilyIDByAccessTokenID(sess, user.Claims.Id); err == dbr.ErrNotFound {
+        return nil
+    } else if err != nil {
+        return err
+    } else if _, err = revokeRefreshTokenFamily(sess, familyID); err != nil {
+        return err
+    } else {
+        return revokeUserSession(sess, familyID)
+    }
+}
+
+// RevokeUserTokens revokes all refresh tokens and sessions of the user, and the access tokens that were issued with
+// them, which signs the user out everywhere. Access tokens are revoked regardless of whether their refresh token was
+// used, revoked or expired since, every access token issued less than TokenValidity ago may still be valid.
+func RevokeUserTokens(sess dbr.SessionRunner, revocations *RevocationList, email string) error {
+    recentTokens, err := queryRefreshTokensIssuedSince(sess, email, db.FormatTime(time.Now().Add(-TokenValidity)))
+    if err != nil {
+        return err
+    }
+    for _, token := range recentTokens {
+        if err := revokeAccessTokenOf(sess, revocations, token); err != nil {
+            return err
+        }
+    }
+    if _, err := revokeRefreshTokensOfUser(sess, email); err != nil {
+        return err
+    }
+    return revokeUserSessionsOfUser(sess, email)
+}
+
+// issueTokens creates an access token and a refresh token that belongs to familyID, the session of the family is
+// started or, on refresh, extended
+func issueTokens(sess dbr.SessionRunner, user UserEntity, familyID string, keys *KeySet) (Tokens, error) {
+    accessToken, claims, err := createToken(user, familyID, keys)
+    if err != nil {
+        return Tokens{}, fmt.Errorf(TokenGenerationErrorFmt, err.Error())
+    }
+    rawRefreshToken, err := generateOpaqueToken()
+    if err != nil {
+        return Tokens{}, fmt.Errorf(TokenGenerationErrorFmt, err.Error())
+    }
+    now := time.Now()
+    if err := insertRefreshToken(sess, refreshTokenEntity{
+        TokenHash:     hashOpaqueToken(rawRefreshToken),
+        FamilyID:      familyID,
+        Email:         user.Email,
+        AccessTokenID: claims.Id,
+        TimeIssued:    db.FormatTime(now),
+        TimeExpires:   db.FormatTime(now.Add(RefreshTokenValidity)),
+    }); err != nil {
+        return Tokens{}, err
+    }
+    if err := storeSession(sess, familyID, user.Email, claims.Id, now, now.Add(RefreshTokenValidity)); err != nil {
+        return Tokens{}, err
+    }
+    return Tokens{AccessToken: accessToken, RefreshToken: rawRefreshToken}, nil
+}
+
+// revokeFamily revokes all refresh tokens of the family and the access token of the most recent one, errors are
+// logged because this is called while already rejecting a request.
+func revokeFamily(sess dbr.SessionRunner, revocations *RevocationList, familyID string) {
+    if latest, err := queryLatestRefreshTokenOfFamily(sess, familyID); err == nil {
+        if err := revokeAccessTokenOf(sess, revocations, latest); err != nil {
+            log.WithError(err).WithField("family", familyID).Error("could not revoke access token of token family")
+        }
+    }
+    if _, err := revokeRefreshTokenFamily(sess, familyID); err != nil {
+        log.WithError(err).WithField("family", familyID).Error("could not revoke token family")
+    }
+    if err := revokeUserSession(sess, familyID); err != nil {
+        log.WithError(err).WithField("family", familyID).Error("could not revoke session of token family")
+    }
+}
+
+// revokeAccessTokenOf revokes the access token that was issued together with the refresh token. The access token
+// expires long before the refresh token, so its expiry is bounded by the issue time of the refresh token.
+func revokeAccessTokenOf(sess dbr.SessionRunner, revocations *RevocationList, token refreshTokenEntity) error {
+    issued, err := db.ParseTime(token.TimeIssued)
+    if err != nil {
+        issued = time.Now()
+    }
+    err = revocations.Revoke(sess, token.AccessTokenID, token.Email, issued.Add(TokenValidity))
+    if db.IsUniqueViolation(err) {
+        return nil // already revoked
+    }
+    return err
+}
+
+func newTokenFamilyID() string {
+    return uuid.NewV4().String()
+}
+
+func generateOpaqueToken() (string, error) {
+    randomBytes := make([]byte, opaqueTokenBytes)
+    if _, err := rand.Read(randomBytes); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// hashOpaqueToken hashes a random token for storage, a fast hash suffices because the token is random
+func hashOpaqueToken(rawToken string) string {
+    sum := sha256.Sum256([]byte(rawToken))
+    return hex.EncodeToString(sum[:])
+}
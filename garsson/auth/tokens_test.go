@@ -0,0 +1,108 @@
+package auth
+
+import (
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// refreshTokenRows returns stored refresh tokens of bar@garsson.io in family-1, the access token ids are jti-<n>
+func refreshTokenRows(rawToken string, used bool, accessTokenIDs ...string) *sqlmock.Rows {
+    rows := sqlmock.NewRows([]string{"token_hash", "family_id", "email", "access_token_id", "time_issued", "time_expires", "time_used", "revoked"})
+    var timeUsed interface{}
+    if used {
+        timeUsed = db.Now()
+    }
+    now := time.Now()
+    for _, accessTokenID := range accessTokenIDs {
+        rows.AddRow(hashOpaqueToken(rawToken), "family-1", "bar@garsson.io", accessTokenID,
+            db.FormatTime(now.Add(-time.Minute)), db.FormatTime(now.Add(RefreshTokenValidity)), timeUsed, false)
+    }
+    return rows
+}
+
+func signingKeys(t *testing.T) *KeySet {
+    key, err := GenerateEd25519Key("ed-1")
+    assert.NoError(t, err)
+    keys := NewKeySet()
+    assert.NoError(t, keys.Add(key))
+    return keys
+}
+
+func TestRefreshTokens_RotatesInOneTransaction(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    keys := signingKeys(t)
+    mock.ExpectQuery(`SELECT \* FROM refresh_token WHERE \(token_hash = '` + hashOpaqueToken("refresh") + `'\)`).
+        WillReturnRows(refreshTokenRows("refresh", false, "jti-1"))
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("bar@garsson.io", "", false))
+    expectUserAccess(mock, "bar", PermissionOrdersRead)
+    mock.ExpectBegin()
+    mock.ExpectExec(`UPDATE "refresh_token" SET "time_used" = .* AND time_used IS NULL`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`INSERT INTO "refresh_token"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "user_session" SET .* WHERE \(id = 'family-1'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    tokens, user, err := RefreshTokens(dao.NewSession(), NewRevocationList(nil, time.Hour), "refresh", keys)
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.Equal(t, "bar@garsson.io", user.Email)
+    assert.NotEmpty(t, tokens.RefreshToken)
+    assert.NotEqual(t, "refresh", tokens.RefreshToken)
+    if validated, err := ValidateJWT(tokens.AccessToken, keys, noRevocations{}); assert.NoError(t, err) {
+        assert.Equal(t, "family-1", validated.Claims.SessionID, "the new tokens stay in the family of the sign-in")
+    }
+}
+
+func TestRefreshTokens_FailureKeepsPresentedTokenUsable(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT \* FROM refresh_token`).WillReturnRows(refreshTokenRows("refresh", false, "jti-1"))
+    mock.ExpectQuery(`SELECT \* FROM user_account`).WillReturnRows(userRows("bar@garsson.io", "", false))
+    expectUserAccess(mock, "bar")
+    mock.ExpectBegin()
+    mock.ExpectExec(`UPDATE "refresh_token" SET "time_used"`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`INSERT INTO "refresh_token"`).WillReturnError(errors.New("connection lost"))
+    mock.ExpectRollback()
+
+    _, _, err := RefreshTokens(dao.NewSession(), NewRevocationList(nil, time.Hour), "refresh", signingKeys(t))
+    assert.EqualError(t, err, "connection lost")
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefreshTokens_ReuseRevokesFamily(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    revocations := NewRevocationList(nil, time.Hour)
+    mock.ExpectQuery(`SELECT \* FROM refresh_token WHERE \(token_hash = `).WillReturnRows(refreshTokenRows("refresh", true, "jti-1"))
+    mock.ExpectQuery(`SELECT \* FROM refresh_token WHERE \(family_id = 'family-1'\) ORDER BY time_issued DESC LIMIT 1`).
+        WillReturnRows(refreshTokenRows("successor", false, "jti-2"))
+    mock.ExpectExec(`INSERT INTO "revoked_token" .*'jti-2'`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "refresh_token" SET "revoked" = TRUE WHERE \(family_id = 'family-1'\)`).WillReturnResult(sqlmock.NewResult(0, 2))
+    mock.ExpectExec(`UPDATE "user_session" SET "revoked" = TRUE WHERE \(id = 'family-1'\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+
+    _, _, err := RefreshTokens(dao.NewSession(), revocations, "refresh", signingKeys(t))
+    assert.Equal(t, ErrInvalidRefreshToken, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.True(t, revocations.revoked["jti-2"], "the access token of the successor is revoked")
+}
+
+func TestRevokeUserTokens_RevokesAccessTokensOfUsedRefreshTokens(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    revocations := NewRevocationList(nil, time.Hour)
+    mock.ExpectQuery(`SELECT \* FROM refresh_token WHERE \(email = 'bar@garsson.io' AND time_issued >= '.*'\)`).
+        WillReturnRows(refreshTokenRows("refresh", true, "jti-1", "jti-2"))
+    mock.ExpectExec(`INSERT INTO "revoked_token" .*'jti-1'`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`INSERT INTO "revoked_token" .*'jti-2'`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "refresh_token" SET "revoked" = TRUE WHERE \(email = 'bar@garsson.io' AND revoked = FALSE\)`).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "user_session" SET "revoked" = TRUE WHERE \(email = 'bar@garsson.io' AND revoked = FALSE\)`).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+
+    assert.NoError(t, RevokeUserTokens(dao.NewSession(), revocations, "bar@garsson.io"))
+    assert.NoError(t, mock.ExpectationsWereMet())
+    assert.True(t, revocations.revoked["jti-1"])
+    assert.True(t, revocations.revoked["jti-2"])
+}
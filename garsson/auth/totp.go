@@ -0,0 +1,94 @@
+package auth
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "encoding/base32"
+    "encoding/binary"
+    "fmt"
+    "net/url"
+    "strings"
+    "time"
+)
+
+// Time-based one-time passwords as specified in RFC 6238, with the parameters that all common authenticator apps
+// support: HMAC-SHA1, 6 digits and a period of 30 seconds.
+
+const (
+    // TOTPIssuer is shown as account issuer in authenticator apps
+    TOTPIssuer = "Garsson"
+    // totpPeriod is the duration of a time step
+    totpPeriod = 30
+    // totpDigits is the length of a code
+    totpDigits = 6
+    // totpSkew is the amount of time steps before and after the current one that is accepted, to allow for clock drift
+    totpSkew = 1
+    // totpSecretBytes is the size of a secret, the size of the SHA1 output recommended by RFC 4226
+    totpSecretBytes = 20
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret returns a new random secret, base32 encoded as expected by authenticator apps
+func generateTOTPSecret() (string, error) {
+    secret := make([]byte, totpSecretBytes)
+    if _, err := rand.Read(secret); err != nil {
+        return "", err
+    }
+    return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpProvisioningURI returns the otpauth URI that authenticator apps import, usually by scanning it as QR code
+func totpProvisioningURI(secret, accountName string) string {
+    params := url.Values{
+        "secret":    {secret},
+        "issuer":    {TOTPIssuer},
+        "algorithm": {"SHA1"},
+        "digits":    {fmt.Sprint(totpDigits)},
+        "period":    {fmt.Sprint(totpPeriod)},
+    }
+    return "otpauth://totp/" + url.PathEscape(TOTPIssuer+":"+accountName) + "?" + params.Encode()
+}
+
+// totpStep returns the time step of t
+func totpStep(t time.Time) int64 {
+    return t.Unix() / totpPeriod
+}
+
+// totpCode computes the code of the secret for a time step
+func totpCode(secret string, step int64) (string, error) {
+    key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+    if err != nil {
+        return "", err
+    }
+    counter := make([]byte, 8)
+    binary.BigEndian.PutUint64(counter, uint64(step))
+    mac := hmac.New(sha1.New, key)
+    mac.Write(counter)
+    sum := mac.Sum(nil)
+
+    offset := sum[len(sum)-1] & 0x0f
+    truncated := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+    modulo := uint32(1)
+    for i := 0; i < totpDigits; i++ {
+        modulo *= 10
+    }
+    return fmt.Sprintf("%0*d", totpDigits, truncated%modulo), nil
+}
+
+// matchTOTPCode returns the time step of which the code is valid at time t, or false if the code does not match any
+// of the accepted steps around t
+func matchTOTPCode(secret, code string, t time.Time) (int64, bool) {
+    code = strings.TrimSpace(code)
+    if len(code) != totpDigits {
+        return 0, false
+    }
+    current := totpStep(t)
+    for step := current - totpSkew; step <= current+totpSkew; step++ {
+        if expected, err := totpCode(secret, step); err == nil && hmac.Equal([]byte(expected), []byte(code)) {
+            return step, true
+        }
+    }
+    return 0, false
+}
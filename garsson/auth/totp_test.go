@@ -0,0 +1,66 @@
+package auth
+
+import (
+    "net/url"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+)
+
+// rfc6238Secret is the SHA1 test secret of RFC 6238, "12345678901234567890" in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode_RFC6238TestVectors(t *testing.T) {
+    // the RFC lists 8 digit codes, these are their last 6 digits
+    vectors := map[int64]string{
+        59:          "287082",
+        1111111109:  "081804",
+        1111111111:  "050471",
+        1234567890:  "005924",
+        2000000000:  "279037",
+        20000000000: "353130",
+    }
+    for unix, expected := range vectors {
+        code, err := totpCode(rfc6238Secret, totpStep(time.Unix(unix, 0)))
+        assert.NoError(t, err)
+        assert.Equal(t, expected, code, "time %v", unix)
+    }
+}
+
+func TestMatchTOTPCode_AcceptsAdjacentSteps(t *testing.T) {
+    now := time.Unix(1111111111, 0)
+    previous, _ := totpCode(rfc6238Secret, totpStep(now)-1)
+    next, _ := totpCode(rfc6238Secret, totpStep(now)+1)
+    tooOld, _ := totpCode(rfc6238Secret, totpStep(now)-2)
+
+    step, matches := matchTOTPCode(rfc6238Secret, previous, now)
+    assert.True(t, matches)
+    assert.Equal(t, totpStep(now)-1, step)
+    _, matches = matchTOTPCode(rfc6238Secret, " "+next+" ", now)
+    assert.True(t, matches)
+    _, matches = matchTOTPCode(rfc6238Secret, tooOld, now)
+    assert.False(t, matches)
+    _, matches = matchTOTPCode(rfc6238Secret, "12345", now)
+    assert.False(t, matches)
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+    secret, err := generateTOTPSecret()
+    assert.NoError(t, err)
+    assert.Len(t, secret, 32)
+    _, err = totpCode(secret, 1)
+    assert.NoError(t, err)
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+    uri, err := url.Parse(totpProvisioningURI(rfc6238Secret, "manager@garsson.nl"))
+    assert.NoError(t, err)
+    assert.Equal(t, "otpauth", uri.Scheme)
+    assert.Equal(t, "totp", uri.Host)
+    assert.Equal(t, "/Garsson:manager@garsson.nl", uri.Path)
+    assert.Equal(t, rfc6238Secret, uri.Query().Get("secret"))
+    assert.Equal(t, "Garsson", uri.Query().Get("issuer"))
+    assert.Equal(t, "6", uri.Query().Get("digits"))
+    assert.Equal(t, "30", uri.Query().Get("period"))
+}
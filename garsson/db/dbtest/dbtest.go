@@ -1,14 +1,24 @@
 package dbtest
 
-//func NewDbMock(t *testing.T) (*db.Dao, sqlmock.Sqlmock) {
-//	database, mock, err := sqlmock.New()
-//	if err != nil {
-//		t.Fatalf("error opening mock db: %s", err)
-//	}
-//	dbr.
-//	return db.NewDaoWithConfiguredDb(dbr.Open(database, nil)), mock
-//}
-//
-//func EmptyRows() sqlmock.Rows {
-//	return sqlmock.NewRows([]string{})
-//}
+import (
+	"testing"
+
+	"github.com/gocraft/dbr"
+	"github.com/gocraft/dbr/dialect"
+	"github.com/toefel18/garsson-api/garsson/db"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// NewDbMock returns a dao on top of a mocked postgres database and the mock to set expectations on
+func NewDbMock(t *testing.T) (*db.Dao, sqlmock.Sqlmock) {
+	database, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening mock db: %s", err)
+	}
+	return db.NewDaoWithConfiguredDb(&dbr.Connection{DB: database, Dialect: dialect.PostgreSQL, EventReceiver: &dbr.NullEventReceiver{}}), mock
+}
+
+// EmptyRows returns a result without columns or rows
+func EmptyRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{})
+}
@@ -0,0 +1,27 @@
+package db
+
+import (
+	"github.com/lib/pq"
+)
+
+const (
+	uniqueViolation     = "23505"
+	foreignKeyViolation = "23503"
+)
+
+// IsUniqueViolation returns true if err is caused by inserting a duplicate key
+func IsUniqueViolation(err error) bool {
+	return hasPostgresCode(err, uniqueViolation)
+}
+
+// IsForeignKeyViolation returns true if err is caused by a row that references, or is referenced by, another row
+func IsForeignKeyViolation(err error) bool {
+	return hasPostgresCode(err, foreignKeyViolation)
+}
+
+func hasPostgresCode(err error, code pq.ErrorCode) bool {
+	if pqErr, ok := err.(*pq.Error); ok {
+		return pqErr.Code == code
+	}
+	return false
+}
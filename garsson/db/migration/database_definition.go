@@ -44,6 +44,350 @@ const (
                                   remark                 TEXT NULL,
                                   PRIMARY KEY (order_id, product_id)
                                 )`
+
+    V5WidenPasswordHash = `ALTER TABLE user_account ALTER COLUMN password_hash TYPE VARCHAR(256)`
+
+    V6UserDisabled = `ALTER TABLE user_account ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE`
+
+    V7RefreshTokenTable = `CREATE TABLE refresh_token (
+                             token_hash      VARCHAR(64) PRIMARY KEY,
+                             family_id       VARCHAR(64) NOT NULL,
+                             email           VARCHAR(128) NOT NULL REFERENCES user_account (email) ON DELETE CASCADE,
+                             access_token_id VARCHAR(64) NOT NULL,
+                             time_issued     VARCHAR(64) NOT NULL,
+                             time_expires    VARCHAR(64) NOT NULL,
+                             time_used       VARCHAR(64),
+                             revoked         BOOLEAN NOT NULL DEFAULT FALSE
+                           )`
+
+    V8RefreshTokenFamilyIndex = `CREATE INDEX idx_refresh_token_family ON refresh_token (family_id)`
+
+    V9RevokedTokenTable = `CREATE TABLE revoked_token (
+                             jti          VARCHAR(64) PRIMARY KEY,
+                             email        VARCHAR(128),
+                             time_revoked VARCHAR(64) NOT NULL,
+                             time_expires VARCHAR(64) NOT NULL
+                           )`
+
+    V10UserPinHash = `ALTER TABLE user_account ADD COLUMN pin_hash VARCHAR(256)`
+
+    V11DeviceTable = `CREATE TABLE device (
+                        id              VARCHAR(64) PRIMARY KEY,
+                        name            VARCHAR(128) NOT NULL,
+                        token_hash      VARCHAR(64) NOT NULL UNIQUE,
+                        registered_by   VARCHAR(128) REFERENCES user_account (email) ON DELETE SET NULL,
+                        time_registered VARCHAR(64) NOT NULL,
+                        time_last_used  VARCHAR(64),
+                        revoked         BOOLEAN NOT NULL DEFAULT FALSE
+                      )`
+
+    V12FailedLoginCounterTable = `CREATE TABLE failed_login_counter (
+                                    kind              VARCHAR(16) NOT NULL,
+                                    subject           VARCHAR(128) NOT NULL,
+                                    failed_attempts   INTEGER NOT NULL,
+                                    time_last_failure VARCHAR(64) NOT NULL,
+                                    time_locked_until VARCHAR(64),
+                                    PRIMARY KEY (kind, subject)
+                                  )`
+
+    V13RoleTable = `CREATE TABLE role (
+                      name        VARCHAR(128) PRIMARY KEY,
+                      description VARCHAR(256)
+                    )`
+
+    V14PermissionTable = `CREATE TABLE permission (
+                            name        VARCHAR(128) PRIMARY KEY,
+                            description VARCHAR(256)
+                          )`
+
+    V15RolePermissionTable = `CREATE TABLE role_permission (
+                                role_name       VARCHAR(128) NOT NULL REFERENCES role (name) ON DELETE CASCADE,
+                                permission_name VARCHAR(128) NOT NULL REFERENCES permission (name) ON DELETE CASCADE,
+                                PRIMARY KEY (role_name, permission_name)
+                              )`
+
+    V16RoleInheritanceTable = `CREATE TABLE role_inheritance (
+                                 role_name           VARCHAR(128) NOT NULL REFERENCES role (name) ON DELETE CASCADE,
+                                 inherited_role_name VARCHAR(128) NOT NULL REFERENCES role (name) ON DELETE CASCADE,
+                                 PRIMARY KEY (role_name, inherited_role_name),
+                                 CHECK (role_name <> inherited_role_name)
+                               )`
+
+    V17UserRoleTable = `CREATE TABLE user_role (
+                          email     VARCHAR(128) NOT NULL REFERENCES user_account (email) ON DELETE CASCADE,
+                          role_name VARCHAR(128) NOT NULL REFERENCES role (name) ON DELETE CASCADE,
+                          PRIMARY KEY (email, role_name)
+                        )`
+
+    V18SeedPermissions = `INSERT INTO permission (name, description) VALUES
+                            ('orders:read', 'view orders'),
+                            ('orders:write', 'create and change orders'),
+                            ('products:read', 'view products'),
+                            ('users:manage', 'manage user accounts'),
+                            ('devices:manage', 'register and revoke shared devices'),
+                            ('db:read', 'view database information')`
+
+    V19SeedRoles = `INSERT INTO role (name, description) VALUES
+                      ('admin', 'administrator, has every permission'),
+                      ('manager', 'manages the floor, includes waiter and bartender'),
+                      ('waiter', 'takes and serves orders'),
+                      ('bartender', 'prepares orders')`
+
+    V20SeedRoleInheritance = `INSERT INTO role_inheritance (role_name, inherited_role_name) VALUES
+                                ('admin', 'manager'),
+                                ('manager', 'waiter'),
+                                ('manager', 'bartender')`
+
+    V21SeedRolePermissions = `INSERT INTO role_permission (role_name, permission_name) VALUES
+                                ('waiter', 'orders:read'),
+                                ('waiter', 'orders:write'),
+                                ('waiter', 'products:read'),
+                                ('bartender', 'orders:read'),
+                                ('bartender', 'orders:write'),
+                                ('bartender', 'products:read'),
+                                ('admin', 'users:manage'),
+                                ('admin', 'devices:manage'),
+                                ('admin', 'db:read')`
+
+    // V22 and V23 convert the comma separated user_account.roles column into user_role records
+    V22ConvertCsvRoles = `INSERT INTO role (name)
+                            SELECT DISTINCT trim(csv_role) FROM user_account, unnest(string_to_array(roles, ',')) AS csv_role
+                            WHERE trim(csv_role) <> ''
+                          ON CONFLICT (name) DO NOTHING`
+
+    V23ConvertCsvUserRoles = `INSERT INTO user_role (email, role_name)
+                                SELECT DISTINCT email, trim(csv_role) FROM user_account, unnest(string_to_array(roles, ',')) AS csv_role
+                                WHERE trim(csv_role) <> ''`
+
+    V24DropUserRolesColumn = `ALTER TABLE user_account DROP COLUMN roles`
+
+    V25LoginEventTable = `CREATE TABLE login_event (
+                            id             BIGSERIAL PRIMARY KEY,
+                            email          VARCHAR(128) NOT NULL,
+                            method         VARCHAR(16) NOT NULL,
+                            success        BOOLEAN NOT NULL,
+                            time_attempted VARCHAR(64) NOT NULL,
+                            ip             VARCHAR(64),
+                            user_agent     VARCHAR(512),
+                            device_id      VARCHAR(64),
+                            failure_reason VARCHAR(128)
+                          )`
+
+    V26LoginEventEmailIndex = `CREATE INDEX idx_login_event_email ON login_event (email, id)`
+
+    V27AccountTokenTable = `CREATE TABLE account_token (
+                              token_hash   VARCHAR(64) PRIMARY KEY,
+                              purpose      VARCHAR(16) NOT NULL,
+                              email        VARCHAR(128) NOT NULL REFERENCES user_account (email) ON DELETE CASCADE,
+                              time_issued  VARCHAR(64) NOT NULL,
+                              time_expires VARCHAR(64) NOT NULL,
+                              time_used    VARCHAR(64)
+                            )`
+
+    V28ApiKeyTable = `CREATE TABLE api_key (
+                        id             VARCHAR(64) PRIMARY KEY,
+                        name           VARCHAR(128) NOT NULL,
+                        key_hash       VARCHAR(64) NOT NULL UNIQUE,
+                        created_by     VARCHAR(128) REFERENCES user_account (email) ON DELETE SET NULL,
+                        time_created   VARCHAR(64) NOT NULL,
+                        time_last_used VARCHAR(64),
+                        revoked        BOOLEAN NOT NULL DEFAULT FALSE
+                      )`
+
+    V29ApiKeyRoleTable = `CREATE TABLE api_key_role (
+                            api_key_id VARCHAR(64) NOT NULL REFERENCES api_key (id) ON DELETE CASCADE,
+                            role_name  VARCHAR(128) NOT NULL REFERENCES role (name) ON DELETE CASCADE,
+                            PRIMARY KEY (api_key_id, role_name)
+                          )`
+
+    V30ApiKeysManagePermission = `INSERT INTO permission (name, description) VALUES ('apikeys:manage', 'manage api keys of machine clients')`
+
+    V31GrantApiKeysManageToAdmin = `INSERT INTO role_permission (role_name, permission_name)
+                                      SELECT name, 'apikeys:manage' FROM role WHERE name = 'admin'`
+
+    V32UserExternalSubject = `ALTER TABLE user_account ADD COLUMN external_subject VARCHAR(256) UNIQUE`
+
+    V33UserTotpTable = `CREATE TABLE user_totp (
+                          email          VARCHAR(128) PRIMARY KEY REFERENCES user_account (email) ON DELETE CASCADE,
+                          secret         VARCHAR(64) NOT NULL,
+                          time_created   VARCHAR(64) NOT NULL,
+                          time_confirmed VARCHAR(64),
+                          last_used_step BIGINT NOT NULL DEFAULT 0
+                        )`
+
+    V34RecoveryCodeTable = `CREATE TABLE recovery_code (
+                              code_hash VARCHAR(64) PRIMARY KEY,
+                              email     VARCHAR(128) NOT NULL REFERENCES user_account (email) ON DELETE CASCADE,
+                              time_used VARCHAR(64)
+                            )`
+
+    V35RoleMfaRequired = `ALTER TABLE role ADD COLUMN mfa_required BOOLEAN NOT NULL DEFAULT FALSE`
+
+    V36UserSessionTable = `CREATE TABLE user_session (
+                             id               VARCHAR(64) PRIMARY KEY,
+                             email            VARCHAR(128) NOT NULL REFERENCES user_account (email) ON DELETE CASCADE,
+                             current_token_id VARCHAR(64) NOT NULL,
+                             device_id        VARCHAR(64),
+                             ip               VARCHAR(64),
+                             user_agent       VARCHAR(512),
+                             time_created     VARCHAR(64) NOT NULL,
+                             time_last_seen   VARCHAR(64) NOT NULL,
+                             time_expires     VARCHAR(64) NOT NULL,
+                             revoked          BOOLEAN NOT NULL DEFAULT FALSE
+                           )`
+
+    V37UserSessionEmailIndex = `CREATE INDEX idx_user_session_email ON user_session (email)`
+
+    V38OrderLifecyclePermissions = `INSERT INTO permission (name, description) VALUES
+                                      ('orders:prepare', 'start and finish the preparation of orders'),
+                                      ('orders:cancel', 'cancel orders that have not been served')`
+
+    V39GrantOrderLifecyclePermissions = `INSERT INTO role_permission (role_name, permission_name)
+                                           SELECT name, 'orders:prepare' FROM role WHERE name = 'bartender'
+                                           UNION ALL
+                                           SELECT name, 'orders:cancel' FROM role WHERE name = 'manager'`
+
+    V40CustomerOrderVersion = `ALTER TABLE customer_order ADD COLUMN version BIGINT NOT NULL DEFAULT 1`
+
+    V41CustomerOrderLineID = `ALTER TABLE customer_order_line ADD COLUMN id BIGSERIAL`
+
+    V42DropCustomerOrderLinePrimaryKey = `ALTER TABLE customer_order_line DROP CONSTRAINT customer_order_line_pkey`
+
+    V43CustomerOrderLinePrimaryKey = `ALTER TABLE customer_order_line ADD PRIMARY KEY (id)`
+
+    V44CustomerOrderLineOrderIndex = `CREATE INDEX idx_customer_order_line_order_id ON customer_order_line (order_id)`
+
+    V45OrderEventTable = `CREATE TABLE order_event (
+                            id              BIGSERIAL PRIMARY KEY,
+                            type            VARCHAR(64) NOT NULL,
+                            order_id        BIGINT NOT NULL REFERENCES customer_order (id),
+                            previous_status VARCHAR(128),
+                            payload         TEXT NOT NULL,
+                            time_created    VARCHAR(64) NOT NULL
+                          )`
+
+    V46CustomerOrderStatusIndex = `CREATE INDEX idx_customer_order_status ON customer_order (status)`
+
+    V47CustomerOrderTimeCreatedIndex = `CREATE INDEX idx_customer_order_time_created ON customer_order ((COALESCE(time_created, '')), id)`
+
+    V48PaymentTable = `CREATE TABLE payment (
+                         id                BIGSERIAL PRIMARY KEY,
+                         order_id          BIGINT NOT NULL REFERENCES customer_order (id),
+                         method            VARCHAR(32) NOT NULL,
+                         amount_in_cents   BIGINT NOT NULL,
+                         tip_in_cents      BIGINT NOT NULL DEFAULT 0,
+                         tendered_in_cents BIGINT,
+                         change_in_cents   BIGINT,
+                         processed_by      VARCHAR(128) NOT NULL REFERENCES user_account (email),
+                         time_created      VARCHAR(64) NOT NULL
+                       )`
+
+    V49PaymentOrderIndex = `CREATE INDEX idx_payment_order_id ON payment (order_id)`
+
+    V50ConvertAmountsPaid = `INSERT INTO payment (order_id, method, amount_in_cents, processed_by, time_created)
+                               SELECT id, 'unknown', amount_paid_in_cents, waiter_id, COALESCE(time_paid, time_created, '')
+                               FROM customer_order WHERE amount_paid_in_cents > 0`
+
+    V51DiningTable = `CREATE TABLE dining_table (
+                        id           BIGSERIAL PRIMARY KEY,
+                        number       INTEGER NOT NULL UNIQUE,
+                        area         VARCHAR(64),
+                        capacity     INTEGER NOT NULL,
+                        status       VARCHAR(32) NOT NULL,
+                        time_created VARCHAR(64) NOT NULL
+                      )`
+
+    V52CustomerOrderDiningTable = `ALTER TABLE customer_order ADD COLUMN dining_table_id BIGINT REFERENCES dining_table (id)`
+
+    V53CustomerOrderDiningTableIndex = `CREATE INDEX idx_customer_order_dining_table_id ON customer_order (dining_table_id)`
+
+    V54TablesManagePermission = `INSERT INTO permission (name, description) VALUES ('tables:manage', 'add tables and change their details')`
+
+    V55GrantTablesManageToManager = `INSERT INTO role_permission (role_name, permission_name)
+                                       SELECT name, 'tables:manage' FROM role WHERE name = 'manager'`
+
+    V56ModifierGroupTable = `CREATE TABLE modifier_group (
+                               id             BIGSERIAL PRIMARY KEY,
+                               product_id     BIGINT NOT NULL REFERENCES product (id),
+                               name           VARCHAR(128) NOT NULL,
+                               min_selections INTEGER NOT NULL DEFAULT 0,
+                               max_selections INTEGER NOT NULL DEFAULT 1,
+                               required       BOOLEAN NOT NULL DEFAULT FALSE,
+                               position       INTEGER NOT NULL DEFAULT 0,
+                               CHECK (min_selections >= 0 AND max_selections >= 1 AND max_selections >= min_selections)
+                             )`
+
+    V57ModifierTable = `CREATE TABLE modifier (
+                          id                   BIGSERIAL PRIMARY KEY,
+                          modifier_group_id    BIGINT NOT NULL REFERENCES modifier_group (id),
+                          name                 VARCHAR(128) NOT NULL,
+                          price_delta_in_cents BIGINT NOT NULL DEFAULT 0,
+                          position             INTEGER NOT NULL DEFAULT 0
+                        )`
+
+    V58ModifierGroupProductIndex = `CREATE INDEX idx_modifier_group_product_id ON modifier_group (product_id)`
+
+    V59ModifierGroupIndex = `CREATE INDEX idx_modifier_modifier_group_id ON modifier (modifier_group_id)`
+
+    V60CustomerOrderLineModifierTable = `CREATE TABLE customer_order_line_modifier (
+                                           id                   BIGSERIAL PRIMARY KEY,
+                                           order_line_id        BIGINT NOT NULL REFERENCES customer_order_line (id) ON DELETE CASCADE,
+                                           modifier_id          BIGINT NOT NULL,
+                                           group_name           VARCHAR(128) NOT NULL,
+                                           modifier_name        VARCHAR(128) NOT NULL,
+                                           price_delta_in_cents BIGINT NOT NULL
+                                         )`
+
+    V61CustomerOrderLineModifierLineIndex = `CREATE INDEX idx_customer_order_line_modifier_order_line_id ON customer_order_line_modifier (order_line_id)`
+
+    V62StationTable = `CREATE TABLE station (
+                         id           BIGSERIAL PRIMARY KEY,
+                         name         VARCHAR(64) NOT NULL UNIQUE,
+                         time_created VARCHAR(64) NOT NULL
+                       )`
+
+    V63SeedBarStation = `INSERT INTO station (name, time_created) VALUES ('bar', to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'))`
+
+    V64ProductStation = `ALTER TABLE product ADD COLUMN station_id BIGINT REFERENCES station (id)`
+
+    V65PrepareProductsAtBar = `UPDATE product SET station_id = (SELECT id FROM station WHERE name = 'bar')`
+
+    V66TicketTable = `CREATE TABLE ticket (
+                        id           BIGSERIAL PRIMARY KEY,
+                        order_id     BIGINT NOT NULL REFERENCES customer_order (id),
+                        station_id   BIGINT NOT NULL REFERENCES station (id),
+                        status       VARCHAR(32) NOT NULL,
+                        handler_id   VARCHAR(128) REFERENCES user_account (email),
+                        time_created VARCHAR(64) NOT NULL,
+                        time_started VARCHAR(64),
+                        time_ready   VARCHAR(64)
+                      )`
+
+    V67TicketStationStatusIndex = `CREATE INDEX idx_ticket_station_id_status ON ticket (station_id, status)`
+
+    V68TicketOrderIndex = `CREATE INDEX idx_ticket_order_id ON ticket (order_id)`
+
+    V69CustomerOrderLineTicket = `ALTER TABLE customer_order_line ADD COLUMN ticket_id BIGINT REFERENCES ticket (id)`
+
+    V70StationsManagePermission = `INSERT INTO permission (name, description) VALUES ('stations:manage', 'add stations and choose where products are prepared')`
+
+    V71GrantStationsManageToManager = `INSERT INTO role_permission (role_name, permission_name)
+                                         SELECT name, 'stations:manage' FROM role WHERE name = 'manager'`
+
+    V72StreamTicketTable = `CREATE TABLE stream_ticket (
+                              token_hash                VARCHAR(64) PRIMARY KEY,
+                              email                     VARCHAR(128) NOT NULL REFERENCES user_account (email) ON DELETE CASCADE,
+                              access_token_id           VARCHAR(64) NOT NULL,
+                              session_id                VARCHAR(64),
+                              time_access_token_expires VARCHAR(64) NOT NULL,
+                              time_issued               VARCHAR(64) NOT NULL,
+                              time_expires              VARCHAR(64) NOT NULL,
+                              time_used                 VARCHAR(64)
+                            )`
+
+    V73StreamTicketExpiresIndex = `CREATE INDEX idx_stream_ticket_time_expires ON stream_ticket (time_expires)`
+
+    V74RefreshTokenEmailIndex = `CREATE INDEX idx_refresh_token_email ON refresh_token (email, time_issued)`
 )
 
 
@@ -52,4 +396,74 @@ var completeDatabaseDefinition = []string{
     V2ProductTable,
     V3CustomerOrderTable,
     V4CustomerOrderLineTable,
+    V5WidenPasswordHash,
+    V6UserDisabled,
+    V7RefreshTokenTable,
+    V8RefreshTokenFamilyIndex,
+    V9RevokedTokenTable,
+    V10UserPinHash,
+    V11DeviceTable,
+    V12FailedLoginCounterTable,
+    V13RoleTable,
+    V14PermissionTable,
+    V15RolePermissionTable,
+    V16RoleInheritanceTable,
+    V17UserRoleTable,
+    V18SeedPermissions,
+    V19SeedRoles,
+    V20SeedRoleInheritance,
+    V21SeedRolePermissions,
+    V22ConvertCsvRoles,
+    V23ConvertCsvUserRoles,
+    V24DropUserRolesColumn,
+    V25LoginEventTable,
+    V26LoginEventEmailIndex,
+    V27AccountTokenTable,
+    V28ApiKeyTable,
+    V29ApiKeyRoleTable,
+    V30ApiKeysManagePermission,
+    V31GrantApiKeysManageToAdmin,
+    V32UserExternalSubject,
+    V33UserTotpTable,
+    V34RecoveryCodeTable,
+    V35RoleMfaRequired,
+    V36UserSessionTable,
+    V37UserSessionEmailIndex,
+    V38OrderLifecyclePermissions,
+    V39GrantOrderLifecyclePermissions,
+    V40CustomerOrderVersion,
+    V41CustomerOrderLineID,
+    V42DropCustomerOrderLinePrimaryKey,
+    V43CustomerOrderLinePrimaryKey,
+    V44CustomerOrderLineOrderIndex,
+    V45OrderEventTable,
+    V46CustomerOrderStatusIndex,
+    V47CustomerOrderTimeCreatedIndex,
+    V48PaymentTable,
+    V49PaymentOrderIndex,
+    V50ConvertAmountsPaid,
+    V51DiningTable,
+    V52CustomerOrderDiningTable,
+    V53CustomerOrderDiningTableIndex,
+    V54TablesManagePermission,
+    V55GrantTablesManageToManager,
+    V56ModifierGroupTable,
+    V57ModifierTable,
+    V58ModifierGroupProductIndex,
+    V59ModifierGroupIndex,
+    V60CustomerOrderLineModifierTable,
+    V61CustomerOrderLineModifierLineIndex,
+    V62StationTable,
+    V63SeedBarStation,
+    V64ProductStation,
+    V65PrepareProductsAtBar,
+    V66TicketTable,
+    V67TicketStationStatusIndex,
+    V68TicketOrderIndex,
+    V69CustomerOrderLineTicket,
+    V70StationsManagePermission,
+    V71GrantStationsManageToManager,
+    V72StreamTicketTable,
+    V73StreamTicketExpiresIndex,
+    V74RefreshTokenEmailIndex,
 }
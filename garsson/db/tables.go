@@ -4,3 +4,28 @@ const UserAccountTable = "user_account"
 const ProductTable = "product"
 const CustomerOrderTable = "customer_order"
 const CustomerOrderLineTable = "customer_order_line"
+const RefreshTokenTable = "refresh_token"
+const RevokedTokenTable = "revoked_token"
+const DeviceTable = "device"
+const FailedLoginCounterTable = "failed_login_counter"
+const RoleTable = "role"
+const PermissionTable = "permission"
+const RolePermissionTable = "role_permission"
+const RoleInheritanceTable = "role_inheritance"
+const UserRoleTable = "user_role"
+const LoginEventTable = "login_event"
+const AccountTokenTable = "account_token"
+const ApiKeyTable = "api_key"
+const ApiKeyRoleTable = "api_key_role"
+const UserTotpTable = "user_totp"
+const RecoveryCodeTable = "recovery_code"
+const UserSessionTable = "user_session"
+const OrderEventTable = "order_event"
+const PaymentTable = "payment"
+const DiningTableTable = "dining_table"
+const ModifierGroupTable = "modifier_group"
+const ModifierTable = "modifier"
+const CustomerOrderLineModifierTable = "customer_order_line_modifier"
+const StationTable = "station"
+const TicketTable = "ticket"
+const StreamTicketTable = "stream_ticket"
@@ -0,0 +1,22 @@
+package db
+
+import "time"
+
+// TimeFormat is the format of all timestamps stored in VARCHAR columns. Timestamps are always stored in UTC so that
+// they can be compared as strings.
+const TimeFormat = time.RFC3339
+
+// FormatTime formats t in UTC using TimeFormat
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
+
+// Now returns the current time formatted with FormatTime
+func Now() string {
+	return FormatTime(time.Now())
+}
+
+// ParseTime parses a timestamp that was formatted with FormatTime
+func ParseTime(value string) (time.Time, error) {
+	return time.Parse(TimeFormat, value)
+}
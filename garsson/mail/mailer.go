@@ -0,0 +1,45 @@
+// Package mail sends e-mail to users, for example invitations and password reset links. The SMTPMailer delivers
+// messages via an SMTP server, the OutboxMailer writes them to a directory for local development and tests.
+package mail
+
+import (
+    "bytes"
+    "fmt"
+    "mime"
+    "strings"
+    "time"
+)
+
+// Mailer sends messages
+type Mailer interface {
+    Send(message Message) error
+}
+
+// Message is a plain text e-mail
+type Message struct {
+    To      string
+    Subject string
+    Body    string
+}
+
+// format renders the message including headers, lines are terminated by CRLF as required by RFC 5322
+func (m Message) format(from string, date time.Time) []byte {
+    var buf bytes.Buffer
+    fmt.Fprintf(&buf, "From: %s\r\n", from)
+    fmt.Fprintf(&buf, "To: %s\r\n", m.To)
+    fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+    fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+    buf.WriteString("MIME-Version: 1.0\r\n")
+    buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+    buf.WriteString("\r\n")
+    buf.WriteString(strings.Replace(strings.Replace(m.Body, "\r\n", "\n", -1), "\n", "\r\n", -1))
+    return buf.Bytes()
+}
+
+// validate rejects addresses and subjects that could inject additional headers
+func (m Message) validate() error {
+    if m.To == "" || strings.ContainsAny(m.To, "\r\n") || strings.ContainsAny(m.Subject, "\r\n") {
+        return fmt.Errorf("invalid message to %q", m.To)
+    }
+    return nil
+}
@@ -0,0 +1,63 @@
+package mail
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+// OutboxMailer writes every message as .eml file to a directory instead of sending it, for local development and tests
+type OutboxMailer struct {
+    dir  string
+    from string
+
+    mutex   sync.Mutex
+    counter int
+}
+
+// NewOutboxMailer creates a mailer that writes to dir, the directory is created if it does not exist
+func NewOutboxMailer(dir, from string) (*OutboxMailer, error) {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, err
+    }
+    return &OutboxMailer{dir: dir, from: from}, nil
+}
+
+// Send writes the message to a new file in the outbox directory
+func (m *OutboxMailer) Send(message Message) error {
+    if err := message.validate(); err != nil {
+        return err
+    }
+    now := time.Now()
+    m.mutex.Lock()
+    m.counter++
+    fileName := fmt.Sprintf("%s-%04d-%s.eml", now.UTC().Format("20060102T150405"), m.counter, sanitizeFileName(message.To))
+    m.mutex.Unlock()
+
+    path := filepath.Join(m.dir, fileName)
+    if err := ioutil.WriteFile(path, message.format(m.from, now), 0600); err != nil {
+        return err
+    }
+    log.WithField("to", message.To).WithField("file", path).Info("mail written to outbox")
+    return nil
+}
+
+// Messages returns the paths of all messages in the outbox, oldest first
+func (m *OutboxMailer) Messages() ([]string, error) {
+    return filepath.Glob(filepath.Join(m.dir, "*.eml"))
+}
+
+func sanitizeFileName(value string) string {
+    return strings.Map(func(r rune) rune {
+        if r == '@' || r == '.' || r == '-' || r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+            return r
+        }
+        return '_'
+    }, value)
+}
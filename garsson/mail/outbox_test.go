@@ -0,0 +1,37 @@
+package mail
+
+import (
+    "io/ioutil"
+    "os"
+    "strings"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestOutboxMailer_WritesMessage(t *testing.T) {
+    dir, err := ioutil.TempDir("", "outbox")
+    assert.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    mailer, err := NewOutboxMailer(dir, "garsson@example.com")
+    assert.NoError(t, err)
+    assert.NoError(t, mailer.Send(Message{To: "waiter@garsson.nl", Subject: "Welcome", Body: "line 1\nline 2"}))
+
+    messages, err := mailer.Messages()
+    assert.NoError(t, err)
+    assert.Len(t, messages, 1)
+    content, err := ioutil.ReadFile(messages[0])
+    assert.NoError(t, err)
+    assert.True(t, strings.HasPrefix(string(content), "From: garsson@example.com\r\nTo: waiter@garsson.nl\r\nSubject: Welcome\r\n"))
+    assert.True(t, strings.HasSuffix(string(content), "\r\n\r\nline 1\r\nline 2"))
+}
+
+func TestOutboxMailer_RejectsHeaderInjection(t *testing.T) {
+    dir, err := ioutil.TempDir("", "outbox")
+    assert.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    mailer, _ := NewOutboxMailer(dir, "garsson@example.com")
+    assert.Error(t, mailer.Send(Message{To: "victim@example.com\r\nBcc: everyone@example.com", Subject: "hi"}))
+}
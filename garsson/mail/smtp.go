@@ -0,0 +1,42 @@
+package mail
+
+import (
+    "net"
+    "net/smtp"
+    "strconv"
+    "time"
+)
+
+// SMTPConfig contains the settings of the SMTP server
+type SMTPConfig struct {
+    Host string
+    Port int
+    // Username and Password are optional, PLAIN authentication is used when Username is set
+    Username string
+    Password string
+    // From is the sender address of all messages
+    From string
+}
+
+// SMTPMailer delivers messages via an SMTP server, STARTTLS is used when the server supports it
+type SMTPMailer struct {
+    config SMTPConfig
+}
+
+// NewSMTPMailer creates a mailer that delivers via the configured server
+func NewSMTPMailer(config SMTPConfig) *SMTPMailer {
+    return &SMTPMailer{config: config}
+}
+
+// Send delivers the message to the SMTP server
+func (m *SMTPMailer) Send(message Message) error {
+    if err := message.validate(); err != nil {
+        return err
+    }
+    var auth smtp.Auth
+    if m.config.Username != "" {
+        auth = smtp.PlainAuth("", m.config.Username, m.config.Password, m.config.Host)
+    }
+    addr := net.JoinHostPort(m.config.Host, strconv.Itoa(m.config.Port))
+    return smtp.SendMail(addr, auth, m.config.From, []string{message.To}, message.format(m.config.From, time.Now()))
+}
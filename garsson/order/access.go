@@ -31,17 +31,416 @@ func queryOrderEntityByID(sess dbr.SessionRunner, id int64) (*customerOrderEntit
 
 func queryOrderLinesByOrderID(sess dbr.SessionRunner, orderId int64) ([]*customerOrderLineEntity, error) {
     var orderLines []*customerOrderLineEntity
-    if _, err := sess.Select("*").From(db.CustomerOrderLineTable).Where("order_id = ?", orderId).Load(&orderLines); err != nil {
+    if _, err := sess.Select("*").From(db.CustomerOrderLineTable).Where("order_id = ?", orderId).OrderBy("id").Load(&orderLines); err != nil {
         return nil, err
     } else {
         return orderLines, nil
     }
 }
 
-func queryOrdersWithStatus(sess dbr.SessionRunner, status []string) ([]*customerOrderEntity, error) {
-    var order = []*customerOrderEntity{}
-    var err error
-    _, err = sess.Select("*").From(db.CustomerOrderTable).Where("status IN ?", status).Load(&order)
-    return order, err
+// queryOrders returns at most limit orders that match all conditions, sorted by column and then by id
+func queryOrders(sess dbr.SessionRunner, conditions []condition, column string, ascending bool, limit uint64) ([]*customerOrderEntity, error) {
+    var orders = []*customerOrderEntity{}
+    query := sess.Select("*").From(db.CustomerOrderTable)
+    for _, condition := range conditions {
+        query.Where(condition.query, condition.values...)
+    }
+    _, err := query.OrderDir(column, ascending).OrderDir("id", ascending).Limit(limit).Load(&orders)
+    return orders, err
+}
+
+// queryOrderLinesByOrderIDs returns the lines of all orders in a single query
+func queryOrderLinesByOrderIDs(sess dbr.SessionRunner, orderIDs []int64) ([]*customerOrderLineEntity, error) {
+    var orderLines []*customerOrderLineEntity
+    if len(orderIDs) == 0 {
+        return orderLines, nil
+    }
+    _, err := sess.Select("*").From(db.CustomerOrderLineTable).Where("order_id IN ?", orderIDs).OrderBy("id").Load(&orderLines)
+    return orderLines, err
+}
+
+func queryProductsByIDs(sess dbr.SessionRunner, ids []int64) ([]ProductEntity, error) {
+    var products = []ProductEntity{}
+    _, err := sess.Select("*").From(db.ProductTable).Where("id IN ?", ids).Load(&products)
+    return products, err
+}
+
+// insertOrderEntity stores the order and returns the generated id
+func insertOrderEntity(sess dbr.SessionRunner, order *customerOrderEntity) (int64, error) {
+    var id int64
+    err := sess.InsertInto(db.CustomerOrderTable).
+        Columns("status", "version", "time_created", "waiter_id", "customer_name", "remark", "dining_table_id").
+        Record(order).
+        Returning("id").
+        Load(&id)
+    return id, err
+}
+
+// insertOrderLineEntities stores the lines with their modifiers and sets the generated ids of the lines
+func insertOrderLineEntities(sess dbr.SessionRunner, lines []*customerOrderLineEntity) error {
+    for _, line := range lines {
+        err := sess.InsertInto(db.CustomerOrderLineTable).
+            Columns("order_id", "product_id", "product_name", "product_brand", "product_price_in_cents", "quantity", "remark", "ticket_id").
+            Record(line).
+            Returning("id").
+            Load(&line.ID)
+        if err != nil {
+            return err
+        }
+        if len(line.Modifiers) == 0 {
+            continue
+        }
+        insert := sess.InsertInto(db.CustomerOrderLineModifierTable).
+            Columns("order_line_id", "modifier_id", "group_name", "modifier_name", "price_delta_in_cents")
+        for _, modifier := range line.Modifiers {
+            modifier.OrderLineID = line.ID
+            insert.Record(modifier)
+        }
+        if _, err := insert.Exec(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
 
-}
\ No newline at end of file
+// queryOrderLineModifiersByLineIDs returns the modifiers of all order lines in a single query
+func queryOrderLineModifiersByLineIDs(sess dbr.SessionRunner, lineIDs []int64) ([]*orderLineModifierEntity, error) {
+    var modifiers []*orderLineModifierEntity
+    if len(lineIDs) == 0 {
+        return modifiers, nil
+    }
+    _, err := sess.Select("*").From(db.CustomerOrderLineModifierTable).Where("order_line_id IN ?", lineIDs).OrderBy("id").Load(&modifiers)
+    return modifiers, err
+}
+
+// queryModifierGroupsByProductIDs returns the modifier groups of the products in display order
+func queryModifierGroupsByProductIDs(sess dbr.SessionRunner, productIDs []int64) ([]*modifierGroupEntity, error) {
+    var groups []*modifierGroupEntity
+    if len(productIDs) == 0 {
+        return groups, nil
+    }
+    _, err := sess.Select("*").From(db.ModifierGroupTable).Where("product_id IN ?", productIDs).OrderBy("position").OrderBy("id").Load(&groups)
+    return groups, err
+}
+
+// queryModifiersByGroupIDs returns the modifiers of the groups in display order
+func queryModifiersByGroupIDs(sess dbr.SessionRunner, groupIDs []int64) ([]*modifierEntity, error) {
+    var modifiers []*modifierEntity
+    if len(groupIDs) == 0 {
+        return modifiers, nil
+    }
+    _, err := sess.Select("*").From(db.ModifierTable).Where("modifier_group_id IN ?", groupIDs).OrderBy("position").OrderBy("id").Load(&modifiers)
+    return modifiers, err
+}
+
+// updateOrderStatus applies the changes if the order still has status from, returns the number of updated rows
+func updateOrderStatus(sess dbr.SessionRunner, id int64, from string, changes map[string]interface{}) (int64, error) {
+    if result, err := sess.Update(db.CustomerOrderTable).SetMap(changes).Where("id = ? AND status = ?", id, from).Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+// incrementOrderVersion increments the version of the order if it still has the expected version, returns the
+// number of updated rows
+func incrementOrderVersion(sess dbr.SessionRunner, id, expectedVersion int64) (int64, error) {
+    if result, err := sess.Update(db.CustomerOrderTable).Set("version", dbr.Expr("version + 1")).Where("id = ? AND version = ?", id, expectedVersion).Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+func updateOrderLineQuantity(sess dbr.SessionRunner, orderID, lineID, quantity int64) error {
+    _, err := sess.Update(db.CustomerOrderLineTable).Set("quantity", quantity).Where("id = ? AND order_id = ?", lineID, orderID).Exec()
+    return err
+}
+
+func deleteOrderLine(sess dbr.SessionRunner, orderID, lineID int64) error {
+    _, err := sess.DeleteFrom(db.CustomerOrderLineTable).Where("id = ? AND order_id = ?", lineID, orderID).Exec()
+    return err
+}
+
+// insertOrderEventEntity stores the event and returns the generated id
+func insertOrderEventEntity(sess dbr.SessionRunner, event *orderEventEntity) (int64, error) {
+    var id int64
+    err := sess.InsertInto(db.OrderEventTable).
+        Columns("type", "order_id", "previous_status", "payload", "time_created").
+        Record(event).
+        Returning("id").
+        Load(&id)
+    return id, err
+}
+
+// queryOrderEventsAfter returns at most limit events with an id greater than afterID, oldest first
+func queryOrderEventsAfter(sess dbr.SessionRunner, afterID int64, limit uint64) ([]*orderEventEntity, error) {
+    var events []*orderEventEntity
+    _, err := sess.Select("*").From(db.OrderEventTable).Where("id > ?", afterID).OrderBy("id").Limit(limit).Load(&events)
+    return events, err
+}
+
+// queryOrderEventIDRange returns the lowest and highest id of the stored events, zeros if there are none
+func queryOrderEventIDRange(sess dbr.SessionRunner) (int64, int64, error) {
+    var idRange struct {
+        Lowest  dbr.NullInt64
+        Highest dbr.NullInt64
+    }
+    err := sess.Select("MIN(id) AS lowest", "MAX(id) AS highest").From(db.OrderEventTable).LoadOne(&idRange)
+    return idRange.Lowest.Int64, idRange.Highest.Int64, err
+}
+
+// deleteOrderEventsBefore deletes the events created before the time, the latest event is kept so that the ids of
+// the pruned events stay recognizable
+func deleteOrderEventsBefore(sess dbr.SessionRunner, before string) (int64, error) {
+    if result, err := sess.DeleteFrom(db.OrderEventTable).
+        Where("time_created < ? AND id < (SELECT MAX(id) FROM order_event)", before).
+        Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+// lockOrderEvents serializes the transactions that store events until they end, so that events are committed in
+// the order of their ids. The lock is shared by all instances, so every change of an order waits for the commit of
+// the previous one once it publishes its event. publishEvent is the last step before the commit, which keeps the lock
+// short, but it caps the changes per second to one over the commit latency, a few hundred on a local database.
+func lockOrderEvents(sess dbr.SessionRunner) error {
+    _, err := sess.UpdateBySql("SELECT pg_advisory_xact_lock(?)", orderEventLockKey).Exec()
+    return err
+}
+
+// queryOrderEntityForUpdate returns the order and locks it until the end of the transaction
+func queryOrderEntityForUpdate(sess dbr.SessionRunner, id int64) (*customerOrderEntity, error) {
+    var order *customerOrderEntity
+    if err := sess.SelectBySql("SELECT * FROM customer_order WHERE id = ? FOR UPDATE", id).LoadOne(&order); err != nil {
+        return nil, err
+    }
+    return order, nil
+}
+
+// queryPaymentsByOrderIDs returns the payments of all orders in a single query
+func queryPaymentsByOrderIDs(sess dbr.SessionRunner, orderIDs []int64) ([]*paymentEntity, error) {
+    var payments []*paymentEntity
+    if len(orderIDs) == 0 {
+        return payments, nil
+    }
+    _, err := sess.Select("*").From(db.PaymentTable).Where("order_id IN ?", orderIDs).OrderBy("id").Load(&payments)
+    return payments, err
+}
+
+func insertPaymentEntity(sess dbr.SessionRunner, payment *paymentEntity) error {
+    _, err := sess.InsertInto(db.PaymentTable).
+        Columns("order_id", "method", "amount_in_cents", "tip_in_cents", "tendered_in_cents", "change_in_cents", "processed_by", "time_created").
+        Record(payment).
+        Exec()
+    return err
+}
+
+// updateOrderPayment applies the changes of a payment and increments the version of the order
+func updateOrderPayment(sess dbr.SessionRunner, id int64, changes map[string]interface{}) error {
+    changes["version"] = dbr.Expr("version + 1")
+    _, err := sess.Update(db.CustomerOrderTable).SetMap(changes).Where("id = ?", id).Exec()
+    return err
+}
+
+func queryDiningTables(sess dbr.SessionRunner) ([]*diningTableEntity, error) {
+    var tables []*diningTableEntity
+    _, err := sess.Select("*").From(db.DiningTableTable).OrderBy("number").Load(&tables)
+    return tables, err
+}
+
+func queryDiningTableByID(sess dbr.SessionRunner, id int64) (*diningTableEntity, error) {
+    var table *diningTableEntity
+    if err := sess.Select("*").From(db.DiningTableTable).Where("id = ?", id).LoadOne(&table); err != nil {
+        return nil, err
+    }
+    return table, nil
+}
+
+func insertDiningTableEntity(sess dbr.SessionRunner, table *diningTableEntity) (int64, error) {
+    var id int64
+    err := sess.InsertInto(db.DiningTableTable).
+        Columns("number", "area", "capacity", "status", "time_created").
+        Record(table).
+        Returning("id").
+        Load(&id)
+    return id, err
+}
+
+// updateDiningTable applies the changes to the table, returns the amount of updated tables
+func updateDiningTable(sess dbr.SessionRunner, id int64, changes map[string]interface{}) (int64, error) {
+    if result, err := sess.Update(db.DiningTableTable).SetMap(changes).Where("id = ?", id).Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+// queryOpenOrdersAtTables returns the orders at the tables that are not paid or cancelled, oldest first. Without
+// table ids the open orders at all tables are returned.
+func queryOpenOrdersAtTables(sess dbr.SessionRunner, tableIDs []int64) ([]*customerOrderEntity, error) {
+    var orders []*customerOrderEntity
+    query := sess.Select("*").From(db.CustomerOrderTable).
+        Where("dining_table_id IS NOT NULL AND status NOT IN ?", []string{StatusPaid, StatusCancelled})
+    if len(tableIDs) > 0 {
+        query = query.Where("dining_table_id IN ?", tableIDs)
+    }
+    _, err := query.OrderBy("id").Load(&orders)
+    return orders, err
+}
+
+// queryOpenOrderIDsAtTableForUpdate returns the ids of the open orders at the table and locks them until the end of
+// the transaction
+func queryOpenOrderIDsAtTableForUpdate(sess dbr.SessionRunner, tableID int64) ([]int64, error) {
+    var ids []int64
+    _, err := sess.SelectBySql("SELECT id FROM customer_order WHERE dining_table_id = ? AND status NOT IN ? ORDER BY id FOR UPDATE",
+        tableID, []string{StatusPaid, StatusCancelled}).Load(&ids)
+    return ids, err
+}
+
+// updateOrderDiningTable moves the order to the table, the version is left to the edit that moves it
+func updateOrderDiningTable(sess dbr.SessionRunner, orderID, tableID int64) error {
+    _, err := sess.Update(db.CustomerOrderTable).Set("dining_table_id", tableID).Where("id = ?", orderID).Exec()
+    return err
+}
+
+// moveOrdersToTable moves the orders to the table and increments their versions
+func moveOrdersToTable(sess dbr.SessionRunner, orderIDs []int64, tableID int64) error {
+    if len(orderIDs) == 0 {
+        return nil
+    }
+    _, err := sess.Update(db.CustomerOrderTable).
+        Set("dining_table_id", tableID).
+        Set("version", dbr.Expr("version + 1")).
+        Where("id IN ?", orderIDs).
+        Exec()
+    return err
+}
+
+func queryStations(sess dbr.SessionRunner) ([]*stationEntity, error) {
+    var stations []*stationEntity
+    _, err := sess.Select("*").From(db.StationTable).OrderBy("name").Load(&stations)
+    return stations, err
+}
+
+func queryStationByID(sess dbr.SessionRunner, id int64) (*stationEntity, error) {
+    var station *stationEntity
+    if err := sess.Select("*").From(db.StationTable).Where("id = ?", id).LoadOne(&station); err != nil {
+        return nil, err
+    }
+    return station, nil
+}
+
+func insertStationEntity(sess dbr.SessionRunner, station *stationEntity) (int64, error) {
+    var id int64
+    err := sess.InsertInto(db.StationTable).
+        Columns("name", "time_created").
+        Record(station).
+        Returning("id").
+        Load(&id)
+    return id, err
+}
+
+// updateProductStation sets the station where the product is prepared, returns the amount of updated products
+func updateProductStation(sess dbr.SessionRunner, productID int64, stationID dbr.NullInt64) (int64, error) {
+    if result, err := sess.Update(db.ProductTable).Set("station_id", stationID).Where("id = ?", productID).Exec(); err != nil {
+        return 0, err
+    } else {
+        return result.RowsAffected()
+    }
+}
+
+// insertTicketEntity stores the ticket and returns the generated id
+func insertTicketEntity(sess dbr.SessionRunner, ticket *ticketEntity) (int64, error) {
+    var id int64
+    err := sess.InsertInto(db.TicketTable).
+        Columns("order_id", "station_id", "status", "time_created").
+        Record(ticket).
+        Returning("id").
+        Load(&id)
+    return id, err
+}
+
+// queryTicketForUpdate returns the ticket and locks it until the end of the transaction
+func queryTicketForUpdate(sess dbr.SessionRunner, id int64) (*ticketEntity, error) {
+    var ticket *ticketEntity
+    if err := sess.SelectBySql("SELECT * FROM ticket WHERE id = ? FOR UPDATE", id).LoadOne(&ticket); err != nil {
+        return nil, err
+    }
+    return ticket, nil
+}
+
+func updateTicket(sess dbr.SessionRunner, id int64, changes map[string]interface{}) error {
+    _, err := sess.Update(db.TicketTable).SetMap(changes).Where("id = ?", id).Exec()
+    return err
+}
+
+// queryTicketsByOrderIDs returns the tickets of all orders in a single query, in fire order
+func queryTicketsByOrderIDs(sess dbr.SessionRunner, orderIDs []int64) ([]*ticketEntity, error) {
+    var tickets []*ticketEntity
+    if len(orderIDs) == 0 {
+        return tickets, nil
+    }
+    _, err := sess.Select("*").From(db.TicketTable).Where("order_id IN ?", orderIDs).OrderBy("id").Load(&tickets)
+    return tickets, err
+}
+
+// queryTicketsAtStation returns the tickets of the station with one of the statuses, in fire order
+func queryTicketsAtStation(sess dbr.SessionRunner, stationID int64, statuses []string) ([]*ticketEntity, error) {
+    var tickets []*ticketEntity
+    _, err := sess.Select("*").From(db.TicketTable).
+        Where("station_id = ? AND status IN ?", stationID, statuses).
+        OrderBy("time_created").
+        OrderBy("id").
+        Load(&tickets)
+    return tickets, err
+}
+
+// cancelTickets cancels the tickets of the order that have one of the statuses
+func cancelTickets(sess dbr.SessionRunner, orderID int64, statuses []string) error {
+    _, err := sess.Update(db.TicketTable).
+        Set("status", TicketCancelled).
+        Where("order_id = ? AND status IN ?", orderID, statuses).
+        Exec()
+    return err
+}
+
+// readyTickets marks the tickets of the order that have one of the statuses ready
+func readyTickets(sess dbr.SessionRunner, orderID int64, statuses []string, now string) error {
+    _, err := sess.Update(db.TicketTable).
+        Set("status", TicketReady).
+        Set("time_started", dbr.Expr("COALESCE(time_started, ?)", now)).
+        Set("time_ready", now).
+        Where("order_id = ? AND status IN ?", orderID, statuses).
+        Exec()
+    return err
+}
+
+// cancelEmptyTickets cancels the tickets of the order with one of the statuses that no longer have any lines
+func cancelEmptyTickets(sess dbr.SessionRunner, orderID int64, statuses []string) error {
+    _, err := sess.Update(db.TicketTable).
+        Set("status", TicketCancelled).
+        Where("order_id = ? AND status IN ?", orderID, statuses).
+        Where("NOT EXISTS (SELECT 1 FROM customer_order_line WHERE customer_order_line.ticket_id = ticket.id)").
+        Exec()
+    return err
+}
+
+func queryOrderEntitiesByIDs(sess dbr.SessionRunner, ids []int64) ([]*customerOrderEntity, error) {
+    var orders []*customerOrderEntity
+    if len(ids) == 0 {
+        return orders, nil
+    }
+    _, err := sess.Select("*").From(db.CustomerOrderTable).Where("id IN ?", ids).Load(&orders)
+    return orders, err
+}
+
+func queryTicketByID(sess dbr.SessionRunner, id int64) (*ticketEntity, error) {
+    var ticket *ticketEntity
+    if err := sess.Select("*").From(db.TicketTable).Where("id = ?", id).LoadOne(&ticket); err != nil {
+        return nil, err
+    }
+    return ticket, nil
+}
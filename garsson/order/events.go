@@ -0,0 +1,142 @@
+package order
+
+import (
+    "sync"
+
+    "github.com/kubernetes/kubernetes/pkg/util/slice"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+// Every change of an order is published as an event, screens subscribe to the EventBus instead of polling the orders.
+// Publishing never blocks: a subscriber that cannot keep up is dropped and has to reconnect and reload the orders.
+
+const (
+    // EventOrderCreated is published when an order is placed
+    EventOrderCreated = "order.created"
+    // EventOrderUpdated is published when the lines of an order change
+    EventOrderUpdated = "order.updated"
+    // EventOrderStatusChanged is published when an order moves to another status
+    EventOrderStatusChanged = "order.status_changed"
+
+    // subscriptionBufferSize is the number of events a subscriber may lag behind before it is dropped
+    subscriptionBufferSize = 64
+)
+
+// Event describes a change of an order, Order is the order after the change
+type Event struct {
+    // ID increases with every event, a client resumes after the last id it received
+    ID    int64          `json:"id"`
+    Type  string         `json:"type"`
+    Time  string         `json:"time"`
+    Order *CustomerOrder `json:"order"`
+    // PreviousStatus is the status before an EventOrderStatusChanged
+    PreviousStatus string `json:"previousStatus,omitempty"`
+}
+
+// EventFilter selects the events of a subscription, an empty filter selects all events
+type EventFilter struct {
+    // Statuses selects events of orders that have, or had before a status change, one of the statuses
+    Statuses []string `json:"statuses,omitempty"`
+    // Stations selects events of orders with a ticket at one of the stations
+    Stations []int64 `json:"stations,omitempty"`
+}
+
+// Matches returns true if the event is selected by both the statuses and the stations of the filter
+func (f EventFilter) Matches(event Event) bool {
+    return f.matchesStatus(event) && f.matchesStation(event)
+}
+
+func (f EventFilter) matchesStatus(event Event) bool {
+    if len(f.Statuses) == 0 {
+        return true
+    }
+    return slice.ContainsString(f.Statuses, event.Order.Status, nil) ||
+        (event.PreviousStatus != "" && slice.ContainsString(f.Statuses, event.PreviousStatus, nil))
+}
+
+func (f EventFilter) matchesStation(event Event) bool {
+    if len(f.Stations) == 0 {
+        return true
+    }
+    for _, ticket := range event.Order.Tickets {
+        for _, station := range f.Stations {
+            if ticket.StationID == station {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// EventBus distributes order events to the subscribers in this process
+type EventBus struct {
+    mutex       sync.Mutex
+    subscribers map[*Subscription]bool
+}
+
+// Subscription receives the events that match its filter until it is closed
+type Subscription struct {
+    bus    *EventBus
+    filter EventFilter
+    events chan Event
+}
+
+// NewEventBus creates an event bus without subscribers
+func NewEventBus() *EventBus {
+    return &EventBus{subscribers: map[*Subscription]bool{}}
+}
+
+// Subscribe starts receiving the events that match filter, the subscription must be closed when no longer needed
+func (b *EventBus) Subscribe(filter EventFilter) *Subscription {
+    subscription := &Subscription{bus: b, filter: filter, events: make(chan Event, subscriptionBufferSize)}
+    b.mutex.Lock()
+    b.subscribers[subscription] = true
+    b.mutex.Unlock()
+    return subscription
+}
+
+// Publish sends the event to all matching subscribers, subscribers whose buffer is full are dropped
+func (b *EventBus) Publish(event Event) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    for subscription := range b.subscribers {
+        if !subscription.filter.Matches(event) {
+            continue
+        }
+        select {
+        case subscription.events <- event:
+        default:
+            log.WithField("event", event.Type).Warn("dropping order event subscriber that cannot keep up")
+            b.remove(subscription)
+        }
+    }
+}
+
+// DropAll drops every subscriber, used when events may have been missed so that the subscribers reload the orders
+func (b *EventBus) DropAll() {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    for subscription := range b.subscribers {
+        b.remove(subscription)
+    }
+}
+
+// remove closes the events of the subscription, requires the lock
+func (b *EventBus) remove(subscription *Subscription) {
+    if b.subscribers[subscription] {
+        delete(b.subscribers, subscription)
+        close(subscription.events)
+    }
+}
+
+// Events returns the events of the subscription, the channel is closed when the subscriber is dropped or closed
+func (s *Subscription) Events() <-chan Event {
+    return s.events
+}
+
+// Close stops the subscription, it is safe to close a subscription more than once
+func (s *Subscription) Close() {
+    s.bus.mutex.Lock()
+    defer s.bus.mutex.Unlock()
+    s.bus.remove(s)
+}
@@ -0,0 +1,158 @@
+package order
+
+import (
+    "encoding/json"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// eventIDRangeRows returns the lowest and highest id of the stored events
+func eventIDRangeRows(lowest, highest int64) *sqlmock.Rows {
+    return sqlmock.NewRows([]string{"lowest", "highest"}).AddRow(lowest, highest)
+}
+
+// eventRows returns stored events of orders with the statuses, their ids start at firstID
+func eventRows(t *testing.T, firstID int64, statuses ...string) *sqlmock.Rows {
+    rows := sqlmock.NewRows([]string{"id", "type", "order_id", "payload", "time_created"})
+    for i, status := range statuses {
+        payload, err := json.Marshal(&CustomerOrder{ID: 1, Status: status})
+        assert.NoError(t, err)
+        rows.AddRow(firstID+int64(i), EventOrderUpdated, 1, string(payload), "2018-06-01T20:00:00Z")
+    }
+    return rows
+}
+
+func TestEventFilter_MatchesCurrentAndPreviousStatus(t *testing.T) {
+    filter := EventFilter{Statuses: []string{StatusPlaced, StatusInPreparation}}
+
+    assert.True(t, filter.Matches(Event{Type: EventOrderCreated, Order: &CustomerOrder{Status: StatusPlaced}}))
+    assert.True(t, filter.Matches(Event{Type: EventOrderStatusChanged, Order: &CustomerOrder{Status: StatusPrepared}, PreviousStatus: StatusInPreparation}))
+    assert.False(t, filter.Matches(Event{Type: EventOrderStatusChanged, Order: &CustomerOrder{Status: StatusPaid}, PreviousStatus: StatusServed}))
+    assert.True(t, EventFilter{}.Matches(Event{Type: EventOrderUpdated, Order: &CustomerOrder{Status: StatusPaid}}))
+}
+
+func TestEventFilter_MatchesStationsOfTickets(t *testing.T) {
+    kitchen := EventFilter{Stations: []int64{2}}
+    order := &CustomerOrder{Status: StatusPlaced, Tickets: []*Ticket{{StationID: 1}, {StationID: 2}}}
+
+    assert.True(t, kitchen.Matches(Event{Type: EventOrderCreated, Order: order}))
+    assert.False(t, kitchen.Matches(Event{Type: EventOrderCreated, Order: &CustomerOrder{Status: StatusPlaced, Tickets: []*Ticket{{StationID: 1}}}}))
+    assert.False(t, EventFilter{Statuses: []string{StatusServed}, Stations: []int64{2}}.Matches(Event{Type: EventOrderCreated, Order: order}))
+}
+
+func TestEventBus_PublishesToMatchingSubscribers(t *testing.T) {
+    bus := NewEventBus()
+    bar := bus.Subscribe(EventFilter{Statuses: []string{StatusPlaced}})
+    defer bar.Close()
+    cashier := bus.Subscribe(EventFilter{Statuses: []string{StatusServed}})
+    defer cashier.Close()
+
+    bus.Publish(Event{Type: EventOrderCreated, Order: &CustomerOrder{ID: 1, Status: StatusPlaced}})
+
+    assert.Equal(t, int64(1), (<-bar.Events()).Order.ID)
+    assert.Len(t, cashier.Events(), 0)
+}
+
+func TestEventBus_DropsSubscriberThatCannotKeepUp(t *testing.T) {
+    bus := NewEventBus()
+    slow := bus.Subscribe(EventFilter{})
+
+    for i := 0; i <= subscriptionBufferSize; i++ {
+        bus.Publish(Event{Type: EventOrderUpdated, Order: &CustomerOrder{ID: int64(i)}})
+    }
+
+    received := 0
+    for range slow.Events() {
+        received++
+    }
+    assert.Equal(t, subscriptionBufferSize, received)
+    slow.Close() // closing a dropped subscription is allowed
+}
+
+func TestEventBus_DropAllClosesSubscriptions(t *testing.T) {
+    bus := NewEventBus()
+    first := bus.Subscribe(EventFilter{})
+    second := bus.Subscribe(EventFilter{Statuses: []string{StatusPlaced}})
+
+    bus.DropAll()
+    bus.Publish(Event{Type: EventOrderCreated, Order: &CustomerOrder{Status: StatusPlaced}})
+
+    _, open := <-first.Events()
+    assert.False(t, open)
+    _, open = <-second.Events()
+    assert.False(t, open)
+}
+
+func TestOrderEventEntity_ToEvent(t *testing.T) {
+    entity := orderEventEntity{
+        ID:             42,
+        Type:           EventOrderStatusChanged,
+        OrderID:        7,
+        PreviousStatus: nullIfEmpty(StatusPlaced),
+        Payload:        `{"id":7,"status":"in_preparation","version":2,"orderLines":[]}`,
+        TimeCreated:    "2018-06-01T10:00:00Z",
+    }
+
+    event, err := entity.toEvent()
+    assert.NoError(t, err)
+    assert.Equal(t, int64(42), event.ID)
+    assert.Equal(t, StatusPlaced, event.PreviousStatus)
+    assert.Equal(t, StatusInPreparation, event.Order.Status)
+    assert.Equal(t, int64(2), event.Order.Version)
+}
+
+func TestReplayEvents_ReturnsMatchingEventsAfterID(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT MIN\(id\) AS lowest, MAX\(id\) AS highest FROM order_event`).WillReturnRows(eventIDRangeRows(10, 14))
+    mock.ExpectQuery(`SELECT \* FROM order_event WHERE \(id > 11\) ORDER BY id LIMIT 1001`).
+        WillReturnRows(eventRows(t, 12, StatusPlaced, StatusPaid, StatusPlaced))
+
+    events, err := ReplayEvents(dao.NewSession(), 11, EventFilter{Statuses: []string{StatusPlaced}})
+    assert.NoError(t, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+    if assert.Len(t, events, 2) {
+        assert.Equal(t, int64(12), events[0].ID)
+        assert.Equal(t, int64(14), events[1].ID)
+        assert.Equal(t, StatusPlaced, events[1].Order.Status)
+    }
+}
+
+func TestReplayEvents_UpToDate(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT MIN\(id\) AS lowest, MAX\(id\) AS highest FROM order_event`).WillReturnRows(eventIDRangeRows(10, 14))
+    mock.ExpectQuery(`SELECT \* FROM order_event WHERE \(id > 14\)`).WillReturnRows(eventRows(t, 15))
+
+    events, err := ReplayEvents(dao.NewSession(), 14, EventFilter{})
+    assert.NoError(t, err)
+    assert.Empty(t, events)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReplayEvents_PrunedOrUnknownID(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectQuery(`SELECT MIN\(id\) AS lowest, MAX\(id\) AS highest FROM order_event`).WillReturnRows(eventIDRangeRows(10, 14))
+    mock.ExpectQuery(`SELECT MIN\(id\) AS lowest, MAX\(id\) AS highest FROM order_event`).WillReturnRows(eventIDRangeRows(10, 14))
+
+    _, err := ReplayEvents(dao.NewSession(), 8, EventFilter{})
+    assert.Equal(t, ErrEventsUnavailable, err, "event 9 was pruned")
+    _, err = ReplayEvents(dao.NewSession(), 15, EventFilter{})
+    assert.Equal(t, ErrEventsUnavailable, err, "event 15 does not exist yet")
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReplayEvents_TooManyMissed(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    statuses := make([]string, eventReplayLimit+1)
+    for i := range statuses {
+        statuses[i] = StatusPlaced
+    }
+    mock.ExpectQuery(`SELECT MIN\(id\) AS lowest, MAX\(id\) AS highest FROM order_event`).WillReturnRows(eventIDRangeRows(1, 5000))
+    mock.ExpectQuery(`SELECT \* FROM order_event WHERE \(id > 1\)`).WillReturnRows(eventRows(t, 2, statuses...))
+
+    _, err := ReplayEvents(dao.NewSession(), 1, EventFilter{})
+    assert.Equal(t, ErrEventsUnavailable, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,142 @@
+package order
+
+import (
+    "errors"
+
+    "github.com/gocraft/dbr"
+    "github.com/toefel18/garsson-api/garsson/db"
+)
+
+// Lines can be added, changed and removed until the order is paid or cancelled. Every change increments the version
+// of the order and must name the version it was based on, so that of two waiters editing the same order the second
+// one is told to reload instead of silently overwriting the first.
+
+var (
+    // ErrVersionMismatch indicates that the order was changed since the version the caller based its change on
+    ErrVersionMismatch = errors.New("order was changed by someone else, reload it and try again")
+    // ErrOrderClosed indicates that the order is paid or cancelled and can no longer be changed
+    ErrOrderClosed = errors.New("order is paid or cancelled and can no longer be changed")
+    // ErrOrderLineNotFound indicates that the order has no line with the given id
+    ErrOrderLineNotFound = errors.New("order line not found")
+    // ErrLastOrderLine indicates that the only line of an order was removed
+    ErrLastOrderLine = errors.New("cannot remove the last order line, cancel the order instead")
+)
+
+// AddOrderLine adds a line for a product to the order, the product and its modifiers are copied like in CreateOrder and
+// the line is fired as a new ticket
+func AddOrderLine(sess *dbr.Session, orderID, expectedVersion int64, newLine NewOrderLine) (*CustomerOrder, error) {
+    if newLine.Quantity <= 0 {
+        return nil, ErrInvalidQuantity
+    }
+    return editOrder(sess, orderID, expectedVersion, func(tx *dbr.Tx, lines []*customerOrderLineEntity) error {
+        products, err := findProductsWithModifiers(tx, []int64{newLine.ProductID})
+        if err != nil {
+            return err
+        }
+        added, err := snapshotOrderLines([]NewOrderLine{newLine}, products)
+        if err != nil {
+            return err
+        }
+        added[0].OrderID = orderID
+        if _, err := fireTickets(tx, orderID, added, db.Now()); err != nil {
+            return err
+        }
+        return insertOrderLineEntities(tx, added)
+    })
+}
+
+// ChangeOrderLineQuantity sets the quantity of a line of the order
+func ChangeOrderLineQuantity(sess *dbr.Session, orderID, expectedVersion, lineID, quantity int64) (*CustomerOrder, error) {
+    if quantity <= 0 {
+        return nil, ErrInvalidQuantity
+    }
+    return editOrder(sess, orderID, expectedVersion, func(tx *dbr.Tx, lines []*customerOrderLineEntity) error {
+        if findOrderLine(lines, lineID) == nil {
+            return ErrOrderLineNotFound
+        }
+        return updateOrderLineQuantity(tx, orderID, lineID, quantity)
+    })
+}
+
+// RemoveOrderLine removes a line of the order, an order keeps at least one line. A ticket without lines is cancelled,
+// which makes the order prepared when all of its other tickets are ready.
+func RemoveOrderLine(sess *dbr.Session, orderID, expectedVersion, lineID int64) (*CustomerOrder, error) {
+    return editOrder(sess, orderID, expectedVersion, func(tx *dbr.Tx, lines []*customerOrderLineEntity) error {
+        if findOrderLine(lines, lineID) == nil {
+            return ErrOrderLineNotFound
+        } else if len(lines) == 1 {
+            return ErrLastOrderLine
+        }
+        if err := deleteOrderLine(tx, orderID, lineID); err != nil {
+            return err
+        }
+        if err := cancelEmptyTickets(tx, orderID, openTicketStatuses); err != nil {
+            return err
+        }
+        return followTickets(tx, orderID)
+    })
+}
+
+// IsEditable returns true if the lines of an order with the status can still be changed
+func IsEditable(status string) bool {
+    return status != StatusPaid && status != StatusCancelled
+}
+
+// editOrder runs edit in a transaction after checking that the order is still editable and has the expected version.
+// The version is incremented before edit runs, which locks the order until the transaction ends.
+func editOrder(sess *dbr.Session, orderID, expectedVersion int64, edit func(tx *dbr.Tx, lines []*customerOrderLineEntity) error) (*CustomerOrder, error) {
+    tx, err := sess.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.RollbackUnlessCommitted()
+
+    current, err := queryOrderEntityByID(tx, orderID)
+    if err == dbr.ErrNotFound {
+        return nil, ErrOrderNotFound
+    } else if err != nil {
+        return nil, err
+    } else if current.Version != expectedVersion {
+        return nil, ErrVersionMismatch
+    } else if !IsEditable(current.Status) {
+        return nil, ErrOrderClosed
+    }
+    // a concurrent edit that committed after the query above has already incremented the version
+    if updated, err := incrementOrderVersion(tx, orderID, expectedVersion); err != nil {
+        return nil, err
+    } else if updated == 0 {
+        return nil, ErrVersionMismatch
+    }
+    lines, err := queryOrderLinesByOrderID(tx, orderID)
+    if err != nil {
+        return nil, err
+    }
+    if err := edit(tx, lines); err != nil {
+        return nil, err
+    }
+    edited, err := FindOrderByID(tx, orderID)
+    if err != nil {
+        return nil, err
+    }
+    if edited.Status != current.Status {
+        err = publishEvent(tx, EventOrderStatusChanged, edited, current.Status)
+    } else {
+        err = publishEvent(tx, EventOrderUpdated, edited, "")
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    return edited, nil
+}
+
+func findOrderLine(lines []*customerOrderLineEntity, lineID int64) *customerOrderLineEntity {
+    for _, line := range lines {
+        if line.ID == lineID {
+            return line
+        }
+    }
+    return nil
+}
@@ -0,0 +1,64 @@
+package order
+
+import (
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestIsEditable(t *testing.T) {
+    assert.True(t, IsEditable(StatusPlaced))
+    assert.True(t, IsEditable(StatusServed))
+    assert.False(t, IsEditable(StatusPaid))
+    assert.False(t, IsEditable(StatusCancelled))
+}
+
+func TestFindOrderLine(t *testing.T) {
+    lines := []*customerOrderLineEntity{{ID: 7, ProductID: 1}, {ID: 8, ProductID: 1}}
+    assert.Equal(t, lines[1], findOrderLine(lines, 8))
+    assert.Nil(t, findOrderLine(lines, 9))
+}
+
+func TestMapOrderToPublicAPI_ExposesVersionAndLineIDs(t *testing.T) {
+    order, err := mapOrderToPublicAPI(&customerOrderEntity{ID: 1, Version: 3}, []*customerOrderLineEntity{{ID: 7, OrderID: 1, ProductID: 2}}, nil, nil)
+    assert.NoError(t, err)
+    assert.Equal(t, int64(3), order.Version)
+    assert.Equal(t, int64(7), order.OrderLines[0].ID)
+}
+
+func TestEditOrder_StaleVersion(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM customer_order WHERE \(id = 1\)`).WillReturnRows(orderRows(1, StatusPlaced, 3))
+    mock.ExpectRollback()
+
+    _, err := ChangeOrderLineQuantity(dao.NewSession(), 1, 2, 7, 4)
+    assert.Equal(t, ErrVersionMismatch, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestEditOrder_ConcurrentEdit(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM customer_order WHERE \(id = 1\)`).WillReturnRows(orderRows(1, StatusPlaced, 2))
+    // another edit incremented the version after the order was read
+    mock.ExpectExec(`UPDATE "customer_order" SET "version" = version \+ 1 WHERE \(id = 1 AND version = 2\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectRollback()
+
+    _, err := ChangeOrderLineQuantity(dao.NewSession(), 1, 2, 7, 4)
+    assert.Equal(t, ErrVersionMismatch, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestEditOrder_ClosedOrder(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM customer_order WHERE \(id = 1\)`).WillReturnRows(orderRows(1, StatusPaid, 2))
+    mock.ExpectRollback()
+
+    _, err := ChangeOrderLineQuantity(dao.NewSession(), 1, 2, 7, 4)
+    assert.Equal(t, ErrOrderClosed, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
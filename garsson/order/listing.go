@@ -0,0 +1,278 @@
+package order
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "strconv"
+    "strings"
+
+    "github.com/gocraft/dbr"
+    "github.com/toefel18/garsson-api/garsson/db"
+)
+
+// Orders are listed a page at a time. The cursor of the next page holds the sort value and id of the last order on
+// the page, so the next page continues after it even when orders are placed in the meantime, which an offset would
+// not. The lines, payments and tickets of all orders on a page are loaded together, not with a query per order.
+
+var (
+    // ErrInvalidSort indicates that the orders cannot be sorted on the requested field
+    ErrInvalidSort = errors.New("unknown sort, use id, timeCreated or customerName, prefix with - to sort descending")
+    // ErrInvalidCursor indicates that the cursor was not issued for this sort
+    ErrInvalidCursor = errors.New("invalid cursor, start again from the first page")
+    // ErrInvalidLimit indicates that the page size is out of range
+    ErrInvalidLimit = errors.New("limit must be between 1 and 200")
+    // ErrInvalidTimeRange indicates that the creation time filter is not a valid range of RFC3339 timestamps
+    ErrInvalidTimeRange = errors.New("createdFrom and createdUntil must be RFC3339 timestamps, createdFrom before createdUntil")
+)
+
+const (
+    // DefaultOrderLimit is the page size when no limit is given
+    DefaultOrderLimit = 50
+    // MaxOrderLimit is the largest page size
+    MaxOrderLimit = 200
+    // DefaultOrderSort lists the newest orders first
+    DefaultOrderSort = "-timeCreated"
+)
+
+// sortColumns maps the sortable fields to their column, NULL is sorted as empty string so the cursor can compare it
+var sortColumns = map[string]string{
+    "id":           "id",
+    "timeCreated":  "COALESCE(time_created, '')",
+    "customerName": "COALESCE(customer_name, '')",
+}
+
+// OrderQuery selects a page of orders, empty fields do not filter
+type OrderQuery struct {
+    Statuses   []string
+    Waiter     string
+    BarHandler string
+    // CustomerName matches customer names that contain it, ignoring case
+    CustomerName string
+    // CreatedFrom selects orders created at or after the RFC3339 timestamp
+    CreatedFrom string
+    // CreatedUntil selects orders created before the RFC3339 timestamp
+    CreatedUntil string
+    // Sort is id, timeCreated or customerName, prefixed with - for descending order, DefaultOrderSort if empty
+    Sort string
+    // Limit is the page size, DefaultOrderLimit if 0
+    Limit int
+    // Cursor is the NextCursor of the previous page, empty for the first page
+    Cursor string
+}
+
+// OrderPage is a page of orders
+type OrderPage struct {
+    Orders     []*CustomerOrder `json:"orders"`
+    Pagination Pagination       `json:"pagination"`
+}
+
+// Pagination describes where a page is in the list
+type Pagination struct {
+    Limit   int    `json:"limit"`
+    Sort    string `json:"sort"`
+    HasMore bool   `json:"hasMore"`
+    // NextCursor selects the next page, empty on the last page
+    NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// orderCursor is the position after the last order of a page
+type orderCursor struct {
+    Sort  string `json:"s"`
+    Value string `json:"v"`
+    ID    int64  `json:"id"`
+}
+
+// condition is a WHERE clause with its values
+type condition struct {
+    query  string
+    values []interface{}
+}
+
+// FindOrders returns the page of orders that match the query
+func FindOrders(sess dbr.SessionRunner, query OrderQuery) (*OrderPage, error) {
+    if query.Sort == "" {
+        query.Sort = DefaultOrderSort
+    }
+    if query.Limit == 0 {
+        query.Limit = DefaultOrderLimit
+    } else if query.Limit < 0 || query.Limit > MaxOrderLimit {
+        return nil, ErrInvalidLimit
+    }
+    field, ascending := strings.TrimPrefix(query.Sort, "-"), !strings.HasPrefix(query.Sort, "-")
+    column, sortable := sortColumns[field]
+    if !sortable {
+        return nil, ErrInvalidSort
+    }
+    conditions, err := orderConditions(query)
+    if err != nil {
+        return nil, err
+    }
+    if query.Cursor != "" {
+        if cursorCondition, err := afterCursor(query.Cursor, query.Sort, column, ascending); err != nil {
+            return nil, err
+        } else {
+            conditions = append(conditions, cursorCondition)
+        }
+    }
+
+    // one more than the limit tells if there is a next page
+    entities, err := queryOrders(sess, conditions, column, ascending, uint64(query.Limit+1))
+    if err != nil {
+        return nil, err
+    }
+    page := &OrderPage{Pagination: Pagination{Limit: query.Limit, Sort: query.Sort}}
+    if len(entities) > query.Limit {
+        entities = entities[:query.Limit]
+        last := entities[len(entities)-1]
+        page.Pagination.HasMore = true
+        page.Pagination.NextCursor = encodeCursor(orderCursor{Sort: query.Sort, Value: sortValue(last, field), ID: last.ID})
+    }
+    if page.Orders, err = loadOrders(sess, entities); err != nil {
+        return nil, err
+    }
+    return page, nil
+}
+
+// loadOrders loads the lines, payments and tickets of all orders together and maps them to the public representation
+func loadOrders(sess dbr.SessionRunner, entities []*customerOrderEntity) ([]*CustomerOrder, error) {
+    ids := make([]int64, 0, len(entities))
+    for _, entity := range entities {
+        ids = append(ids, entity.ID)
+    }
+    lines, err := loadOrderLines(sess, ids)
+    if err != nil {
+        return nil, err
+    }
+    payments, err := queryPaymentsByOrderIDs(sess, ids)
+    if err != nil {
+        return nil, err
+    }
+    linesByOrder := map[int64][]*customerOrderLineEntity{}
+    for _, line := range lines {
+        linesByOrder[line.OrderID] = append(linesByOrder[line.OrderID], line)
+    }
+    paymentsByOrder := map[int64][]*paymentEntity{}
+    for _, payment := range payments {
+        paymentsByOrder[payment.OrderID] = append(paymentsByOrder[payment.OrderID], payment)
+    }
+    tickets, err := queryTicketsByOrderIDs(sess, ids)
+    if err != nil {
+        return nil, err
+    }
+    ticketsByOrder := map[int64][]*ticketEntity{}
+    for _, ticket := range tickets {
+        ticketsByOrder[ticket.OrderID] = append(ticketsByOrder[ticket.OrderID], ticket)
+    }
+    orders := make([]*CustomerOrder, 0, len(entities))
+    for _, entity := range entities {
+        if order, err := mapOrderToPublicAPI(entity, linesByOrder[entity.ID], paymentsByOrder[entity.ID], ticketsByOrder[entity.ID]); err != nil {
+            return nil, err
+        } else {
+            orders = append(orders, order)
+        }
+    }
+    return orders, nil
+}
+
+// orderConditions returns the conditions of the filters in the query
+func orderConditions(query OrderQuery) ([]condition, error) {
+    var conditions []condition
+    for _, status := range query.Statuses {
+        if !IsValidStatus(status) {
+            return nil, ErrUnknownStatus
+        }
+    }
+    if len(query.Statuses) > 0 {
+        conditions = append(conditions, condition{"status IN ?", []interface{}{query.Statuses}})
+    }
+    if query.Waiter != "" {
+        conditions = append(conditions, condition{"waiter_id = ?", []interface{}{query.Waiter}})
+    }
+    if query.BarHandler != "" {
+        conditions = append(conditions, condition{"bar_handler_id = ?", []interface{}{query.BarHandler}})
+    }
+    if name := strings.TrimSpace(query.CustomerName); name != "" {
+        conditions = append(conditions, condition{"customer_name ILIKE ?", []interface{}{containsPattern(name)}})
+    }
+    from, until, err := normalizeTimeRange(query.CreatedFrom, query.CreatedUntil)
+    if err != nil {
+        return nil, err
+    }
+    if from != "" {
+        conditions = append(conditions, condition{"time_created >= ?", []interface{}{from}})
+    }
+    if until != "" {
+        conditions = append(conditions, condition{"time_created < ?", []interface{}{until}})
+    }
+    return conditions, nil
+}
+
+// normalizeTimeRange formats the timestamps like the stored ones, so that they can be compared as strings
+func normalizeTimeRange(from, until string) (string, string, error) {
+    var normalized [2]string
+    for i, value := range []string{from, until} {
+        if value == "" {
+            continue
+        } else if parsed, err := db.ParseTime(value); err != nil {
+            return "", "", ErrInvalidTimeRange
+        } else {
+            normalized[i] = db.FormatTime(parsed)
+        }
+    }
+    if normalized[0] != "" && normalized[1] != "" && normalized[0] >= normalized[1] {
+        return "", "", ErrInvalidTimeRange
+    }
+    return normalized[0], normalized[1], nil
+}
+
+// afterCursor returns the condition that selects the orders after the cursor in the sort order
+func afterCursor(encoded, sort, column string, ascending bool) (condition, error) {
+    cursor, err := decodeCursor(encoded)
+    if err != nil || cursor.Sort != sort {
+        return condition{}, ErrInvalidCursor
+    }
+    operator := ">"
+    if !ascending {
+        operator = "<"
+    }
+    if column == "id" {
+        return condition{"id " + operator + " ?", []interface{}{cursor.ID}}, nil
+    }
+    return condition{
+        "(" + column + " " + operator + " ? OR (" + column + " = ? AND id " + operator + " ?))",
+        []interface{}{cursor.Value, cursor.Value, cursor.ID},
+    }, nil
+}
+
+// sortValue returns the value of the order in the sort column
+func sortValue(order *customerOrderEntity, field string) string {
+    switch field {
+    case "timeCreated":
+        return order.TimeCreated
+    case "customerName":
+        return order.CustomerName.String
+    default:
+        return strconv.FormatInt(order.ID, 10)
+    }
+}
+
+func encodeCursor(cursor orderCursor) string {
+    encoded, _ := json.Marshal(cursor)
+    return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeCursor(encoded string) (orderCursor, error) {
+    var cursor orderCursor
+    if decoded, err := base64.RawURLEncoding.DecodeString(encoded); err != nil {
+        return cursor, err
+    } else {
+        return cursor, json.Unmarshal(decoded, &cursor)
+    }
+}
+
+// containsPattern returns a LIKE pattern that matches values containing the text, wildcards in text are escaped
+func containsPattern(text string) string {
+    escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(text)
+    return "%" + escaped + "%"
+}
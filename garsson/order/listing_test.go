@@ -0,0 +1,98 @@
+package order
+
+import (
+    "testing"
+
+    "github.com/gocraft/dbr"
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestFindOrders_RejectsInvalidQueries(t *testing.T) {
+    _, err := FindOrders(nil, OrderQuery{Sort: "waiter"})
+    assert.Equal(t, ErrInvalidSort, err)
+    _, err = FindOrders(nil, OrderQuery{Limit: MaxOrderLimit + 1})
+    assert.Equal(t, ErrInvalidLimit, err)
+    _, err = FindOrders(nil, OrderQuery{Statuses: []string{"open"}})
+    assert.Equal(t, ErrUnknownStatus, err)
+    _, err = FindOrders(nil, OrderQuery{Cursor: "garbage"})
+    assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestAfterCursor(t *testing.T) {
+    encoded := encodeCursor(orderCursor{Sort: "-timeCreated", Value: "2018-06-01T10:00:00Z", ID: 12})
+
+    after, err := afterCursor(encoded, "-timeCreated", sortColumns["timeCreated"], false)
+    assert.NoError(t, err)
+    assert.Equal(t, "(COALESCE(time_created, '') < ? OR (COALESCE(time_created, '') = ? AND id < ?))", after.query)
+    assert.Equal(t, []interface{}{"2018-06-01T10:00:00Z", "2018-06-01T10:00:00Z", int64(12)}, after.values)
+
+    _, err = afterCursor(encoded, "timeCreated", sortColumns["timeCreated"], true)
+    assert.Equal(t, ErrInvalidCursor, err, "cursor of another sort")
+}
+
+func TestAfterCursor_SortedByID(t *testing.T) {
+    after, err := afterCursor(encodeCursor(orderCursor{Sort: "id", Value: "12", ID: 12}), "id", "id", true)
+    assert.NoError(t, err)
+    assert.Equal(t, "id > ?", after.query)
+    assert.Equal(t, []interface{}{int64(12)}, after.values)
+}
+
+func TestOrderConditions(t *testing.T) {
+    conditions, err := orderConditions(OrderQuery{
+        Statuses:     []string{StatusPlaced},
+        Waiter:       "waiter@garsson.nl",
+        CustomerName: " 50%_off ",
+        CreatedFrom:  "2018-06-01T12:00:00+02:00",
+    })
+    assert.NoError(t, err)
+    assert.Equal(t, []condition{
+        {"status IN ?", []interface{}{[]string{StatusPlaced}}},
+        {"waiter_id = ?", []interface{}{"waiter@garsson.nl"}},
+        {"customer_name ILIKE ?", []interface{}{`%50\%\_off%`}},
+        {"time_created >= ?", []interface{}{"2018-06-01T10:00:00Z"}},
+    }, conditions)
+}
+
+func TestNormalizeTimeRange_RejectsInvalidRanges(t *testing.T) {
+    _, _, err := normalizeTimeRange("yesterday", "")
+    assert.Equal(t, ErrInvalidTimeRange, err)
+    _, _, err = normalizeTimeRange("2018-06-02T00:00:00Z", "2018-06-01T00:00:00Z")
+    assert.Equal(t, ErrInvalidTimeRange, err)
+}
+
+func TestSortValue(t *testing.T) {
+    entity := &customerOrderEntity{ID: 3, TimeCreated: "2018-06-01T10:00:00Z", CustomerName: dbr.NewNullString("Jan")}
+    assert.Equal(t, "3", sortValue(entity, "id"))
+    assert.Equal(t, "2018-06-01T10:00:00Z", sortValue(entity, "timeCreated"))
+    assert.Equal(t, "Jan", sortValue(entity, "customerName"))
+}
+
+func TestFindOrders_LoadsLinesOfPageInOneQuery(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    // one more order than the limit tells that there is a next page, its lines are not loaded
+    mock.ExpectQuery(`SELECT \* FROM customer_order ORDER BY .* LIMIT 3`).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "status", "time_created", "version"}).
+            AddRow(3, StatusPlaced, "2018-06-01T20:30:00Z", 1).
+            AddRow(2, StatusPlaced, "2018-06-01T20:20:00Z", 1).
+            AddRow(1, StatusPlaced, "2018-06-01T20:10:00Z", 1))
+    mock.ExpectQuery(`SELECT \* FROM customer_order_line WHERE \(order_id IN \(3,2\)\) ORDER BY id`).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "product_name", "product_price_in_cents", "quantity"}).
+            AddRow(7, 2, "Pils", 250, 2).
+            AddRow(8, 3, "Bitterballen", 600, 1).
+            AddRow(9, 3, "Pils", 250, 1))
+    mock.ExpectQuery(`SELECT \* FROM customer_order_line_modifier WHERE \(order_line_id IN \(7,8,9\)\)`).WillReturnRows(dbtest.EmptyRows())
+    mock.ExpectQuery(`SELECT \* FROM payment WHERE \(order_id IN \(3,2\)\)`).WillReturnRows(dbtest.EmptyRows())
+    mock.ExpectQuery(`SELECT \* FROM ticket WHERE \(order_id IN \(3,2\)\)`).WillReturnRows(dbtest.EmptyRows())
+
+    page, err := FindOrders(dao.NewSession(), OrderQuery{Limit: 2})
+    assert.NoError(t, mock.ExpectationsWereMet())
+    if !assert.NoError(t, err) {
+        return
+    }
+    assert.True(t, page.Pagination.HasMore)
+    assert.Len(t, page.Orders, 2)
+    assert.Len(t, page.Orders[0].OrderLines, 2)
+    assert.Len(t, page.Orders[1].OrderLines, 1)
+}
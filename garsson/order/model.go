@@ -13,9 +13,12 @@ type customerOrderEntity struct {
     CustomerName      dbr.NullString
     AmountPaidInCents dbr.NullInt64
     Remark            dbr.NullString
+    Version           int64
+    DiningTableID     dbr.NullInt64
 }
 
 type customerOrderLineEntity struct {
+    ID                  int64
     OrderID             int64
     ProductID           int64
     ProductName         string
@@ -23,35 +26,251 @@ type customerOrderLineEntity struct {
     ProductPriceInCents int64
     Quantity            int64
     Remark              dbr.NullString
+    TicketID            dbr.NullInt64
+    // Modifiers are the chosen modifiers, they are stored in a table of their own
+    Modifiers           []*orderLineModifierEntity `db:"-"`
+    // StationID is where the product is prepared, it decides the ticket of a new line
+    StationID           int64 `db:"-"`
+}
+
+type stationEntity struct {
+    ID          int64
+    Name        string
+    TimeCreated string
+}
+
+type ticketEntity struct {
+    ID          int64
+    OrderID     int64
+    StationID   int64
+    Status      string
+    HandlerID   dbr.NullString
+    TimeCreated string
+    TimeStarted dbr.NullString
+    TimeReady   dbr.NullString
+}
+
+type orderLineModifierEntity struct {
+    ID                int64
+    OrderLineID       int64
+    ModifierID        int64
+    GroupName         string
+    ModifierName      string
+    PriceDeltaInCents int64
+}
+
+type modifierGroupEntity struct {
+    ID            int64
+    ProductID     int64
+    Name          string
+    MinSelections int64
+    MaxSelections int64
+    Required      bool
+    Position      int64
+}
+
+type modifierEntity struct {
+    ID                int64
+    ModifierGroupID   int64
+    Name              string
+    PriceDeltaInCents int64
+    Position          int64
+}
+
+type orderEventEntity struct {
+    ID             int64
+    Type           string
+    OrderID        int64
+    PreviousStatus dbr.NullString
+    // Payload is the order after the change as JSON
+    Payload     string
+    TimeCreated string
+}
+
+type diningTableEntity struct {
+    ID          int64
+    Number      int64
+    Area        dbr.NullString
+    Capacity    int64
+    Status      string
+    TimeCreated string
+}
+
+type paymentEntity struct {
+    ID              int64
+    OrderID         int64
+    Method          string
+    AmountInCents   int64
+    TipInCents      int64
+    TenderedInCents dbr.NullInt64
+    ChangeInCents   dbr.NullInt64
+    ProcessedBy     string
+    TimeCreated     string
 }
 
 // ProductEntity is the same as the data
 type ProductEntity struct {
     ID           int64  `json:"id"`
     Name         string `json:"name"`
+    Brand        string `json:"brand,omitempty"`
     PriceInCents int64  `json:"priceInCents"`
     TimeAdded    string `json:"timeAdded,omitempty"`
+    // StationID is the station where the product is prepared, NULL if it needs no preparation
+    StationID    dbr.NullInt64 `json:"stationId"`
+    // ModifierGroups are the options that can be chosen when ordering the product, loaded separately
+    ModifierGroups []*ModifierGroup `json:"modifierGroups,omitempty" db:"-"`
+}
+
+// ModifierGroup is a set of options of a product, such as the size or the milk
+type ModifierGroup struct {
+    ID   int64  `json:"id"`
+    Name string `json:"name"`
+    // MinSelections and MaxSelections limit how many modifiers of the group are chosen for one order line
+    MinSelections int64 `json:"minSelections"`
+    MaxSelections int64 `json:"maxSelections"`
+    // Required groups need at least one chosen modifier, even if MinSelections is 0
+    Required  bool        `json:"required"`
+    Modifiers []*Modifier `json:"modifiers"`
+}
+
+// Modifier is an option of a product that changes its price by the delta
+type Modifier struct {
+    ID                int64  `json:"id"`
+    Name              string `json:"name"`
+    PriceDeltaInCents int64  `json:"priceDeltaInCents"`
+}
+
+// OrderLineModifier is a copy of a modifier chosen for an order line
+type OrderLineModifier struct {
+    ModifierID        int64  `json:"modifierId"`
+    Group             string `json:"group"`
+    Name              string `json:"name"`
+    PriceDeltaInCents int64  `json:"priceDeltaInCents"`
 }
 
 // CustomerOrder is the public interface, requires multiple queries to run
 type CustomerOrder struct {
-    ID                int64                `json:"id"`
-    Status            string               `json:"status"`
-    TimeCreated       string               `json:"timeCreated"`
-    TimePrepared      string               `json:"timePrepared,omitempty"`
-    Waiter            string               `json:"waiter"`
-    BarHandler        string               `json:"barHandler,omitempty"`
-    CustomerName      string               `json:"customerName,omitempty"`
-    TimePaid          string               `json:"timePaid,omitempty"`
-    AmountPaidInCents int64                `json:"amountPaidInCents,omitempty"`
-    Remark            string               `json:"remark,omitempty"`
-    OrderLines        []*CustomerOrderLine `json:"orderLines"`
+    ID                 int64                `json:"id"`
+    Status             string               `json:"status"`
+    TimeCreated        string               `json:"timeCreated"`
+    TimePrepared       string               `json:"timePrepared,omitempty"`
+    Waiter             string               `json:"waiter"`
+    BarHandler         string               `json:"barHandler,omitempty"`
+    CustomerName       string               `json:"customerName,omitempty"`
+    // TableID is the dining table at which the order is served, 0 if it is not served at a table
+    TableID            int64                `json:"tableId,omitempty"`
+    TimePaid           string               `json:"timePaid,omitempty"`
+    AmountPaidInCents  int64                `json:"amountPaidInCents,omitempty"`
+    Remark             string               `json:"remark,omitempty"`
+    // Version increases with every change of the order, it is also sent as ETag
+    Version            int64                `json:"version"`
+    OrderLines         []*CustomerOrderLine `json:"orderLines"`
+    // TotalInCents is the price of all order lines
+    TotalInCents       int64                `json:"totalInCents"`
+    // OutstandingInCents is the part of the total that has not been paid, negative if too much has been paid
+    OutstandingInCents int64                `json:"outstandingInCents"`
+    TipsInCents        int64                `json:"tipsInCents,omitempty"`
+    Payments           []*Payment           `json:"payments"`
+    // Tickets are the parts of the order that are prepared at a station
+    Tickets            []*Ticket            `json:"tickets"`
 }
 
 type CustomerOrderLine struct {
-    ProductName         string `json:"productName"`
-    ProductBrand        string `json:"productBrand,omitempty"`
-    ProductPriceInCents int64 `json:"productPriceInCents"`
-    Quantity            int64  `json:"quantity"`
-    Remark              string `json:"remark,omitempty"`
+    ID                  int64                `json:"id"`
+    ProductID           int64                `json:"productId"`
+    ProductName         string               `json:"productName"`
+    ProductBrand        string               `json:"productBrand,omitempty"`
+    ProductPriceInCents int64                `json:"productPriceInCents"`
+    Quantity            int64                `json:"quantity"`
+    Remark              string               `json:"remark,omitempty"`
+    // Modifiers are the chosen modifiers, their deltas are included in ProductPriceInCents
+    Modifiers           []*OrderLineModifier `json:"modifiers,omitempty"`
+    // TicketID is the ticket on which the line is prepared, 0 if it needs no preparation
+    TicketID            int64                `json:"ticketId,omitempty"`
+}
+
+// Station is a place where products are prepared, such as the bar or the kitchen
+type Station struct {
+    ID          int64  `json:"id"`
+    Name        string `json:"name"`
+    TimeCreated string `json:"timeCreated"`
+}
+
+// Ticket contains the lines of an order that are prepared at one station
+type Ticket struct {
+    ID          int64  `json:"id"`
+    OrderID     int64  `json:"orderId"`
+    StationID   int64  `json:"stationId"`
+    Status      string `json:"status"`
+    Handler     string `json:"handler,omitempty"`
+    TimeCreated string `json:"timeCreated"`
+    TimeStarted string `json:"timeStarted,omitempty"`
+    TimeReady   string `json:"timeReady,omitempty"`
+}
+
+// QueuedTicket is a ticket in the queue of a station with the order details needed to prepare and deliver it
+type QueuedTicket struct {
+    Ticket
+    TableID      int64                `json:"tableId,omitempty"`
+    CustomerName string               `json:"customerName,omitempty"`
+    Waiter       string               `json:"waiter"`
+    Remark       string               `json:"remark,omitempty"`
+    Lines        []*CustomerOrderLine `json:"lines"`
+}
+
+// Payment is a payment of (a part of) an order, the tip is paid on top of the amount
+type Payment struct {
+    ID            int64  `json:"id"`
+    Method        string `json:"method"`
+    AmountInCents int64  `json:"amountInCents"`
+    TipInCents    int64  `json:"tipInCents"`
+    // TenderedInCents is the cash handed over, ChangeInCents the cash returned
+    TenderedInCents int64  `json:"tenderedInCents,omitempty"`
+    ChangeInCents   int64  `json:"changeInCents,omitempty"`
+    ProcessedBy     string `json:"processedBy"`
+    TimeCreated     string `json:"timeCreated"`
+}
+
+// NewPayment contains the fields required to record a payment, the user that records it processes it
+type NewPayment struct {
+    Method        string `json:"method"`
+    AmountInCents int64  `json:"amountInCents"`
+    TipInCents    int64  `json:"tipInCents"`
+    // TenderedInCents is the cash handed over, the change is calculated from it. Amount and tip when empty.
+    TenderedInCents int64 `json:"tenderedInCents"`
+}
+
+// DiningTable is a table at which customers are seated
+type DiningTable struct {
+    ID          int64  `json:"id"`
+    Number      int64  `json:"number"`
+    Area        string `json:"area,omitempty"`
+    Capacity    int64  `json:"capacity"`
+    Status      string `json:"status"`
+    TimeCreated string `json:"timeCreated"`
+}
+
+// NewDiningTable contains the fields required to add a table or change its details
+type NewDiningTable struct {
+    Number   int64  `json:"number"`
+    Area     string `json:"area"`
+    Capacity int64  `json:"capacity"`
+}
+
+// NewOrder contains the fields required to place an order, the waiter is the user that places it
+type NewOrder struct {
+    CustomerName string         `json:"customerName"`
+    // TableID is the dining table at which the order is served, optional
+    TableID      int64          `json:"tableId"`
+    Remark       string         `json:"remark"`
+    OrderLines   []NewOrderLine `json:"orderLines"`
+}
+
+// NewOrderLine orders a quantity of a product, name, brand and price are copied from the product
+type NewOrderLine struct {
+    ProductID int64  `json:"productId"`
+    Quantity  int64  `json:"quantity"`
+    Remark    string `json:"remark"`
+    // Modifiers are the ids of the chosen modifiers of the product
+    Modifiers []int64 `json:"modifiers"`
 }
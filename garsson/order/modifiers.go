@@ -0,0 +1,188 @@
+package order
+
+import (
+    "errors"
+    "fmt"
+
+    "github.com/gocraft/dbr"
+)
+
+// Products can have modifier groups, such as the size of a beer or the milk in a coffee. Each group limits how many
+// of its modifiers are chosen for an order line and every modifier changes the price by its delta. The chosen
+// modifiers are copied into the order line like the product itself, and the price of the line is the price of the
+// product plus the deltas, so later changes to the modifiers do not alter the order.
+
+var (
+    // ErrUnknownModifier indicates that a chosen modifier does not belong to the ordered product
+    ErrUnknownModifier = errors.New("unknown modifier for this product")
+    // ErrDuplicateModifier indicates that a modifier was chosen twice for the same order line
+    ErrDuplicateModifier = errors.New("a modifier can be chosen only once per order line")
+    // ErrNegativeLinePrice indicates that the deltas of the chosen modifiers make the price of the line negative
+    ErrNegativeLinePrice = errors.New("the chosen modifiers make the price negative")
+)
+
+// ModifierSelectionError indicates that the amount of chosen modifiers of a group is out of range
+type ModifierSelectionError struct {
+    Group string
+    Min   int64
+    Max   int64
+}
+
+func (e *ModifierSelectionError) Error() string {
+    if e.Min == e.Max {
+        return fmt.Sprintf("choose %v of %v", e.Min, e.Group)
+    }
+    return fmt.Sprintf("choose %v to %v of %v", e.Min, e.Max, e.Group)
+}
+
+// FindProducts returns all products with their modifier groups
+func FindProducts(sess dbr.SessionRunner) ([]ProductEntity, error) {
+    products, err := QueryProducts(sess)
+    if err != nil {
+        return nil, err
+    }
+    return products, loadModifierGroups(sess, products)
+}
+
+// findProductsWithModifiers returns the products with the ids and their modifier groups
+func findProductsWithModifiers(sess dbr.SessionRunner, ids []int64) ([]ProductEntity, error) {
+    products, err := queryProductsByIDs(sess, ids)
+    if err != nil {
+        return nil, err
+    }
+    return products, loadModifierGroups(sess, products)
+}
+
+// loadModifierGroups sets the modifier groups of the products
+func loadModifierGroups(sess dbr.SessionRunner, products []ProductEntity) error {
+    productIDs := make([]int64, 0, len(products))
+    for _, product := range products {
+        productIDs = append(productIDs, product.ID)
+    }
+    groups, err := queryModifierGroupsByProductIDs(sess, productIDs)
+    if err != nil {
+        return err
+    }
+    groupIDs := make([]int64, 0, len(groups))
+    for _, group := range groups {
+        groupIDs = append(groupIDs, group.ID)
+    }
+    modifiers, err := queryModifiersByGroupIDs(sess, groupIDs)
+    if err != nil {
+        return err
+    }
+
+    modifiersByGroup := map[int64][]*Modifier{}
+    for _, modifier := range modifiers {
+        modifiersByGroup[modifier.ModifierGroupID] = append(modifiersByGroup[modifier.ModifierGroupID], &Modifier{
+            ID:                modifier.ID,
+            Name:              modifier.Name,
+            PriceDeltaInCents: modifier.PriceDeltaInCents,
+        })
+    }
+    groupsByProduct := map[int64][]*ModifierGroup{}
+    for _, group := range groups {
+        groupsByProduct[group.ProductID] = append(groupsByProduct[group.ProductID], &ModifierGroup{
+            ID:            group.ID,
+            Name:          group.Name,
+            MinSelections: group.MinSelections,
+            MaxSelections: group.MaxSelections,
+            Required:      group.Required,
+            Modifiers:     append([]*Modifier{}, modifiersByGroup[group.ID]...),
+        })
+    }
+    for i := range products {
+        products[i].ModifierGroups = groupsByProduct[products[i].ID]
+    }
+    return nil
+}
+
+// chooseModifiers validates the modifiers chosen for the product against its groups and returns their copies, the
+// deltas may lower the price of the line to 0 but not below
+func chooseModifiers(product ProductEntity, modifierIDs []int64) ([]*orderLineModifierEntity, error) {
+    chosen := map[int64]bool{}
+    for _, id := range modifierIDs {
+        if chosen[id] {
+            return nil, ErrDuplicateModifier
+        }
+        chosen[id] = true
+    }
+
+    var copies []*orderLineModifierEntity
+    for _, group := range product.ModifierGroups {
+        var selections int64
+        for _, modifier := range group.Modifiers {
+            if !chosen[modifier.ID] {
+                continue
+            }
+            delete(chosen, modifier.ID)
+            selections++
+            copies = append(copies, &orderLineModifierEntity{
+                ModifierID:        modifier.ID,
+                GroupName:         group.Name,
+                ModifierName:      modifier.Name,
+                PriceDeltaInCents: modifier.PriceDeltaInCents,
+            })
+        }
+        minSelections := group.MinSelections
+        if group.Required && minSelections < 1 {
+            minSelections = 1
+        }
+        if selections < minSelections || selections > group.MaxSelections {
+            return nil, &ModifierSelectionError{Group: group.Name, Min: minSelections, Max: group.MaxSelections}
+        }
+    }
+    // the modifiers that are left do not belong to any group of the product
+    if len(chosen) > 0 {
+        return nil, ErrUnknownModifier
+    } else if priceWithModifiers(product.PriceInCents, copies) < 0 {
+        return nil, ErrNegativeLinePrice
+    }
+    return copies, nil
+}
+
+// priceWithModifiers returns the base price plus the deltas of the modifiers
+func priceWithModifiers(basePriceInCents int64, modifiers []*orderLineModifierEntity) int64 {
+    price := basePriceInCents
+    for _, modifier := range modifiers {
+        price += modifier.PriceDeltaInCents
+    }
+    return price
+}
+
+// loadOrderLines returns the lines of the orders with their modifiers
+func loadOrderLines(sess dbr.SessionRunner, orderIDs []int64) ([]*customerOrderLineEntity, error) {
+    lines, err := queryOrderLinesByOrderIDs(sess, orderIDs)
+    if err != nil {
+        return nil, err
+    }
+    lineIDs := make([]int64, 0, len(lines))
+    for _, line := range lines {
+        lineIDs = append(lineIDs, line.ID)
+    }
+    modifiers, err := queryOrderLineModifiersByLineIDs(sess, lineIDs)
+    if err != nil {
+        return nil, err
+    }
+    modifiersByLine := map[int64][]*orderLineModifierEntity{}
+    for _, modifier := range modifiers {
+        modifiersByLine[modifier.OrderLineID] = append(modifiersByLine[modifier.OrderLineID], modifier)
+    }
+    for _, line := range lines {
+        line.Modifiers = modifiersByLine[line.ID]
+    }
+    return lines, nil
+}
+
+func mapOrderLineModifiersToPublicAPI(modifiers []*orderLineModifierEntity) []*OrderLineModifier {
+    var publicModifiers []*OrderLineModifier
+    for _, modifier := range modifiers {
+        publicModifiers = append(publicModifiers, &OrderLineModifier{
+            ModifierID:        modifier.ModifierID,
+            Group:             modifier.GroupName,
+            Name:              modifier.ModifierName,
+            PriceDeltaInCents: modifier.PriceDeltaInCents,
+        })
+    }
+    return publicModifiers
+}
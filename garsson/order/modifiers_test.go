@@ -0,0 +1,81 @@
+package order
+
+import (
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func coffee() ProductEntity {
+    return ProductEntity{ID: 1, Name: "Cappuccino", PriceInCents: 300, ModifierGroups: []*ModifierGroup{
+        {ID: 1, Name: "size", MinSelections: 1, MaxSelections: 1, Required: true, Modifiers: []*Modifier{
+            {ID: 10, Name: "regular"},
+            {ID: 11, Name: "large", PriceDeltaInCents: 50},
+        }},
+        {ID: 2, Name: "milk", MaxSelections: 1, Modifiers: []*Modifier{
+            {ID: 20, Name: "oat milk", PriceDeltaInCents: 40},
+            {ID: 21, Name: "soy milk", PriceDeltaInCents: 40},
+        }},
+        {ID: 3, Name: "extras", MaxSelections: 2, Modifiers: []*Modifier{
+            {ID: 30, Name: "no sugar"},
+            {ID: 31, Name: "extra shot", PriceDeltaInCents: 60},
+            {ID: 32, Name: "syrup", PriceDeltaInCents: 30},
+        }},
+    }}
+}
+
+func TestChooseModifiers(t *testing.T) {
+    modifiers, err := chooseModifiers(coffee(), []int64{20, 11, 31})
+    assert.NoError(t, err)
+    assert.Len(t, modifiers, 3)
+    assert.Equal(t, "size", modifiers[0].GroupName)
+    assert.Equal(t, "large", modifiers[0].ModifierName)
+    assert.Equal(t, int64(450), priceWithModifiers(300, modifiers))
+}
+
+func TestChooseModifiers_EnforcesSelections(t *testing.T) {
+    _, err := chooseModifiers(coffee(), []int64{20})
+    assert.Equal(t, &ModifierSelectionError{Group: "size", Min: 1, Max: 1}, err, "size is required")
+    _, err = chooseModifiers(coffee(), []int64{10, 11})
+    assert.Equal(t, &ModifierSelectionError{Group: "size", Min: 1, Max: 1}, err)
+    _, err = chooseModifiers(coffee(), []int64{10, 30, 31, 32})
+    assert.Equal(t, &ModifierSelectionError{Group: "extras", Min: 0, Max: 2}, err)
+    _, err = chooseModifiers(coffee(), []int64{10, 99})
+    assert.Equal(t, ErrUnknownModifier, err)
+    _, err = chooseModifiers(coffee(), []int64{10, 10})
+    assert.Equal(t, ErrDuplicateModifier, err)
+    assert.True(t, IsValidationError(&ModifierSelectionError{Group: "size", Min: 1, Max: 1}))
+}
+
+func TestChooseModifiers_ProductWithoutModifiers(t *testing.T) {
+    modifiers, err := chooseModifiers(ProductEntity{ID: 2, Name: "Pils"}, nil)
+    assert.NoError(t, err)
+    assert.Empty(t, modifiers)
+    _, err = chooseModifiers(ProductEntity{ID: 2, Name: "Pils"}, []int64{10})
+    assert.Equal(t, ErrUnknownModifier, err)
+}
+
+func TestSnapshotOrderLines_CopiesModifiers(t *testing.T) {
+    lines, err := snapshotOrderLines([]NewOrderLine{{ProductID: 1, Quantity: 2, Modifiers: []int64{11, 20}}}, []ProductEntity{coffee()})
+    assert.NoError(t, err)
+    assert.Equal(t, int64(390), lines[0].ProductPriceInCents)
+    assert.Len(t, lines[0].Modifiers, 2)
+
+    public := mapOrderLinesToPublicAPI(lines)
+    assert.Equal(t, &OrderLineModifier{ModifierID: 20, Group: "milk", Name: "oat milk", PriceDeltaInCents: 40}, public[0].Modifiers[1])
+}
+
+func TestChooseModifiers_RejectsNegativePrice(t *testing.T) {
+    water := ProductEntity{ID: 3, Name: "Water", PriceInCents: 100, ModifierGroups: []*ModifierGroup{
+        {ID: 4, Name: "discounts", MaxSelections: 2, Modifiers: []*Modifier{
+            {ID: 40, Name: "tap water", PriceDeltaInCents: -100},
+            {ID: 41, Name: "happy hour", PriceDeltaInCents: -50},
+        }},
+    }}
+    modifiers, err := chooseModifiers(water, []int64{40})
+    assert.NoError(t, err)
+    assert.Equal(t, int64(0), priceWithModifiers(water.PriceInCents, modifiers), "free is allowed")
+
+    _, err = chooseModifiers(water, []int64{40, 41})
+    assert.Equal(t, ErrNegativeLinePrice, err)
+}
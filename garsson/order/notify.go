@@ -0,0 +1,206 @@
+package order
+
+import (
+    "encoding/json"
+    "errors"
+    "strconv"
+    "time"
+
+    "github.com/gocraft/dbr"
+    "github.com/lib/pq"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/log"
+)
+
+// Events are stored in the order_event table in the transaction of the change and announced with NOTIFY, which
+// Postgres delivers only if the change commits. Every instance LISTENs and forwards the stored events after the last
+// one it forwarded to its own EventBus, so a client sees the changes made through any instance and events announced
+// while the listener reconnected are forwarded after the reconnect. Storing events is serialized until commit, so
+// event ids increase in commit order and a client can resume after the last id it received. The price is that changes
+// of orders commit one at a time across all instances, see lockOrderEvents.
+
+var (
+    // ErrEventsUnavailable indicates that the events after the last received event cannot be replayed, because they
+    // have been pruned, there are too many of them or the id is unknown
+    ErrEventsUnavailable = errors.New("missed events are no longer available, reload the orders")
+)
+
+const (
+    // EventChannel is the Postgres channel on which the ids of new order events are sent
+    EventChannel = "order_events"
+    // EventRetention is how long events are kept for replay
+    EventRetention = 24 * time.Hour
+
+    // eventReplayLimit is the maximum amount of events that are replayed at once
+    eventReplayLimit = 1000
+    // eventPruneInterval is how often events older than EventRetention are deleted
+    eventPruneInterval = time.Hour
+    // orderEventLockKey identifies the advisory lock that serializes storing events
+    orderEventLockKey = 4201
+    listenerMinReconnectInterval = time.Second
+    listenerMaxReconnectInterval = time.Minute
+    // listenerPingInterval is how often an idle listener checks its connection
+    listenerPingInterval = 90 * time.Second
+)
+
+// EventListener forwards the order events of all instances to the local EventBus
+type EventListener struct {
+    listener    *pq.Listener
+    dao         *db.Dao
+    bus         *EventBus
+    lastEventID int64
+}
+
+// ListenForEvents connects to the database and forwards the order events to bus until the listener is closed
+func ListenForEvents(connectionString string, dao *db.Dao, bus *EventBus) (*EventListener, error) {
+    listener := pq.NewListener(connectionString, listenerMinReconnectInterval, listenerMaxReconnectInterval, logListenerEvent)
+    if err := listener.Listen(EventChannel); err != nil {
+        listener.Close()
+        return nil, err
+    }
+    // events stored after this query are announced to the listener
+    _, lastEventID, err := queryOrderEventIDRange(dao.NewSession())
+    if err != nil {
+        listener.Close()
+        return nil, err
+    }
+    eventListener := &EventListener{listener: listener, dao: dao, bus: bus, lastEventID: lastEventID}
+    go eventListener.forward()
+    return eventListener, nil
+}
+
+// Close stops listening, the subscribers of the bus are not dropped
+func (l *EventListener) Close() error {
+    return l.listener.Close()
+}
+
+func (l *EventListener) forward() {
+    prune := time.NewTicker(eventPruneInterval)
+    defer prune.Stop()
+    for {
+        select {
+        case notification, open := <-l.listener.Notify:
+            if !open {
+                return
+            } else if notification == nil {
+                log.WithField("lastEventId", l.lastEventID).Info("reconnected to order events, forwarding missed events")
+            }
+            l.forwardNewEvents()
+        case <-time.After(listenerPingInterval):
+            go func() {
+                if err := l.listener.Ping(); err != nil {
+                    log.WithError(err).Warn("order event listener lost its connection")
+                }
+            }()
+        case <-prune.C:
+            if pruned, err := PruneEvents(l.dao.NewSession(), time.Now().Add(-EventRetention)); err != nil {
+                log.WithError(err).Warn("could not prune order events")
+            } else if pruned > 0 {
+                log.WithField("pruned", pruned).Debug("pruned order events")
+            }
+        }
+    }
+}
+
+// forwardNewEvents publishes the events after the last forwarded event, if that fails the subscribers are dropped
+// because they would miss events
+func (l *EventListener) forwardNewEvents() {
+    for {
+        entities, err := queryOrderEventsAfter(l.dao.NewSession(), l.lastEventID, eventReplayLimit)
+        if err != nil {
+            log.WithError(err).Error("could not load order events, dropping subscribers")
+            l.bus.DropAll()
+            return
+        }
+        for _, entity := range entities {
+            if event, err := entity.toEvent(); err != nil {
+                log.WithError(err).WithField("event", entity.ID).Error("invalid order event")
+            } else {
+                l.bus.Publish(event)
+            }
+            l.lastEventID = entity.ID
+        }
+        if len(entities) < eventReplayLimit {
+            return
+        }
+    }
+}
+
+// ReplayEvents returns the events after lastEventID that match the filter, oldest first
+func ReplayEvents(sess dbr.SessionRunner, lastEventID int64, filter EventFilter) ([]Event, error) {
+    lowest, highest, err := queryOrderEventIDRange(sess)
+    if err != nil {
+        return nil, err
+    } else if lastEventID > highest || lastEventID < lowest-1 {
+        return nil, ErrEventsUnavailable
+    }
+    entities, err := queryOrderEventsAfter(sess, lastEventID, eventReplayLimit+1)
+    if err != nil {
+        return nil, err
+    } else if len(entities) > eventReplayLimit {
+        return nil, ErrEventsUnavailable
+    }
+    events := make([]Event, 0, len(entities))
+    for _, entity := range entities {
+        if event, err := entity.toEvent(); err != nil {
+            return nil, err
+        } else if filter.Matches(event) {
+            events = append(events, event)
+        }
+    }
+    return events, nil
+}
+
+// PruneEvents deletes the events created before the time, returns the amount of deleted events
+func PruneEvents(sess dbr.SessionRunner, before time.Time) (int64, error) {
+    return deleteOrderEventsBefore(sess, db.FormatTime(before))
+}
+
+// publishEvent stores the event of the change and announces it when the transaction commits
+func publishEvent(tx dbr.SessionRunner, eventType string, changed *CustomerOrder, previousStatus string) error {
+    payload, err := json.Marshal(changed)
+    if err != nil {
+        return err
+    }
+    if err := lockOrderEvents(tx); err != nil {
+        return err
+    }
+    id, err := insertOrderEventEntity(tx, &orderEventEntity{
+        Type:           eventType,
+        OrderID:        changed.ID,
+        PreviousStatus: nullIfEmpty(previousStatus),
+        Payload:        string(payload),
+        TimeCreated:    db.Now(),
+    })
+    if err != nil {
+        return err
+    }
+    // pg_notify accepts the channel and payload as parameters, unlike the NOTIFY statement
+    _, err = tx.UpdateBySql("SELECT pg_notify(?, ?)", EventChannel, strconv.FormatInt(id, 10)).Exec()
+    return err
+}
+
+func (e orderEventEntity) toEvent() (Event, error) {
+    changed := new(CustomerOrder)
+    if err := json.Unmarshal([]byte(e.Payload), changed); err != nil {
+        return Event{}, err
+    }
+    return Event{
+        ID:             e.ID,
+        Type:           e.Type,
+        Time:           e.TimeCreated,
+        Order:          changed,
+        PreviousStatus: e.PreviousStatus.String,
+    }, nil
+}
+
+func logListenerEvent(event pq.ListenerEventType, err error) {
+    switch event {
+    case pq.ListenerEventDisconnected:
+        log.WithError(err).Warn("order event listener disconnected")
+    case pq.ListenerEventConnectionAttemptFailed:
+        log.WithError(err).Warn("order event listener could not reconnect")
+    case pq.ListenerEventReconnected:
+        log.Info("order event listener reconnected")
+    }
+}
@@ -0,0 +1,275 @@
+package order
+
+import (
+    "errors"
+
+    "github.com/gocraft/dbr"
+    "github.com/toefel18/garsson-api/garsson/db"
+)
+
+// An order is paid with one or more payments, so that a table can pay part by card and part in cash. A payment never
+// exceeds the outstanding balance, the tip is paid on top of it. A served order becomes paid as soon as its payments
+// cover the total. The split helpers only calculate amounts, each share is recorded as a payment of its own.
+
+var (
+    // ErrUnknownPaymentMethod indicates that the payment method is not cash or card
+    ErrUnknownPaymentMethod = errors.New("unknown payment method, use cash or card")
+    // ErrInvalidPaymentAmount indicates that the amount of a payment is zero or negative
+    ErrInvalidPaymentAmount = errors.New("payment amount must be at least 1 cent")
+    // ErrInvalidTip indicates that the tip is negative
+    ErrInvalidTip = errors.New("tip cannot be negative")
+    // ErrOverpayment indicates that the payment exceeds the outstanding balance of the order
+    ErrOverpayment = errors.New("payment exceeds the outstanding balance, pay the rest as tip")
+    // ErrInsufficientTender indicates that the cash handed over does not cover the amount and tip
+    ErrInsufficientTender = errors.New("tendered cash must cover the amount and tip")
+    // ErrTenderedNotCash indicates that a tendered amount was given for a payment that is not cash
+    ErrTenderedNotCash = errors.New("only cash payments can have a tendered amount")
+    // ErrInvalidSplit indicates that the bill cannot be split as requested
+    ErrInvalidSplit = errors.New("split into 1 to 100 parts, selecting at most the ordered quantity of each line")
+    // ErrOrderNotPaid indicates that an order was marked paid while its payments do not cover the total
+    ErrOrderNotPaid = errors.New("the payments of the order do not cover its total")
+)
+
+const (
+    // PaymentMethodCash is a payment in cash, the change is calculated from the tendered amount
+    PaymentMethodCash = "cash"
+    // PaymentMethodCard is a payment by debit or credit card
+    PaymentMethodCard = "card"
+    // PaymentMethodUnknown is the method of payments that were recorded before methods were registered
+    PaymentMethodUnknown = "unknown"
+
+    // maxSplitParts is the largest amount of parts a bill can be split into
+    maxSplitParts = 100
+)
+
+// Split contains the shares of the outstanding balance of an order
+type Split struct {
+    OutstandingInCents int64   `json:"outstandingInCents"`
+    SharesInCents      []int64 `json:"sharesInCents"`
+}
+
+// LineSelection selects a quantity of an order line, to pay for
+type LineSelection struct {
+    LineID   int64 `json:"lineId"`
+    Quantity int64 `json:"quantity"`
+}
+
+// RecordPayment records a payment of the order processed by the user. The order moves to paid when it has been served
+// and the payment settles the outstanding balance.
+func RecordPayment(sess *dbr.Session, orderID int64, processedBy string, newPayment NewPayment) (*CustomerOrder, error) {
+    change, err := validateNewPayment(newPayment)
+    if err != nil {
+        return nil, err
+    }
+    tx, err := sess.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.RollbackUnlessCommitted()
+
+    // the lock keeps concurrent payments from both settling the same balance
+    current, err := queryOrderEntityForUpdate(tx, orderID)
+    if err == dbr.ErrNotFound {
+        return nil, ErrOrderNotFound
+    } else if err != nil {
+        return nil, err
+    } else if !IsEditable(current.Status) {
+        return nil, ErrOrderClosed
+    }
+    before, err := FindOrderByID(tx, orderID)
+    if err != nil {
+        return nil, err
+    } else if newPayment.AmountInCents > before.OutstandingInCents {
+        return nil, ErrOverpayment
+    }
+
+    now := db.Now()
+    payment := &paymentEntity{
+        OrderID:       orderID,
+        Method:        newPayment.Method,
+        AmountInCents: newPayment.AmountInCents,
+        TipInCents:    newPayment.TipInCents,
+        ProcessedBy:   processedBy,
+        TimeCreated:   now,
+    }
+    if newPayment.Method == PaymentMethodCash {
+        payment.TenderedInCents = dbr.NewNullInt64(newPayment.AmountInCents + newPayment.TipInCents + change)
+        payment.ChangeInCents = dbr.NewNullInt64(change)
+    }
+    if err := insertPaymentEntity(tx, payment); err != nil {
+        return nil, err
+    }
+    changes := map[string]interface{}{"amount_paid_in_cents": before.AmountPaidInCents + newPayment.AmountInCents}
+    settled := current.Status == StatusServed && newPayment.AmountInCents == before.OutstandingInCents
+    if settled {
+        changes["status"] = StatusPaid
+        changes["time_paid"] = now
+    }
+    if err := updateOrderPayment(tx, orderID, changes); err != nil {
+        return nil, err
+    }
+
+    paid, err := FindOrderByID(tx, orderID)
+    if err != nil {
+        return nil, err
+    }
+    if settled {
+        err = publishEvent(tx, EventOrderStatusChanged, paid, current.Status)
+    } else {
+        err = publishEvent(tx, EventOrderUpdated, paid, "")
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    return paid, nil
+}
+
+// SplitOrderEvenly splits the outstanding balance of the order into equal parts
+func SplitOrderEvenly(sess dbr.SessionRunner, orderID int64, parts int) (*Split, error) {
+    customerOrder, err := findOrderToSplit(sess, orderID)
+    if err != nil {
+        return nil, err
+    }
+    shares, err := SplitEvenly(customerOrder.OutstandingInCents, parts)
+    if err != nil {
+        return nil, err
+    }
+    return &Split{OutstandingInCents: customerOrder.OutstandingInCents, SharesInCents: shares}, nil
+}
+
+// SplitOrderByLines returns the share of the outstanding balance for the selected lines
+func SplitOrderByLines(sess dbr.SessionRunner, orderID int64, selections []LineSelection) (*Split, error) {
+    customerOrder, err := findOrderToSplit(sess, orderID)
+    if err != nil {
+        return nil, err
+    }
+    share, err := SplitByLines(customerOrder, selections)
+    if err != nil {
+        return nil, err
+    }
+    return &Split{OutstandingInCents: customerOrder.OutstandingInCents, SharesInCents: []int64{share}}, nil
+}
+
+// SplitEvenly divides the amount into parts that differ at most one cent, the first parts receive the extra cents
+func SplitEvenly(amountInCents int64, parts int) ([]int64, error) {
+    if parts < 1 || parts > maxSplitParts || amountInCents < 0 {
+        return nil, ErrInvalidSplit
+    }
+    shares := make([]int64, parts)
+    share, remainder := amountInCents/int64(parts), amountInCents%int64(parts)
+    for i := range shares {
+        shares[i] = share
+        if int64(i) < remainder {
+            shares[i]++
+        }
+    }
+    return shares, nil
+}
+
+// SplitByLines returns the price of the selected quantities of the order lines, at most the outstanding balance
+func SplitByLines(customerOrder *CustomerOrder, selections []LineSelection) (int64, error) {
+    if len(selections) == 0 {
+        return 0, ErrInvalidSplit
+    }
+    selected := map[int64]int64{}
+    var share int64
+    for _, selection := range selections {
+        line := findPublicOrderLine(customerOrder.OrderLines, selection.LineID)
+        if line == nil {
+            return 0, ErrOrderLineNotFound
+        }
+        selected[line.ID] += selection.Quantity
+        if selection.Quantity <= 0 || selected[line.ID] > line.Quantity {
+            return 0, ErrInvalidSplit
+        }
+        share += line.ProductPriceInCents * selection.Quantity
+    }
+    if share > customerOrder.OutstandingInCents {
+        share = customerOrder.OutstandingInCents
+    }
+    if share < 0 {
+        share = 0
+    }
+    return share, nil
+}
+
+// CalculateChange returns the cash to return when tendered is handed over for the amount and tip, a tendered amount
+// of 0 means the exact amount is paid
+func CalculateChange(tenderedInCents, amountInCents, tipInCents int64) (int64, error) {
+    if tenderedInCents == 0 {
+        return 0, nil
+    } else if tenderedInCents < amountInCents+tipInCents {
+        return 0, ErrInsufficientTender
+    }
+    return tenderedInCents - amountInCents - tipInCents, nil
+}
+
+// validateNewPayment validates the payment and returns the change
+func validateNewPayment(newPayment NewPayment) (int64, error) {
+    if newPayment.Method != PaymentMethodCash && newPayment.Method != PaymentMethodCard {
+        return 0, ErrUnknownPaymentMethod
+    } else if newPayment.AmountInCents <= 0 {
+        return 0, ErrInvalidPaymentAmount
+    } else if newPayment.TipInCents < 0 {
+        return 0, ErrInvalidTip
+    } else if newPayment.Method != PaymentMethodCash && newPayment.TenderedInCents != 0 {
+        return 0, ErrTenderedNotCash
+    }
+    return CalculateChange(newPayment.TenderedInCents, newPayment.AmountInCents, newPayment.TipInCents)
+}
+
+func findOrderToSplit(sess dbr.SessionRunner, orderID int64) (*CustomerOrder, error) {
+    customerOrder, err := FindOrderByID(sess, orderID)
+    if err == dbr.ErrNotFound {
+        return nil, ErrOrderNotFound
+    }
+    return customerOrder, err
+}
+
+func findPublicOrderLine(lines []*CustomerOrderLine, lineID int64) *CustomerOrderLine {
+    for _, line := range lines {
+        if line.ID == lineID {
+            return line
+        }
+    }
+    return nil
+}
+
+// orderTotal returns the price of all lines
+func orderTotal(lines []*customerOrderLineEntity) int64 {
+    var total int64
+    for _, line := range lines {
+        total += line.ProductPriceInCents * line.Quantity
+    }
+    return total
+}
+
+// paidAmounts returns the sum of the amounts and the tips of the payments
+func paidAmounts(payments []*paymentEntity) (int64, int64) {
+    var amount, tips int64
+    for _, payment := range payments {
+        amount += payment.AmountInCents
+        tips += payment.TipInCents
+    }
+    return amount, tips
+}
+
+func mapPaymentsToPublicAPI(payments []*paymentEntity) []*Payment {
+    publicPayments := []*Payment{} // provide empty array if none found
+    for _, payment := range payments {
+        publicPayments = append(publicPayments, &Payment{
+            ID:              payment.ID,
+            Method:          payment.Method,
+            AmountInCents:   payment.AmountInCents,
+            TipInCents:      payment.TipInCents,
+            TenderedInCents: payment.TenderedInCents.Int64,
+            ChangeInCents:   payment.ChangeInCents.Int64,
+            ProcessedBy:     payment.ProcessedBy,
+            TimeCreated:     payment.TimeCreated,
+        })
+    }
+    return publicPayments
+}
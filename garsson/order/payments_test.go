@@ -0,0 +1,95 @@
+package order
+
+import (
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestSplitEvenly(t *testing.T) {
+    shares, err := SplitEvenly(1000, 3)
+    assert.NoError(t, err)
+    assert.Equal(t, []int64{334, 333, 333}, shares)
+
+    shares, err = SplitEvenly(900, 3)
+    assert.NoError(t, err)
+    assert.Equal(t, []int64{300, 300, 300}, shares)
+
+    _, err = SplitEvenly(1000, 0)
+    assert.Equal(t, ErrInvalidSplit, err)
+    _, err = SplitEvenly(1000, maxSplitParts+1)
+    assert.Equal(t, ErrInvalidSplit, err)
+}
+
+func TestSplitByLines(t *testing.T) {
+    order := &CustomerOrder{
+        OutstandingInCents: 900,
+        OrderLines: []*CustomerOrderLine{
+            {ID: 1, ProductPriceInCents: 250, Quantity: 2},
+            {ID: 2, ProductPriceInCents: 400, Quantity: 1},
+        },
+    }
+    share, err := SplitByLines(order, []LineSelection{{LineID: 1, Quantity: 1}, {LineID: 2, Quantity: 1}})
+    assert.NoError(t, err)
+    assert.Equal(t, int64(650), share)
+
+    order.OutstandingInCents = 500
+    share, err = SplitByLines(order, []LineSelection{{LineID: 1, Quantity: 2}, {LineID: 2, Quantity: 1}})
+    assert.NoError(t, err)
+    assert.Equal(t, int64(500), share, "capped at the outstanding balance")
+
+    _, err = SplitByLines(order, []LineSelection{{LineID: 1, Quantity: 2}, {LineID: 1, Quantity: 1}})
+    assert.Equal(t, ErrInvalidSplit, err, "more than ordered")
+    _, err = SplitByLines(order, []LineSelection{{LineID: 3, Quantity: 1}})
+    assert.Equal(t, ErrOrderLineNotFound, err)
+    _, err = SplitByLines(order, nil)
+    assert.Equal(t, ErrInvalidSplit, err)
+}
+
+func TestCalculateChange(t *testing.T) {
+    change, err := CalculateChange(2000, 1650, 150)
+    assert.NoError(t, err)
+    assert.Equal(t, int64(200), change)
+
+    change, err = CalculateChange(0, 1650, 150)
+    assert.NoError(t, err)
+    assert.Equal(t, int64(0), change, "exact amount")
+
+    _, err = CalculateChange(1700, 1650, 150)
+    assert.Equal(t, ErrInsufficientTender, err)
+}
+
+func TestValidateNewPayment(t *testing.T) {
+    _, err := validateNewPayment(NewPayment{Method: PaymentMethodUnknown, AmountInCents: 100})
+    assert.Equal(t, ErrUnknownPaymentMethod, err)
+    _, err = validateNewPayment(NewPayment{Method: PaymentMethodCard, AmountInCents: 0})
+    assert.Equal(t, ErrInvalidPaymentAmount, err)
+    _, err = validateNewPayment(NewPayment{Method: PaymentMethodCard, AmountInCents: 100, TipInCents: -1})
+    assert.Equal(t, ErrInvalidTip, err)
+    _, err = validateNewPayment(NewPayment{Method: PaymentMethodCard, AmountInCents: 100, TenderedInCents: 200})
+    assert.Equal(t, ErrTenderedNotCash, err)
+
+    change, err := validateNewPayment(NewPayment{Method: PaymentMethodCash, AmountInCents: 100, TipInCents: 20, TenderedInCents: 200})
+    assert.NoError(t, err)
+    assert.Equal(t, int64(80), change)
+}
+
+func TestMapOrderToPublicAPI_ShowsPaymentsAndOutstandingBalance(t *testing.T) {
+    lines := []*customerOrderLineEntity{{ID: 1, OrderID: 1, ProductPriceInCents: 250, Quantity: 2}, {ID: 2, OrderID: 1, ProductPriceInCents: 400, Quantity: 1}}
+    payments := []*paymentEntity{
+        {ID: 1, OrderID: 1, Method: PaymentMethodCard, AmountInCents: 450, TipInCents: 50},
+        {ID: 2, OrderID: 1, Method: PaymentMethodCash, AmountInCents: 200},
+    }
+    order, err := mapOrderToPublicAPI(&customerOrderEntity{ID: 1}, lines, payments, nil)
+    assert.NoError(t, err)
+    assert.Equal(t, int64(900), order.TotalInCents)
+    assert.Equal(t, int64(650), order.AmountPaidInCents)
+    assert.Equal(t, int64(50), order.TipsInCents)
+    assert.Equal(t, int64(250), order.OutstandingInCents)
+    assert.Len(t, order.Payments, 2)
+
+    order, err = mapOrderToPublicAPI(&customerOrderEntity{ID: 1}, lines, nil, nil)
+    assert.NoError(t, err)
+    assert.Equal(t, int64(900), order.OutstandingInCents)
+    assert.NotNil(t, order.Payments)
+}
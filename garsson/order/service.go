@@ -1,40 +1,281 @@
 package order
 
 import (
+    "errors"
+    "fmt"
+    "strings"
+
     "github.com/gocraft/dbr"
+    "github.com/kubernetes/kubernetes/pkg/util/slice"
+    "github.com/toefel18/garsson-api/garsson/db"
+)
+
+var (
+    // ErrNoOrderLines indicates that an order without lines was placed
+    ErrNoOrderLines = errors.New("an order requires at least one order line")
+    // ErrInvalidQuantity indicates that the quantity of an order line is zero or negative
+    ErrInvalidQuantity = errors.New("quantity must be at least 1")
+    // ErrUnknownProduct indicates that an order line refers to a product that does not exist
+    ErrUnknownProduct = errors.New("unknown product")
+    // ErrCustomerNameTooLong indicates that the customer name does not fit in the database
+    ErrCustomerNameTooLong = errors.New("customer name must have at most 128 characters")
+    // ErrOrderNotFound indicates that no order exists with the given id
+    ErrOrderNotFound = errors.New("order not found")
+    // ErrUnknownStatus indicates that a status is not part of the order lifecycle
+    ErrUnknownStatus = errors.New("unknown order status")
+    // ErrTransitionNotPermitted indicates that the user lacks the permission required for the status change
+    ErrTransitionNotPermitted = errors.New("not authorized to change the order to this status")
+    // ErrOrderChanged indicates that the order was changed by someone else in the meantime
+    ErrOrderChanged = errors.New("order was changed concurrently, reload it and try again")
+)
+
+// IllegalTransitionError indicates that the lifecycle does not allow the status change
+type IllegalTransitionError struct {
+    From string
+    To   string
+}
+
+func (e *IllegalTransitionError) Error() string {
+    return fmt.Sprintf("cannot change order status from %v to %v", e.From, e.To)
+}
+
+const (
+    // maxCustomerNameLength is the size of the customer_name column
+    maxCustomerNameLength = 128
 )
 
 func FindOrderByID(sess dbr.SessionRunner, id int64) (*CustomerOrder, error) {
     if order, err := queryOrderEntityByID(sess, id); err != nil {
         return nil, err
-    } else if lines, err := queryOrderLinesByOrderID(sess, order.ID); err != nil {
+    } else if lines, err := loadOrderLines(sess, []int64{order.ID}); err != nil {
+        return nil, err
+    } else if payments, err := queryPaymentsByOrderIDs(sess, []int64{order.ID}); err != nil {
+        return nil, err
+    } else if tickets, err := queryTicketsByOrderIDs(sess, []int64{order.ID}); err != nil {
         return nil, err
     } else {
-        return mapOrderToPublicAPI(order, lines)
+        return mapOrderToPublicAPI(order, lines, payments, tickets)
+    }
+}
+
+// CreateOrder places the order for the waiter, at the table if one is given. The name, brand and price of the products
+// and the chosen modifiers are copied into the order lines, so later changes to products do not alter the order. The
+// lines are fired as tickets to the stations where they are prepared.
+func CreateOrder(sess *dbr.Session, waiter string, newOrder NewOrder) (*CustomerOrder, error) {
+    if err := validateNewOrder(newOrder); err != nil {
+        return nil, err
+    }
+    tx, err := sess.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.RollbackUnlessCommitted()
+
+    if newOrder.TableID != 0 {
+        if err := seatAtTable(tx, newOrder.TableID); err != nil {
+            return nil, err
+        }
+    }
+    products, err := findProductsWithModifiers(tx, productIDsOf(newOrder.OrderLines))
+    if err != nil {
+        return nil, err
+    }
+    order := &customerOrderEntity{
+        Status:       StatusPlaced,
+        Version:      1,
+        TimeCreated:  db.Now(),
+        WaiterID:     waiter,
+        CustomerName: nullIfEmpty(strings.TrimSpace(newOrder.CustomerName)),
+        Remark:       nullIfEmpty(strings.TrimSpace(newOrder.Remark)),
+    }
+    if newOrder.TableID != 0 {
+        order.DiningTableID = dbr.NewNullInt64(newOrder.TableID)
+    }
+    lines, err := snapshotOrderLines(newOrder.OrderLines, products)
+    if err != nil {
+        return nil, err
+    }
+    if order.ID, err = insertOrderEntity(tx, order); err != nil {
+        return nil, err
+    }
+    for _, line := range lines {
+        line.OrderID = order.ID
+    }
+    tickets, err := fireTickets(tx, order.ID, lines, order.TimeCreated)
+    if err != nil {
+        return nil, err
+    }
+    if err := insertOrderLineEntities(tx, lines); err != nil {
+        return nil, err
+    }
+    created, err := mapOrderToPublicAPI(order, lines, nil, tickets)
+    if err != nil {
+        return nil, err
+    }
+    if err := publishEvent(tx, EventOrderCreated, created, ""); err != nil {
+        return nil, err
     }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    return created, nil
 }
 
-func FindOrdersWithStatus(sess dbr.SessionRunner, status []string) ([]*CustomerOrder, error) {
-    orders, err := queryOrdersWithStatus(sess, status)
+// TransitionOrder changes the status of the order if the lifecycle allows it and the actor has the required
+// permission. Starting the preparation records the actor as bar handler, finishing it records the time prepared and
+// paying records the time paid, which requires payments that cover the total.
+func TransitionOrder(sess *dbr.Session, orderID int64, to, actor string, actorPermissions []string) (*CustomerOrder, error) {
+    if !IsValidStatus(to) {
+        return nil, ErrUnknownStatus
+    }
+    tx, err := sess.Begin()
     if err != nil {
         return nil, err
     }
+    defer tx.RollbackUnlessCommitted()
 
-    customerOrders := make([]*CustomerOrder, 0)
-    for _, v := range orders {
-        if orderLines, err := queryOrderLinesByOrderID(sess, v.ID); err != nil {
+    var current *customerOrderEntity
+    if to == StatusPaid {
+        // the lock keeps lines from being added between checking the outstanding balance and closing the order
+        current, err = queryOrderEntityForUpdate(tx, orderID)
+    } else {
+        current, err = queryOrderEntityByID(tx, orderID)
+    }
+    if err == dbr.ErrNotFound {
+        return nil, ErrOrderNotFound
+    } else if err != nil {
+        return nil, err
+    }
+    transition, allowed := findTransition(current.Status, to)
+    if !allowed {
+        return nil, &IllegalTransitionError{From: current.Status, To: to}
+    } else if !slice.ContainsString(actorPermissions, transition.Permission, nil) {
+        return nil, ErrTransitionNotPermitted
+    }
+    if to == StatusPaid {
+        if unpaid, err := FindOrderByID(tx, orderID); err != nil {
             return nil, err
-        } else if customerOrder, err := mapOrderToPublicAPI(v, orderLines); err != nil{
+        } else if unpaid.OutstandingInCents > 0 {
+            return nil, ErrOrderNotPaid
+        }
+    }
+
+    // the condition on the current status makes sure that only one of two concurrent changes succeeds
+    now := db.Now()
+    if updated, err := updateOrderStatus(tx, orderID, current.Status, transitionChanges(transition, actor, now)); err != nil {
+        return nil, err
+    } else if updated == 0 {
+        return nil, ErrOrderChanged
+    }
+    // the tickets are changed after the update locked the order, like SetTicketStatus does, so that they cannot deadlock
+    if err := closeTickets(tx, orderID, to, now); err != nil {
+        return nil, err
+    }
+    changed, err := FindOrderByID(tx, orderID)
+    if err != nil {
+        return nil, err
+    }
+    if err := publishEvent(tx, EventOrderStatusChanged, changed, current.Status); err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    return changed, nil
+}
+
+// transitionChanges returns the columns to update for the transition
+func transitionChanges(transition Transition, actor, now string) map[string]interface{} {
+    changes := map[string]interface{}{"status": transition.To, "version": dbr.Expr("version + 1")}
+    switch transition.To {
+    case StatusInPreparation:
+        changes["bar_handler_id"] = nullIfEmpty(actor)
+    case StatusPrepared:
+        changes["time_prepared"] = now
+        changes["bar_handler_id"] = dbr.Expr("COALESCE(bar_handler_id, ?)", nullIfEmpty(actor))
+    case StatusPaid:
+        changes["time_paid"] = now
+    }
+    return changes
+}
+
+// IsValidationError returns true if err is caused by invalid input of the caller
+func IsValidationError(err error) bool {
+    return err == ErrNoOrderLines || err == ErrInvalidQuantity || err == ErrUnknownProduct || err == ErrCustomerNameTooLong ||
+        err == ErrUnknownStatus || err == ErrInvalidSort || err == ErrInvalidCursor || err == ErrInvalidLimit ||
+        err == ErrInvalidTimeRange || err == ErrUnknownPaymentMethod || err == ErrInvalidPaymentAmount || err == ErrInvalidTip ||
+        err == ErrInsufficientTender || err == ErrTenderedNotCash || err == ErrInvalidSplit || err == ErrInvalidTableNumber ||
+        err == ErrInvalidCapacity || err == ErrAreaTooLong || err == ErrUnknownTableStatus || err == ErrSameTable ||
+        err == ErrUnknownModifier || err == ErrDuplicateModifier || err == ErrNegativeLinePrice || isModifierSelectionError(err) || err == ErrInvalidStationName ||
+        err == ErrUnknownTicketStatus
+}
+
+func isModifierSelectionError(err error) bool {
+    _, selection := err.(*ModifierSelectionError)
+    return selection
+}
+
+func validateNewOrder(newOrder NewOrder) error {
+    if len(newOrder.OrderLines) == 0 {
+        return ErrNoOrderLines
+    } else if len([]rune(strings.TrimSpace(newOrder.CustomerName))) > maxCustomerNameLength {
+        return ErrCustomerNameTooLong
+    }
+    for _, line := range newOrder.OrderLines {
+        if line.Quantity <= 0 {
+            return ErrInvalidQuantity
+        }
+    }
+    return nil
+}
+
+// snapshotOrderLines creates the order lines with a copy of the ordered products and their chosen modifiers, the
+// products must have their modifier groups loaded
+func snapshotOrderLines(newLines []NewOrderLine, products []ProductEntity) ([]*customerOrderLineEntity, error) {
+    productsByID := map[int64]ProductEntity{}
+    for _, product := range products {
+        productsByID[product.ID] = product
+    }
+    lines := make([]*customerOrderLineEntity, 0, len(newLines))
+    for _, newLine := range newLines {
+        product, found := productsByID[newLine.ProductID]
+        if !found {
+            return nil, ErrUnknownProduct
+        }
+        modifiers, err := chooseModifiers(product, newLine.Modifiers)
+        if err != nil {
             return nil, err
-        } else {
-            customerOrders = append(customerOrders, customerOrder)
         }
+        lines = append(lines, &customerOrderLineEntity{
+            ProductID:           product.ID,
+            ProductName:         product.Name,
+            ProductBrand:        nullIfEmpty(product.Brand),
+            ProductPriceInCents: priceWithModifiers(product.PriceInCents, modifiers),
+            Quantity:            newLine.Quantity,
+            Remark:              nullIfEmpty(strings.TrimSpace(newLine.Remark)),
+            Modifiers:           modifiers,
+            StationID:           product.StationID.Int64,
+        })
     }
-    return customerOrders, nil
+    return lines, nil
 }
 
+func productIDsOf(lines []NewOrderLine) []int64 {
+    ids := make([]int64, 0, len(lines))
+    for _, line := range lines {
+        ids = append(ids, line.ProductID)
+    }
+    return ids
+}
+
+func nullIfEmpty(value string) dbr.NullString {
+    if value == "" {
+        return dbr.NullString{}
+    }
+    return dbr.NewNullString(value)
+}
 
-func mapOrderToPublicAPI(order *customerOrderEntity, lines []*customerOrderLineEntity) (*CustomerOrder, error) {
+func mapOrderToPublicAPI(order *customerOrderEntity, lines []*customerOrderLineEntity, payments []*paymentEntity, tickets []*ticketEntity) (*CustomerOrder, error) {
     publicOrder := CustomerOrder{
         ID:                order.ID,
         Status:            order.Status,
@@ -46,8 +287,15 @@ func mapOrderToPublicAPI(order *customerOrderEntity, lines []*customerOrderLineE
         CustomerName:      order.CustomerName.String,
         AmountPaidInCents: order.AmountPaidInCents.Int64,
         Remark:            order.Remark.String,
+        Version:           order.Version,
+        TableID:           order.DiningTableID.Int64,
         OrderLines:        mapOrderLinesToPublicAPI(lines),
+        TotalInCents:      orderTotal(lines),
+        Payments:          mapPaymentsToPublicAPI(payments),
+        Tickets:           mapTicketsToPublicAPI(tickets),
     }
+    publicOrder.AmountPaidInCents, publicOrder.TipsInCents = paidAmounts(payments)
+    publicOrder.OutstandingInCents = publicOrder.TotalInCents - publicOrder.AmountPaidInCents
 
     return &publicOrder, nil
 }
@@ -56,11 +304,15 @@ func mapOrderLinesToPublicAPI(lines []*customerOrderLineEntity) []*CustomerOrder
     orderLines := []*CustomerOrderLine{} // provide empty array if none found
     for _, line := range lines {
         orderLine := CustomerOrderLine{
+            ID:                  line.ID,
+            ProductID:           line.ProductID,
             ProductName:         line.ProductName,
             ProductBrand:        line.ProductBrand.String,
             ProductPriceInCents: line.ProductPriceInCents,
             Quantity:            line.Quantity,
             Remark:              line.Remark.String,
+            Modifiers:           mapOrderLineModifiersToPublicAPI(line.Modifiers),
+            TicketID:            line.TicketID.Int64,
         }
         orderLines = append(orderLines, &orderLine)
     }
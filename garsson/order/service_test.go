@@ -0,0 +1,43 @@
+package order
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// orderRows returns the row of an order with the status and version as selected from the database
+func orderRows(id int64, status string, version int64) *sqlmock.Rows {
+    return sqlmock.NewRows([]string{"id", "status", "time_created", "waiter_id", "version"}).
+        AddRow(id, status, "2018-06-01T20:00:00Z", "waiter@garsson.io", version)
+}
+
+func TestValidateNewOrder(t *testing.T) {
+    valid := NewOrder{OrderLines: []NewOrderLine{{ProductID: 1, Quantity: 2}, {ProductID: 2, Quantity: 1}}}
+    assert.NoError(t, validateNewOrder(valid))
+
+    assert.Equal(t, ErrNoOrderLines, validateNewOrder(NewOrder{}))
+    assert.Equal(t, ErrInvalidQuantity, validateNewOrder(NewOrder{OrderLines: []NewOrderLine{{ProductID: 1, Quantity: 0}}}))
+    assert.NoError(t, validateNewOrder(NewOrder{OrderLines: []NewOrderLine{{ProductID: 1, Quantity: 1}, {ProductID: 1, Quantity: 2, Remark: "no ice"}}}))
+    assert.Equal(t, ErrCustomerNameTooLong, validateNewOrder(NewOrder{CustomerName: strings.Repeat("a", 129), OrderLines: valid.OrderLines}))
+}
+
+func TestSnapshotOrderLines_CopiesProduct(t *testing.T) {
+    products := []ProductEntity{{ID: 1, Name: "Pils", Brand: "Hertog Jan", PriceInCents: 250}}
+
+    lines, err := snapshotOrderLines([]NewOrderLine{{ProductID: 1, Quantity: 3, Remark: " no foam "}}, products)
+    assert.NoError(t, err)
+    assert.Len(t, lines, 1)
+    assert.Equal(t, "Pils", lines[0].ProductName)
+    assert.Equal(t, "Hertog Jan", lines[0].ProductBrand.String)
+    assert.Equal(t, int64(250), lines[0].ProductPriceInCents)
+    assert.Equal(t, int64(3), lines[0].Quantity)
+    assert.Equal(t, "no foam", lines[0].Remark.String)
+}
+
+func TestSnapshotOrderLines_RejectsUnknownProduct(t *testing.T) {
+    _, err := snapshotOrderLines([]NewOrderLine{{ProductID: 2, Quantity: 1}}, []ProductEntity{{ID: 1, Name: "Pils"}})
+    assert.Equal(t, ErrUnknownProduct, err)
+}
@@ -0,0 +1,352 @@
+package order
+
+import (
+    "errors"
+    "strings"
+
+    "github.com/gocraft/dbr"
+    "github.com/toefel18/garsson-api/garsson/db"
+)
+
+// Products are prepared at a station, drinks at the bar and food in the kitchen. When lines are ordered they are
+// fired as one ticket per station, and every station works through its own queue of tickets in fire order. Lines
+// added later are fired as new tickets. Products without a station need no preparation and are not on any ticket.
+//
+// The tickets drive the status of the order: it is in preparation once a station starts on it and prepared when every
+// ticket is ready. Cancelling the order cancels its open tickets, and an order that is marked prepared or served by hand
+// takes its open tickets off the queues by marking them ready.
+
+var (
+    // ErrStationNotFound indicates that no station exists with the given id
+    ErrStationNotFound = errors.New("station not found")
+    // ErrStationNameTaken indicates that another station already has the name
+    ErrStationNameTaken = errors.New("another station already has this name")
+    // ErrInvalidStationName indicates that the station name is empty or too long
+    ErrInvalidStationName = errors.New("station name must have 1 to 64 characters")
+    // ErrProductNotFound indicates that no product exists with the given id
+    ErrProductNotFound = errors.New("product not found")
+    // ErrTicketNotFound indicates that no ticket exists with the given id
+    ErrTicketNotFound = errors.New("ticket not found")
+    // ErrUnknownTicketStatus indicates that the status is not queued, in_preparation or ready
+    ErrUnknownTicketStatus = errors.New("unknown ticket status, use in_preparation or ready")
+    // ErrIllegalTicketStatus indicates that the ticket cannot move to the status from its current status
+    ErrIllegalTicketStatus = errors.New("the ticket cannot change to this status")
+)
+
+const (
+    // TicketQueued is the status of a fired ticket
+    TicketQueued = "queued"
+    // TicketInPreparation indicates that the station is preparing the ticket
+    TicketInPreparation = "in_preparation"
+    // TicketReady indicates that the lines of the ticket can be served
+    TicketReady = "ready"
+    // TicketCancelled indicates that the ticket will not be prepared
+    TicketCancelled = "cancelled"
+
+    // maxStationNameLength is the size of the name column
+    maxStationNameLength = 64
+)
+
+// openTicketStatuses are the statuses of tickets in the queue of a station
+var openTicketStatuses = []string{TicketQueued, TicketInPreparation}
+
+// ticketTransitions lists the statuses that a ticket can move to, a station may mark a queued ticket ready at once
+var ticketTransitions = map[string][]string{
+    TicketQueued:        {TicketInPreparation, TicketReady},
+    TicketInPreparation: {TicketReady},
+}
+
+// ListStations returns all stations ordered by name
+func ListStations(sess dbr.SessionRunner) ([]*Station, error) {
+    entities, err := queryStations(sess)
+    if err != nil {
+        return nil, err
+    }
+    stations := make([]*Station, 0, len(entities))
+    for _, entity := range entities {
+        stations = append(stations, mapStationToPublicAPI(entity))
+    }
+    return stations, nil
+}
+
+// CreateStation adds a station
+func CreateStation(sess dbr.SessionRunner, name string) (*Station, error) {
+    name = strings.TrimSpace(name)
+    if name == "" || len([]rune(name)) > maxStationNameLength {
+        return nil, ErrInvalidStationName
+    }
+    station := &stationEntity{Name: name, TimeCreated: db.Now()}
+    var err error
+    if station.ID, err = insertStationEntity(sess, station); db.IsUniqueViolation(err) {
+        return nil, ErrStationNameTaken
+    } else if err != nil {
+        return nil, err
+    }
+    return mapStationToPublicAPI(station), nil
+}
+
+// SetProductStation sets the station where the product is prepared, 0 if it needs no preparation. Lines that have
+// already been ordered stay on their tickets.
+func SetProductStation(sess dbr.SessionRunner, productID, stationID int64) (ProductEntity, error) {
+    station := dbr.NullInt64{}
+    if stationID != 0 {
+        if _, err := queryStationByID(sess, stationID); err == dbr.ErrNotFound {
+            return ProductEntity{}, ErrStationNotFound
+        } else if err != nil {
+            return ProductEntity{}, err
+        }
+        station = dbr.NewNullInt64(stationID)
+    }
+    if updated, err := updateProductStation(sess, productID, station); err != nil {
+        return ProductEntity{}, err
+    } else if updated == 0 {
+        return ProductEntity{}, ErrProductNotFound
+    }
+    return QueryProductByID(sess, productID)
+}
+
+// StationQueue returns the queued tickets and those in preparation of the station, in fire order
+func StationQueue(sess dbr.SessionRunner, stationID int64) ([]*QueuedTicket, error) {
+    if _, err := queryStationByID(sess, stationID); err == dbr.ErrNotFound {
+        return nil, ErrStationNotFound
+    } else if err != nil {
+        return nil, err
+    }
+    tickets, err := queryTicketsAtStation(sess, stationID, openTicketStatuses)
+    if err != nil {
+        return nil, err
+    }
+    orderIDs := make([]int64, 0, len(tickets))
+    for _, ticket := range tickets {
+        orderIDs = append(orderIDs, ticket.OrderID)
+    }
+    orders, err := queryOrderEntitiesByIDs(sess, orderIDs)
+    if err != nil {
+        return nil, err
+    }
+    lines, err := loadOrderLines(sess, orderIDs)
+    if err != nil {
+        return nil, err
+    }
+    return queueTickets(tickets, orders, lines), nil
+}
+
+// SetTicketStatus changes the status of the ticket, the actor becomes its handler when preparation starts. The order
+// follows its tickets, it is in preparation once one of them is and prepared when all of them are ready.
+func SetTicketStatus(sess *dbr.Session, ticketID int64, to, actor string) (*CustomerOrder, error) {
+    if to != TicketInPreparation && to != TicketReady {
+        return nil, ErrUnknownTicketStatus
+    }
+    tx, err := sess.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.RollbackUnlessCommitted()
+
+    unlocked, err := queryTicketByID(tx, ticketID)
+    if err == dbr.ErrNotFound {
+        return nil, ErrTicketNotFound
+    } else if err != nil {
+        return nil, err
+    }
+    // the order is locked before the ticket, like edits of the order do, so that they cannot deadlock
+    current, err := queryOrderEntityForUpdate(tx, unlocked.OrderID)
+    if err != nil {
+        return nil, err
+    }
+    ticket, err := queryTicketForUpdate(tx, ticketID)
+    if err != nil {
+        return nil, err
+    } else if !canChangeTicketStatus(ticket.Status, to) {
+        return nil, ErrIllegalTicketStatus
+    }
+    if err := updateTicket(tx, ticketID, ticketChanges(ticket, to, actor, db.Now())); err != nil {
+        return nil, err
+    }
+
+    tickets, err := queryTicketsByOrderIDs(tx, []int64{current.ID})
+    if err != nil {
+        return nil, err
+    }
+    next := orderStatusForTickets(current.Status, tickets)
+    if next != current.Status {
+        if _, err := updateOrderStatus(tx, current.ID, current.Status, transitionChanges(Transition{From: current.Status, To: next}, actor, db.Now())); err != nil {
+            return nil, err
+        }
+    } else if _, err := incrementOrderVersion(tx, current.ID, current.Version); err != nil {
+        return nil, err
+    }
+
+    changed, err := FindOrderByID(tx, current.ID)
+    if err != nil {
+        return nil, err
+    }
+    if next != current.Status {
+        err = publishEvent(tx, EventOrderStatusChanged, changed, current.Status)
+    } else {
+        err = publishEvent(tx, EventOrderUpdated, changed, "")
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    return changed, nil
+}
+
+// fireTickets creates a ticket for every station at which one of the new lines is prepared and assigns the lines to
+// them, returns the created tickets
+func fireTickets(tx dbr.SessionRunner, orderID int64, lines []*customerOrderLineEntity, now string) ([]*ticketEntity, error) {
+    var tickets []*ticketEntity
+    ticketsByStation := map[int64]*ticketEntity{}
+    for _, line := range lines {
+        if line.StationID == 0 {
+            continue
+        }
+        ticket, fired := ticketsByStation[line.StationID]
+        if !fired {
+            ticket = &ticketEntity{OrderID: orderID, StationID: line.StationID, Status: TicketQueued, TimeCreated: now}
+            var err error
+            if ticket.ID, err = insertTicketEntity(tx, ticket); err != nil {
+                return nil, err
+            }
+            ticketsByStation[line.StationID] = ticket
+            tickets = append(tickets, ticket)
+        }
+        line.TicketID = dbr.NewNullInt64(ticket.ID)
+    }
+    return tickets, nil
+}
+
+// closeTickets takes the open tickets of an order that moved to the status off the queues of the stations
+func closeTickets(tx dbr.SessionRunner, orderID int64, status, now string) error {
+    switch status {
+    case StatusCancelled:
+        return cancelTickets(tx, orderID, openTicketStatuses)
+    case StatusPrepared, StatusServed:
+        return readyTickets(tx, orderID, openTicketStatuses, now)
+    }
+    return nil
+}
+
+// followTickets moves the order to the status that its tickets dictate after some of them were cancelled. The order
+// must be locked and its version incremented by the caller.
+func followTickets(tx dbr.SessionRunner, orderID int64) error {
+    current, err := queryOrderEntityByID(tx, orderID)
+    if err != nil {
+        return err
+    }
+    tickets, err := queryTicketsByOrderIDs(tx, []int64{orderID})
+    if err != nil {
+        return err
+    }
+    next := orderStatusForTickets(current.Status, tickets)
+    if next == current.Status {
+        return nil
+    }
+    changes := transitionChanges(Transition{From: current.Status, To: next}, "", db.Now())
+    delete(changes, "version")
+    _, err = updateOrderStatus(tx, orderID, current.Status, changes)
+    return err
+}
+
+// orderStatusForTickets returns the status of the order after a change of its tickets. Only orders that are placed
+// or in preparation follow their tickets.
+func orderStatusForTickets(status string, tickets []*ticketEntity) string {
+    if status != StatusPlaced && status != StatusInPreparation {
+        return status
+    }
+    started, ready, open := false, 0, 0
+    for _, ticket := range tickets {
+        switch ticket.Status {
+        case TicketCancelled:
+            continue
+        case TicketInPreparation:
+            started = true
+        case TicketReady:
+            started = true
+            ready++
+        }
+        open++
+    }
+    if open > 0 && ready == open {
+        return StatusPrepared
+    } else if started {
+        return StatusInPreparation
+    }
+    return status
+}
+
+func canChangeTicketStatus(from, to string) bool {
+    for _, allowed := range ticketTransitions[from] {
+        if allowed == to {
+            return true
+        }
+    }
+    return false
+}
+
+// ticketChanges returns the columns to update when the ticket moves to the status
+func ticketChanges(ticket *ticketEntity, to, actor, now string) map[string]interface{} {
+    changes := map[string]interface{}{"status": to}
+    if !ticket.TimeStarted.Valid {
+        changes["time_started"] = now
+        changes["handler_id"] = nullIfEmpty(actor)
+    }
+    if to == TicketReady {
+        changes["time_ready"] = now
+    }
+    return changes
+}
+
+// queueTickets combines the tickets with the details of their orders and their lines
+func queueTickets(tickets []*ticketEntity, orders []*customerOrderEntity, lines []*customerOrderLineEntity) []*QueuedTicket {
+    ordersByID := map[int64]*customerOrderEntity{}
+    for _, entity := range orders {
+        ordersByID[entity.ID] = entity
+    }
+    linesByTicket := map[int64][]*customerOrderLineEntity{}
+    for _, line := range lines {
+        if line.TicketID.Valid {
+            linesByTicket[line.TicketID.Int64] = append(linesByTicket[line.TicketID.Int64], line)
+        }
+    }
+    queue := make([]*QueuedTicket, 0, len(tickets))
+    for _, ticket := range tickets {
+        queued := &QueuedTicket{Ticket: *mapTicketToPublicAPI(ticket), Lines: mapOrderLinesToPublicAPI(linesByTicket[ticket.ID])}
+        if entity, found := ordersByID[ticket.OrderID]; found {
+            queued.TableID = entity.DiningTableID.Int64
+            queued.CustomerName = entity.CustomerName.String
+            queued.Waiter = entity.WaiterID
+            queued.Remark = entity.Remark.String
+        }
+        queue = append(queue, queued)
+    }
+    return queue
+}
+
+func mapStationToPublicAPI(station *stationEntity) *Station {
+    return &Station{ID: station.ID, Name: station.Name, TimeCreated: station.TimeCreated}
+}
+
+func mapTicketToPublicAPI(ticket *ticketEntity) *Ticket {
+    return &Ticket{
+        ID:          ticket.ID,
+        OrderID:     ticket.OrderID,
+        StationID:   ticket.StationID,
+        Status:      ticket.Status,
+        Handler:     ticket.HandlerID.String,
+        TimeCreated: ticket.TimeCreated,
+        TimeStarted: ticket.TimeStarted.String,
+        TimeReady:   ticket.TimeReady.String,
+    }
+}
+
+func mapTicketsToPublicAPI(tickets []*ticketEntity) []*Ticket {
+    publicTickets := []*Ticket{} // provide empty array if none found
+    for _, ticket := range tickets {
+        publicTickets = append(publicTickets, mapTicketToPublicAPI(ticket))
+    }
+    return publicTickets
+}
@@ -0,0 +1,110 @@
+package order
+
+import (
+    "errors"
+    "testing"
+
+    "github.com/gocraft/dbr"
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/auth"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestOrderStatusForTickets(t *testing.T) {
+    queued := &ticketEntity{Status: TicketQueued}
+    started := &ticketEntity{Status: TicketInPreparation}
+    ready := &ticketEntity{Status: TicketReady}
+    cancelled := &ticketEntity{Status: TicketCancelled}
+
+    assert.Equal(t, StatusPlaced, orderStatusForTickets(StatusPlaced, []*ticketEntity{queued, queued}))
+    assert.Equal(t, StatusInPreparation, orderStatusForTickets(StatusPlaced, []*ticketEntity{queued, started}))
+    assert.Equal(t, StatusInPreparation, orderStatusForTickets(StatusPlaced, []*ticketEntity{queued, ready}))
+    assert.Equal(t, StatusPrepared, orderStatusForTickets(StatusInPreparation, []*ticketEntity{ready, ready}))
+    assert.Equal(t, StatusPrepared, orderStatusForTickets(StatusPlaced, []*ticketEntity{ready, cancelled}), "cancelled tickets are ignored")
+    assert.Equal(t, StatusServed, orderStatusForTickets(StatusServed, []*ticketEntity{started}), "served orders no longer follow their tickets")
+}
+
+func TestCanChangeTicketStatus(t *testing.T) {
+    assert.True(t, canChangeTicketStatus(TicketQueued, TicketInPreparation))
+    assert.True(t, canChangeTicketStatus(TicketQueued, TicketReady))
+    assert.True(t, canChangeTicketStatus(TicketInPreparation, TicketReady))
+    assert.False(t, canChangeTicketStatus(TicketReady, TicketInPreparation))
+    assert.False(t, canChangeTicketStatus(TicketCancelled, TicketReady))
+}
+
+func TestTicketChanges(t *testing.T) {
+    changes := ticketChanges(&ticketEntity{Status: TicketQueued}, TicketInPreparation, "bar@garsson.io", "now")
+    assert.Equal(t, map[string]interface{}{"status": TicketInPreparation, "time_started": "now", "handler_id": dbr.NewNullString("bar@garsson.io")}, changes)
+
+    changes = ticketChanges(&ticketEntity{Status: TicketInPreparation, TimeStarted: dbr.NewNullString("before")}, TicketReady, "bar@garsson.io", "now")
+    assert.Equal(t, map[string]interface{}{"status": TicketReady, "time_ready": "now"}, changes)
+}
+
+func TestQueueTickets_AddsOrderDetailsAndLines(t *testing.T) {
+    tickets := []*ticketEntity{{ID: 5, OrderID: 1, StationID: 2, Status: TicketQueued}}
+    orders := []*customerOrderEntity{{ID: 1, WaiterID: "waiter@garsson.io", DiningTableID: dbr.NewNullInt64(3)}}
+    lines := []*customerOrderLineEntity{
+        {ID: 7, OrderID: 1, ProductName: "Bitterballen", Quantity: 2, TicketID: dbr.NewNullInt64(5)},
+        {ID: 8, OrderID: 1, ProductName: "Pils", Quantity: 2, TicketID: dbr.NewNullInt64(4)},
+    }
+
+    queue := queueTickets(tickets, orders, lines)
+    assert.Len(t, queue, 1)
+    assert.Equal(t, int64(5), queue[0].ID)
+    assert.Equal(t, int64(3), queue[0].TableID)
+    assert.Equal(t, "waiter@garsson.io", queue[0].Waiter)
+    assert.Len(t, queue[0].Lines, 1)
+    assert.Equal(t, "Bitterballen", queue[0].Lines[0].ProductName)
+}
+
+func TestSnapshotOrderLines_KeepsStation(t *testing.T) {
+    products := []ProductEntity{{ID: 1, Name: "Pils", StationID: dbr.NewNullInt64(2)}, {ID: 2, Name: "Chips"}}
+    lines, err := snapshotOrderLines([]NewOrderLine{{ProductID: 1, Quantity: 1}, {ProductID: 2, Quantity: 1}}, products)
+    assert.NoError(t, err)
+    assert.Equal(t, int64(2), lines[0].StationID)
+    assert.Equal(t, int64(0), lines[1].StationID, "needs no preparation")
+}
+
+func TestTransitionOrder_LocksOrderBeforeTickets(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM customer_order WHERE \(id = 1\)`).WillReturnRows(orderRows(1, StatusInPreparation, 2))
+    mock.ExpectExec(`UPDATE "customer_order" SET `).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`UPDATE "ticket" SET "status" = 'cancelled' WHERE \(order_id = 1 AND status IN \('queued','in_preparation'\)\)`).
+        WillReturnResult(sqlmock.NewResult(0, 2))
+    mock.ExpectQuery(`SELECT \* FROM customer_order WHERE \(id = 1\)`).WillReturnError(errors.New("stop"))
+    mock.ExpectRollback()
+
+    _, err := TransitionOrder(dao.NewSession(), 1, StatusCancelled, "manager@garsson.io", []string{auth.PermissionOrdersCancel})
+    assert.EqualError(t, err, "stop")
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTransitionOrder_LocksOrderToCheckPayment(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM customer_order WHERE id = 1 FOR UPDATE`).WillReturnRows(orderRows(1, StatusServed, 3))
+    mock.ExpectQuery(`SELECT \* FROM customer_order WHERE \(id = 1\)`).WillReturnRows(orderRows(1, StatusServed, 3))
+    mock.ExpectQuery(`SELECT \* FROM customer_order_line WHERE \(order_id IN \(1\)\)`).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "product_id", "product_name", "product_price_in_cents", "quantity"}).
+            AddRow(7, 1, 1, "Pils", 250, 2))
+    mock.ExpectQuery(`SELECT \* FROM customer_order_line_modifier`).WillReturnRows(dbtest.EmptyRows())
+    mock.ExpectQuery(`SELECT \* FROM payment`).WillReturnRows(dbtest.EmptyRows())
+    mock.ExpectQuery(`SELECT \* FROM ticket`).WillReturnRows(dbtest.EmptyRows())
+    mock.ExpectRollback()
+
+    _, err := TransitionOrder(dao.NewSession(), 1, StatusPaid, "waiter@garsson.io", []string{auth.PermissionOrdersWrite})
+    assert.Equal(t, ErrOrderNotPaid, err)
+    assert.NoError(t, mock.ExpectationsWereMet(), "the order is not closed")
+}
+
+func TestCloseTickets_ReadiesOpenTicketsOfPreparedOrder(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectExec(`UPDATE "ticket" SET .*"status" = 'ready'.* WHERE \(order_id = 1 AND status IN \('queued','in_preparation'\)\)`).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+
+    assert.NoError(t, closeTickets(dao.NewSession(), 1, StatusServed, "now"))
+    assert.NoError(t, closeTickets(dao.NewSession(), 1, StatusPaid, "now"), "paid orders have no open tickets left")
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
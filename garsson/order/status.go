@@ -0,0 +1,72 @@
+package order
+
+import (
+    "github.com/toefel18/garsson-api/garsson/auth"
+)
+
+// An order is placed by a waiter, prepared at the stations, served and finally paid. Orders can be cancelled until
+// they are served. Each status change requires a permission, so that for example only bar staff starts the
+// preparation. The tickets of the stations also move the order into preparation and to prepared.
+
+const (
+    // StatusPlaced is the status of a new order
+    StatusPlaced = "placed"
+    // StatusInPreparation indicates that the bar is preparing the order
+    StatusInPreparation = "in_preparation"
+    // StatusPrepared indicates that the order is ready to be served
+    StatusPrepared = "prepared"
+    // StatusServed indicates that the order has been brought to the customer
+    StatusServed = "served"
+    // StatusPaid indicates that the order has been paid, it cannot change anymore
+    StatusPaid = "paid"
+    // StatusCancelled indicates that the order will not be served, it cannot change anymore
+    StatusCancelled = "cancelled"
+)
+
+// Transition is an allowed status change and the permission it requires
+type Transition struct {
+    From       string `json:"from"`
+    To         string `json:"to"`
+    Permission string `json:"permission"`
+}
+
+// transitions is the lifecycle of an order
+var transitions = []Transition{
+    {From: StatusPlaced, To: StatusInPreparation, Permission: auth.PermissionOrdersPrepare},
+    {From: StatusInPreparation, To: StatusPrepared, Permission: auth.PermissionOrdersPrepare},
+    {From: StatusPrepared, To: StatusServed, Permission: auth.PermissionOrdersWrite},
+    {From: StatusServed, To: StatusPaid, Permission: auth.PermissionOrdersWrite},
+    {From: StatusPlaced, To: StatusCancelled, Permission: auth.PermissionOrdersCancel},
+    {From: StatusInPreparation, To: StatusCancelled, Permission: auth.PermissionOrdersCancel},
+    {From: StatusPrepared, To: StatusCancelled, Permission: auth.PermissionOrdersCancel},
+}
+
+// Statuses returns all statuses in lifecycle order
+func Statuses() []string {
+    return []string{StatusPlaced, StatusInPreparation, StatusPrepared, StatusServed, StatusPaid, StatusCancelled}
+}
+
+// Transitions returns the allowed status changes
+func Transitions() []Transition {
+    return append([]Transition{}, transitions...)
+}
+
+// IsValidStatus returns true if status is part of the lifecycle
+func IsValidStatus(status string) bool {
+    for _, known := range Statuses() {
+        if status == known {
+            return true
+        }
+    }
+    return false
+}
+
+// findTransition returns the transition from one status to another, or false if the change is not allowed
+func findTransition(from, to string) (Transition, bool) {
+    for _, transition := range transitions {
+        if transition.From == from && transition.To == to {
+            return transition, true
+        }
+    }
+    return Transition{}, false
+}
@@ -0,0 +1,51 @@
+package order
+
+import (
+    "testing"
+
+    "github.com/gocraft/dbr"
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/auth"
+)
+
+func TestFindTransition_FollowsLifecycle(t *testing.T) {
+    lifecycle := []string{StatusPlaced, StatusInPreparation, StatusPrepared, StatusServed, StatusPaid}
+    for i := 0; i < len(lifecycle)-1; i++ {
+        _, allowed := findTransition(lifecycle[i], lifecycle[i+1])
+        assert.True(t, allowed, "%v -> %v", lifecycle[i], lifecycle[i+1])
+    }
+
+    for _, illegal := range [][2]string{
+        {StatusPlaced, StatusPrepared},
+        {StatusPrepared, StatusInPreparation},
+        {StatusServed, StatusCancelled},
+        {StatusPaid, StatusPlaced},
+        {StatusCancelled, StatusPlaced},
+    } {
+        _, allowed := findTransition(illegal[0], illegal[1])
+        assert.False(t, allowed, "%v -> %v", illegal[0], illegal[1])
+    }
+}
+
+func TestFindTransition_RequiresPermission(t *testing.T) {
+    transition, _ := findTransition(StatusPlaced, StatusInPreparation)
+    assert.Equal(t, auth.PermissionOrdersPrepare, transition.Permission)
+    transition, _ = findTransition(StatusPlaced, StatusCancelled)
+    assert.Equal(t, auth.PermissionOrdersCancel, transition.Permission)
+}
+
+func TestIsValidStatus(t *testing.T) {
+    assert.True(t, IsValidStatus(StatusInPreparation))
+    assert.False(t, IsValidStatus("IN_PREPARATION"))
+    assert.False(t, IsValidStatus(""))
+}
+
+func TestTransitionChanges(t *testing.T) {
+    start, _ := findTransition(StatusPlaced, StatusInPreparation)
+    assert.Equal(t, map[string]interface{}{"status": StatusInPreparation, "version": dbr.Expr("version + 1"), "bar_handler_id": dbr.NewNullString("bar@garsson.nl")},
+        transitionChanges(start, "bar@garsson.nl", "2018-06-01T10:00:00Z"))
+
+    pay, _ := findTransition(StatusServed, StatusPaid)
+    assert.Equal(t, map[string]interface{}{"status": StatusPaid, "version": dbr.Expr("version + 1"), "time_paid": "2018-06-01T10:00:00Z"},
+        transitionChanges(pay, "waiter@garsson.nl", "2018-06-01T10:00:00Z"))
+}
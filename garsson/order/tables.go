@@ -0,0 +1,274 @@
+package order
+
+import (
+    "errors"
+    "strings"
+    "time"
+
+    "github.com/gocraft/dbr"
+    "github.com/toefel18/garsson-api/garsson/db"
+)
+
+// Customers are seated at dining tables and orders are placed for a table. Placing an order at a table marks it
+// occupied, staff mark it available again once the guests have left. When guests change tables their open orders move
+// along, one at a time or all at once by merging one table into another. Paid and cancelled orders stay where they
+// were placed.
+
+var (
+    // ErrTableNotFound indicates that no dining table exists with the given id
+    ErrTableNotFound = errors.New("table not found")
+    // ErrTableNumberTaken indicates that another table already has the number
+    ErrTableNumberTaken = errors.New("another table already has this number")
+    // ErrInvalidTableNumber indicates that the table number is zero or negative
+    ErrInvalidTableNumber = errors.New("table number must be at least 1")
+    // ErrInvalidCapacity indicates that the capacity of a table is zero or negative
+    ErrInvalidCapacity = errors.New("table capacity must be at least 1")
+    // ErrAreaTooLong indicates that the area does not fit in the database
+    ErrAreaTooLong = errors.New("area must have at most 64 characters")
+    // ErrUnknownTableStatus indicates that the table status is not available, occupied, reserved or out of service
+    ErrUnknownTableStatus = errors.New("unknown table status, use available, occupied, reserved or out_of_service")
+    // ErrTableOutOfService indicates that orders cannot be placed at or moved to the table
+    ErrTableOutOfService = errors.New("table is out of service")
+    // ErrSameTable indicates that a table was merged into itself
+    ErrSameTable = errors.New("cannot merge a table into itself")
+)
+
+const (
+    // TableAvailable indicates that the table is free
+    TableAvailable = "available"
+    // TableOccupied indicates that guests are seated at the table
+    TableOccupied = "occupied"
+    // TableReserved indicates that the table is kept free for expected guests
+    TableReserved = "reserved"
+    // TableOutOfService indicates that the table is not used
+    TableOutOfService = "out_of_service"
+
+    // maxAreaLength is the size of the area column
+    maxAreaLength = 64
+)
+
+// TableOverview shows how a table is doing
+type TableOverview struct {
+    Table      *DiningTable     `json:"table"`
+    OpenOrders []*CustomerOrder `json:"openOrders"`
+    // AmountOwedInCents is the outstanding balance of the open orders
+    AmountOwedInCents int64 `json:"amountOwedInCents"`
+    // TimeLastOrder is when the newest open order was placed, empty without open orders
+    TimeLastOrder         string `json:"timeLastOrder,omitempty"`
+    SecondsSinceLastOrder int64  `json:"secondsSinceLastOrder,omitempty"`
+}
+
+// ListTables returns the overview of all tables ordered by number
+func ListTables(sess dbr.SessionRunner, now time.Time) ([]*TableOverview, error) {
+    tables, err := queryDiningTables(sess)
+    if err != nil {
+        return nil, err
+    }
+    entities, err := queryOpenOrdersAtTables(sess, nil)
+    if err != nil {
+        return nil, err
+    }
+    orders, err := loadOrders(sess, entities)
+    if err != nil {
+        return nil, err
+    }
+    ordersByTable := map[int64][]*CustomerOrder{}
+    for _, customerOrder := range orders {
+        ordersByTable[customerOrder.TableID] = append(ordersByTable[customerOrder.TableID], customerOrder)
+    }
+    overviews := make([]*TableOverview, 0, len(tables))
+    for _, table := range tables {
+        overviews = append(overviews, tableOverview(table, ordersByTable[table.ID], now))
+    }
+    return overviews, nil
+}
+
+// CreateTable adds an available table
+func CreateTable(sess dbr.SessionRunner, newTable NewDiningTable) (*DiningTable, error) {
+    if err := validateNewDiningTable(newTable); err != nil {
+        return nil, err
+    }
+    table := &diningTableEntity{
+        Number:      newTable.Number,
+        Area:        nullIfEmpty(strings.TrimSpace(newTable.Area)),
+        Capacity:    newTable.Capacity,
+        Status:      TableAvailable,
+        TimeCreated: db.Now(),
+    }
+    var err error
+    if table.ID, err = insertDiningTableEntity(sess, table); db.IsUniqueViolation(err) {
+        return nil, ErrTableNumberTaken
+    } else if err != nil {
+        return nil, err
+    }
+    return mapTableToPublicAPI(table), nil
+}
+
+// UpdateTable changes the number, area and capacity of the table
+func UpdateTable(sess dbr.SessionRunner, tableID int64, changed NewDiningTable) (*DiningTable, error) {
+    if err := validateNewDiningTable(changed); err != nil {
+        return nil, err
+    }
+    changes := map[string]interface{}{
+        "number":   changed.Number,
+        "area":     nullIfEmpty(strings.TrimSpace(changed.Area)),
+        "capacity": changed.Capacity,
+    }
+    return changeTable(sess, tableID, changes)
+}
+
+// SetTableStatus changes the status of the table
+func SetTableStatus(sess dbr.SessionRunner, tableID int64, status string) (*DiningTable, error) {
+    if !isValidTableStatus(status) {
+        return nil, ErrUnknownTableStatus
+    }
+    return changeTable(sess, tableID, map[string]interface{}{"status": status})
+}
+
+// MoveOrder moves the order to another table, like the other edits it requires the version of the order
+func MoveOrder(sess *dbr.Session, orderID, expectedVersion, tableID int64) (*CustomerOrder, error) {
+    return editOrder(sess, orderID, expectedVersion, func(tx *dbr.Tx, lines []*customerOrderLineEntity) error {
+        if err := seatAtTable(tx, tableID); err != nil {
+            return err
+        }
+        return updateOrderDiningTable(tx, orderID, tableID)
+    })
+}
+
+// MergeTables moves the open orders of one table to another and returns the overview of the table they moved to
+func MergeTables(sess *dbr.Session, intoTableID, fromTableID int64, now time.Time) (*TableOverview, error) {
+    if intoTableID == fromTableID {
+        return nil, ErrSameTable
+    }
+    tx, err := sess.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.RollbackUnlessCommitted()
+
+    if _, err := queryDiningTableByID(tx, fromTableID); err == dbr.ErrNotFound {
+        return nil, ErrTableNotFound
+    } else if err != nil {
+        return nil, err
+    }
+    if err := seatAtTable(tx, intoTableID); err != nil {
+        return nil, err
+    }
+    orderIDs, err := queryOpenOrderIDsAtTableForUpdate(tx, fromTableID)
+    if err != nil {
+        return nil, err
+    }
+    if err := moveOrdersToTable(tx, orderIDs, intoTableID); err != nil {
+        return nil, err
+    }
+    for _, orderID := range orderIDs {
+        moved, err := FindOrderByID(tx, orderID)
+        if err != nil {
+            return nil, err
+        }
+        if err := publishEvent(tx, EventOrderUpdated, moved, ""); err != nil {
+            return nil, err
+        }
+    }
+
+    table, err := queryDiningTableByID(tx, intoTableID)
+    if err != nil {
+        return nil, err
+    }
+    entities, err := queryOpenOrdersAtTables(tx, []int64{intoTableID})
+    if err != nil {
+        return nil, err
+    }
+    orders, err := loadOrders(tx, entities)
+    if err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    return tableOverview(table, orders, now), nil
+}
+
+// TableStatuses returns all table statuses
+func TableStatuses() []string {
+    return []string{TableAvailable, TableOccupied, TableReserved, TableOutOfService}
+}
+
+// seatAtTable marks the table occupied if orders can be placed at it
+func seatAtTable(tx dbr.SessionRunner, tableID int64) error {
+    table, err := queryDiningTableByID(tx, tableID)
+    if err == dbr.ErrNotFound {
+        return ErrTableNotFound
+    } else if err != nil {
+        return err
+    } else if table.Status == TableOutOfService {
+        return ErrTableOutOfService
+    } else if table.Status == TableOccupied {
+        return nil
+    }
+    _, err = updateDiningTable(tx, tableID, map[string]interface{}{"status": TableOccupied})
+    return err
+}
+
+// changeTable applies the changes and returns the changed table
+func changeTable(sess dbr.SessionRunner, tableID int64, changes map[string]interface{}) (*DiningTable, error) {
+    if updated, err := updateDiningTable(sess, tableID, changes); db.IsUniqueViolation(err) {
+        return nil, ErrTableNumberTaken
+    } else if err != nil {
+        return nil, err
+    } else if updated == 0 {
+        return nil, ErrTableNotFound
+    }
+    if table, err := queryDiningTableByID(sess, tableID); err != nil {
+        return nil, err
+    } else {
+        return mapTableToPublicAPI(table), nil
+    }
+}
+
+// tableOverview summarizes the open orders of the table
+func tableOverview(table *diningTableEntity, openOrders []*CustomerOrder, now time.Time) *TableOverview {
+    overview := &TableOverview{Table: mapTableToPublicAPI(table), OpenOrders: []*CustomerOrder{}}
+    for _, customerOrder := range openOrders {
+        overview.OpenOrders = append(overview.OpenOrders, customerOrder)
+        overview.AmountOwedInCents += customerOrder.OutstandingInCents
+        if customerOrder.TimeCreated > overview.TimeLastOrder {
+            overview.TimeLastOrder = customerOrder.TimeCreated
+        }
+    }
+    if lastOrder, err := db.ParseTime(overview.TimeLastOrder); err == nil && now.After(lastOrder) {
+        overview.SecondsSinceLastOrder = int64(now.Sub(lastOrder) / time.Second)
+    }
+    return overview
+}
+
+func validateNewDiningTable(newTable NewDiningTable) error {
+    if newTable.Number <= 0 {
+        return ErrInvalidTableNumber
+    } else if newTable.Capacity <= 0 {
+        return ErrInvalidCapacity
+    } else if len([]rune(strings.TrimSpace(newTable.Area))) > maxAreaLength {
+        return ErrAreaTooLong
+    }
+    return nil
+}
+
+func isValidTableStatus(status string) bool {
+    for _, known := range TableStatuses() {
+        if status == known {
+            return true
+        }
+    }
+    return false
+}
+
+func mapTableToPublicAPI(table *diningTableEntity) *DiningTable {
+    return &DiningTable{
+        ID:          table.ID,
+        Number:      table.Number,
+        Area:        table.Area.String,
+        Capacity:    table.Capacity,
+        Status:      table.Status,
+        TimeCreated: table.TimeCreated,
+    }
+}
@@ -0,0 +1,110 @@
+package order
+
+import (
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/toefel18/garsson-api/garsson/db"
+    "github.com/toefel18/garsson-api/garsson/db/dbtest"
+    "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// tableRows returns the row of a dining table with the status as selected from the database
+func tableRows(id int64, status string) *sqlmock.Rows {
+    return sqlmock.NewRows([]string{"id", "number", "capacity", "status"}).AddRow(id, id*10, 4, status)
+}
+
+func TestTableOverview(t *testing.T) {
+    now := time.Date(2018, 6, 1, 20, 0, 0, 0, time.UTC)
+    table := &diningTableEntity{ID: 3, Number: 12, Capacity: 4, Status: TableOccupied}
+    orders := []*CustomerOrder{
+        {ID: 1, TableID: 3, TimeCreated: db.FormatTime(now.Add(-time.Hour)), OutstandingInCents: 1200},
+        {ID: 2, TableID: 3, TimeCreated: db.FormatTime(now.Add(-10 * time.Minute)), OutstandingInCents: 450},
+    }
+
+    overview := tableOverview(table, orders, now)
+    assert.Equal(t, int64(12), overview.Table.Number)
+    assert.Len(t, overview.OpenOrders, 2)
+    assert.Equal(t, int64(1650), overview.AmountOwedInCents)
+    assert.Equal(t, orders[1].TimeCreated, overview.TimeLastOrder)
+    assert.Equal(t, int64(600), overview.SecondsSinceLastOrder)
+}
+
+func TestTableOverview_WithoutOrders(t *testing.T) {
+    overview := tableOverview(&diningTableEntity{ID: 3, Status: TableAvailable}, nil, time.Now())
+    assert.NotNil(t, overview.OpenOrders)
+    assert.Equal(t, int64(0), overview.AmountOwedInCents)
+    assert.Empty(t, overview.TimeLastOrder)
+    assert.Equal(t, int64(0), overview.SecondsSinceLastOrder)
+}
+
+func TestValidateNewDiningTable(t *testing.T) {
+    assert.NoError(t, validateNewDiningTable(NewDiningTable{Number: 1, Capacity: 2, Area: "terrace"}))
+    assert.Equal(t, ErrInvalidTableNumber, validateNewDiningTable(NewDiningTable{Number: 0, Capacity: 2}))
+    assert.Equal(t, ErrInvalidCapacity, validateNewDiningTable(NewDiningTable{Number: 1, Capacity: 0}))
+    assert.Equal(t, ErrAreaTooLong, validateNewDiningTable(NewDiningTable{Number: 1, Capacity: 2, Area: string(make([]rune, maxAreaLength+1))}))
+}
+
+func TestIsValidTableStatus(t *testing.T) {
+    for _, status := range TableStatuses() {
+        assert.True(t, isValidTableStatus(status))
+    }
+    assert.False(t, isValidTableStatus("dirty"))
+}
+
+func TestMoveOrder_IncrementsVersionOnce(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM customer_order WHERE \(id = 1\)`).WillReturnRows(orderRows(1, StatusPlaced, 2))
+    mock.ExpectExec(`UPDATE "customer_order" SET "version" = version \+ 1 WHERE \(id = 1 AND version = 2\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery(`SELECT \* FROM customer_order_line`).WillReturnRows(dbtest.EmptyRows())
+    mock.ExpectQuery(`SELECT \* FROM dining_table WHERE \(id = 3\)`).WillReturnRows(tableRows(3, TableAvailable))
+    mock.ExpectExec(`UPDATE "dining_table" SET "status" = 'occupied' WHERE \(id = 3\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(`^UPDATE "customer_order" SET "dining_table_id" = 3 WHERE \(id = 1\)$`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery(`SELECT \* FROM customer_order WHERE \(id = 1\)`).WillReturnError(errors.New("stop"))
+    mock.ExpectRollback()
+
+    _, err := MoveOrder(dao.NewSession(), 1, 2, 3)
+    assert.EqualError(t, err, "stop")
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMoveOrder_OutOfServiceTable(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM customer_order WHERE \(id = 1\)`).WillReturnRows(orderRows(1, StatusPlaced, 2))
+    mock.ExpectExec(`UPDATE "customer_order" SET "version" = version \+ 1`).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery(`SELECT \* FROM customer_order_line`).WillReturnRows(dbtest.EmptyRows())
+    mock.ExpectQuery(`SELECT \* FROM dining_table WHERE \(id = 3\)`).WillReturnRows(tableRows(3, TableOutOfService))
+    mock.ExpectRollback()
+
+    _, err := MoveOrder(dao.NewSession(), 1, 2, 3)
+    assert.Equal(t, ErrTableOutOfService, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMergeTables_MovesOpenOrdersInOneUpdate(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    mock.ExpectBegin()
+    mock.ExpectQuery(`SELECT \* FROM dining_table WHERE \(id = 4\)`).WillReturnRows(tableRows(4, TableOccupied))
+    mock.ExpectQuery(`SELECT \* FROM dining_table WHERE \(id = 3\)`).WillReturnRows(tableRows(3, TableOccupied))
+    mock.ExpectQuery(`SELECT id FROM customer_order WHERE dining_table_id = 4 .* FOR UPDATE`).
+        WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+    mock.ExpectExec(`UPDATE "customer_order" SET ("dining_table_id" = 3, "version" = version \+ 1|"version" = version \+ 1, "dining_table_id" = 3) WHERE \(id IN \(1,2\)\)`).
+        WillReturnResult(sqlmock.NewResult(0, 2))
+    mock.ExpectQuery(`SELECT \* FROM customer_order WHERE \(id = 1\)`).WillReturnError(errors.New("stop"))
+    mock.ExpectRollback()
+
+    _, err := MergeTables(dao.NewSession(), 3, 4, time.Now())
+    assert.EqualError(t, err, "stop")
+    assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMergeTables_SameTable(t *testing.T) {
+    dao, mock := dbtest.NewDbMock(t)
+    _, err := MergeTables(dao.NewSession(), 3, 3, time.Now())
+    assert.Equal(t, ErrSameTable, err)
+    assert.NoError(t, mock.ExpectationsWereMet())
+}